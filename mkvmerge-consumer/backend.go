@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"mkvmerge-consumer/config"
+)
+
+// Backend reads the tracks of media files and writes copies with a
+// selection of them
+type Backend interface {
+	Name() string
+	// Extensions lists the lower-case file extensions the backend handles
+	Extensions() []string
+	// Identify reads the container and track information of a file
+	Identify(ctx context.Context, path string) (mkvInfo, error)
+	// Remux writes the selected tracks of f to output. The container of
+	// output is chosen by its extension.
+	Remux(ctx context.Context, f *mediaFile, selection trackSelection, output string) error
+}
+
+// newBackend returns the backend configured for a category
+func newBackend(policy config.CategoryPolicy) Backend {
+	if policy.Backend == config.BackendFFmpeg {
+		return ffmpegBackend{}
+	}
+	return mkvmergeBackend{}
+}
+
+// handles reports whether the backend processes the file at path
+func handles(b Backend, path string) bool {
+	return slices.Contains(b.Extensions(), strings.ToLower(filepath.Ext(path)))
+}
+
+// isMatroska reports whether path names an MKV file, which the MKVToolNix
+// based steps require
+func isMatroska(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".mkv")
+}
+
+// mkvmergeBackend processes MKV files with MKVToolNix
+type mkvmergeBackend struct{}
+
+// Name returns the configuration name of the backend
+func (mkvmergeBackend) Name() string { return config.BackendMkvmerge }
+
+// Extensions returns the extensions of the files mkvmerge handles
+func (mkvmergeBackend) Extensions() []string { return []string{".mkv"} }
+
+// Identify reads the tracks with mkvmerge -J
+func (mkvmergeBackend) Identify(ctx context.Context, path string) (mkvInfo, error) {
+	return identify(ctx, path)
+}
+
+// Remux writes the selected tracks with mkvmerge
+func (mkvmergeBackend) Remux(ctx context.Context, f *mediaFile, selection trackSelection, output string) error {
+	return runMkvtoolnix(ctx, f, "mkvmerge", selection.mkvmergeArgs(f.Path, output)...)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ffmpegPolicy returns the default policy processed with ffmpeg
+func ffmpegPolicy(convert bool) config.CategoryPolicy {
+	policy := config.DefaultCategoryPolicy()
+	policy.Backend = config.BackendFFmpeg
+	policy.ConvertToMKV = convert
+	return policy
+}
+
+// Test for choosing the backend and the files it handles
+func TestNewBackend(t *testing.T) {
+	mkvmerge := newBackend(config.DefaultCategoryPolicy())
+	assert.Equal(t, "mkvmerge", mkvmerge.Name())
+	assert.True(t, handles(mkvmerge, "/movies/Movie.MKV"))
+	assert.False(t, handles(mkvmerge, "/movies/movie.mp4"))
+
+	ffmpeg := newBackend(ffmpegPolicy(false))
+	assert.Equal(t, "ffmpeg", ffmpeg.Name())
+	for _, path := range []string{"a.mkv", "b.mp4", "c.M4V", "d.avi"} {
+		assert.True(t, handles(ffmpeg, path), path)
+	}
+	assert.False(t, handles(ffmpeg, "movie.nfo"))
+}
+
+// Test that ffprobe streams are converted to mkvmerge tracks
+func TestFFmpegIdentify(t *testing.T) {
+	setupPipelineTest(t)
+
+	info, err := ffmpegBackend{}.Identify(context.Background(), "/test/movie.mp4")
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(90*time.Minute), info.Container.Properties.Duration)
+	assert.Equal(t, "Movie", info.Container.Properties.Title)
+	assert.Equal(t, 2, info.Chapters[0].NumEntries)
+	assert.Len(t, info.Tracks, 5)
+	assert.Equal(t, "audio", info.Tracks[2].Type)
+	assert.Equal(t, "spa", info.Tracks[2].Properties.Language)
+	assert.True(t, info.Tracks[1].Properties.DefaultTrack)
+	assert.Equal(t, "subtitles", info.Tracks[3].Type)
+	assert.Equal(t, "mov_text", info.Tracks[3].Codec)
+	assert.Equal(t, "data", info.Tracks[4].Type)
+}
+
+// Test for the ffmpeg arguments of a selection
+func TestFFmpegArgs(t *testing.T) {
+	video := mkvTrack{ID: 0, Type: "video"}
+	english := mkvTrack{ID: 2, Type: "audio"}
+	spanish := mkvTrack{ID: 1, Type: "audio"}
+	subtitles := mkvTrack{ID: 3, Type: "subtitles", Codec: "mov_text"}
+	selection := trackSelection{Video: []mkvTrack{video}, Audio: []mkvTrack{english, spanish}, Subtitles: []mkvTrack{subtitles}}
+
+	assert.Equal(t, []string{
+		"-nostdin", "-v", "warning", "-y", "-i", "in.mp4",
+		"-map", "0:0", "-map", "0:2", "-map", "0:1", "-map", "0:3",
+		"-c", "copy", "out.mp4",
+	}, ffmpegArgs("in.mp4", "out.mp4", selection))
+
+	// MKV keeps attachments and cannot store MP4 text subtitles
+	assert.Equal(t, []string{
+		"-nostdin", "-v", "warning", "-y", "-i", "in.mp4",
+		"-map", "0:0", "-map", "0:2", "-map", "0:1", "-map", "0:3", "-map", "0:t?",
+		"-c", "copy", "-c:s:0", "srt", "out.mkv",
+	}, ffmpegArgs("in.mp4", "out.mkv", selection))
+}
+
+// Test that ffmpeg filters the tracks of an MP4 file in place
+func TestFFmpegStripTracks(t *testing.T) {
+	mockCmd, mockFS := setupPipelineTest(t)
+	withSafetyPolicy(t, config.DefaultSafetyConfig())
+	mockFS.On("Stat", "/test/movie.mp4").Return(MockFileInfo{FileSize: 2000}, nil).Twice()
+	mockFS.On("Rename", "/test/.movie.mp4.tmp.mp4", "/test/movie.mp4").Return(nil).Once()
+
+	steps, err := newPipeline(ffmpegPolicy(false))
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), "/test/movie.mp4")
+
+	assert.Equal(t, fileProcessed, result.Outcome, result.Error)
+	assert.Empty(t, result.RenamedTo)
+	assert.Equal(t, []trackSummary{{ID: 2, Type: "audio", Language: "spa"}}, result.Removed)
+	assert.Equal(t, []string{"ffprobe", "ffmpeg", "ffprobe"}, mockCmd.Commands)
+	mockFS.AssertExpectations(t)
+}
+
+// Test that ffmpeg converts other containers to MKV and removes the original
+func TestFFmpegConvertToMKV(t *testing.T) {
+	mockCmd, _ := setupPipelineTest(t)
+	statFunc, renameFunc, removeFunc = os.Stat, os.Rename, os.Remove
+	withSafetyPolicy(t, config.DefaultSafetyConfig())
+
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "movie.mp4", "original")
+
+	policy := ffmpegPolicy(true)
+	policy.Pipeline = append(policy.Pipeline, config.StepConfig{Step: config.StepDefaultFlags, Audio: "eng"})
+	steps, err := newPipeline(policy)
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), path)
+
+	assert.Equal(t, fileProcessed, result.Outcome, result.Error)
+	assert.Equal(t, filepath.Join(dir, "movie.mkv"), result.RenamedTo)
+	assert.NoFileExists(t, path)
+	assert.FileExists(t, result.RenamedTo)
+	assert.Equal(t, "-c:s:0", mockCmd.Args[1][len(mockCmd.Args[1])-3])
+
+	// default_flags runs on the converted file with MKVToolNix
+	assert.Equal(t, []string{"ffprobe", "ffmpeg", "ffprobe", "mkvpropedit"}, mockCmd.Commands)
+}
+
+// Test that a conversion never overwrites an existing MKV file
+func TestFFmpegConvertTargetExists(t *testing.T) {
+	setupPipelineTest(t)
+	statFunc = os.Stat
+
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "movie.avi", "original")
+	writeTestFile(t, dir, "movie.mkv", "other release")
+
+	steps, err := newPipeline(ffmpegPolicy(true))
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), path)
+
+	assert.Equal(t, fileFailed, result.Outcome)
+	assert.Equal(t, "strip_tracks: cannot convert to movie.mkv, the file already exists", result.Error)
+}
+
+// Test that the MKVToolNix steps leave other containers alone
+func TestMkvtoolnixStepsSkipOtherContainers(t *testing.T) {
+	mockCmd, _ := setupPipelineTest(t)
+	f := newMediaFile("/test/movie.mp4", mkvTrack{ID: 1, Type: "audio"})
+
+	for _, step := range []Step{
+		defaultFlagsStep{audio: "eng"},
+		extractSubtitlesStep{},
+		metadataStep{title: true},
+	} {
+		changed, err := step.Run(context.Background(), f)
+		assert.NoError(t, err)
+		assert.False(t, changed, step.Name())
+	}
+	assert.Empty(t, mockCmd.Commands)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"mkvmerge-consumer/config"
+)
+
+// usage describes the available subcommands
+const usage = `Usage: mkvmerge-consumer [command]
+
+Without a command the consumer processes messages until it is stopped.
+
+Commands:
+  dlq [-limit 1000] list
+        List the dead-lettered messages
+  dlq [-limit 1000] show <id>...
+        Show dead-lettered messages in detail
+  dlq [-limit 1000] replay [-category name] (-all | <id>...)
+        Send messages back to the tasks queue, optionally into another category
+  dlq [-limit 1000] purge [-older-than 72h] [-reason text] [-all]
+        Delete dead-lettered messages
+  ledger list [-prefix path]
+        List the files already handled
+  ledger show <path>...
+        Show the ledger entry of files and whether they changed since
+  ledger reset (-all | -prefix path | <path>...)
+        Forget files so that they are processed again
+  publish [-priority n] <category> <torrent name>
+        Queue a torrent for processing
+  report [-format table|json] [-category name] [path...]
+        Show the tracks each file would keep or lose, without changing it
+`
+
+// runCommand runs a subcommand and returns the process exit code
+func runCommand(args []string, out io.Writer) int {
+	// Keep log lines out of the command output
+	log.SetOutput(os.Stderr)
+
+	var err error
+	switch args[0] {
+	case "dlq":
+		err = withChannel(func(ch ChannelInterface) error {
+			return dlqCommand(ch, args[1:], out)
+		})
+	case "ledger":
+		err = withConfig(func() error {
+			return ledgerCommand(fileLedger, args[1:], out)
+		})
+	case "publish":
+		err = withChannel(func(ch ChannelInterface) error {
+			return publishCommand(ch, args[1:], out)
+		})
+	case "report":
+		err = withConfig(func() error {
+			return reportCommand(args[1:], out)
+		})
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(out, usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// withConfig loads and applies the configuration before running fn
+func withConfig(fn func() error) error {
+	var err error
+	cfg, err = config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	applyConfig(cfg)
+	return fn()
+}
+
+// withChannel loads the configuration, connects to RabbitMQ and runs fn on a new channel
+func withChannel(fn func(ch ChannelInterface) error) error {
+	return withConfig(func() error {
+		return dialAndRun(fn)
+	})
+}
+
+// dialAndRun connects to RabbitMQ and runs fn on a new channel
+func dialAndRun(fn func(ch ChannelInterface) error) error {
+	tlsConfig, err := newTLSConfig(cfg.RabbitMQ.TLS)
+	if err != nil {
+		return err
+	}
+	conn, err := dialBroker(cfg.ConnectionString(), tlsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
+
+	return fn(ch)
+}
@@ -3,7 +3,11 @@ package config
 import (
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
@@ -11,8 +15,117 @@ import (
 
 // Config holds all configuration for our application
 type Config struct {
-	RabbitMQ RabbitMQConfig `mapstructure:"rabbitmq"`
-	Paths    PathConfig     `mapstructure:"paths"`
+	RabbitMQ   RabbitMQConfig   `mapstructure:"rabbitmq"`
+	Paths      PathConfig       `mapstructure:"paths"`
+	Policy     PolicyConfig     `mapstructure:"policy"`
+	Processing ProcessingConfig `mapstructure:"processing"`
+	Retry      RetryConfig      `mapstructure:"retry"`
+	HTTP       HTTPConfig       `mapstructure:"http"`
+	Ledger     LedgerConfig     `mapstructure:"ledger"`
+	Safety     SafetyConfig     `mapstructure:"safety"`
+	Watch      WatchConfig      `mapstructure:"watch"`
+	Log        LogConfig        `mapstructure:"log"`
+}
+
+// LogConfig holds how the consumer writes its logs
+type LogConfig struct {
+	// Level is the lowest level logged: debug, info, warn or error
+	Level string `mapstructure:"level"`
+	// Format is text for key=value lines or json for one object per line
+	Format string `mapstructure:"format"`
+}
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// WatchConfig holds the file system watcher that picks up new folders of the
+// category directories, for download clients that cannot publish tasks
+type WatchConfig struct {
+	// Enabled watches the category directories for new folders
+	Enabled bool `mapstructure:"enabled"`
+	// QuietPeriod is how long nothing may change in a new folder before it is processed
+	QuietPeriod time.Duration `mapstructure:"quiet_period"`
+	// Broker publishes new folders as tasks and the results to the done
+	// queue. Without it folders are processed right away and the results
+	// appended to DoneLog.
+	Broker bool `mapstructure:"broker"`
+	// DoneLog is the file receiving done and dead-lettered messages without a broker
+	DoneLog string `mapstructure:"done_log"`
+}
+
+// SafetyConfig holds the checks made around replacing an original file
+type SafetyConfig struct {
+	// MinFreeMB is the free space in MiB that must be left on the file
+	// system after the remuxed copy has been written
+	MinFreeMB int64 `mapstructure:"min_free_mb"`
+	// Verify identifies the remuxed copy and compares it with the
+	// selected tracks and the original duration before replacing the original
+	Verify bool `mapstructure:"verify"`
+	// DurationTolerance is how much the duration of the copy may differ
+	DurationTolerance time.Duration `mapstructure:"duration_tolerance"`
+	// BackupDir keeps the replaced originals; empty disables backups
+	BackupDir string `mapstructure:"backup_dir"`
+	// BackupRetention is how long originals are kept in BackupDir
+	BackupRetention time.Duration `mapstructure:"backup_retention"`
+}
+
+// LedgerConfig holds where the consumer remembers the files it already handled
+type LedgerConfig struct {
+	// Path is the ledger database file; empty disables the ledger
+	Path string `mapstructure:"path"`
+}
+
+// HTTPConfig holds the settings of the health and metrics server
+type HTTPConfig struct {
+	// Listen is the address of the server; empty disables it
+	Listen string `mapstructure:"listen"`
+	// LivenessTimeout is how long the broker may be unreachable before
+	// /healthz reports the consumer as unhealthy
+	LivenessTimeout time.Duration `mapstructure:"liveness_timeout"`
+	// QueueDepthInterval is how often the queue depths are sampled
+	QueueDepthInterval time.Duration `mapstructure:"queue_depth_interval"`
+}
+
+// RetryConfig holds how transient failures are retried before dead-lettering
+type RetryConfig struct {
+	// MaxAttempts is the number of delayed retries; 0 dead-letters right away
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// InitialDelay is the wait before the first retry, doubled for each retry
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	// MaxDelay caps the wait between retries
+	MaxDelay time.Duration `mapstructure:"max_delay"`
+}
+
+// DefaultRetryConfig returns the retry settings used when nothing is configured
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:  3,
+		InitialDelay: time.Minute,
+		MaxDelay:     30 * time.Minute,
+	}
+}
+
+// DefaultSafetyConfig returns the safety settings used when nothing is configured
+func DefaultSafetyConfig() SafetyConfig {
+	return SafetyConfig{
+		MinFreeMB:         1024,
+		Verify:            true,
+		DurationTolerance: time.Second,
+		BackupRetention:   7 * 24 * time.Hour,
+	}
+}
+
+// ProcessingConfig holds how much work the consumer does in parallel
+type ProcessingConfig struct {
+	// Workers is the number of messages processed at the same time
+	Workers int `mapstructure:"workers"`
+	// MkvmergeConcurrency is the number of files remuxed at the same time
+	MkvmergeConcurrency int `mapstructure:"mkvmerge_concurrency"`
+	// DryRun logs what would be done to each file instead of changing it
+	DryRun bool `mapstructure:"dry_run"`
 }
 
 // RabbitMQConfig holds all RabbitMQ related configuration
@@ -21,12 +134,58 @@ type RabbitMQConfig struct {
 	Port     string `mapstructure:"port"`
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
-	Vhost    string `mapstructure:"vhost"`
-	Queue    struct {
+	// PasswordFile is read for the password when set, e.g. a Docker secret
+	// under /run/secrets
+	PasswordFile string    `mapstructure:"password_file"`
+	Vhost        string    `mapstructure:"vhost"`
+	TLS          TLSConfig `mapstructure:"tls"`
+	Queue        struct {
 		Tasks string `mapstructure:"tasks"`
 		Done  string `mapstructure:"done"`
 		DLQ   string `mapstructure:"dlq"`
 	} `mapstructure:"queue"`
+	Reconnect ReconnectConfig `mapstructure:"reconnect"`
+	Priority  PriorityConfig  `mapstructure:"priority"`
+	Routing   RoutingConfig   `mapstructure:"routing"`
+}
+
+// PriorityConfig holds the priorities of task messages
+type PriorityConfig struct {
+	// Max is the x-max-priority of the task queues, 0 disables priorities
+	Max int `mapstructure:"max"`
+	// Default is the priority of tasks whose category has none
+	Default int `mapstructure:"default"`
+	// Categories maps a category to the priority of its tasks
+	Categories map[string]int `mapstructure:"categories"`
+}
+
+// RoutingConfig holds the optional routing of tasks to per-category queues
+type RoutingConfig struct {
+	// Exchange is the topic exchange tasks are published to with their
+	// category as routing key. Empty sends every task to the tasks queue.
+	Exchange string `mapstructure:"exchange"`
+	// Categories lists the categories whose queues this consumer reads,
+	// empty reads all of them
+	Categories []string `mapstructure:"categories"`
+}
+
+// TLSConfig holds the settings of an amqps connection
+type TLSConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// CAFile is a PEM bundle of the authorities trusted for the broker
+	// certificate, the system pool is used when empty
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile hold the PEM client certificate and key
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ServerName is checked against the broker certificate instead of the host
+	ServerName string `mapstructure:"server_name"`
+}
+
+// ReconnectConfig holds the backoff used when the RabbitMQ connection is lost
+type ReconnectConfig struct {
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	MaxDelay     time.Duration `mapstructure:"max_delay"`
 }
 
 // PathConfig holds path configuration for different media categories
@@ -34,23 +193,125 @@ type PathConfig struct {
 	Categories map[string]string `mapstructure:"categories"`
 }
 
+// PolicyConfig holds the processing policy applied to each media category.
+// Categories without an entry use Default, and any field a category entry
+// leaves out is inherited from Default.
+type PolicyConfig struct {
+	Default    CategoryPolicy            `mapstructure:"default"`
+	Categories map[string]CategoryPolicy `mapstructure:"categories"`
+}
+
+// CategoryPolicy holds the processing settings for a single media category
+type CategoryPolicy struct {
+	Languages LanguagePolicy `mapstructure:"languages"`
+	// Timeout bounds how long a single message of the category may take
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Pipeline lists the steps applied to every file, in order
+	Pipeline []StepConfig `mapstructure:"pipeline"`
+	// Backend is the toolset that reads and remuxes the files
+	Backend string `mapstructure:"backend"`
+	// ConvertToMKV makes the ffmpeg backend write other containers as MKV
+	ConvertToMKV bool `mapstructure:"convert_to_mkv"`
+}
+
+// Names of the available processing backends
+const (
+	BackendMkvmerge = "mkvmerge" // MKVToolNix, .mkv files only
+	BackendFFmpeg   = "ffmpeg"   // ffprobe and ffmpeg, .mkv, .mp4, .m4v and .avi files
+)
+
+// Names of the available pipeline steps
+const (
+	StepStripTracks      = "strip_tracks"      // remove tracks according to the language policy
+	StepDefaultFlags     = "default_flags"     // mark the preferred audio and subtitle tracks as default
+	StepRename           = "rename"            // rename files to a Jellyfin-friendly pattern
+	StepExtractSubtitles = "extract_subtitles" // extract text subtitles to .srt sidecars
+	StepMetadata         = "metadata"          // write title and chapter metadata
+)
+
+// StepConfig configures a single pipeline step. Only the fields of the
+// selected step are used.
+type StepConfig struct {
+	Step string `mapstructure:"step"`
+
+	// Audio and Subtitles are the languages marked as default by
+	// default_flags; "none" clears the flag, empty leaves the tracks alone
+	Audio     string `mapstructure:"audio"`
+	Subtitles string `mapstructure:"subtitles"`
+
+	// Pattern is the text/template used by rename to build the file name
+	Pattern string `mapstructure:"pattern"`
+
+	// Languages limits extract_subtitles to these languages, empty means all
+	Languages []string `mapstructure:"languages"`
+
+	// Title makes metadata set the title from the file name
+	Title bool `mapstructure:"title"`
+	// ChapterInterval makes metadata add chapters to files without any
+	ChapterInterval time.Duration `mapstructure:"chapter_interval"`
+}
+
+// Fallback modes used when no audio track matches the language policy
+const (
+	FallbackAll   = "all"   // keep every audio track
+	FallbackFirst = "first" // keep only the first audio track
+	FallbackSkip  = "skip"  // leave the file untouched
+)
+
+// LanguagePolicy describes which audio and subtitle tracks survive a remux
+type LanguagePolicy struct {
+	// Audio lists the audio languages to keep, in order of preference
+	Audio []string `mapstructure:"audio"`
+	// Subtitles lists the subtitle languages to keep, in order of preference
+	Subtitles []string `mapstructure:"subtitles"`
+	// KeepForcedSubtitles keeps forced subtitle tracks whatever their language
+	KeepForcedSubtitles bool `mapstructure:"keep_forced_subtitles"`
+	// KeepUndefined keeps audio and subtitle tracks tagged "und"
+	KeepUndefined bool `mapstructure:"keep_undefined"`
+	// Fallback decides what happens when no audio track matches
+	Fallback string `mapstructure:"fallback"`
+}
+
+// DefaultCategoryPolicy returns the policy used when nothing is configured:
+// English audio and subtitles only, keeping all audio if none is English,
+// and at most 30 minutes per message.
+func DefaultCategoryPolicy() CategoryPolicy {
+	return CategoryPolicy{
+		Languages: LanguagePolicy{
+			Audio:               []string{"eng"},
+			Subtitles:           []string{"eng"},
+			KeepForcedSubtitles: false,
+			KeepUndefined:       false,
+			Fallback:            FallbackAll,
+		},
+		Timeout:  30 * time.Minute,
+		Pipeline: []StepConfig{{Step: StepStripTracks}},
+		Backend:  BackendMkvmerge,
+	}
+}
+
 // Load reads in config from files and environment variables
 func Load() (*Config, error) {
+	config, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// read reads in config from files and environment variables without
+// validating it
+func read() (*Config, error) {
 	// Load .env file if it exists
 	_ = godotenv.Load()
 
 	// Create a new viper instance
-	v := viper.New()
-
-	// Set default values
-	setDefaults(v)
-
-	// Set config name and paths
-	v.SetConfigName("config")
-	v.SetConfigType("yaml")
-	v.AddConfigPath(".")
-	v.AddConfigPath("./config")
-	v.AddConfigPath("/etc/mkvmerge-consumer/")
+	v := newViper()
 
 	// Read config file
 	if err := v.ReadInConfig(); err != nil {
@@ -65,15 +326,174 @@ func Load() (*Config, error) {
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
 
+	// Let category policies inherit whatever they don't set from the default
+	inheritDefaultPolicy(v)
+
 	// Unmarshal config into struct
 	var config Config
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	// Read the password from its file, ignoring the trailing newline editors add
+	if path := config.RabbitMQ.PasswordFile; path != "" {
+		password, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rabbitmq.password_file: %w", err)
+		}
+		config.RabbitMQ.Password = strings.TrimRight(string(password), "\r\n")
+	}
+
 	return &config, nil
 }
 
+// newViper returns a viper instance with the defaults and config file search paths
+func newViper() *viper.Viper {
+	v := viper.New()
+
+	// Set default values
+	setDefaults(v)
+
+	// Set config name and paths
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
+	v.AddConfigPath(".")
+	v.AddConfigPath("./config")
+	v.AddConfigPath("/etc/mkvmerge-consumer/")
+	return v
+}
+
+// inheritDefaultPolicy copies every policy.default key into each configured
+// category that does not set it itself
+func inheritDefaultPolicy(v *viper.Viper) {
+	const defaultPrefix = "policy.default."
+
+	for category := range v.GetStringMap("policy.categories") {
+		for _, key := range v.AllKeys() {
+			field, ok := strings.CutPrefix(key, defaultPrefix)
+			if !ok {
+				continue
+			}
+			categoryKey := "policy.categories." + category + "." + field
+			if !v.InConfig(categoryKey) {
+				v.SetDefault(categoryKey, v.Get(key))
+			}
+		}
+	}
+}
+
+// validate checks the loaded configuration for values we cannot work with
+func (c *Config) validate() error {
+	if c.RabbitMQ.Reconnect.InitialDelay <= 0 || c.RabbitMQ.Reconnect.MaxDelay < c.RabbitMQ.Reconnect.InitialDelay {
+		return fmt.Errorf("invalid reconnect delays: initial %s, max %s",
+			c.RabbitMQ.Reconnect.InitialDelay, c.RabbitMQ.Reconnect.MaxDelay)
+	}
+
+	if err := c.RabbitMQ.validateRouting(c.Paths.Categories); err != nil {
+		return err
+	}
+
+	if tls := c.RabbitMQ.TLS; tls.Enabled && (tls.CertFile == "") != (tls.KeyFile == "") {
+		return fmt.Errorf("rabbitmq.tls.cert_file and rabbitmq.tls.key_file must be set together")
+	}
+
+	if c.Processing.Workers < 1 {
+		return fmt.Errorf("processing.workers must be at least 1, got %d", c.Processing.Workers)
+	}
+	if c.Processing.MkvmergeConcurrency < 1 {
+		return fmt.Errorf("processing.mkvmerge_concurrency must be at least 1, got %d", c.Processing.MkvmergeConcurrency)
+	}
+
+	if c.HTTP.Listen != "" && (c.HTTP.LivenessTimeout <= 0 || c.HTTP.QueueDepthInterval <= 0) {
+		return fmt.Errorf("http.liveness_timeout and http.queue_depth_interval must be positive")
+	}
+
+	if c.Safety.MinFreeMB < 0 {
+		return fmt.Errorf("safety.min_free_mb must not be negative, got %d", c.Safety.MinFreeMB)
+	}
+	if c.Safety.DurationTolerance < 0 {
+		return fmt.Errorf("safety.duration_tolerance must not be negative, got %s", c.Safety.DurationTolerance)
+	}
+	if c.Safety.BackupDir != "" && c.Safety.BackupRetention <= 0 {
+		return fmt.Errorf("safety.backup_retention must be positive, got %s", c.Safety.BackupRetention)
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", c.Log.Format, LogFormatText, LogFormatJSON)
+	}
+
+	if c.Watch.Enabled && c.Watch.QuietPeriod <= 0 {
+		return fmt.Errorf("watch.quiet_period must be positive, got %s", c.Watch.QuietPeriod)
+	}
+	if c.Watch.Enabled && !c.Watch.Broker && c.Watch.DoneLog == "" {
+		return fmt.Errorf("watch.done_log is required without a broker")
+	}
+
+	if c.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("retry.max_attempts must not be negative, got %d", c.Retry.MaxAttempts)
+	}
+	if c.Retry.MaxAttempts > 0 && (c.Retry.InitialDelay < time.Second || c.Retry.MaxDelay < c.Retry.InitialDelay) {
+		return fmt.Errorf("invalid retry delays: initial %s, max %s", c.Retry.InitialDelay, c.Retry.MaxDelay)
+	}
+
+	policies := map[string]CategoryPolicy{"default": c.Policy.Default}
+	for category, policy := range c.Policy.Categories {
+		policies[category] = policy
+	}
+
+	for name, policy := range policies {
+		if policy.Timeout <= 0 {
+			return fmt.Errorf("policy %q: timeout must be positive, got %s", name, policy.Timeout)
+		}
+		switch policy.Backend {
+		case BackendMkvmerge:
+			if policy.ConvertToMKV {
+				return fmt.Errorf("policy %q: convert_to_mkv needs the %s backend", name, BackendFFmpeg)
+			}
+		case BackendFFmpeg:
+		default:
+			return fmt.Errorf("policy %q: unknown backend %q", name, policy.Backend)
+		}
+		switch policy.Languages.Fallback {
+		case FallbackAll, FallbackFirst, FallbackSkip:
+		default:
+			return fmt.Errorf("policy %q: unknown language fallback %q", name, policy.Languages.Fallback)
+		}
+		for i, step := range policy.Pipeline {
+			if err := step.validate(); err != nil {
+				return fmt.Errorf("policy %q: pipeline step %d: %w", name, i+1, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate checks that the step is known and has the settings it needs
+func (s StepConfig) validate() error {
+	switch s.Step {
+	case StepStripTracks, StepRename, StepExtractSubtitles:
+	case StepDefaultFlags:
+		if s.Audio == "" && s.Subtitles == "" {
+			return fmt.Errorf("%s needs audio or subtitles", s.Step)
+		}
+	case StepMetadata:
+		if !s.Title && s.ChapterInterval <= 0 {
+			return fmt.Errorf("%s needs title or chapter_interval", s.Step)
+		}
+	default:
+		return fmt.Errorf("unknown step %q", s.Step)
+	}
+	return nil
+}
+
 // setDefaults sets default values for configuration
 func setDefaults(v *viper.Viper) {
 	// RabbitMQ defaults
@@ -81,24 +501,122 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("rabbitmq.port", "5672")
 	v.SetDefault("rabbitmq.username", "guest")
 	v.SetDefault("rabbitmq.password", "guest")
+	v.SetDefault("rabbitmq.password_file", "")
 	v.SetDefault("rabbitmq.vhost", "/")
+	v.SetDefault("rabbitmq.tls.enabled", false)
+	v.SetDefault("rabbitmq.tls.ca_file", "")
+	v.SetDefault("rabbitmq.tls.cert_file", "")
+	v.SetDefault("rabbitmq.tls.key_file", "")
+	v.SetDefault("rabbitmq.tls.server_name", "")
 	v.SetDefault("rabbitmq.queue.tasks", "mkvmerge.tasks")
 	v.SetDefault("rabbitmq.queue.done", "mkvmerge.done")
 	v.SetDefault("rabbitmq.queue.dlq", "mkvmerge.tasks_DLQ")
+	v.SetDefault("rabbitmq.reconnect.initial_delay", time.Second)
+	v.SetDefault("rabbitmq.reconnect.max_delay", time.Minute)
+	v.SetDefault("rabbitmq.priority.max", 0)
+	v.SetDefault("rabbitmq.priority.default", 0)
+	v.SetDefault("rabbitmq.priority.categories", map[string]int{})
+	v.SetDefault("rabbitmq.routing.exchange", "")
+	v.SetDefault("rabbitmq.routing.categories", []string{})
 
 	// Default category paths
 	v.SetDefault("paths.categories", map[string]string{
 		"local-movies":  "/mnt/vault/media/jello/movies",
 		"local-tvshows": "/mnt/vault/media/jello/tvshows",
 	})
+
+	// Retry defaults
+	retry := DefaultRetryConfig()
+	v.SetDefault("retry.max_attempts", retry.MaxAttempts)
+	v.SetDefault("retry.initial_delay", retry.InitialDelay)
+	v.SetDefault("retry.max_delay", retry.MaxDelay)
+
+	// Health and metrics server defaults
+	v.SetDefault("http.listen", ":9090")
+	v.SetDefault("http.liveness_timeout", 5*time.Minute)
+	v.SetDefault("http.queue_depth_interval", 15*time.Second)
+
+	// Ledger defaults
+	v.SetDefault("ledger.path", "ledger.db")
+
+	// Safety defaults
+	safety := DefaultSafetyConfig()
+	v.SetDefault("safety.min_free_mb", safety.MinFreeMB)
+	v.SetDefault("safety.verify", safety.Verify)
+	v.SetDefault("safety.duration_tolerance", safety.DurationTolerance)
+	v.SetDefault("safety.backup_dir", safety.BackupDir)
+	v.SetDefault("safety.backup_retention", safety.BackupRetention)
+
+	// Watcher defaults
+	v.SetDefault("watch.enabled", false)
+	v.SetDefault("watch.quiet_period", 2*time.Minute)
+	v.SetDefault("watch.broker", true)
+	v.SetDefault("watch.done_log", "done.log")
+
+	// Logging defaults
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", LogFormatText)
+
+	// Processing defaults
+	v.SetDefault("processing.workers", 1)
+	v.SetDefault("processing.mkvmerge_concurrency", 1)
+	v.SetDefault("processing.dry_run", false)
+
+	// Default processing policy
+	policy := DefaultCategoryPolicy()
+	v.SetDefault("policy.default.languages.audio", policy.Languages.Audio)
+	v.SetDefault("policy.default.languages.subtitles", policy.Languages.Subtitles)
+	v.SetDefault("policy.default.languages.keep_forced_subtitles", policy.Languages.KeepForcedSubtitles)
+	v.SetDefault("policy.default.languages.keep_undefined", policy.Languages.KeepUndefined)
+	v.SetDefault("policy.default.languages.fallback", policy.Languages.Fallback)
+	v.SetDefault("policy.default.timeout", policy.Timeout)
+	v.SetDefault("policy.default.backend", policy.Backend)
+	v.SetDefault("policy.default.convert_to_mkv", policy.ConvertToMKV)
+	pipeline := make([]map[string]interface{}, 0, len(policy.Pipeline))
+	for _, step := range policy.Pipeline {
+		pipeline = append(pipeline, map[string]interface{}{"step": step.Step})
+	}
+	v.SetDefault("policy.default.pipeline", pipeline)
+}
+
+// validateRouting checks the priorities and the consumed categories
+func (r RabbitMQConfig) validateRouting(categories map[string]string) error {
+	if r.Priority.Max < 0 || r.Priority.Max > 255 {
+		return fmt.Errorf("rabbitmq.priority.max must be between 0 and 255, got %d", r.Priority.Max)
+	}
+	if r.Priority.Default < 0 || r.Priority.Default > r.Priority.Max {
+		return fmt.Errorf("rabbitmq.priority.default must be between 0 and %d, got %d", r.Priority.Max, r.Priority.Default)
+	}
+	for category, priority := range r.Priority.Categories {
+		if priority < 0 || priority > r.Priority.Max {
+			return fmt.Errorf("priority of category %q must be between 0 and %d, got %d", category, r.Priority.Max, priority)
+		}
+	}
+
+	if len(r.Routing.Categories) > 0 && r.Routing.Exchange == "" {
+		return fmt.Errorf("rabbitmq.routing.categories needs rabbitmq.routing.exchange")
+	}
+	for _, category := range r.Routing.Categories {
+		if _, ok := categories[category]; !ok {
+			return fmt.Errorf("rabbitmq.routing.categories: unknown category %q", category)
+		}
+	}
+	return nil
 }
 
-// ConnectionString returns the RabbitMQ connection string
+// ConnectionString returns the RabbitMQ connection string. The credentials
+// and the vhost are escaped, so the default vhost "/" becomes %2F.
 func (c *Config) ConnectionString() string {
-	return fmt.Sprintf("amqp://%s:%s@%s:%s/%s",
-		c.RabbitMQ.Username,
-		c.RabbitMQ.Password,
-		c.RabbitMQ.Host,
-		c.RabbitMQ.Port,
-		c.RabbitMQ.Vhost)
+	scheme := "amqp"
+	if c.RabbitMQ.TLS.Enabled {
+		scheme = "amqps"
+	}
+	u := url.URL{
+		Scheme:  scheme,
+		User:    url.UserPassword(c.RabbitMQ.Username, c.RabbitMQ.Password),
+		Host:    net.JoinHostPort(c.RabbitMQ.Host, c.RabbitMQ.Port),
+		Path:    "/" + c.RabbitMQ.Vhost,
+		RawPath: "/" + url.PathEscape(c.RabbitMQ.Vhost),
+	}
+	return u.String()
 }
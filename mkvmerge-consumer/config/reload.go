@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Reload reads the configuration again. The changes compared to current
+// are returned also when the new configuration is invalid, so a rejected
+// edit can be reported.
+func Reload(current *Config) (*Config, []string, error) {
+	next, err := read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := Diff(current, next)
+	if err := next.validate(); err != nil {
+		return nil, changes, err
+	}
+	return next, changes, nil
+}
+
+// Watch calls onChange whenever the config file found by Load is written.
+// It returns the watched file, or "" when there is no config file to watch.
+func Watch(onChange func()) string {
+	v := newViper()
+	if err := v.ReadInConfig(); err != nil {
+		return ""
+	}
+
+	v.OnConfigChange(func(fsnotify.Event) { onChange() })
+	v.WatchConfig()
+	return v.ConfigFileUsed()
+}
+
+// Diff lists the settings that differ between old and new, sorted by key,
+// as "key: old -> new". Passwords are only reported as changed.
+func Diff(old, new *Config) []string {
+	before, after := flatten(old), flatten(new)
+
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, key := range keys {
+		was, ok := before[key]
+		if !ok {
+			was = "<unset>"
+		}
+		is, ok := after[key]
+		if !ok {
+			is = "<unset>"
+		}
+		if was == is {
+			continue
+		}
+		if strings.HasSuffix(key, "password") {
+			changes = append(changes, key+": changed")
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, was, is))
+	}
+	return changes
+}
+
+// flatten maps every setting of c to its formatted value, keyed like the
+// config file
+func flatten(c *Config) map[string]string {
+	values := make(map[string]string)
+	if c != nil {
+		flattenValue(reflect.ValueOf(*c), "", values)
+	}
+	return values
+}
+
+// durationType is formatted as a duration rather than a number
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// flattenValue adds v and everything below it to values
+func flattenValue(v reflect.Value, key string, values map[string]string) {
+	switch {
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Tag.Get("mapstructure")
+			flattenValue(v.Field(i), joinKey(key, name), values)
+		}
+	case v.Kind() == reflect.Map:
+		for _, k := range v.MapKeys() {
+			flattenValue(v.MapIndex(k), joinKey(key, fmt.Sprint(k.Interface())), values)
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < v.Len(); i++ {
+			flattenValue(v.Index(i), joinKey(key, fmt.Sprint(i)), values)
+		}
+	case v.Type() == durationType:
+		values[key] = time.Duration(v.Int()).String()
+	case v.Kind() == reflect.String:
+		values[key] = fmt.Sprintf("%q", v.String())
+	default:
+		values[key] = fmt.Sprint(v.Interface())
+	}
+}
+
+// joinKey appends name to a dotted key
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
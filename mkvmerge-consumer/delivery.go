@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// acknowledger is the part of amqp.Delivery used to settle a message
+type acknowledger interface {
+	Ack(multiple bool) error
+	Nack(multiple, requeue bool) error
+	Reject(requeue bool) error
+}
+
+// errAlreadySettled is returned when a delivery is settled a second time
+var errAlreadySettled = errors.New("delivery already settled")
+
+// settleOnce wraps an acknowledger so that only the first Ack, Nack or
+// Reject reaches the broker. Acknowledging a delivery twice closes the
+// channel, so later attempts are refused with errAlreadySettled.
+type settleOnce struct {
+	mu      sync.Mutex
+	d       acknowledger
+	settled bool
+}
+
+// newSettleOnce returns an acknowledger that settles d at most once
+func newSettleOnce(d acknowledger) *settleOnce {
+	return &settleOnce{d: d}
+}
+
+// Ack acknowledges the delivery unless it was already settled
+func (s *settleOnce) Ack(multiple bool) error {
+	return s.settle(func() error { return s.d.Ack(multiple) })
+}
+
+// Nack negatively acknowledges the delivery unless it was already settled
+func (s *settleOnce) Nack(multiple, requeue bool) error {
+	return s.settle(func() error { return s.d.Nack(multiple, requeue) })
+}
+
+// Reject rejects the delivery unless it was already settled
+func (s *settleOnce) Reject(requeue bool) error {
+	return s.settle(func() error { return s.d.Reject(requeue) })
+}
+
+// Settled reports whether the delivery has been settled
+func (s *settleOnce) Settled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settled
+}
+
+// settle runs fn if nothing has settled the delivery yet
+func (s *settleOnce) settle(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.settled {
+		return errAlreadySettled
+	}
+	s.settled = true
+	return fn()
+}
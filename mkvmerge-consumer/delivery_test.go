@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that settleOnce only forwards the first settlement
+func TestSettleOnce(t *testing.T) {
+	mockDelivery := new(MockDelivery)
+	mockDelivery.On("Reject", false).Return(nil).Once()
+
+	delivery := newSettleOnce(mockDelivery)
+	assert.False(t, delivery.Settled())
+
+	assert.NoError(t, delivery.Reject(false))
+	assert.True(t, delivery.Settled())
+
+	// A late ack from a timed-out run never reaches the broker
+	assert.ErrorIs(t, delivery.Ack(false), errAlreadySettled)
+	assert.ErrorIs(t, delivery.Nack(false, true), errAlreadySettled)
+
+	mockDelivery.AssertExpectations(t)
+	mockDelivery.AssertNotCalled(t, "Ack", false)
+}
+
+// Test that a failed settlement still counts as the one attempt
+func TestSettleOnceError(t *testing.T) {
+	mockDelivery := new(MockDelivery)
+	mockDelivery.On("Ack", false).Return(errors.New("channel closed")).Once()
+
+	delivery := newSettleOnce(mockDelivery)
+
+	assert.Error(t, delivery.Ack(false))
+	assert.ErrorIs(t, delivery.Ack(false), errAlreadySettled)
+	mockDelivery.AssertExpectations(t)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// diskFree is only implemented on Linux, elsewhere the free space check is skipped
+func diskFree(path string) (uint64, error) {
+	return 0, errFreeSpaceUnknown
+}
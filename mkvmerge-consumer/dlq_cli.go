@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// dlqEntry is a message browsed from the DLQ
+type dlqEntry struct {
+	// ID is derived from the message ID, or the content of messages without
+	// one, so it stays the same between runs. Identical messages are told
+	// apart by their position in the queue.
+	ID  string
+	Tag uint64
+	// Body is the original task message
+	Body     []byte
+	Reason   string
+	Time     time.Time
+	Attempts int
+	History  []retryAttempt
+	// CorrelationID identifies the task in the logs and is kept by a replay
+	CorrelationID string
+}
+
+// dlqEnvelope is the wrapper written by publishToDLQ
+type dlqEnvelope struct {
+	OriginalMessage string         `json:"originalMessage"`
+	ErrorReason     string         `json:"errorReason"`
+	Timestamp       string         `json:"timestamp"`
+	CorrelationID   string         `json:"correlationId"`
+	Attempts        int            `json:"attempts"`
+	History         []retryAttempt `json:"history"`
+}
+
+// newDLQEntry describes a DLQ delivery. Messages either carry the envelope
+// written by publishToDLQ or are the original task rejected through the DLX.
+func newDLQEntry(d amqp.Delivery) dlqEntry {
+	key := d.Body
+	if id := d.MessageId + d.CorrelationId; id != "" {
+		key = []byte(id)
+	}
+	sum := sha256.Sum256(key)
+	entry := dlqEntry{
+		ID:            hex.EncodeToString(sum[:])[:12],
+		Tag:           d.DeliveryTag,
+		Body:          d.Body,
+		Time:          d.Timestamp,
+		CorrelationID: d.MessageId,
+	}
+	if entry.CorrelationID == "" {
+		entry.CorrelationID = d.CorrelationId
+	}
+
+	var envelope dlqEnvelope
+	if err := json.Unmarshal(d.Body, &envelope); err == nil && envelope.ErrorReason != "" {
+		entry.Body = []byte(envelope.OriginalMessage)
+		entry.Reason = envelope.ErrorReason
+		entry.Attempts = max(envelope.Attempts, 1)
+		entry.History = envelope.History
+		if envelope.CorrelationID != "" {
+			entry.CorrelationID = envelope.CorrelationID
+		}
+		if t, err := time.Parse(time.RFC3339, envelope.Timestamp); err == nil {
+			entry.Time = t
+		}
+		return entry
+	}
+
+	// The broker records why, from which queue and when a message was
+	// dead-lettered
+	entry.Reason = "rejected"
+	if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			if reason, ok := death["reason"].(string); ok {
+				entry.Reason = reason
+			}
+			if queue, ok := death["queue"].(string); ok && queue != "" {
+				entry.Reason = fmt.Sprintf("%s from %s", entry.Reason, queue)
+			}
+			if t, ok := death["time"].(time.Time); ok {
+				entry.Time = t
+			}
+		}
+	}
+	entry.History = retryHistory(d.Headers)
+	entry.Attempts = retryCount(d.Headers) + 1
+	return entry
+}
+
+// message returns the original task, if it can be parsed
+func (e dlqEntry) message() Message {
+	var msg Message
+	json.Unmarshal(e.Body, &msg)
+	return msg
+}
+
+// dlqBrowser holds DLQ messages fetched without acknowledging them. Every
+// message that is neither replayed nor purged is returned to the queue by release.
+type dlqBrowser struct {
+	ch        ChannelInterface
+	entries   []dlqEntry
+	unsettled map[uint64]bool
+	// unread is the number of messages left in the DLQ past the limit
+	unread int
+}
+
+// defaultDLQLimit is the number of DLQ messages a command reads by default.
+// They are all held unacknowledged until the command ends.
+const defaultDLQLimit = 1000
+
+// browseDLQ fetches up to limit messages from the DLQ
+func browseDLQ(ch ChannelInterface, limit int) (*dlqBrowser, error) {
+	b := &dlqBrowser{ch: ch, unsettled: make(map[uint64]bool)}
+	seen := make(map[string]int)
+	for {
+		if len(b.entries) >= limit {
+			return b, nil
+		}
+		d, ok, err := ch.Get(dlqQueueName, false)
+		if err != nil {
+			return b, fmt.Errorf("failed to read from DLQ: %w", err)
+		}
+		if !ok {
+			b.unread = 0
+			return b, nil
+		}
+		entry := newDLQEntry(d)
+		seen[entry.ID]++
+		if n := seen[entry.ID]; n > 1 {
+			entry.ID = fmt.Sprintf("%s-%d", entry.ID, n)
+		}
+		b.entries = append(b.entries, entry)
+		b.unsettled[d.DeliveryTag] = true
+		b.unread = int(d.MessageCount)
+	}
+}
+
+// release puts the messages that were not replayed or purged back in the DLQ
+func (b *dlqBrowser) release() error {
+	var errs []error
+	for _, entry := range b.entries {
+		if !b.unsettled[entry.Tag] {
+			continue
+		}
+		if err := b.ch.Nack(entry.Tag, false, true); err != nil {
+			errs = append(errs, fmt.Errorf("failed to return message %s to DLQ: %w", entry.ID, err))
+		}
+		delete(b.unsettled, entry.Tag)
+	}
+	return errors.Join(errs...)
+}
+
+// find returns the entries with the given IDs
+func (b *dlqBrowser) find(ids []string) ([]dlqEntry, error) {
+	var found []dlqEntry
+	for _, id := range ids {
+		matched := false
+		for _, entry := range b.entries {
+			if entry.ID == id {
+				found = append(found, entry)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no DLQ message with ID %s", id)
+		}
+	}
+	return found, nil
+}
+
+// purge removes entry from the DLQ
+func (b *dlqBrowser) purge(entry dlqEntry) error {
+	if err := b.ch.Ack(entry.Tag, false); err != nil {
+		return fmt.Errorf("failed to purge message %s: %w", entry.ID, err)
+	}
+	delete(b.unsettled, entry.Tag)
+	return nil
+}
+
+// replay publishes the original task of entry to the tasks queue, optionally
+// moving it to another category, and then removes it from the DLQ
+func (b *dlqBrowser) replay(entry dlqEntry, category string) error {
+	body := entry.Body
+	if category != "" {
+		var err error
+		if body, err = withCategory(body, category); err != nil {
+			return fmt.Errorf("failed to change category of message %s: %w", entry.ID, err)
+		}
+	}
+
+	err := publishTask(b.ch, body, entry.CorrelationID)
+	if err != nil {
+		return fmt.Errorf("failed to replay message %s: %w", entry.ID, err)
+	}
+	var msg Message
+	_ = json.Unmarshal(body, &msg)
+	exchange, key := taskDestination(msg)
+	slog.Info("Replayed DLQ message", "id", entry.ID, "exchange", exchange, "routing_key", key,
+		"correlation_id", entry.CorrelationID)
+
+	// Only remove the message once the replay has been published
+	return b.purge(entry)
+}
+
+// withCategory returns body with its category replaced, keeping any other fields
+func withCategory(body []byte, category string) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["category"] = category
+	return json.Marshal(fields)
+}
+
+// dlqCommand runs a "dlq" subcommand against the DLQ
+func dlqCommand(ch ChannelInterface, args []string, out io.Writer) (err error) {
+	flags := flag.NewFlagSet("dlq", flag.ContinueOnError)
+	flags.SetOutput(out)
+	limit := flags.Int("limit", defaultDLQLimit, "read at most this many messages")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *limit <= 0 {
+		return errors.New("-limit must be positive")
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New("missing dlq command: list, show, replay or purge")
+	}
+
+	var run func(b *dlqBrowser, args []string, out io.Writer) error
+	switch args[0] {
+	case "list":
+		run = dlqList
+	case "show":
+		run = dlqShow
+	case "replay":
+		run = dlqReplay
+	case "purge":
+		run = dlqPurge
+	default:
+		return fmt.Errorf("unknown dlq command: %s", args[0])
+	}
+
+	b, err := browseDLQ(ch, *limit)
+	defer func() {
+		err = errors.Join(err, b.release())
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := run(b, args[1:], out); err != nil {
+		return err
+	}
+	if b.unread > 0 {
+		fmt.Fprintf(out, "%d more message(s) in %s were not read, raise -limit to include them\n", b.unread, dlqQueueName)
+	}
+	return nil
+}
+
+// dlqList prints a line for every DLQ message
+func dlqList(b *dlqBrowser, args []string, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tATTEMPTS\tCATEGORY\tTORRENT\tREASON")
+	for _, entry := range b.entries {
+		msg := entry.message()
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			entry.ID, formatEntryTime(entry.Time), entry.Attempts, msg.Category, msg.TorrentName, entry.Reason)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d message(s) in %s\n", len(b.entries), dlqQueueName)
+	return nil
+}
+
+// dlqShow prints the details of the given messages
+func dlqShow(b *dlqBrowser, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("missing message ID")
+	}
+	entries, err := b.find(args)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Fprintf(out, "ID:       %s\n", entry.ID)
+		fmt.Fprintf(out, "Time:     %s\n", formatEntryTime(entry.Time))
+		fmt.Fprintf(out, "Reason:   %s\n", entry.Reason)
+		fmt.Fprintf(out, "Attempts: %d\n", entry.Attempts)
+
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, entry.Body, "  ", "  "); err != nil {
+			pretty.Reset()
+			pretty.Write(entry.Body)
+		}
+		fmt.Fprintf(out, "Message:\n  %s\n", pretty.String())
+
+		if len(entry.History) > 0 {
+			fmt.Fprintln(out, "History:")
+			for _, attempt := range entry.History {
+				fmt.Fprintf(out, "  %d. %s %s\n", attempt.Attempt, attempt.Time, attempt.Reason)
+			}
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+// dlqReplay sends the selected messages back to the tasks queue
+func dlqReplay(b *dlqBrowser, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+	flags.SetOutput(out)
+	all := flags.Bool("all", false, "replay every message")
+	category := flags.String("category", "", "replay into this category instead of the original one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	entries := b.entries
+	if !*all {
+		if flags.NArg() == 0 {
+			return errors.New("select messages by ID or use -all")
+		}
+		var err error
+		if entries, err = b.find(flags.Args()); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := b.replay(entry, *category); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "Replayed %d message(s) to %s\n", len(entries), tasksDestination())
+	return nil
+}
+
+// dlqPurge deletes the messages matching the given filters
+func dlqPurge(b *dlqBrowser, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dlq purge", flag.ContinueOnError)
+	flags.SetOutput(out)
+	all := flags.Bool("all", false, "purge every message")
+	olderThan := flags.Duration("older-than", 0, "purge messages dead-lettered longer ago than this")
+	reason := flags.String("reason", "", "purge messages whose reason contains this text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*all && *olderThan == 0 && *reason == "" {
+		return errors.New("select messages with -older-than, -reason or -all")
+	}
+
+	cutoff := time.Now().Add(-*olderThan)
+	purged := 0
+	for _, entry := range b.entries {
+		// Messages without a known time are never considered old
+		if *olderThan > 0 && (entry.Time.IsZero() || entry.Time.After(cutoff)) {
+			continue
+		}
+		if *reason != "" && !strings.Contains(strings.ToLower(entry.Reason), strings.ToLower(*reason)) {
+			continue
+		}
+		if err := b.purge(entry); err != nil {
+			return err
+		}
+		purged++
+	}
+	fmt.Fprintf(out, "Purged %d message(s) from %s\n", purged, dlqQueueName)
+	return nil
+}
+
+// formatEntryTime formats the time a message was dead-lettered
+func formatEntryTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// dlqEnvelopeDelivery returns a DLQ delivery as written by publishToDLQ
+func dlqEnvelopeDelivery(t *testing.T, tag uint64, torrent, reason string, age time.Duration) amqp.Delivery {
+	original, err := json.Marshal(Message{TorrentName: torrent, Category: "test-category"})
+	assert.NoError(t, err)
+	body, err := json.Marshal(dlqEnvelope{
+		OriginalMessage: string(original),
+		ErrorReason:     reason,
+		Timestamp:       time.Now().Add(-age).Format(time.RFC3339),
+		Attempts:        2,
+		History:         []retryAttempt{{Attempt: 1, Reason: reason}, {Attempt: 2, Reason: reason}},
+	})
+	assert.NoError(t, err)
+	return amqp.Delivery{DeliveryTag: tag, Body: body}
+}
+
+// newDLQChannel returns a mock channel holding the given DLQ deliveries
+func newDLQChannel(deliveries ...amqp.Delivery) *MockChannelInterface {
+	queueName = "test-queue"
+	dlqQueueName = "test-dlq"
+
+	mockChannel := new(MockChannelInterface)
+	for _, d := range deliveries {
+		mockChannel.On("Get", "test-dlq", false).Return(d, true, nil).Once()
+	}
+	mockChannel.On("Get", "test-dlq", false).Return(amqp.Delivery{}, false, nil).Once()
+	return mockChannel
+}
+
+// Test that listing shows every message and returns them all to the DLQ
+func TestDLQList(t *testing.T) {
+	rejected := amqp.Delivery{
+		DeliveryTag: 2,
+		Body:        []byte(`{"torrentName":"other","category":"test-category"}`),
+		Headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"reason": "rejected", "time": time.Now()},
+		}},
+	}
+	mockChannel := newDLQChannel(dlqEnvelopeDelivery(t, 1, "movie", "Folder does not exist", time.Hour), rejected)
+	mockChannel.On("Nack", uint64(1), false, true).Return(nil).Once()
+	mockChannel.On("Nack", uint64(2), false, true).Return(nil).Once()
+
+	var out bytes.Buffer
+	err := dlqCommand(mockChannel, []string{"list"}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "movie")
+	assert.Contains(t, out.String(), "Folder does not exist")
+	assert.Contains(t, out.String(), "other")
+	assert.Contains(t, out.String(), "rejected")
+	assert.Contains(t, out.String(), "2 message(s) in test-dlq")
+	mockChannel.AssertExpectations(t)
+	mockChannel.AssertNotCalled(t, "Ack", mock.Anything, mock.Anything)
+}
+
+// Test that show prints the original message and its history
+func TestDLQShow(t *testing.T) {
+	d := dlqEnvelopeDelivery(t, 1, "movie", "Folder does not exist", time.Hour)
+	entry := newDLQEntry(d)
+	mockChannel := newDLQChannel(d)
+	mockChannel.On("Nack", uint64(1), false, true).Return(nil).Once()
+
+	var out bytes.Buffer
+	err := dlqCommand(mockChannel, []string{"show", entry.ID}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `"torrentName": "movie"`)
+	assert.Contains(t, out.String(), "Attempts: 2")
+	assert.Contains(t, out.String(), "2.  Folder does not exist")
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that an unknown ID is reported and nothing is removed
+func TestDLQShowUnknownID(t *testing.T) {
+	mockChannel := newDLQChannel(dlqEnvelopeDelivery(t, 1, "movie", "reason", time.Hour))
+	mockChannel.On("Nack", uint64(1), false, true).Return(nil).Once()
+
+	err := dlqCommand(mockChannel, []string{"show", "unknown"}, &bytes.Buffer{})
+
+	assert.EqualError(t, err, "no DLQ message with ID unknown")
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that a replayed message is published with the new category before it is removed
+func TestDLQReplayWithCategory(t *testing.T) {
+	replayed := dlqEnvelopeDelivery(t, 1, "movie", "Unknown category: test-category", time.Hour)
+	replayed.CorrelationId = "task-1"
+	kept := dlqEnvelopeDelivery(t, 2, "other", "Unknown category: test-category", time.Hour)
+	mockChannel := newDLQChannel(replayed, kept)
+
+	mockChannel.On("Publish", "", "test-queue", false, false,
+		mock.MatchedBy(func(msg amqp.Publishing) bool {
+			var task Message
+			err := json.Unmarshal(msg.Body, &task)
+			return err == nil && task.TorrentName == "movie" && task.Category == "local-movies" &&
+				msg.CorrelationId == "task-1" && msg.DeliveryMode == amqp.Persistent && msg.Headers[retryCountHeader] == nil
+		})).Return(nil).Once()
+	mockChannel.On("Ack", uint64(1), false).Return(nil).Once()
+	mockChannel.On("Nack", uint64(2), false, true).Return(nil).Once()
+
+	var out bytes.Buffer
+	err := dlqCommand(mockChannel, []string{"replay", "-category", "local-movies", newDLQEntry(replayed).ID}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Replayed 1 message(s) to test-queue")
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that a failed publish keeps the message in the DLQ
+func TestDLQReplayPublishFailure(t *testing.T) {
+	mockChannel := newDLQChannel(dlqEnvelopeDelivery(t, 1, "movie", "reason", time.Hour))
+	mockChannel.On("Publish", "", "test-queue", false, false, mock.Anything).Return(&amqp.Error{Code: 504, Reason: "channel closed"})
+	mockChannel.On("Nack", uint64(1), false, true).Return(nil).Once()
+
+	err := dlqCommand(mockChannel, []string{"replay", "-all"}, &bytes.Buffer{})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to replay message")
+	mockChannel.AssertExpectations(t)
+	mockChannel.AssertNotCalled(t, "Ack", mock.Anything, mock.Anything)
+}
+
+// Test that replay requires a selection
+func TestDLQReplayRequiresSelection(t *testing.T) {
+	mockChannel := newDLQChannel()
+
+	err := dlqCommand(mockChannel, []string{"replay"}, &bytes.Buffer{})
+
+	assert.EqualError(t, err, "select messages by ID or use -all")
+}
+
+// Test that purge only removes messages matching age and reason
+func TestDLQPurge(t *testing.T) {
+	mockChannel := newDLQChannel(
+		dlqEnvelopeDelivery(t, 1, "old-missing", "Folder does not exist", 96*time.Hour),
+		dlqEnvelopeDelivery(t, 2, "new-missing", "Folder does not exist", time.Hour),
+		dlqEnvelopeDelivery(t, 3, "old-timeout", "Processing timed out", 96*time.Hour),
+	)
+	mockChannel.On("Ack", uint64(1), false).Return(nil).Once()
+	mockChannel.On("Nack", uint64(2), false, true).Return(nil).Once()
+	mockChannel.On("Nack", uint64(3), false, true).Return(nil).Once()
+
+	var out bytes.Buffer
+	err := dlqCommand(mockChannel, []string{"purge", "-older-than", "72h", "-reason", "folder"}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Purged 1 message(s) from test-dlq")
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that purge refuses to run without a filter
+func TestDLQPurgeRequiresFilter(t *testing.T) {
+	mockChannel := newDLQChannel()
+
+	err := dlqCommand(mockChannel, []string{"purge"}, &bytes.Buffer{})
+
+	assert.EqualError(t, err, "select messages with -older-than, -reason or -all")
+}
+
+// Test that only the first messages up to the limit are read and the rest reported
+func TestDLQListLimit(t *testing.T) {
+	first := dlqEnvelopeDelivery(t, 1, "movie", "reason", time.Hour)
+	first.MessageCount = 4
+	second := dlqEnvelopeDelivery(t, 2, "other", "reason", time.Hour)
+	second.MessageCount = 3
+	mockChannel := newDLQChannel(first, second)
+	mockChannel.On("Nack", uint64(1), false, true).Return(nil).Once()
+	mockChannel.On("Nack", uint64(2), false, true).Return(nil).Once()
+
+	var out bytes.Buffer
+	err := dlqCommand(mockChannel, []string{"-limit", "2", "list"}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "2 message(s) in test-dlq")
+	assert.Contains(t, out.String(), "3 more message(s) in test-dlq were not read")
+	mockChannel.AssertNumberOfCalls(t, "Get", 2)
+
+	assert.EqualError(t, dlqCommand(newDLQChannel(), []string{"-limit", "0", "list"}, &out), "-limit must be positive")
+}
+
+// Test for newDLQEntry with a message rejected through the DLX
+func TestNewDLQEntryRejected(t *testing.T) {
+	deadAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := newDLQEntry(amqp.Delivery{
+		DeliveryTag: 7,
+		MessageId:   "task-7",
+		Body:        []byte(`{"torrentName":"movie","category":"unknown"}`),
+		Headers: amqp.Table{
+			retryCountHeader: int32(1),
+			"x-death":        []interface{}{amqp.Table{"reason": "rejected", "queue": "test-queue", "time": deadAt}},
+		},
+	})
+
+	assert.Len(t, entry.ID, 12)
+	assert.Equal(t, uint64(7), entry.Tag)
+	assert.Equal(t, "rejected from test-queue", entry.Reason)
+	assert.Equal(t, deadAt, entry.Time)
+	assert.Equal(t, 2, entry.Attempts)
+	assert.Equal(t, "task-7", entry.CorrelationID)
+	assert.Equal(t, "unknown", entry.message().Category)
+}
+
+// Test that identical messages get distinct IDs and the message ID is used
+// when there is one
+func TestDLQEntryIDs(t *testing.T) {
+	body := []byte(`{"torrentName":"movie","category":"unknown"}`)
+	mockChannel := newDLQChannel(
+		amqp.Delivery{DeliveryTag: 1, Body: body},
+		amqp.Delivery{DeliveryTag: 2, Body: body},
+		amqp.Delivery{DeliveryTag: 3, Body: body, MessageId: "task-3"},
+	)
+	mockChannel.On("Ack", uint64(2), false).Return(nil).Once()
+	mockChannel.On("Nack", uint64(1), false, true).Return(nil).Once()
+	mockChannel.On("Nack", uint64(3), false, true).Return(nil).Once()
+
+	b, err := browseDLQ(mockChannel, defaultDLQLimit)
+	assert.NoError(t, err)
+	ids := []string{b.entries[0].ID, b.entries[1].ID, b.entries[2].ID}
+	assert.Equal(t, ids[0]+"-2", ids[1])
+	assert.Len(t, ids[2], 12)
+	assert.NotEqual(t, ids[0], ids[2])
+
+	entries, err := b.find([]string{ids[1]})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.NoError(t, b.purge(entries[0]))
+	}
+	assert.NoError(t, b.release())
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that a replay through the routing exchange reports the exchange
+func TestDLQReplayThroughExchange(t *testing.T) {
+	mockChannel := newDLQChannel(dlqEnvelopeDelivery(t, 1, "movie", "reason", time.Hour))
+	taskRouting = config.RoutingConfig{Exchange: "test-tasks"}
+	defer func() { taskRouting = config.RoutingConfig{} }()
+
+	mockChannel.On("Publish", "test-tasks", "test-category", false, false, mock.Anything).Return(nil).Once()
+	mockChannel.On("Ack", uint64(1), false).Return(nil).Once()
+
+	var out bytes.Buffer
+	err := dlqCommand(mockChannel, []string{"replay", "-all"}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Replayed 1 message(s) to exchange test-tasks")
+	mockChannel.AssertExpectations(t)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
@@ -50,7 +51,7 @@ func TestPublishToDLQ(t *testing.T) {
 		})).Return(nil)
 
 	// Call the function being tested
-	err := publishToDLQ(mockChannel, []byte("test message"), "test reason")
+	err := publishToDLQ(context.Background(), mockChannel, []byte("test message"), "test reason", nil)
 
 	// Verify results
 	assert.NoError(t, err)
@@ -87,10 +88,34 @@ func TestPublishToDLQError(t *testing.T) {
 		mock.Anything).Return(publishErr)
 
 	// Call the function being tested
-	err := publishToDLQ(mockChannel, []byte("test message"), "test reason")
+	err := publishToDLQ(context.Background(), mockChannel, []byte("test message"), "test reason", nil)
 
 	// Verify results
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to publish to DLQ")
 	mockChannel.AssertExpectations(t)
 }
+
+// Test that the DLQ payload carries the correlation ID of the task
+func TestPublishToDLQCorrelationID(t *testing.T) {
+	// Setup global variables for test
+	dlqQueueName = "test-dlq"
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("QueueDeclare", dlqQueueName, true, false, false, false, mock.Anything).
+		Return(amqp.Queue{Name: dlqQueueName}, nil)
+	mockChannel.On("Publish", "", dlqQueueName, false, false,
+		mock.MatchedBy(func(msg amqp.Publishing) bool {
+			var dlqMessage map[string]interface{}
+			if err := json.Unmarshal(msg.Body, &dlqMessage); err != nil {
+				return false
+			}
+			return dlqMessage["correlationId"] == "task-42" && msg.CorrelationId == "task-42"
+		})).Return(nil)
+
+	ctx := withCorrelationID(context.Background(), "task-42")
+	err := publishToDLQ(ctx, mockChannel, []byte("test message"), "test reason", nil)
+
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+}
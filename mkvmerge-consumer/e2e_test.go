@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/streadway/amqp"
+)
+
+// e2eCategory is the category the end-to-end tests publish tasks for
+const e2eCategory = "movies"
+
+// e2eConsumer is a consumer running against a fake broker with the fake
+// mkvmerge
+type e2eConsumer struct {
+	broker *fakeBroker
+	// dir is the base directory of e2eCategory
+	dir string
+	// ch is a channel for publishing tasks
+	ch ChannelInterface
+}
+
+// startConsumer applies a test configuration and runs a supervisor against
+// a new fake broker until the test ends
+func startConsumer(t *testing.T) *e2eConsumer {
+	t.Helper()
+	restoreGlobals(t)
+	useFakeMkvmerge(t)
+	diskFreeFunc = func(string) (uint64, error) { return 1 << 40, nil }
+
+	dir := t.TempDir()
+	c := &config.Config{}
+	c.RabbitMQ.Queue.Tasks = "tasks"
+	c.RabbitMQ.Queue.Done = "done"
+	c.RabbitMQ.Queue.DLQ = "dlq"
+	c.Paths.Categories = map[string]string{e2eCategory: dir}
+	c.Policy.Default = config.DefaultCategoryPolicy()
+	c.Processing.MkvmergeConcurrency = 1
+	// Every retry waits the same 10ms, so a single retry queue is declared
+	c.Retry = config.RetryConfig{MaxAttempts: 2, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	c.Safety = config.DefaultSafetyConfig()
+	applyConfig(c)
+
+	broker := newFakeBroker()
+	s := &supervisor{
+		dial:     broker.dial,
+		handle:   handleDelivery,
+		workers:  1,
+		prefetch: 1,
+		minDelay: 5 * time.Millisecond,
+		maxDelay: 20 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	// Tasks published before the queues exist would be dropped
+	assert.Eventually(t, s.connected, 5*time.Second, 5*time.Millisecond)
+
+	conn, err := broker.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &e2eConsumer{broker: broker, dir: dir, ch: ch}
+}
+
+// restoreGlobals restores the settings applyConfig and the tests change
+func restoreGlobals(t *testing.T) {
+	tasks, done, dlq := queueName, doneQueueName, dlqQueueName
+	paths, policies, defaults := CategoryPathMap, CategoryPolicyMap, defaultPolicy
+	retries, slots, ledger, safety := retryPolicy, mkvmergeSlots, fileLedger, safetyPolicy
+	dry, priorities, routing, queues := dryRun, taskPriorities, taskRouting, categoryQueues
+	t.Cleanup(func() {
+		queueName, doneQueueName, dlqQueueName = tasks, done, dlq
+		CategoryPathMap, CategoryPolicyMap, defaultPolicy = paths, policies, defaults
+		retryPolicy, mkvmergeSlots, fileLedger, safetyPolicy = retries, slots, ledger, safety
+		dryRun, taskPriorities, taskRouting, categoryQueues = dry, priorities, routing, queues
+		diskFreeFunc = diskFree
+	})
+}
+
+// addTorrent writes a torrent folder holding one media file with English
+// and Spanish audio and returns the path of the file
+func (e *e2eConsumer) addTorrent(t *testing.T, name string) string {
+	t.Helper()
+	folder := filepath.Join(e.dir, name)
+	if err := os.MkdirAll(folder, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(folder, "movie.mkv")
+	writeFakeMkv(t, path, fakeMkvFile{
+		Container: json.RawMessage(`{"properties":{"duration":5400000000000}}`),
+		Tracks: []fakeMkvTrack{
+			{ID: 0, Type: "video", Properties: json.RawMessage(`{"language":"eng"}`)},
+			{ID: 1, Type: "audio", Properties: json.RawMessage(`{"language":"eng"}`)},
+			{ID: 2, Type: "audio", Properties: json.RawMessage(`{"language":"spa"}`)},
+			{ID: 3, Type: "subtitles", Properties: json.RawMessage(`{"language":"eng"}`)},
+		},
+	})
+	return path
+}
+
+// publish publishes a task for e2eCategory
+func (e *e2eConsumer) publish(t *testing.T, torrentName string) []byte {
+	t.Helper()
+	body, _ := json.Marshal(Message{TorrentName: torrentName, Category: e2eCategory})
+	if err := publishTask(e.ch, body, ""); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// Test for a task being processed end to end: the file is remuxed and the
+// done event published
+func TestEndToEndProcessesTask(t *testing.T) {
+	e := startConsumer(t)
+	path := e.addTorrent(t, "Movie (2020)")
+
+	e.publish(t, "Movie (2020)")
+
+	messages := e.broker.waitForMessages(t, doneQueueName, 1)
+	var event doneEvent
+	assert.NoError(t, json.Unmarshal(messages[0].Body, &event))
+	assert.Equal(t, "Movie (2020)", event.TorrentName)
+	assert.Equal(t, e2eCategory, event.Category)
+	if assert.Len(t, event.Files, 1) {
+		assert.Equal(t, path, event.Files[0].Path)
+		assert.Equal(t, fileProcessed, event.Files[0].Outcome)
+		assert.Equal(t, []trackSummary{{ID: 2, Type: "audio", Language: "spa"}}, event.Files[0].Removed)
+	}
+
+	file := readFakeMkv(t, path)
+	var types []string
+	for _, track := range file.Tracks {
+		types = append(types, track.Type)
+		assert.JSONEq(t, `{"language":"eng"}`, string(track.Properties))
+	}
+	assert.Equal(t, []string{"video", "audio", "subtitles"}, types)
+
+	// The task was acknowledged and nothing was dead-lettered
+	assert.Eventually(t, func() bool { return e.broker.unackedCount() == 0 }, 5*time.Second, 5*time.Millisecond)
+	assert.Empty(t, e.broker.ready(queueName))
+	assert.Empty(t, e.broker.ready(dlqQueueName))
+}
+
+// Test for messages that can never be processed being sent to the DLQ with
+// the correlation ID they were logged with
+func TestEndToEndRejectsBrokenMessages(t *testing.T) {
+	e := startConsumer(t)
+
+	invalid := []byte("not json")
+	assert.NoError(t, publishTask(e.ch, invalid, ""))
+	unknown, _ := json.Marshal(Message{TorrentName: "Movie (2020)", Category: "books"})
+	assert.NoError(t, publishTask(e.ch, unknown, ""))
+
+	messages := e.broker.waitForMessages(t, dlqQueueName, 2)
+	for i, body := range [][]byte{invalid, unknown} {
+		var envelope dlqEnvelope
+		assert.NoError(t, json.Unmarshal(messages[i].Body, &envelope))
+		assert.Equal(t, string(body), envelope.OriginalMessage)
+		assert.NotEmpty(t, envelope.CorrelationID)
+		assert.Equal(t, envelope.CorrelationID, messages[i].CorrelationId)
+		assert.NotContains(t, messages[i].Headers, "x-death")
+	}
+	assert.Empty(t, e.broker.ready(doneQueueName))
+	assert.Empty(t, e.broker.ready(queueName))
+}
+
+// Test for a task whose folder is missing being retried through the retry
+// queue and then sent to the DLQ with its history
+func TestEndToEndRetriesThenDeadLetters(t *testing.T) {
+	e := startConsumer(t)
+
+	body := e.publish(t, "Missing (2020)")
+
+	messages := e.broker.waitForMessages(t, dlqQueueName, 1)
+	var envelope dlqEnvelope
+	assert.NoError(t, json.Unmarshal(messages[0].Body, &envelope))
+	assert.Equal(t, string(body), envelope.OriginalMessage)
+	assert.Contains(t, envelope.ErrorReason, "Folder does not exist")
+	// The first attempt and the two retries
+	assert.Equal(t, 3, envelope.Attempts)
+	assert.Len(t, envelope.History, 3)
+	assert.Empty(t, e.broker.ready(doneQueueName))
+}
+
+// Test for the consumer reconnecting after the broker dropped its
+// connection and processing the tasks published afterwards
+func TestEndToEndReconnects(t *testing.T) {
+	e := startConsumer(t)
+	path := e.addTorrent(t, "Movie (2020)")
+
+	e.broker.dropConnections()
+	assert.Eventually(t, func() bool { return e.broker.dialCount() > 2 }, 5*time.Second, 5*time.Millisecond)
+
+	// The publishing channel was dropped too
+	conn, err := e.broker.dial()
+	assert.NoError(t, err)
+	e.ch, err = conn.Channel()
+	assert.NoError(t, err)
+	e.publish(t, "Movie (2020)")
+
+	e.broker.waitForMessages(t, doneQueueName, 1)
+	assert.Len(t, readFakeMkv(t, path).Tracks, 3)
+}
+
+// Test for the fake broker redelivering unacknowledged messages when their
+// channel closes and on nack with requeue
+func TestFakeBrokerRedelivery(t *testing.T) {
+	broker := newFakeBroker()
+	conn, _ := broker.dial()
+	ch, _ := conn.Channel()
+	_, err := ch.QueueDeclare("q", true, false, false, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte("a")}))
+
+	d, ok, err := ch.Get("q", false)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.False(t, d.Redelivered)
+	assert.NoError(t, d.Nack(false, true))
+
+	d, _, _ = ch.Get("q", false)
+	assert.True(t, d.Redelivered)
+	assert.Equal(t, 1, broker.unackedCount())
+
+	// Closing the channel puts the message back
+	assert.NoError(t, ch.Close())
+	assert.Len(t, broker.ready("q"), 1)
+
+	ch, _ = conn.Channel()
+	msgs, err := ch.Consume("q", "", false, false, false, false, nil)
+	assert.NoError(t, err)
+	d = <-msgs
+	assert.Equal(t, []byte("a"), d.Body)
+	assert.True(t, d.Redelivered)
+	assert.NoError(t, d.Ack(false))
+	assert.Equal(t, 0, broker.unackedCount())
+	assert.Empty(t, broker.ready("q"))
+
+	// Settling a delivery twice is a channel error
+	assert.Error(t, d.Ack(false))
+}
+
+// Test for the fake broker dead-lettering expired messages and delivering
+// by priority
+func TestFakeBrokerDeadLetteringAndPriority(t *testing.T) {
+	broker := newFakeBroker()
+	conn, _ := broker.dial()
+	ch, _ := conn.Channel()
+	assert.NoError(t, ch.ExchangeDeclare("dlx", "direct", true, false, false, false, nil))
+	_, err := ch.QueueDeclare("dead", true, false, false, false, amqp.Table{"x-max-priority": int32(5)})
+	assert.NoError(t, err)
+	assert.NoError(t, ch.QueueBind("dead", "dead", "dlx", false, nil))
+	_, err = ch.QueueDeclare("wait", true, false, false, false, amqp.Table{
+		"x-message-ttl":             int32(10),
+		"x-dead-letter-exchange":    "dlx",
+		"x-dead-letter-routing-key": "dead",
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, ch.Publish("", "wait", false, false, amqp.Publishing{Body: []byte("low"), Priority: 1}))
+	assert.NoError(t, ch.Publish("", "wait", false, false, amqp.Publishing{Body: []byte("high"), Priority: 4}))
+
+	messages := broker.waitForMessages(t, "dead", 2)
+	death := messages[0].Headers["x-death"].([]interface{})[0].(amqp.Table)
+	assert.Equal(t, "expired", death["reason"])
+	assert.Equal(t, "wait", death["queue"])
+
+	d, _, _ := ch.Get("dead", true)
+	assert.Equal(t, []byte("high"), d.Body)
+	d, _, _ = ch.Get("dead", true)
+	assert.Equal(t, []byte("low"), d.Body)
+
+	// Redeclaring with other arguments closes the channel like RabbitMQ
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	_, err = ch.QueueDeclare("wait", true, false, false, false, nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+	}
+	assert.NotNil(t, <-closed)
+}
+
+// Test for the fake broker routing through topic exchanges and their
+// alternate exchange
+func TestFakeBrokerTopicRouting(t *testing.T) {
+	broker := newFakeBroker()
+	conn, _ := broker.dial()
+	ch, _ := conn.Channel()
+	for _, queue := range []string{"movies", "shows", "rest"} {
+		_, err := ch.QueueDeclare(queue, true, false, false, false, nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, ch.ExchangeDeclare("other", "fanout", true, false, false, false, nil))
+	assert.NoError(t, ch.QueueBind("rest", "", "other", false, nil))
+	assert.NoError(t, ch.ExchangeDeclare("tasks", "topic", true, false, false, false, amqp.Table{"alternate-exchange": "other"}))
+	assert.NoError(t, ch.QueueBind("movies", "movies", "tasks", false, nil))
+	assert.NoError(t, ch.QueueBind("shows", "shows.#", "tasks", false, nil))
+
+	for _, key := range []string{"movies", "shows", "shows.anime.2020", "music"} {
+		assert.NoError(t, ch.Publish("tasks", key, false, false, amqp.Publishing{Body: []byte(key)}))
+	}
+
+	assert.Len(t, broker.ready("movies"), 1)
+	assert.Len(t, broker.ready("shows"), 2)
+	if assert.Len(t, broker.ready("rest"), 1) {
+		assert.Equal(t, []byte("music"), broker.ready("rest")[0].Body)
+	}
+}
+
+// Test for a changed priority.max recreating the empty task queue and
+// keeping one that holds tasks, against the fake broker
+func TestEndToEndPriorityChange(t *testing.T) {
+	restoreGlobals(t)
+	queueName, doneQueueName, dlqQueueName = "tasks", "done", "dlq"
+	taskRouting, categoryQueues = config.RoutingConfig{}, nil
+	retryPolicy = config.RetryConfig{}
+
+	queueArgs := func(broker *fakeBroker) amqp.Table {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return copyTable(broker.queues[queueName].args)
+	}
+
+	// declareOld declares the task queue as it was without priorities
+	declareOld := func(t *testing.T, tasks int) (*fakeBroker, ConnectionInterface) {
+		taskPriorities = config.PriorityConfig{}
+		broker := newFakeBroker()
+		conn, _ := broker.dial()
+		ch, _ := conn.Channel()
+		assert.NoError(t, ch.ExchangeDeclare("dlx", "direct", true, false, false, false, nil))
+		_, err := ch.QueueDeclare(queueName, true, false, false, false, taskQueueArgs())
+		assert.NoError(t, err)
+		for i := 0; i < tasks; i++ {
+			assert.NoError(t, ch.Publish("", queueName, false, false, amqp.Publishing{Body: []byte("task")}))
+		}
+		taskPriorities = config.PriorityConfig{Max: 10, Default: 1}
+		return broker, conn
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		broker, _ := declareOld(t, 0)
+		s := &supervisor{
+			dial:     broker.dial,
+			handle:   handleDelivery,
+			workers:  1,
+			prefetch: 1,
+			minDelay: 5 * time.Millisecond,
+			maxDelay: 20 * time.Millisecond,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.run(ctx)
+		}()
+		defer func() {
+			cancel()
+			<-stopped
+		}()
+
+		assert.Eventually(t, s.connected, 5*time.Second, 5*time.Millisecond)
+		assert.Equal(t, int32(10), queueArgs(broker)["x-max-priority"])
+	})
+
+	t.Run("holding tasks", func(t *testing.T) {
+		broker, conn := declareOld(t, 2)
+		ch, _ := conn.Channel()
+
+		_, err := ensureMainQueueWithDLX(ch, conn.Channel)
+
+		if assert.Error(t, err) {
+			assert.NotErrorIs(t, err, errQueueRecreated)
+			assert.Contains(t, err.Error(), "task queue 'tasks'")
+			assert.Contains(t, err.Error(), "priority.max=10")
+		}
+		assert.Len(t, broker.ready(queueName), 2)
+		assert.Nil(t, queueArgs(broker)["x-max-priority"])
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// doneEventVersion is the version of the done-event schema. Version 1 was the
+// bare filename/status/time message; bump it on incompatible changes.
+const doneEventVersion = 2
+
+// doneStatusProcessed is the status of a torrent whose files were handled
+const doneStatusProcessed = "processed"
+
+// doneEvent is published to the done queue once a torrent has been handled
+type doneEvent struct {
+	Version int `json:"version"`
+	// Filename holds the torrent name, kept for consumers of version 1
+	Filename    string       `json:"filename"`
+	Status      string       `json:"status"`
+	Time        string       `json:"time"`
+	TorrentName string       `json:"torrentName"`
+	Category    string       `json:"category"`
+	Files       []fileResult `json:"files"`
+	// CorrelationID identifies the task message across the logs of every service
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// newDoneEvent returns the done event for a torrent and its file results
+func newDoneEvent(msg Message, files []fileResult) doneEvent {
+	return doneEvent{
+		Version:     doneEventVersion,
+		Filename:    msg.TorrentName,
+		Status:      doneStatusProcessed,
+		Time:        time.Now().Format(time.RFC3339),
+		TorrentName: msg.TorrentName,
+		Category:    msg.Category,
+		Files:       files,
+	}
+}
+
+// fileOutcome describes what happened to a single file of a message
+type fileOutcome string
+
+const (
+	fileFailed    fileOutcome = "failed"    // the file could not be processed
+	fileSkipped   fileOutcome = "skipped"   // no pipeline step had anything to change
+	fileProcessed fileOutcome = "processed" // at least one pipeline step changed the file
+)
+
+// fileResult reports what processing did to a single file
+type fileResult struct {
+	Path    string      `json:"path"`
+	Outcome fileOutcome `json:"status"`
+	Skipped bool        `json:"skipped"`
+	// AlreadyProcessed is set when the ledger shows the file was handled before
+	AlreadyProcessed bool `json:"alreadyProcessed,omitempty"`
+	// Steps lists the pipeline steps that changed the file
+	Steps      []string       `json:"steps,omitempty"`
+	Kept       []trackSummary `json:"kept,omitempty"`
+	Removed    []trackSummary `json:"removed,omitempty"`
+	RenamedTo  string         `json:"renamedTo,omitempty"`
+	Backup     string         `json:"backup,omitempty"`
+	Sidecars   []string       `json:"sidecars,omitempty"`
+	SizeBefore int64          `json:"sizeBefore"`
+	SizeAfter  int64          `json:"sizeAfter"`
+	Warnings   []string       `json:"warnings,omitempty"`
+	DurationMs int64          `json:"durationMs"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// trackSummary describes a track in a done event
+type trackSummary struct {
+	ID       int    `json:"id"`
+	Type     string `json:"type"`
+	Language string `json:"language"`
+	Forced   bool   `json:"forced,omitempty"`
+}
+
+// summarizeTracks converts mkvmerge tracks to their done-event form
+func summarizeTracks(groups ...[]mkvTrack) []trackSummary {
+	var summaries []trackSummary
+	for _, tracks := range groups {
+		for _, track := range tracks {
+			language := track.Properties.Language
+			if language == "" {
+				language = undefinedLanguage
+			}
+			summaries = append(summaries, trackSummary{
+				ID:       track.ID,
+				Type:     track.Type,
+				Language: language,
+				Forced:   track.Properties.ForcedTrack,
+			})
+		}
+	}
+	return summaries
+}
+
+// mkvmergeWarnings extracts the warnings from mkvmerge output. When no line
+// is marked as a warning the whole output is returned as a single one.
+func mkvmergeWarnings(output []byte) []string {
+	var warnings []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Warning:") {
+			warnings = append(warnings, strings.TrimSpace(strings.TrimPrefix(line, "Warning:")))
+		}
+	}
+	if len(warnings) == 0 {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			warnings = append(warnings, text)
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test for mkvmergeWarnings parsing
+func TestMkvmergeWarnings(t *testing.T) {
+	output := []byte("mkvmerge v80.0\nWarning: track 2 has no language\nProgress: 100%\nWarning: unknown codec private data\n")
+	assert.Equal(t, []string{"track 2 has no language", "unknown codec private data"}, mkvmergeWarnings(output))
+
+	// Output without marked warnings is kept as a single warning
+	assert.Equal(t, []string{"something odd"}, mkvmergeWarnings([]byte("  something odd\n")))
+	assert.Empty(t, mkvmergeWarnings(nil))
+}
+
+// Test for summarizeTracks conversion
+func TestSummarizeTracks(t *testing.T) {
+	summaries := summarizeTracks(
+		[]mkvTrack{newTrack(0, "video", "eng", false)},
+		[]mkvTrack{newTrack(3, "subtitles", "", true)},
+	)
+
+	assert.Equal(t, []trackSummary{
+		{ID: 0, Type: "video", Language: "eng"},
+		{ID: 3, Type: "subtitles", Language: "und", Forced: true},
+	}, summaries)
+}
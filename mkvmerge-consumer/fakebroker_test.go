@@ -0,0 +1,808 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeBroker is an in-process stand-in for RabbitMQ. It implements the
+// parts of AMQP 0-9-1 the consumer relies on: durable queues and the
+// default, direct, fanout and topic exchanges, alternate exchanges, manual
+// acknowledgements with prefetch limits, redelivery of unacknowledged
+// messages when a channel closes, dead-lettering on reject and TTL expiry,
+// and priority queues. Like RabbitMQ it closes a channel on any channel
+// error. Everything lives in memory and is guarded by a single lock.
+type fakeBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*fakeExchange
+	queues    map[string]*fakeQueue
+	conns     []*fakeAMQPConnection
+	dials     int
+}
+
+// fakeExchange routes published messages to the queues bound to it
+type fakeExchange struct {
+	kind     string
+	args     amqp.Table
+	bindings []fakeBinding
+}
+
+// fakeBinding binds a queue to an exchange with a routing key pattern
+type fakeBinding struct {
+	queue string
+	key   string
+}
+
+// fakeQueue holds the ready messages of a queue and its consumers
+type fakeQueue struct {
+	name      string
+	args      amqp.Table
+	messages  []*fakeMessage
+	consumers []*fakeConsumer
+	next      int
+}
+
+// fakeMessage is a message in a queue or waiting for its acknowledgement
+type fakeMessage struct {
+	exchange    string
+	routingKey  string
+	publishing  amqp.Publishing
+	redelivered bool
+}
+
+// fakeConsumer receives the messages of a queue on a channel
+type fakeConsumer struct {
+	tag        string
+	queue      *fakeQueue
+	ch         *fakeAMQPChannel
+	autoAck    bool
+	deliveries chan amqp.Delivery
+}
+
+// fakeUnacked is a delivered message the client still has to settle
+type fakeUnacked struct {
+	queue *fakeQueue
+	msg   *fakeMessage
+}
+
+// fakeAMQPConnection is a connection to a fakeBroker
+type fakeAMQPConnection struct {
+	broker   *fakeBroker
+	channels []*fakeAMQPChannel
+	closed   bool
+	notify   []chan *amqp.Error
+}
+
+// fakeAMQPChannel implements ChannelInterface and amqp.Acknowledger on a fakeBroker
+type fakeAMQPChannel struct {
+	broker    *fakeBroker
+	conn      *fakeAMQPConnection
+	prefetch  int
+	nextTag   uint64
+	unacked   map[uint64]fakeUnacked
+	consumers []*fakeConsumer
+	closed    bool
+	notify    []chan *amqp.Error
+}
+
+var (
+	_ ChannelInterface    = (*fakeAMQPChannel)(nil)
+	_ ConnectionInterface = (*fakeAMQPConnection)(nil)
+	_ amqp.Acknowledger   = (*fakeAMQPChannel)(nil)
+)
+
+// fakeDeliveryBuffer bounds the deliveries a consumer holds without a
+// prefetch limit
+const fakeDeliveryBuffer = 256
+
+// newFakeBroker returns a broker with only the default exchange
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		exchanges: map[string]*fakeExchange{"": {kind: "direct"}},
+		queues:    make(map[string]*fakeQueue),
+	}
+}
+
+// dial opens a new connection, it is a dialFunc
+func (b *fakeBroker) dial() (ConnectionInterface, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn := &fakeAMQPConnection{broker: b}
+	b.conns = append(b.conns, conn)
+	b.dials++
+	return conn, nil
+}
+
+// dialCount returns how many connections were opened
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+// dropConnections closes every connection as if the broker restarted.
+// Unacknowledged messages are requeued for redelivery.
+func (b *fakeBroker) dropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.closeLocked(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure", Server: true})
+	}
+	b.conns = nil
+	b.dispatchLocked()
+}
+
+// ready returns a copy of the ready messages of a queue
+func (b *fakeBroker) ready(queue string) []amqp.Publishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil
+	}
+	messages := make([]amqp.Publishing, 0, len(q.messages))
+	for _, msg := range q.messages {
+		messages = append(messages, msg.publishing)
+	}
+	return messages
+}
+
+// waitForMessages waits until a queue holds n ready messages and returns them
+func (b *fakeBroker) waitForMessages(t *testing.T, queue string, n int) []amqp.Publishing {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		messages := b.ready(queue)
+		if len(messages) >= n {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue %s holds %d messages, expected %d", queue, len(messages), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// unackedCount returns how many delivered messages wait for their acknowledgement
+func (b *fakeBroker) unackedCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count := 0
+	for _, conn := range b.conns {
+		for _, ch := range conn.channels {
+			count += len(ch.unacked)
+		}
+	}
+	return count
+}
+
+// route returns the queues a message published to exchange with key
+// reaches, following the alternate exchange when no binding matches
+func (b *fakeBroker) routeLocked(exchange, key string) []*fakeQueue {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*fakeQueue{q}
+		}
+		return nil
+	}
+
+	x, ok := b.exchanges[exchange]
+	if !ok {
+		return nil
+	}
+	var queues []*fakeQueue
+	seen := make(map[string]bool)
+	for _, binding := range x.bindings {
+		var match bool
+		switch x.kind {
+		case "fanout":
+			match = true
+		case "direct":
+			match = binding.key == key
+		case "topic":
+			match = topicMatch(binding.key, key)
+		}
+		if q, ok := b.queues[binding.queue]; ok && match && !seen[q.name] {
+			seen[q.name] = true
+			queues = append(queues, q)
+		}
+	}
+	if alternate, ok := x.args["alternate-exchange"].(string); ok && len(queues) == 0 {
+		return b.routeLocked(alternate, key)
+	}
+	return queues
+}
+
+// topicMatch reports whether a topic routing key matches a binding pattern,
+// where * matches one word and # zero or more
+func topicMatch(pattern, key string) bool {
+	return topicWordsMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+// topicWordsMatch matches the words of a topic pattern and routing key
+func topicWordsMatch(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(key); i++ {
+			if topicWordsMatch(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(key) == 0 || pattern[0] != "*" && pattern[0] != key[0] {
+		return false
+	}
+	return topicWordsMatch(pattern[1:], key[1:])
+}
+
+// publishLocked routes a message to its queues
+func (b *fakeBroker) publishLocked(exchange, key string, publishing amqp.Publishing) {
+	for _, q := range b.routeLocked(exchange, key) {
+		msg := &fakeMessage{exchange: exchange, routingKey: key, publishing: publishing}
+		msg.publishing.Headers = copyTable(publishing.Headers)
+		b.enqueueLocked(q, msg)
+	}
+}
+
+// enqueueLocked appends a message to a queue and starts its TTL
+func (b *fakeBroker) enqueueLocked(q *fakeQueue, msg *fakeMessage) {
+	q.messages = append(q.messages, msg)
+	if ttl, ok := q.args["x-message-ttl"]; ok {
+		time.AfterFunc(time.Duration(tableInt(ttl))*time.Millisecond, func() { b.expire(q, msg) })
+	}
+}
+
+// expire dead-letters a message whose TTL ran out if it is still waiting
+func (b *fakeBroker) expire(q *fakeQueue, msg *fakeMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, m := range q.messages {
+		if m == msg {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			b.deadLetterLocked(q, msg, "expired")
+			b.dispatchLocked()
+			return
+		}
+	}
+}
+
+// deadLetterLocked republishes a rejected or expired message to the dead
+// letter exchange of its queue with an x-death entry, or drops it
+func (b *fakeBroker) deadLetterLocked(q *fakeQueue, msg *fakeMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := msg.routingKey
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	publishing := msg.publishing
+	headers := copyTable(publishing.Headers)
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	counted := false
+	for _, entry := range deaths {
+		death, ok := entry.(amqp.Table)
+		if ok && death["queue"] == q.name && death["reason"] == reason {
+			death["count"] = int64(tableInt(death["count"]) + 1)
+			death["time"] = time.Now()
+			counted = true
+		}
+	}
+	if !counted {
+		deaths = append([]interface{}{amqp.Table{
+			"queue":        q.name,
+			"reason":       reason,
+			"count":        int64(1),
+			"exchange":     msg.exchange,
+			"routing-keys": []interface{}{msg.routingKey},
+			"time":         time.Now(),
+		}}, deaths...)
+	}
+	headers["x-death"] = deaths
+	publishing.Headers = headers
+	b.publishLocked(dlx, key, publishing)
+}
+
+// dispatchLocked hands ready messages to consumers with spare prefetch
+// capacity, round robin per queue
+func (b *fakeBroker) dispatchLocked() {
+	names := make([]string, 0, len(b.queues))
+	for name := range b.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		q := b.queues[name]
+		for len(q.messages) > 0 {
+			consumer := q.nextConsumer()
+			if consumer == nil {
+				break
+			}
+			msg := q.popLocked()
+			consumer.deliveries <- consumer.ch.deliveryLocked(q, msg, consumer.tag, !consumer.autoAck)
+		}
+	}
+}
+
+// nextConsumer returns the next consumer able to take a message, if any
+func (q *fakeQueue) nextConsumer() *fakeConsumer {
+	for i := range q.consumers {
+		consumer := q.consumers[(q.next+i)%len(q.consumers)]
+		ch := consumer.ch
+		if len(consumer.deliveries) == cap(consumer.deliveries) ||
+			!consumer.autoAck && ch.prefetch > 0 && len(ch.unacked) >= ch.prefetch {
+			continue
+		}
+		q.next = (q.next + i + 1) % len(q.consumers)
+		return consumer
+	}
+	return nil
+}
+
+// popLocked removes the next message, the oldest of the highest priority
+// in a priority queue
+func (q *fakeQueue) popLocked() *fakeMessage {
+	index := 0
+	if maxPriority := tableInt(q.args["x-max-priority"]); maxPriority > 0 {
+		best := -1
+		for i, msg := range q.messages {
+			if priority := min(int(msg.publishing.Priority), maxPriority); priority > best {
+				index, best = i, priority
+			}
+		}
+	}
+	msg := q.messages[index]
+	q.messages = append(q.messages[:index], q.messages[index+1:]...)
+	return msg
+}
+
+// copyTable returns a shallow copy of an AMQP table
+func copyTable(table amqp.Table) amqp.Table {
+	if table == nil {
+		return nil
+	}
+	copied := make(amqp.Table, len(table))
+	for key, value := range table {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Channel opens a new channel
+func (c *fakeAMQPConnection) Channel() (ChannelInterface, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &fakeAMQPChannel{broker: c.broker, conn: c, unacked: make(map[uint64]fakeUnacked)}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+// NotifyClose registers a listener for the closing of the connection
+func (c *fakeAMQPConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.notify = append(c.notify, receiver)
+	}
+	return receiver
+}
+
+// IsClosed reports whether the connection was closed
+func (c *fakeAMQPConnection) IsClosed() bool {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	return c.closed
+}
+
+// Close closes the connection and its channels
+func (c *fakeAMQPConnection) Close() error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closeLocked(nil)
+	c.broker.dispatchLocked()
+	return nil
+}
+
+// closeLocked closes the connection and its channels, reporting err
+func (c *fakeAMQPConnection) closeLocked(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, ch := range c.channels {
+		ch.closeLocked(err)
+	}
+	notifyClosed(c.notify, err)
+}
+
+// notifyClosed sends err, if any, to close listeners and closes them
+func notifyClosed(receivers []chan *amqp.Error, err *amqp.Error) {
+	for _, receiver := range receivers {
+		if err != nil {
+			select {
+			case receiver <- err:
+			default:
+			}
+		}
+		close(receiver)
+	}
+}
+
+// failLocked closes the channel with a channel error, as RabbitMQ does
+func (c *fakeAMQPChannel) failLocked(code int, reason string) error {
+	err := &amqp.Error{Code: code, Reason: reason, Server: true}
+	c.closeLocked(err)
+	c.broker.dispatchLocked()
+	return err
+}
+
+// closeLocked closes the channel, cancels its consumers and requeues its
+// unacknowledged messages for redelivery
+func (c *fakeAMQPChannel) closeLocked(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	for _, consumer := range c.consumers {
+		consumer.queue.removeConsumer(consumer)
+		close(consumer.deliveries)
+	}
+	c.consumers = nil
+
+	// Requeue in delivery order at the head of their queues
+	tags := make([]uint64, 0, len(c.unacked))
+	for tag := range c.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		c.unacked[tag].requeueLocked()
+	}
+	c.unacked = map[uint64]fakeUnacked{}
+
+	notifyClosed(c.notify, err)
+	c.notify = nil
+}
+
+// requeueLocked puts a delivered message back at the head of its queue
+func (u fakeUnacked) requeueLocked() {
+	u.msg.redelivered = true
+	u.queue.messages = append([]*fakeMessage{u.msg}, u.queue.messages...)
+}
+
+// removeConsumer stops delivering to a consumer
+func (q *fakeQueue) removeConsumer(consumer *fakeConsumer) {
+	for i, c := range q.consumers {
+		if c == consumer {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			q.next = 0
+			return
+		}
+	}
+}
+
+// deliveryLocked builds the delivery of a message, tracking it until it is
+// settled when the consumer acknowledges manually
+func (c *fakeAMQPChannel) deliveryLocked(q *fakeQueue, msg *fakeMessage, consumerTag string, track bool) amqp.Delivery {
+	c.nextTag++
+	if track {
+		c.unacked[c.nextTag] = fakeUnacked{queue: q, msg: msg}
+	}
+	p := msg.publishing
+	return amqp.Delivery{
+		Acknowledger:    c,
+		Headers:         copyTable(p.Headers),
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     c.nextTag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.routingKey,
+		Body:            p.Body,
+	}
+}
+
+// QueueDeclare declares a queue, failing when it exists with other arguments
+func (c *fakeAMQPChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = fmt.Sprintf("amq.gen-%d", len(c.broker.queues)+1)
+	}
+
+	q, ok := c.broker.queues[name]
+	if !ok {
+		q = &fakeQueue{name: name, args: copyTable(args)}
+		c.broker.queues[name] = q
+		c.broker.exchanges[""].bindings = append(c.broker.exchanges[""].bindings, fakeBinding{queue: name, key: name})
+	} else {
+		for _, key := range []string{"x-dead-letter-exchange", "x-dead-letter-routing-key", "x-message-ttl", "x-max-priority"} {
+			if fmt.Sprint(q.args[key]) != fmt.Sprint(args[key]) {
+				return amqp.Queue{}, c.failLocked(amqp.PreconditionFailed,
+					fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg '%s' for queue '%s'", key, name))
+			}
+		}
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+// Publish routes a message through an exchange
+func (c *fakeAMQPChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := c.broker.exchanges[exchange]; !ok {
+		return c.failLocked(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange))
+	}
+	c.broker.publishLocked(exchange, key, msg)
+	c.broker.dispatchLocked()
+	return nil
+}
+
+// ExchangeDeclare declares a direct, fanout or topic exchange
+func (c *fakeAMQPChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	if kind != "direct" && kind != "fanout" && kind != "topic" {
+		return c.failLocked(amqp.CommandInvalid, fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind))
+	}
+	if x, ok := c.broker.exchanges[name]; ok {
+		if x.kind != kind {
+			return c.failLocked(amqp.PreconditionFailed,
+				fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name))
+		}
+		return nil
+	}
+	c.broker.exchanges[name] = &fakeExchange{kind: kind, args: copyTable(args)}
+	return nil
+}
+
+// QueueDelete deletes a queue, cancelling its consumers
+func (c *fakeAMQPChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := c.broker.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	if ifEmpty && len(q.messages) > 0 || ifUnused && len(q.consumers) > 0 {
+		return 0, c.failLocked(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in use", name))
+	}
+	for _, consumer := range q.consumers {
+		close(consumer.deliveries)
+		consumer.ch.removeConsumer(consumer)
+	}
+	delete(c.broker.queues, name)
+	for _, x := range c.broker.exchanges {
+		bindings := x.bindings[:0]
+		for _, binding := range x.bindings {
+			if binding.queue != name {
+				bindings = append(bindings, binding)
+			}
+		}
+		x.bindings = bindings
+	}
+	return len(q.messages), nil
+}
+
+// removeConsumer forgets a consumer of the channel
+func (c *fakeAMQPChannel) removeConsumer(consumer *fakeConsumer) {
+	for i, other := range c.consumers {
+		if other == consumer {
+			c.consumers = append(c.consumers[:i], c.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// QueueBind binds a queue to an exchange
+func (c *fakeAMQPChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	x, ok := c.broker.exchanges[exchange]
+	if !ok || exchange == "" {
+		return c.failLocked(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange))
+	}
+	if _, ok := c.broker.queues[name]; !ok {
+		return c.failLocked(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	for _, binding := range x.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	x.bindings = append(x.bindings, fakeBinding{queue: name, key: key})
+	return nil
+}
+
+// Qos sets how many messages the channel may hold unacknowledged
+func (c *fakeAMQPChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.prefetch = prefetchCount
+	return nil
+}
+
+// Consume starts delivering the messages of a queue
+func (c *fakeAMQPChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := c.broker.queues[queue]
+	if !ok {
+		return nil, c.failLocked(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue))
+	}
+	if consumer == "" {
+		consumer = fmt.Sprintf("ctag-%p-%d", c, len(c.consumers)+1)
+	}
+
+	fc := &fakeConsumer{tag: consumer, queue: q, ch: c, autoAck: autoAck, deliveries: make(chan amqp.Delivery, fakeDeliveryBuffer)}
+	q.consumers = append(q.consumers, fc)
+	c.consumers = append(c.consumers, fc)
+	c.broker.dispatchLocked()
+	return fc.deliveries, nil
+}
+
+// Get fetches a single message from a queue
+func (c *fakeAMQPChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := c.broker.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, c.failLocked(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue))
+	}
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	d := c.deliveryLocked(q, q.popLocked(), "", !autoAck)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+// QueueInspect returns the number of ready messages and consumers of a queue
+func (c *fakeAMQPChannel) QueueInspect(name string) (amqp.Queue, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := c.broker.queues[name]
+	if !ok {
+		return amqp.Queue{}, c.failLocked(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+// settleLocked removes the delivery with tag, or every delivery up to it,
+// from the unacknowledged messages and passes each to fn
+func (c *fakeAMQPChannel) settleLocked(tag uint64, multiple bool, fn func(fakeUnacked)) error {
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := c.unacked[tag]; !ok {
+		return c.failLocked(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag))
+	}
+
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range c.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	}
+	for _, t := range tags {
+		fn(c.unacked[t])
+		delete(c.unacked, t)
+	}
+	c.broker.dispatchLocked()
+	return nil
+}
+
+// Ack acknowledges a delivery, removing the message for good
+func (c *fakeAMQPChannel) Ack(tag uint64, multiple bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	return c.settleLocked(tag, multiple, func(fakeUnacked) {})
+}
+
+// Nack requeues a delivery for redelivery or dead-letters it
+func (c *fakeAMQPChannel) Nack(tag uint64, multiple, requeue bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	return c.settleLocked(tag, multiple, func(u fakeUnacked) {
+		if requeue {
+			u.requeueLocked()
+		} else {
+			c.broker.deadLetterLocked(u.queue, u.msg, "rejected")
+		}
+	})
+}
+
+// Reject is Nack of a single delivery
+func (c *fakeAMQPChannel) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+// NotifyClose registers a listener for the closing of the channel
+func (c *fakeAMQPChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.notify = append(c.notify, receiver)
+	}
+	return receiver
+}
+
+// Close closes the channel, requeueing its unacknowledged messages
+func (c *fakeAMQPChannel) Close() error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closeLocked(nil)
+	c.broker.dispatchLocked()
+	return nil
+}
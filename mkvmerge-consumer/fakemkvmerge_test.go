@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeMkvFile is the content of a media file as the fake mkvmerge sees it:
+// the mkvmerge -J output describing the file
+type fakeMkvFile struct {
+	Container json.RawMessage `json:"container,omitempty"`
+	Tracks    []fakeMkvTrack  `json:"tracks"`
+}
+
+// fakeMkvTrack is a track of a fakeMkvFile
+type fakeMkvTrack struct {
+	ID         int             `json:"id"`
+	Type       string          `json:"type"`
+	Properties json.RawMessage `json:"properties,omitempty"`
+}
+
+// useFakeMkvmerge makes the consumer run the fake mkvmerge of this test
+// binary for the duration of a test
+func useFakeMkvmerge(t *testing.T) {
+	origExec := execCommand
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=TestFakeMkvmerge", "--", command}, args...)...)
+		cmd.Env = []string{"GO_WANT_FAKE_MKVMERGE=1"}
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = origExec })
+}
+
+// writeFakeMkv writes a media file the fake mkvmerge understands
+func writeFakeMkv(t *testing.T, path string, file fakeMkvFile) {
+	t.Helper()
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFakeMkv reads a media file written by the fake mkvmerge
+func readFakeMkv(t *testing.T, path string) fakeMkvFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file fakeMkvFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("%s is not a fake MKV file: %v", path, err)
+	}
+	return file
+}
+
+// TestFakeMkvmerge is the fake mkvmerge run by useFakeMkvmerge. Media files
+// are JSON documents in the form of the mkvmerge -J output: -J prints them,
+// and -o writes the selected tracks of the input to the output.
+func TestFakeMkvmerge(t *testing.T) {
+	if os.Getenv("GO_WANT_FAKE_MKVMERGE") != "1" {
+		return
+	}
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	if args[0] != "mkvmerge" {
+		fmt.Fprintf(os.Stderr, "Error: %s is not faked\n", args[0])
+		os.Exit(2)
+	}
+	args = args[1:]
+
+	if len(args) == 2 && args[0] == "-J" {
+		file, err := readFakeMkvFile(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		data, _ := json.Marshal(file)
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+
+	if err := fakeRemux(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// readFakeMkvFile reads a media file, failing like mkvmerge on anything else
+func readFakeMkvFile(path string) (fakeMkvFile, error) {
+	var file fakeMkvFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, fmt.Errorf("the file '%s' could not be opened for reading", path)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("the type of file '%s' could not be recognized", path)
+	}
+	return file, nil
+}
+
+// fakeRemux handles "mkvmerge -o output [options] input" with the track
+// selection and order options the consumer uses
+func fakeRemux(args []string) error {
+	var output string
+	selected := map[string][]string{}
+	var order []string
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-o":
+			i++
+			output = args[i]
+		case "--video-tracks":
+			i++
+			selected["video"] = strings.Split(args[i], ",")
+		case "--audio-tracks":
+			i++
+			selected["audio"] = strings.Split(args[i], ",")
+		case "--subtitle-tracks":
+			i++
+			selected["subtitles"] = strings.Split(args[i], ",")
+		case "--no-subtitles":
+			selected["subtitles"] = []string{}
+		case "--track-order":
+			i++
+			order = strings.Split(args[i], ",")
+		default:
+			return fmt.Errorf("unsupported option %s", args[i])
+		}
+	}
+	if output == "" {
+		return fmt.Errorf("no output file given")
+	}
+
+	file, err := readFakeMkvFile(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+
+	var tracks []fakeMkvTrack
+	for _, track := range file.Tracks {
+		ids, ok := selected[track.Type]
+		if !ok || slices.Contains(ids, fmt.Sprint(track.ID)) {
+			tracks = append(tracks, track)
+		}
+	}
+	if order != nil {
+		slices.SortStableFunc(tracks, func(a, b fakeMkvTrack) int {
+			return slices.Index(order, fmt.Sprintf("0:%d", a.ID)) - slices.Index(order, fmt.Sprintf("0:%d", b.ID))
+		})
+	}
+	// mkvmerge numbers the tracks of the output from zero
+	for i := range tracks {
+		tracks[i].ID = i
+	}
+	file.Tracks = tracks
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, data, 0o644)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mkvmerge-consumer/config"
+)
+
+// ffmpegBackend processes MKV, MP4 and AVI files with ffprobe and ffmpeg
+type ffmpegBackend struct{}
+
+// Name returns the configuration name of the backend
+func (ffmpegBackend) Name() string { return config.BackendFFmpeg }
+
+// Extensions returns the extensions of the files ffmpeg handles
+func (ffmpegBackend) Extensions() []string { return []string{".mkv", ".mp4", ".m4v", ".avi"} }
+
+// ffprobeOutput is the part of the ffprobe JSON output we rely on
+type ffprobeOutput struct {
+	Streams []struct {
+		Index     int    `json:"index"`
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		// BitRate is in bits per second
+		BitRate     string `json:"bit_rate"`
+		Disposition struct {
+			Default int `json:"default"`
+			Forced  int `json:"forced"`
+		} `json:"disposition"`
+		Tags struct {
+			Language string `json:"language"`
+			// NumberOfBytes is written by mkvmerge into MKV files
+			NumberOfBytes string `json:"NUMBER_OF_BYTES"`
+		} `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		// Duration is in seconds
+		Duration string `json:"duration"`
+		Tags     struct {
+			Title string `json:"title"`
+		} `json:"tags"`
+	} `json:"format"`
+	Chapters []json.RawMessage `json:"chapters"`
+}
+
+// ffprobeTrackTypes maps ffprobe stream types to mkvmerge track types
+var ffprobeTrackTypes = map[string]string{
+	"video":    "video",
+	"audio":    "audio",
+	"subtitle": "subtitles",
+}
+
+// matroskaCodecIDs maps ffprobe codec names to the Matroska codec IDs the
+// steps look for
+var matroskaCodecIDs = map[string]string{
+	"subrip": "S_TEXT/UTF8",
+}
+
+// Identify reads the streams with ffprobe and converts them to mkvmerge tracks
+func (ffmpegBackend) Identify(ctx context.Context, path string) (mkvInfo, error) {
+	output, err := execCommand(ctx, "ffprobe", "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", "-show_chapters", path).Output()
+	if err != nil {
+		return mkvInfo{}, fmt.Errorf("failed to get track info: %v", err)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return mkvInfo{}, fmt.Errorf("failed to parse track info: %v", err)
+	}
+	return probe.mkvInfo(), nil
+}
+
+// mkvInfo converts the ffprobe output to the mkvmerge form used by the pipeline
+func (p ffprobeOutput) mkvInfo() mkvInfo {
+	var info mkvInfo
+	seconds, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err == nil {
+		info.Container.Properties.Duration = int64(seconds * float64(time.Second))
+	}
+	info.Container.Properties.Title = p.Format.Tags.Title
+	if len(p.Chapters) > 0 {
+		info.Chapters = append(info.Chapters, struct {
+			NumEntries int `json:"num_entries"`
+		}{NumEntries: len(p.Chapters)})
+	}
+
+	for _, stream := range p.Streams {
+		trackType, ok := ffprobeTrackTypes[stream.CodecType]
+		if !ok {
+			trackType = stream.CodecType
+		}
+		var track mkvTrack
+		track.ID = stream.Index
+		track.Type = trackType
+		track.Codec = stream.CodecName
+		track.Properties.Language = stream.Tags.Language
+		track.Properties.DefaultTrack = stream.Disposition.Default == 1
+		track.Properties.ForcedTrack = stream.Disposition.Forced == 1
+		track.Properties.CodecID = matroskaCodecIDs[stream.CodecName]
+
+		// Prefer the exact size, else estimate it from the bit rate
+		if size, err := strconv.ParseInt(stream.Tags.NumberOfBytes, 10, 64); err == nil {
+			track.Properties.NumberOfBytes = tagInt(size)
+		} else if bitRate, err := strconv.ParseInt(stream.BitRate, 10, 64); err == nil {
+			track.Properties.NumberOfBytes = tagInt(float64(bitRate) / 8 * seconds)
+		}
+		info.Tracks = append(info.Tracks, track)
+	}
+	return info
+}
+
+// Remux copies the selected streams to output with ffmpeg
+func (ffmpegBackend) Remux(ctx context.Context, f *mediaFile, selection trackSelection, output string) error {
+	return runFFmpeg(ctx, f, ffmpegArgs(f.Path, output, selection)...)
+}
+
+// ffmpegArgs builds the ffmpeg arguments that copy the selection to output
+// in the given order
+func ffmpegArgs(input, output string, selection trackSelection) []string {
+	args := []string{"-nostdin", "-v", "warning", "-y", "-i", input}
+
+	for _, group := range [][]mkvTrack{selection.Video, selection.Audio, selection.Subtitles} {
+		for _, track := range group {
+			args = append(args, "-map", fmt.Sprintf("0:%d", track.ID))
+		}
+	}
+	if isMatroska(output) {
+		// Keep attachments such as fonts when there are any
+		args = append(args, "-map", "0:t?")
+	}
+	args = append(args, "-c", "copy")
+
+	// MP4 text subtitles cannot be stored in MKV and are converted to SRT
+	if isMatroska(output) {
+		for i, track := range selection.Subtitles {
+			if track.Codec == "mov_text" {
+				args = append(args, fmt.Sprintf("-c:s:%d", i), "srt")
+			}
+		}
+	}
+	return append(args, output)
+}
+
+// runFFmpeg runs ffmpeg on f. Anything ffmpeg prints at the warning level
+// is recorded as a warning on the file result.
+func runFFmpeg(ctx context.Context, f *mediaFile, args ...string) error {
+	logger := loggerFrom(ctx).With("tool", "ffmpeg", "file", f.Path)
+	logger.Info("Running tool", "args", args)
+	start := time.Now()
+	output, err := execCommand(ctx, "ffmpeg", args...).CombinedOutput()
+	toolDuration.WithLabelValues("ffmpeg").Observe(time.Since(start).Seconds())
+
+	// The context kills ffmpeg on timeout
+	if ctx.Err() != nil {
+		return fmt.Errorf("ffmpeg was cancelled: %w", ctx.Err())
+	}
+
+	if err != nil {
+		logger.Error("Tool failed", "output", string(output))
+		return fmt.Errorf("ffmpeg failed: %v", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			f.Result.Warnings = append(f.Result.Warnings, line)
+		}
+	}
+	logger.Info("Tool completed successfully")
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthResponse is the body of /healthz and /readyz
+type healthResponse struct {
+	Status     string `json:"status"`
+	Connection string `json:"connection"`
+	Channel    string `json:"channel"`
+	Since      string `json:"since,omitempty"`
+}
+
+// newHTTPHandler serves the health endpoints and the metrics.
+// /readyz succeeds while messages are being consumed. /healthz only fails
+// once the broker has been unreachable for longer than livenessTimeout,
+// because reconnecting is handled by the supervisor. Without a supervisor,
+// in watcher mode without a broker, both always succeed.
+func newHTTPHandler(sup *supervisor, livenessTimeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if sup == nil {
+			writeHealth(w, supervisorStatus{}, true)
+			return
+		}
+		status := sup.status()
+		healthy := status.Connection || time.Since(status.Since) < livenessTimeout
+		writeHealth(w, status, healthy)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if sup == nil {
+			writeHealth(w, supervisorStatus{}, true)
+			return
+		}
+		status := sup.status()
+		writeHealth(w, status, status.Connection && status.Channel)
+	})
+
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// writeHealth writes a health response with 200 when ok and 503 otherwise
+func writeHealth(w http.ResponseWriter, status supervisorStatus, ok bool) {
+	response := healthResponse{
+		Status:     "ok",
+		Connection: openOrClosed(status.Connection),
+		Channel:    openOrClosed(status.Channel),
+	}
+	if !status.Since.IsZero() {
+		response.Since = status.Since.Format(time.RFC3339)
+	}
+
+	code := http.StatusOK
+	if !ok {
+		response.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+// openOrClosed describes a connection state
+func openOrClosed(open bool) string {
+	if open {
+		return "open"
+	}
+	return "closed"
+}
+
+// serveHTTP runs the health and metrics server until ctx is cancelled
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Health and metrics server listening", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Health and metrics server stopped", "error", err)
+	}
+}
+
+// watchQueues samples the depth of the consumer queues until ctx is cancelled
+func watchQueues(ctx context.Context, sup *supervisor, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			updateQueueDepths(sup)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateQueueDepths sets the queue depth gauges from the broker
+func updateQueueDepths(sup *supervisor) {
+	depths, err := sup.inspectQueues(append(taskQueues(), doneQueueName, dlqQueueName)...)
+	if err != nil && !errors.Is(err, errNotConnected) {
+		slog.Error("Error reading queue depths", "error", err)
+	}
+	for queue, depth := range depths {
+		queueMessages.WithLabelValues(queue).Set(float64(depth))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveRequest performs a request against the HTTP handler and decodes health responses
+func serveRequest(t *testing.T, handler http.Handler, path string) (int, healthResponse, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+	body, err := io.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+
+	var response healthResponse
+	if recorder.Header().Get("Content-Type") == "application/json" {
+		assert.NoError(t, json.Unmarshal(body, &response))
+	}
+	return recorder.Code, response, string(body)
+}
+
+// Test for the health endpoints while connected
+func TestHealthEndpointsConnected(t *testing.T) {
+	sup := &supervisor{}
+	sup.setActive(&fakeConnection{}, new(MockChannelInterface))
+	handler := newHTTPHandler(sup, time.Minute)
+
+	code, response, _ := serveRequest(t, handler, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", response.Status)
+	assert.Equal(t, "open", response.Connection)
+
+	code, response, _ = serveRequest(t, handler, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "open", response.Channel)
+}
+
+// Test for the health endpoints while reconnecting
+func TestHealthEndpointsDisconnected(t *testing.T) {
+	sup := &supervisor{}
+	sup.setActive(nil, nil)
+	handler := newHTTPHandler(sup, time.Minute)
+
+	// Still alive: the supervisor is given time to reconnect
+	code, _, _ := serveRequest(t, handler, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, response, _ := serveRequest(t, handler, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", response.Status)
+	assert.Equal(t, "closed", response.Connection)
+
+	// Disconnected for longer than the liveness timeout
+	sup.mu.Lock()
+	sup.changed = time.Now().Add(-2 * time.Minute)
+	sup.mu.Unlock()
+
+	code, _, _ = serveRequest(t, handler, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+// Test for the metrics endpoint and the queue depth gauges
+func TestMetricsEndpoint(t *testing.T) {
+	oldQueue, oldDone, oldDLQ := queueName, doneQueueName, dlqQueueName
+	queueName, doneQueueName, dlqQueueName = "metrics-tasks", "metrics-done", "metrics-dlq"
+	defer func() { queueName, doneQueueName, dlqQueueName = oldQueue, oldDone, oldDLQ }()
+
+	inspectChannel := new(MockChannelInterface)
+	inspectChannel.On("QueueInspect", "metrics-tasks").Return(amqp.Queue{Name: "metrics-tasks", Messages: 7}, nil)
+	inspectChannel.On("QueueInspect", "metrics-done").Return(amqp.Queue{Name: "metrics-done", Messages: 0}, nil)
+	inspectChannel.On("QueueInspect", "metrics-dlq").Return(amqp.Queue{Name: "metrics-dlq", Messages: 2}, nil)
+	inspectChannel.On("Close").Return(nil)
+
+	sup := &supervisor{}
+	sup.setActive(&fakeConnection{channels: []ChannelInterface{inspectChannel}}, new(MockChannelInterface))
+	updateQueueDepths(sup)
+	inspectChannel.AssertExpectations(t)
+
+	recordFileResult(fileResult{Outcome: fileProcessed, SizeBefore: 1000, SizeAfter: 400})
+	toolDuration.WithLabelValues("mkvmerge").Observe(1.5)
+
+	code, _, body := serveRequest(t, newHTTPHandler(sup, time.Minute), "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `mkvmerge_consumer_queue_messages{queue="metrics-tasks"} 7`)
+	assert.Contains(t, body, `mkvmerge_consumer_queue_messages{queue="metrics-dlq"} 2`)
+	assert.Contains(t, body, `mkvmerge_consumer_files_total{outcome="processed"}`)
+	assert.Contains(t, body, "mkvmerge_consumer_bytes_saved_total")
+	assert.Contains(t, body, `mkvmerge_consumer_tool_duration_seconds_count{tool="mkvmerge"}`)
+	assert.Contains(t, body, "mkvmerge_consumer_broker_connected 1")
+}
+
+// Test that queue depths are left alone while disconnected
+func TestUpdateQueueDepthsDisconnected(t *testing.T) {
+	sup := &supervisor{}
+	sup.setActive(nil, nil)
+
+	_, err := sup.inspectQueues(queueName)
+	assert.ErrorIs(t, err, errNotConnected)
+	updateQueueDepths(sup)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ledgerBucket holds one entry per file path
+var ledgerBucket = []byte("files")
+
+// ledgerHashSize is how much of the start and of the end of a file is
+// hashed. Hashing whole remuxed movies would take longer than identifying them.
+const ledgerHashSize = 1 << 20
+
+// ledgerLockTimeout is how long to wait for another process holding the ledger
+const ledgerLockTimeout = 5 * time.Second
+
+// fileLedger remembers the files that were already handled; nil disables it
+var fileLedger *ledger
+
+// ledgerEntry records a file as it was left by the pipeline
+type ledgerEntry struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"modTime"`
+	Hash    string      `json:"hash"`
+	Outcome fileOutcome `json:"status"`
+	// Steps lists the pipeline steps that changed the file
+	Steps       []string  `json:"steps,omitempty"`
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+// ledger is a bbolt file of ledgerEntry keyed by path. The file is only
+// opened for the duration of an operation so that the ledger commands can
+// be used while the consumer is running.
+type ledger struct {
+	path string
+	// mu serializes access, bbolt locks the file for the whole process
+	mu sync.Mutex
+}
+
+// newLedger returns the ledger stored at path, or nil when path is empty
+func newLedger(path string) *ledger {
+	if path == "" {
+		return nil
+	}
+	return &ledger{path: path}
+}
+
+// view runs fn on the entries bucket, which is nil while the ledger is empty
+func (l *ledger) view(fn func(b *bolt.Bucket) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := os.Stat(l.path); errors.Is(err, os.ErrNotExist) {
+		return fn(nil)
+	}
+	db, err := bolt.Open(l.path, 0o600, &bolt.Options{Timeout: ledgerLockTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open ledger %s: %w", l.path, err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(ledgerBucket))
+	})
+}
+
+// update runs fn on the entries bucket in a read-write transaction
+func (l *ledger) update(fn func(b *bolt.Bucket) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	db, err := bolt.Open(l.path, 0o600, &bolt.Options{Timeout: ledgerLockTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open ledger %s: %w", l.path, err)
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(ledgerBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// get returns the entry of path, if any
+func (l *ledger) get(path string) (entry ledgerEntry, found bool, err error) {
+	err = l.view(func(b *bolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(path))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &entry)
+	})
+	return entry, found, err
+}
+
+// list returns the entries whose path starts with prefix, ordered by path
+func (l *ledger) list(prefix string) ([]ledgerEntry, error) {
+	var entries []ledgerEntry
+	err := l.view(func(b *bolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			var entry ledgerEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("failed to read entry %s: %w", k, err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// put stores entry, replacing the entry of the same path
+func (l *ledger) put(entry ledgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return l.update(func(b *bolt.Bucket) error {
+		return b.Put([]byte(entry.Path), data)
+	})
+}
+
+// remove deletes the entries whose path starts with prefix, or the entries
+// of the exact paths given, and returns how many were deleted
+func (l *ledger) remove(prefix string, paths ...string) (int, error) {
+	removed := 0
+	err := l.update(func(b *bolt.Bucket) error {
+		for _, path := range paths {
+			if b.Get([]byte(path)) == nil {
+				continue
+			}
+			if err := b.Delete([]byte(path)); err != nil {
+				return err
+			}
+			removed++
+		}
+		if len(paths) > 0 {
+			return nil
+		}
+
+		// Collect first, deleting moves the cursor
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// fingerprint returns the ledger entry describing the current state of path
+func fingerprint(path string) (ledgerEntry, error) {
+	info, err := statFunc(path)
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	hash, err := hashFile(path, info.Size())
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	return ledgerEntry{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		Hash:    hash,
+	}, nil
+}
+
+// hashFile hashes the size, the first and the last ledgerHashSize bytes of a file
+func hashFile(path string, size int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, size)
+	if _, err := io.CopyN(h, file, ledgerHashSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	if size > 2*ledgerHashSize {
+		if _, err := file.Seek(-ledgerHashSize, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// handled reports whether path is in the ledger and unchanged since it was recorded
+func (l *ledger) handled(path string) (ledgerEntry, bool, error) {
+	entry, found, err := l.get(path)
+	if err != nil || !found {
+		return entry, false, err
+	}
+
+	current, err := fingerprint(path)
+	if err != nil {
+		return entry, false, err
+	}
+	unchanged := current.Size == entry.Size && current.ModTime.Equal(entry.ModTime) && current.Hash == entry.Hash
+	return entry, unchanged, nil
+}
+
+// record stores the state a file was left in by the pipeline
+func (l *ledger) record(result fileResult) error {
+	path := result.Path
+	if result.RenamedTo != "" {
+		path = result.RenamedTo
+	}
+
+	entry, err := fingerprint(path)
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint %s: %w", path, err)
+	}
+	entry.Outcome = result.Outcome
+	entry.Steps = result.Steps
+	entry.ProcessedAt = time.Now().UTC()
+
+	if err := l.put(entry); err != nil {
+		return err
+	}
+	if result.RenamedTo != "" {
+		_, err = l.remove("", result.Path)
+	}
+	return err
+}
+
+// processOnce runs the pipeline on a file unless the ledger shows that it was
+// already processed and has not changed since. Skipped files are not
+// recorded, a later policy may change them. Ledger errors are only logged
+// so that a broken ledger never stops processing.
+func processOnce(ctx context.Context, p pipeline, path string) fileResult {
+	if fileLedger == nil {
+		return p.process(ctx, path)
+	}
+
+	entry, handled, err := fileLedger.handled(path)
+	if err != nil {
+		loggerFrom(ctx).Error("Error checking ledger", "file", path, "error", err)
+	}
+	if handled {
+		loggerFrom(ctx).Info("Skipping file handled before", "file", path,
+			"outcome", entry.Outcome, "processed_at", entry.ProcessedAt.Format(time.RFC3339))
+		result := fileResult{
+			Path:             path,
+			Outcome:          fileSkipped,
+			Skipped:          true,
+			AlreadyProcessed: true,
+			SizeBefore:       entry.Size,
+			SizeAfter:        entry.Size,
+		}
+		recordFileResult(result)
+		return result
+	}
+
+	result := p.process(ctx, path)
+	if result.Outcome == fileProcessed {
+		if err := fileLedger.record(result); err != nil {
+			loggerFrom(ctx).Error("Error recording file in ledger", "file", path, "error", err)
+		}
+	}
+	return result
+}
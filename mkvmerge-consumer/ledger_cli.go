@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ledgerCommand runs a "ledger" subcommand against the ledger
+func ledgerCommand(l *ledger, args []string, out io.Writer) error {
+	if l == nil {
+		return errors.New("the ledger is disabled, set ledger.path")
+	}
+	if len(args) == 0 {
+		return errors.New("missing ledger command: list, show or reset")
+	}
+
+	switch args[0] {
+	case "list":
+		return ledgerList(l, args[1:], out)
+	case "show":
+		return ledgerShow(l, args[1:], out)
+	case "reset":
+		return ledgerReset(l, args[1:], out)
+	default:
+		return fmt.Errorf("unknown ledger command: %s", args[0])
+	}
+}
+
+// ledgerList prints a line for every entry below an optional path prefix
+func ledgerList(l *ledger, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("ledger list", flag.ContinueOnError)
+	flags.SetOutput(out)
+	prefix := flags.String("prefix", "", "only list files whose path starts with this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	entries, err := l.list(*prefix)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROCESSED\tSTATUS\tSIZE\tPATH")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n",
+			formatEntryTime(entry.ProcessedAt), entry.Outcome, entry.Size, entry.Path)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d file(s) in %s\n", len(entries), l.path)
+	return nil
+}
+
+// ledgerShow prints the entries of the given paths and whether the files
+// changed since they were recorded
+func ledgerShow(l *ledger, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("missing file path")
+	}
+
+	for _, path := range args {
+		entry, found, err := l.get(path)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%s is not in the ledger", path)
+		}
+
+		fmt.Fprintf(out, "Path:      %s\n", entry.Path)
+		fmt.Fprintf(out, "Status:    %s\n", entry.Outcome)
+		fmt.Fprintf(out, "Processed: %s\n", formatEntryTime(entry.ProcessedAt))
+		if len(entry.Steps) > 0 {
+			fmt.Fprintf(out, "Steps:     %s\n", strings.Join(entry.Steps, ", "))
+		}
+		fmt.Fprintf(out, "Size:      %d\n", entry.Size)
+		fmt.Fprintf(out, "Modified:  %s\n", entry.ModTime.Local().Format(time.RFC3339))
+		fmt.Fprintf(out, "Hash:      %s\n", entry.Hash)
+
+		state := "unchanged"
+		if current, err := fingerprint(path); err != nil {
+			state = fmt.Sprintf("unavailable (%v)", err)
+		} else if current.Size != entry.Size || !current.ModTime.Equal(entry.ModTime) || current.Hash != entry.Hash {
+			state = "changed, it will be processed again"
+		}
+		fmt.Fprintf(out, "File:      %s\n\n", state)
+	}
+	return nil
+}
+
+// ledgerReset forgets files so that they are processed again
+func ledgerReset(l *ledger, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("ledger reset", flag.ContinueOnError)
+	flags.SetOutput(out)
+	all := flags.Bool("all", false, "forget every file")
+	prefix := flags.String("prefix", "", "forget the files whose path starts with this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*all && *prefix == "" && flags.NArg() == 0 {
+		return errors.New("select files by path, with -prefix or use -all")
+	}
+	if *all && (*prefix != "" || flags.NArg() > 0) || *prefix != "" && flags.NArg() > 0 {
+		return errors.New("use only one of -all, -prefix or paths")
+	}
+
+	removed, err := l.remove(*prefix, flags.Args()...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Reset %d file(s) in %s\n", removed, l.path)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLedger returns an empty ledger in a temporary directory
+func newTestLedger(t *testing.T) *ledger {
+	return newLedger(filepath.Join(t.TempDir(), "ledger.db"))
+}
+
+// writeTestFile creates a file with the given content and returns its path
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+// Test that a disabled ledger is nil
+func TestNewLedgerDisabled(t *testing.T) {
+	assert.Nil(t, newLedger(""))
+}
+
+// Test for storing, listing and removing ledger entries
+func TestLedgerEntries(t *testing.T) {
+	l := newTestLedger(t)
+
+	// An empty ledger is not created by reading it
+	entries, err := l.list("")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	_, found, err := l.get("/movies/a.mkv")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	for _, path := range []string{"/movies/a.mkv", "/movies/b.mkv", "/tvshows/c.mkv"} {
+		assert.NoError(t, l.put(ledgerEntry{Path: path, Size: 10, Outcome: fileProcessed}))
+	}
+
+	entry, found, err := l.get("/movies/b.mkv")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(10), entry.Size)
+
+	entries, err = l.list("/movies/")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	removed, err := l.remove("", "/movies/a.mkv", "/movies/unknown.mkv")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	removed, err = l.remove("/tvshows/")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	entries, err = l.list("")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "/movies/b.mkv", entries[0].Path)
+}
+
+// Test that hashing covers the start and the end of large files
+func TestHashFile(t *testing.T) {
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("a"), 3*ledgerHashSize)
+	first := writeTestFile(t, dir, "first.mkv", string(large))
+
+	// A change in the middle of a large file is not part of the hash
+	large[ledgerHashSize+10] = 'b'
+	middle := writeTestFile(t, dir, "middle.mkv", string(large))
+
+	// A change at the end is
+	large[len(large)-1] = 'b'
+	end := writeTestFile(t, dir, "end.mkv", string(large))
+
+	hash := func(path string) string {
+		h, err := hashFile(path, int64(len(large)))
+		assert.NoError(t, err)
+		return h
+	}
+	assert.Equal(t, hash(first), hash(middle))
+	assert.NotEqual(t, hash(first), hash(end))
+}
+
+// Test that processOnce skips files the ledger recorded and processes changed ones
+func TestProcessOnce(t *testing.T) {
+	mockCmd, _ := setupPipelineTest(t)
+	statFunc = os.Stat
+
+	oldLedger := fileLedger
+	fileLedger = newTestLedger(t)
+	defer func() { fileLedger = oldLedger }()
+
+	path := writeTestFile(t, t.TempDir(), "movie.mkv", "original")
+
+	// The canned file has English and Spanish audio, nothing changes
+	policy := config.DefaultCategoryPolicy()
+	policy.Languages.Audio = []string{"eng", "spa"}
+	steps, err := newPipeline(policy)
+	assert.NoError(t, err)
+
+	// A skipped file is not recorded, a later policy may change it
+	result := processOnce(context.Background(), steps, path)
+	assert.Equal(t, fileSkipped, result.Outcome)
+	assert.False(t, result.AlreadyProcessed)
+	assert.Equal(t, []string{"mkvmerge"}, mockCmd.Commands)
+
+	_, found, err := fileLedger.get(path)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	result = processOnce(context.Background(), steps, path)
+	assert.False(t, result.AlreadyProcessed)
+	assert.Len(t, mockCmd.Commands, 2)
+
+	// A redelivered message does not identify a processed file again
+	assert.NoError(t, fileLedger.record(fileResult{Path: path, Outcome: fileProcessed, Steps: []string{"strip_tracks"}}))
+	result = processOnce(context.Background(), steps, path)
+	assert.True(t, result.AlreadyProcessed)
+	assert.True(t, result.Skipped)
+	assert.Len(t, mockCmd.Commands, 2)
+
+	// A replaced file is processed again
+	assert.NoError(t, os.WriteFile(path, []byte("replaced"), 0o644))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Hour)))
+	result = processOnce(context.Background(), steps, path)
+	assert.False(t, result.AlreadyProcessed)
+	assert.Len(t, mockCmd.Commands, 3)
+}
+
+// Test for the ledger list, show and reset commands
+func TestLedgerCommands(t *testing.T) {
+	l := newTestLedger(t)
+	path := writeTestFile(t, t.TempDir(), "movie.mkv", "content")
+	assert.NoError(t, l.record(fileResult{Path: path, Outcome: fileProcessed, Steps: []string{"strip_tracks"}}))
+
+	var out bytes.Buffer
+	assert.NoError(t, ledgerCommand(l, []string{"list"}, &out))
+	assert.Contains(t, out.String(), path)
+	assert.Contains(t, out.String(), "1 file(s)")
+
+	out.Reset()
+	assert.NoError(t, ledgerCommand(l, []string{"show", path}, &out))
+	assert.Contains(t, out.String(), "Steps:     strip_tracks")
+	assert.Contains(t, out.String(), "File:      unchanged")
+
+	assert.NoError(t, os.WriteFile(path, []byte("changed content"), 0o644))
+	out.Reset()
+	assert.NoError(t, ledgerCommand(l, []string{"show", path}, &out))
+	assert.Contains(t, out.String(), "changed, it will be processed again")
+
+	assert.EqualError(t, ledgerCommand(l, []string{"reset"}, &out), "select files by path, with -prefix or use -all")
+	assert.EqualError(t, ledgerCommand(l, []string{"reset", "-all", path}, &out), "use only one of -all, -prefix or paths")
+
+	out.Reset()
+	assert.NoError(t, ledgerCommand(l, []string{"reset", "-all"}, &out))
+	assert.Contains(t, out.String(), "Reset 1 file(s)")
+
+	assert.ErrorContains(t, ledgerCommand(l, []string{"show", path}, &out), "is not in the ledger")
+	assert.EqualError(t, ledgerCommand(nil, []string{"list"}, &out), "the ledger is disabled, set ledger.path")
+}
+
+// Test that a renamed file replaces the entry of its old name
+func TestLedgerRecordRenamed(t *testing.T) {
+	l := newTestLedger(t)
+	dir := t.TempDir()
+	renamed := writeTestFile(t, dir, "Movie (2020).mkv", "content")
+	original := filepath.Join(dir, "movie.2020.mkv")
+	assert.NoError(t, l.put(ledgerEntry{Path: original}))
+
+	assert.NoError(t, l.record(fileResult{Path: original, RenamedTo: renamed, Outcome: fileProcessed}))
+
+	entries, err := l.list("")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, renamed, entries[0].Path)
+}
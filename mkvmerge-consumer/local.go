@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// errNoBroker is returned by operations that need RabbitMQ in watcher mode
+// without a broker
+var errNoBroker = errors.New("no broker configured")
+
+// localChannel stands in for a RabbitMQ channel when the watcher runs
+// without a broker. Published messages, such as done events and DLQ
+// entries, are appended as JSON lines to a local log.
+type localChannel struct {
+	mu   sync.Mutex
+	path string
+}
+
+// localLogEntry is a line of the local log
+type localLogEntry struct {
+	Time    string          `json:"time"`
+	Queue   string          `json:"queue"`
+	Message json.RawMessage `json:"message"`
+}
+
+// newLocalChannel returns a channel that writes to the log at path
+func newLocalChannel(path string) *localChannel {
+	return &localChannel{path: path}
+}
+
+// Publish appends the message body to the log
+func (c *localChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	message := json.RawMessage(msg.Body)
+	if !json.Valid(msg.Body) {
+		// Keep the line valid JSON whatever the body is
+		quoted, _ := json.Marshal(string(msg.Body))
+		message = quoted
+	}
+	line, err := json.Marshal(localLogEntry{
+		Time:    time.Now().Format(time.RFC3339),
+		Queue:   key,
+		Message: message,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal log entry: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", c.path, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", c.path, err)
+	}
+	return f.Close()
+}
+
+// QueueDeclare pretends the queue exists, every queue is the log
+func (c *localChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+// ExchangeDeclare does nothing
+func (c *localChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+// QueueDelete does nothing
+func (c *localChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	return 0, nil
+}
+
+// QueueBind does nothing
+func (c *localChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+// Qos does nothing
+func (c *localChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+// Consume is not supported without a broker
+func (c *localChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return nil, errNoBroker
+}
+
+// Get is not supported without a broker
+func (c *localChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	return amqp.Delivery{}, false, errNoBroker
+}
+
+// QueueInspect is not supported without a broker
+func (c *localChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{}, errNoBroker
+}
+
+// Ack does nothing
+func (c *localChannel) Ack(tag uint64, multiple bool) error {
+	return nil
+}
+
+// Nack does nothing
+func (c *localChannel) Nack(tag uint64, multiple, requeue bool) error {
+	return nil
+}
+
+// NotifyClose never reports a close
+func (c *localChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return receiver
+}
+
+// Close does nothing
+func (c *localChannel) Close() error {
+	return nil
+}
+
+// localDelivery settles a message submitted by the watcher. There is no
+// broker to return it to, so a rejected message is written to the DLQ
+// entries of the local log.
+type localDelivery struct {
+	ch   *localChannel
+	body []byte
+}
+
+// Ack does nothing
+func (d localDelivery) Ack(multiple bool) error {
+	return nil
+}
+
+// Nack does nothing, the watcher does not resubmit a processed folder
+func (d localDelivery) Nack(multiple, requeue bool) error {
+	return nil
+}
+
+// Reject records the message as dead-lettered
+func (d localDelivery) Reject(requeue bool) error {
+	return d.ch.Publish("", dlqQueueName, false, false, amqp.Publishing{Body: d.body})
+}
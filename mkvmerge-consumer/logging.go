@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+)
+
+// logLevel is the lowest level logged. It can change on reload.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes slog write in the configured format and level. The
+// standard log package writes through the same handler at the info level.
+func setupLogging(c config.LogConfig, out io.Writer) {
+	logLevel.Set(parseLogLevel(c.Level))
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler = slog.NewTextHandler(out, options)
+	if c.Format == config.LogFormatJSON {
+		handler = slog.NewJSONHandler(out, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// parseLogLevel converts a configured level, validated by config, to slog
+func parseLogLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// correlationKey stores the correlation ID of a message in a context
+type correlationKey struct{}
+
+// withCorrelationID returns a context carrying the correlation ID of a message
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// correlationID returns the correlation ID carried by ctx, if any
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// loggerFrom returns the logger for the message handled under ctx
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if id := correlationID(ctx); id != "" {
+		return slog.With("correlation_id", id)
+	}
+	return slog.Default()
+}
+
+// deliveryCorrelationID identifies a delivery by its message ID or
+// correlation ID, or by a new ID when the publisher set neither
+func deliveryCorrelationID(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	if d.CorrelationId != "" {
+		return d.CorrelationId
+	}
+	return newCorrelationID()
+}
+
+// newCorrelationID returns a random version 4 UUID
+func newCorrelationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
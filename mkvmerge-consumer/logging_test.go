@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"testing"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that deliveries are identified by their message ID, correlation ID or a new ID
+func TestDeliveryCorrelationID(t *testing.T) {
+	assert.Equal(t, "message", deliveryCorrelationID(amqp.Delivery{MessageId: "message", CorrelationId: "correlation"}))
+	assert.Equal(t, "correlation", deliveryCorrelationID(amqp.Delivery{CorrelationId: "correlation"}))
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	generated := deliveryCorrelationID(amqp.Delivery{})
+	assert.Regexp(t, uuid, generated)
+	assert.NotEqual(t, generated, deliveryCorrelationID(amqp.Delivery{}))
+}
+
+// Test that JSON logs carry the correlation ID and respect the level
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer logLevel.Set(logLevel.Level())
+
+	var out bytes.Buffer
+	setupLogging(config.LogConfig{Level: "warn", Format: config.LogFormatJSON}, &out)
+
+	logger := loggerFrom(withCorrelationID(context.Background(), "task-42"))
+	logger.Info("Hidden")
+	logger.Warn("Shown", "torrent", "Movie")
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "Shown", line["msg"])
+	assert.Equal(t, "WARN", line["level"])
+	assert.Equal(t, "task-42", line["correlation_id"])
+	assert.Equal(t, "Movie", line["torrent"])
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,24 +28,37 @@ var (
 	doneQueueName   string
 	dlqQueueName    string
 	CategoryPathMap map[string]string
+	// CategoryPolicyMap holds the processing policy of each configured category
+	CategoryPolicyMap map[string]config.CategoryPolicy
+	// defaultPolicy applies to categories without their own policy
+	defaultPolicy = config.DefaultCategoryPolicy()
+	// mkvmergeSlots limits how many files are remuxed at the same time
+	mkvmergeSlots = make(chan struct{}, 1)
+	// dryRun makes the consumer report what it would do instead of doing it
+	dryRun bool
+	// settingsMu guards the category paths, policies and safety checks,
+	// which a reload replaces while messages are processed
+	settingsMu sync.RWMutex
 )
 
 // Message represents the structure of incoming RabbitMQ messages
 type Message struct {
 	TorrentName string `json:"torrentName"`
 	Category    string `json:"category"`
+	// Priority overrides the priority of the category, see taskPriority
+	Priority *int `json:"priority,omitempty"`
 }
 
 // failOnError logs and exits on error
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Fatalf("%s: %s", msg, err)
+		slog.Error(msg, "error", err)
 		osExit(1)
 	}
 }
 
 // ensureQueueExists creates a queue if it does not already exist
-func ensureQueueExists(ch ChannelInterface, qName string) amqp.Queue {
+func ensureQueueExists(ch ChannelInterface, qName string) (amqp.Queue, error) {
 	q, err := ch.QueueDeclare(
 		qName, // name
 		true,  // durable
@@ -49,13 +67,17 @@ func ensureQueueExists(ch ChannelInterface, qName string) amqp.Queue {
 		false, // no-wait
 		nil,   // arguments
 	)
-	failOnError(err, fmt.Sprintf("Failed to declare queue?! '%s'", qName))
-	log.Printf("Queue '%s' declared", qName)
-	return q
+	if err != nil {
+		return q, fmt.Errorf("failed to declare queue '%s': %w", qName, err)
+	}
+	slog.Info("Queue declared", "queue", qName)
+	return q, nil
 }
 
-// ensureMainQueueWithDLX creates the main processing queue with Dead Letter Exchange configuration
-func ensureMainQueueWithDLX(ch ChannelInterface) amqp.Queue {
+// ensureMainQueueWithDLX creates the main processing queue with Dead Letter
+// Exchange configuration. openChannel opens the channel an outdated queue
+// is deleted on, see declareTaskQueue.
+func ensureMainQueueWithDLX(ch ChannelInterface, openChannel func() (ChannelInterface, error)) (amqp.Queue, error) {
 	// First, declare the DLX exchange
 	err := ch.ExchangeDeclare(
 		"dlx",    // name
@@ -66,57 +88,19 @@ func ensureMainQueueWithDLX(ch ChannelInterface) amqp.Queue {
 		false,    // no-wait
 		nil,      // arguments
 	)
-	failOnError(err, "Failed to declare DLX exchange")
-
-	// Try to declare the main queue with DLX configuration
-	q, err := ch.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		amqp.Table{
-			"x-dead-letter-exchange":    "dlx",
-			"x-dead-letter-routing-key": dlqQueueName,
-		}, // arguments
-	)
-
-	// If we get a precondition failed error, try to delete and recreate the queue
-	if err != nil && isInequivalentArgError(err) {
-		log.Printf("Queue '%s' exists with different configuration, attempting to delete and recreate...", queueName)
-
-		// Try to delete the existing queue (this will fail if it has messages)
-		_, deleteErr := ch.QueueDelete(queueName, false, false, false)
-		if deleteErr != nil {
-			log.Printf("Warning: Could not delete existing queue '%s': %v", queueName, deleteErr)
-			log.Printf("You may need to manually delete the queue '%s' from RabbitMQ management interface", queueName)
-			failOnError(err, fmt.Sprintf("Failed to declare main queue '%s' with DLX (queue exists with different config)", queueName))
-		}
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to declare DLX exchange: %w", err)
+	}
 
-		// Try to declare again after deletion
-		q, err = ch.QueueDeclare(
-			queueName, // name
-			true,      // durable
-			false,     // delete when unused
-			false,     // exclusive
-			false,     // no-wait
-			amqp.Table{
-				"x-dead-letter-exchange":    "dlx",
-				"x-dead-letter-routing-key": dlqQueueName,
-			}, // arguments
-		)
-		if err != nil {
-			failOnError(err, fmt.Sprintf("Failed to declare main queue '%s' with DLX after deletion", queueName))
-		}
-		log.Printf("Successfully recreated queue '%s' with DLX configuration", queueName)
-	} else if err != nil {
-		failOnError(err, fmt.Sprintf("Failed to declare main queue '%s' with DLX", queueName))
-	} else {
-		log.Printf("Main queue '%s' declared with DLX configuration", queueName)
+	q, err := declareTaskQueue(ch, openChannel, queueName)
+	if err != nil {
+		return amqp.Queue{}, err
 	}
 
 	// Ensure DLQ exists and bind to the DLX exchange
-	_ = ensureQueueExists(ch, dlqQueueName)
+	if _, err := ensureQueueExists(ch, dlqQueueName); err != nil {
+		return amqp.Queue{}, err
+	}
 
 	err = ch.QueueBind(
 		dlqQueueName, // queue name
@@ -125,10 +109,71 @@ func ensureMainQueueWithDLX(ch ChannelInterface) amqp.Queue {
 		false,
 		nil,
 	)
-	failOnError(err, "Failed to bind DLQ to DLX")
-	log.Printf("DLQ '%s' bound to DLX exchange", dlqQueueName)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to bind DLQ to DLX: %w", err)
+	}
+	slog.Info("DLQ bound to DLX exchange", "queue", dlqQueueName)
 
-	return q
+	return q, nil
+}
+
+// errQueueRecreated is returned after a task queue declared with other
+// arguments was recreated. The declare that found it closed the channel, so
+// the topology has to be declared again on a new one.
+var errQueueRecreated = errors.New("task queue recreated")
+
+// declareTaskQueue declares a task queue with the DLX and priority
+// arguments. A queue declared with other arguments, such as another
+// priority.max, is recreated on a channel of openChannel if it is empty.
+func declareTaskQueue(ch ChannelInterface, openChannel func() (ChannelInterface, error), name string) (amqp.Queue, error) {
+	q, err := ch.QueueDeclare(
+		name,            // name
+		true,            // durable
+		false,           // delete when unused
+		false,           // exclusive
+		false,           // no-wait
+		taskQueueArgs(), // arguments
+	)
+	if err != nil && isInequivalentArgError(err) {
+		slog.Warn("Queue exists with different configuration, attempting to delete and recreate", "queue", name)
+		return amqp.Queue{}, recreateTaskQueue(openChannel, name, err)
+	}
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to declare task queue '%s' with DLX: %w", name, err)
+	}
+	slog.Info("Task queue declared with DLX configuration", "queue", name)
+	return q, nil
+}
+
+// recreateTaskQueue deletes a task queue declared with other arguments,
+// unless it holds tasks, and declares it again. The failed declare closed
+// its channel, so this runs on a new one. It returns errQueueRecreated once
+// the queue was recreated.
+func recreateTaskQueue(openChannel func() (ChannelInterface, error), name string, declareErr error) error {
+	ch, err := openChannel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel to recreate task queue '%s': %w", name, err)
+	}
+	defer ch.Close()
+
+	// Only an empty queue is deleted, the broker refuses otherwise
+	if _, err := ch.QueueDelete(name, false, true, false); err != nil {
+		return fmt.Errorf("task queue '%s' was declared with other arguments (%v) and could not be deleted to apply "+
+			"priority.max=%d, drain and delete it first: %w", name, declareErr, taskPriorities.Max, err)
+	}
+	_, err = ch.QueueDeclare(
+		name,            // name
+		true,            // durable
+		false,           // delete when unused
+		false,           // exclusive
+		false,           // no-wait
+		taskQueueArgs(), // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare task queue '%s' with DLX after deletion: %w", name, err)
+	}
+	slog.Info("Recreated queue with DLX configuration", "queue", name, "priority_max", taskPriorities.Max)
+	return fmt.Errorf("%w: '%s'", errQueueRecreated, name)
 }
 
 // isInequivalentArgError checks if the error is due to inequivalent arguments
@@ -143,17 +188,10 @@ func isInequivalentArgError(err error) bool {
 	return false
 }
 
-// publishDoneMessage publishes a message to the done queue
-func publishDoneMessage(ch ChannelInterface, filename string) error {
-	// Create a simple message with the filename
-	message := map[string]string{
-		"filename": filename,
-		"status":   "processed",
-		"time":     time.Now().Format(time.RFC3339),
-	}
-
+// publishDoneMessage publishes the result of a torrent to the done queue
+func publishDoneMessage(ch ChannelInterface, event doneEvent) error {
 	// Convert to JSON
-	body, err := json.Marshal(message)
+	body, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal done message: %v", err)
 	}
@@ -165,27 +203,38 @@ func publishDoneMessage(ch ChannelInterface, filename string) error {
 		false,         // mandatory
 		false,         // immediate
 		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: amqp.Persistent, // make message persistent
+			ContentType:   "application/json",
+			CorrelationId: event.CorrelationID,
+			Body:          body,
+			DeliveryMode:  amqp.Persistent, // make message persistent
 		})
 
 	if err != nil {
 		return fmt.Errorf("failed to publish done message: %v", err)
 	}
 
-	log.Printf("Published completion message for file %s to %s queue", filename, doneQueueName)
+	slog.Info("Published completion message", "torrent", event.TorrentName,
+		"queue", doneQueueName, "correlation_id", event.CorrelationID)
 	return nil
 }
 
-// publishToDLQ publishes a message to the Dead Letter Queue with an error reason
-func publishToDLQ(ch ChannelInterface, body []byte, reason string) error {
+// publishToDLQ publishes a message to the Dead Letter Queue with an error reason,
+// the history of failed attempts, if any, and the correlation ID carried by ctx
+func publishToDLQ(ctx context.Context, ch ChannelInterface, body []byte, reason string, history []retryAttempt) error {
 	// Create a wrapper message with the original message and error reason
 	dlqMessage := map[string]interface{}{
 		"originalMessage": string(body),
 		"errorReason":     reason,
 		"timestamp":       time.Now().Format(time.RFC3339),
 	}
+	id := correlationID(ctx)
+	if id != "" {
+		dlqMessage["correlationId"] = id
+	}
+	if len(history) > 0 {
+		dlqMessage["attempts"] = len(history)
+		dlqMessage["history"] = history
+	}
 
 	// Convert to JSON
 	dlqBody, err := json.Marshal(dlqMessage)
@@ -194,7 +243,9 @@ func publishToDLQ(ch ChannelInterface, body []byte, reason string) error {
 	}
 
 	// Ensure DLQ exists
-	_ = ensureQueueExists(ch, dlqQueueName)
+	if _, err := ensureQueueExists(ch, dlqQueueName); err != nil {
+		return err
+	}
 
 	// Publish to the DLQ
 	err = ch.Publish(
@@ -203,32 +254,40 @@ func publishToDLQ(ch ChannelInterface, body []byte, reason string) error {
 		false,        // mandatory
 		false,        // immediate
 		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         dlqBody,
-			DeliveryMode: amqp.Persistent, // make message persistent
+			ContentType:   "application/json",
+			CorrelationId: id,
+			Body:          dlqBody,
+			DeliveryMode:  amqp.Persistent, // make message persistent
 		})
 
 	if err != nil {
 		return fmt.Errorf("failed to publish to DLQ: %v", err)
 	}
 
-	log.Printf("Published message to DLQ %s with reason: %s", dlqQueueName, reason)
+	loggerFrom(ctx).Warn("Published message to DLQ", "queue", dlqQueueName, "reason", reason)
 	return nil
 }
 
-// rejectMessageToDLQ rejects a message and routes it to the DLQ automatically
-func rejectMessageToDLQ(d interface {
-	Reject(bool) error
-}, reason string) error {
-	log.Printf("Rejecting message to DLQ with reason: %s", reason)
-
-	// Reject the message with requeue=false, which will send it to DLX
-	err := d.Reject(false)
-	if err != nil {
-		return fmt.Errorf("failed to reject message: %v", err)
+// rejectMessageToDLQ sends a message that can never be processed to the DLQ.
+// It is published in an envelope carrying its correlation ID and then
+// acknowledged. Only when publishing fails is it rejected through the DLX,
+// which routes the bare message without the ID.
+func rejectMessageToDLQ(ctx context.Context, ch ChannelInterface, d acknowledger, body []byte, reason string) error {
+	logger := loggerFrom(ctx)
+	logger.Warn("Rejecting message to DLQ", "reason", reason)
+
+	if err := publishToDLQ(ctx, ch, body, reason, nil); err != nil {
+		logger.Error("Error publishing to DLQ, rejecting through the DLX", "error", err)
+		// Reject the message with requeue=false, which will send it to DLX
+		if err := d.Reject(false); err != nil {
+			return fmt.Errorf("failed to reject message: %v", err)
+		}
+		logger.Warn("Message rejected and routed to DLQ", "reason", reason)
+	} else if err := d.Ack(false); err != nil {
+		return fmt.Errorf("failed to acknowledge dead-lettered message: %v", err)
 	}
 
-	log.Printf("Message rejected and routed to DLQ: %s", reason)
+	messagesTotal.WithLabelValues(outcomeRejected).Inc()
 	return nil
 }
 
@@ -241,6 +300,11 @@ type ChannelInterface interface {
 	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
 	Qos(prefetchCount, prefetchSize int, global bool) error
 	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple, requeue bool) error
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
 	Close() error
 }
 
@@ -254,403 +318,355 @@ func main() {
 	// Set up logging
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.Println("Starting RabbitMQ consumer...")
+
+	// Subcommands such as "dlq" run once and exit
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout))
+	}
+
+	slog.Info("Starting RabbitMQ consumer")
 
 	// Load configuration
 	var err error
 	cfg, err = config.Load()
 	failOnError(err, "Failed to load configuration")
+	setupLogging(cfg.Log, os.Stdout)
+	failOnError(checkPipelines(cfg), "Invalid pipeline configuration")
+	applyConfig(cfg)
+
+	slog.Info("Configuration loaded", "host", cfg.RabbitMQ.Host,
+		"tasks_queue", queueName, "done_queue", doneQueueName, "dlq", dlqQueueName)
+	slog.Info("Processing messages and mkvmerge runs in parallel",
+		"workers", cfg.Processing.Workers, "mkvmerge_concurrency", cfg.Processing.MkvmergeConcurrency)
+
+	// Stop consuming on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Backups may be enabled by a reload, so expired ones are always pruned
+	go watchBackups(ctx)
+
+	// The watcher feeds new folders of the category directories to the consumer
+	var watcher *folderWatcher
+	if cfg.Watch.Enabled {
+		watcher, err = newFolderWatcher(CategoryPathMap, cfg.Watch.QuietPeriod)
+		failOnError(err, "Failed to watch category directories")
+	}
 
-	// Set global variables from config
-	queueName = cfg.RabbitMQ.Queue.Tasks
-	doneQueueName = cfg.RabbitMQ.Queue.Done
-	dlqQueueName = cfg.RabbitMQ.Queue.DLQ
-	CategoryPathMap = cfg.Paths.Categories
+	// Category paths, policies and safety checks change without a restart
+	go watchReloads(ctx, cfg, func() {
+		if watcher == nil {
+			return
+		}
+		settingsMu.RLock()
+		categories := CategoryPathMap
+		settingsMu.RUnlock()
+		if err := watcher.setCategories(categories); err != nil {
+			slog.Error("Error watching new category directories", "error", err)
+		}
+	})
 
-	log.Printf("Configuration loaded: RabbitMQ host=%s, queues=%s,%s,%s",
-		cfg.RabbitMQ.Host, queueName, doneQueueName, dlqQueueName)
+	if cfg.Watch.Enabled && !cfg.Watch.Broker {
+		if cfg.HTTP.Listen != "" {
+			go serveHTTP(ctx, cfg.HTTP.Listen, newHTTPHandler(nil, cfg.HTTP.LivenessTimeout))
+		}
+		slog.Info("Watcher is now running. Press CTRL+C to exit")
+		runWithoutBroker(ctx, watcher, cfg.Watch.DoneLog, cfg.Processing.Workers)
+		slog.Info("Consumer shutdown complete")
+		return
+	}
 
-	// Connect to RabbitMQ
-	conn, err := amqp.Dial(cfg.ConnectionString())
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
-	log.Println("Successfully connected to RabbitMQ")
+	tlsConfig, err := newTLSConfig(cfg.RabbitMQ.TLS)
+	failOnError(err, "Invalid RabbitMQ TLS configuration")
+
+	// The supervisor owns the RabbitMQ connection and reconnects whenever it is lost
+	sup := &supervisor{
+		dial:     dialAMQP(cfg.ConnectionString(), tlsConfig),
+		handle:   handleDelivery,
+		workers:  cfg.Processing.Workers,
+		prefetch: cfg.Processing.Workers, // one unacknowledged message per worker
+		minDelay: cfg.RabbitMQ.Reconnect.InitialDelay,
+		maxDelay: cfg.RabbitMQ.Reconnect.MaxDelay,
+	}
+	if watcher != nil {
+		go watcher.run(ctx, submitToBroker(sup))
+	}
 
-	// Set up connection monitoring
-	connClosed := make(chan *amqp.Error)
-	conn.NotifyClose(connClosed)
+	// Expose health endpoints and metrics for probes and monitoring
+	if cfg.HTTP.Listen != "" {
+		go watchQueues(ctx, sup, cfg.HTTP.QueueDepthInterval)
+		go serveHTTP(ctx, cfg.HTTP.Listen, newHTTPHandler(sup, cfg.HTTP.LivenessTimeout))
+	}
 
-	// Create a channel
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-	log.Println("Channel opened")
-
-	// Set up channel monitoring
-	chClosed := make(chan *amqp.Error)
-	ch.NotifyClose(chClosed)
-
-	// Monitor channel health
-	go func() {
-		err := <-chClosed
-		log.Printf("RabbitMQ channel closed unexpectedly: %v", err)
-		// In a production environment, you might want to attempt to recreate the channel
-		// For simplicity, we'll just exit and let the container orchestration restart the process
-		log.Println("Channel closed - process will exit to allow container orchestration to restart it")
-		os.Exit(1)
-	}()
-
-	// Declare queues (ensures they exist)
-	processingQueue := ensureMainQueueWithDLX(ch) // Use DLX-configured queue
-	_ = ensureQueueExists(ch, doneQueueName)      // Ensure done queue exists
-	_ = ensureQueueExists(ch, dlqQueueName)       // Ensure dead letter queue exists
-
-	// Set QoS (prefetch count)
-	err = ch.Qos(
-		1,     // prefetch count (process one message at a time)
-		0,     // prefetch size
-		false, // global
-	)
-	failOnError(err, "Failed to set QoS")
-
-	// Register consumer
-	msgs, err := ch.Consume(
-		processingQueue.Name, // queue
-		"",                   // consumer tag (empty means auto-generated)
-		false,                // auto-ack (false means manual acknowledgment)
-		false,                // exclusive
-		false,                // no-local
-		false,                // no-wait
-		nil,                  // args
-	)
-	failOnError(err, "Failed to register a consumer")
-	log.Println("Consumer registered, waiting for messages...")
-
-	// Create a channel to handle shutdown signals
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
-
-	// Create a channel to process messages
-	forever := make(chan bool)
-	// Process messages in a goroutine
-	go func() {
-		for d := range msgs {
-			log.Printf("Received a message: %s", d.Body)
-
-			// Create a timeout for message processing
-			done := make(chan bool, 1)
-			go func(msg amqp.Delivery) {
-				// Process the message and acknowledge only after successful processing
-				processMessage(ch, msg, msg.Body)
-				done <- true
-			}(d)
-
-			// Wait for either completion or timeout
-			select {
-			case <-done:
-				log.Println("Message processed within timeout")
-			case <-time.After(30 * time.Minute): // Adjust timeout as needed for your workload
-				log.Println("WARNING: Message processing timed out, rejecting message to avoid blocking")
-				if err := d.Reject(false); err != nil { // false = don't requeue
-					log.Printf("Error rejecting timed-out message: %v", err)
-				} else {
-					log.Println("Timed-out message rejected")
-				}
-			}
-		}
-	}()
-
-	// Wait for shutdown signal or connection close
-	go func() {
-		select {
-		case sig := <-shutdown:
-			log.Printf("Received shutdown signal: %v", sig)
-			log.Println("Shutting down gracefully...")
-
-			// Close RabbitMQ connection
-			if err := conn.Close(); err != nil {
-				log.Printf("Error closing RabbitMQ connection: %v", err)
-			}
+	slog.Info("Consumer is now running. Press CTRL+C to exit")
+	if err := sup.run(ctx); err != nil {
+		slog.Error("Consumer stopped", "error", err)
+	}
+	slog.Info("Consumer shutdown complete")
+}
 
-			close(forever)
-		case err := <-connClosed:
-			log.Printf("RabbitMQ connection closed: %v", err)
-			log.Println("Attempting to reconnect...")
+// applyConfig sets the global variables from the configuration
+func applyConfig(c *config.Config) {
+	queueName = c.RabbitMQ.Queue.Tasks
+	doneQueueName = c.RabbitMQ.Queue.Done
+	dlqQueueName = c.RabbitMQ.Queue.DLQ
+	CategoryPathMap = c.Paths.Categories
+	CategoryPolicyMap = c.Policy.Categories
+	retryPolicy = c.Retry
+	defaultPolicy = c.Policy.Default
+	mkvmergeSlots = make(chan struct{}, c.Processing.MkvmergeConcurrency)
+	dryRun = c.Processing.DryRun
+	taskPriorities = c.RabbitMQ.Priority
+	taskRouting = c.RabbitMQ.Routing
+	categoryQueues = newCategoryQueues(c.RabbitMQ.Routing, c.Paths.Categories)
+	fileLedger = newLedger(c.Ledger.Path)
+	safetyPolicy = c.Safety
+}
 
-			// Signal that the process should restart
-			// In a production environment, you would implement reconnection logic here
-			// or use a supervisor (like systemd) to restart the process
-			log.Println("Connection lost - process will exit to allow container orchestration to restart it")
-			os.Exit(1) // Exit with error so container orchestration can restart
-		}
-	}()
+// handleDelivery processes a single delivery and makes sure it is settled exactly once
+func handleDelivery(ctx context.Context, ch ChannelInterface, d amqp.Delivery) {
+	ctx = withCorrelationID(ctx, deliveryCorrelationID(d))
+	logger := loggerFrom(ctx)
+	logger.Info("Received a message", "body", string(d.Body))
 
-	// Start health check routine
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
+	// Process the message and acknowledge only after successful processing
+	delivery := newSettleOnce(d)
+	processMessage(ctx, ch, delivery, d.Body, d.Headers)
 
-		for {
-			select {
-			case <-ticker.C:
-				if conn.IsClosed() {
-					log.Println("WARNING: RabbitMQ connection is closed")
-				} else {
-					log.Println("Health check: RabbitMQ connection is active")
-				}
-			case <-forever:
-				return
-			}
+	// A message left unsettled because of shutdown goes back to the queue
+	if ctx.Err() != nil && !delivery.Settled() {
+		if err := delivery.Nack(false, true); err != nil {
+			logger.Error("Error requeueing message on shutdown", "error", err)
+		} else {
+			logger.Info("Message requeued because the consumer is shutting down")
 		}
-	}()
-
-	log.Println("Consumer is now running. Press CTRL+C to exit")
-	<-forever
-	log.Println("Consumer shutdown complete")
+	}
 }
 
 // Define variable aliases for functions to make them mockable in tests
 var (
-	statFunc    = os.Stat
-	walkFunc    = filepath.Walk
-	renameFunc  = os.Rename
-	removeFunc  = os.Remove
-	execCommand = exec.Command
+	statFunc      = os.Stat
+	walkFunc      = filepath.Walk
+	renameFunc    = os.Rename
+	removeFunc    = os.Remove
+	writeFileFunc = os.WriteFile
+	execCommand   = exec.CommandContext
 )
 
-// processMessage handles the received message
-func processMessage(ch ChannelInterface, d interface {
-	Ack(bool) error
-	Nack(bool, bool) error
-	Reject(bool) error
-}, body []byte) {
-	log.Printf("Processing message: %s", body)
+// processMessage handles the received message. It stops when ctx is
+// cancelled or the category timeout expires, killing any running mkvmerge.
+func processMessage(ctx context.Context, ch ChannelInterface, d acknowledger, body []byte, headers amqp.Table) {
+	// Messages that do not come from RabbitMQ get an ID of their own
+	if correlationID(ctx) == "" {
+		ctx = withCorrelationID(ctx, newCorrelationID())
+	}
+	logger := loggerFrom(ctx)
+	logger.Info("Processing message", "body", string(body))
 
 	// Parse the JSON message
 	var msg Message
 	if err := json.Unmarshal(body, &msg); err != nil {
-		log.Printf("Error parsing message JSON: %v", err)
+		logger.Error("Error parsing message JSON", "error", err)
 		// Reject message to DLQ for parsing errors
-		if err := rejectMessageToDLQ(d, fmt.Sprintf("JSON parsing error: %v", err)); err != nil {
-			log.Printf("Error rejecting message to DLQ: %v", err)
+		if err := rejectMessageToDLQ(ctx, ch, d, body, fmt.Sprintf("JSON parsing error: %v", err)); err != nil {
+			logger.Error("Error rejecting message to DLQ", "error", err)
 		}
 		return
 	}
+	logger = logger.With("torrent", msg.TorrentName, "category", msg.Category)
 
 	// Map category to base directory path
-	basePath, exists := CategoryPathMap[msg.Category]
+	basePath, exists := categoryPath(msg.Category)
 	if !exists {
-		log.Printf("Unknown category: %s", msg.Category)
+		logger.Error("Unknown category")
 		// Reject message to DLQ for unknown category
 		reason := fmt.Sprintf("Unknown category: %s", msg.Category)
-		if err := rejectMessageToDLQ(d, reason); err != nil {
-			log.Printf("Error rejecting message to DLQ: %v", err)
+		if err := rejectMessageToDLQ(ctx, ch, d, body, reason); err != nil {
+			logger.Error("Error rejecting message to DLQ", "error", err)
 		}
 		return
 	}
 
+	// Build the processing steps of the category
+	policy := policyForCategory(msg.Category)
+	steps, err := newPipeline(policy)
+	if err != nil {
+		logger.Error("Invalid pipeline for category", "error", err)
+		if err := rejectMessageToDLQ(ctx, ch, d, body, fmt.Sprintf("Invalid pipeline: %v", err)); err != nil {
+			logger.Error("Error rejecting message to DLQ", "error", err)
+		}
+		return
+	}
+
+	// Bound the processing time by the category timeout
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+
 	// Construct full folder path
 	folderPath := filepath.Join(basePath, msg.TorrentName)
-	log.Printf("Looking for MKV files in: %s", folderPath)
+	logger.Info("Looking for media files", "folder", folderPath)
 
 	// Check if the folder exists
 	if _, err := statFunc(folderPath); os.IsNotExist(err) {
-		log.Printf("Folder does not exist: %s", folderPath)
-		// Reject message to DLQ for non-existent folder
+		logger.Warn("Folder does not exist", "folder", folderPath)
+		// The download client may still be moving the folder, try again later
 		reason := fmt.Sprintf("Folder does not exist: %s", folderPath)
-		if err := rejectMessageToDLQ(d, reason); err != nil {
-			log.Printf("Error rejecting message to DLQ: %v", err)
-		}
+		retryOrDeadLetter(ctx, ch, d, body, headers, reason)
 		return
 	}
 
-	// Find all .mkv files in the folder
-	var mkvFiles []string
-	err := walkFunc(folderPath, func(path string, info os.FileInfo, err error) error {
+	// Find all files the backend of the category handles
+	var mediaFiles []string
+	err = walkFunc(folderPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && filepath.Ext(path) == ".mkv" {
-			mkvFiles = append(mkvFiles, path)
+		if !info.IsDir() && handles(steps.backend, path) {
+			mediaFiles = append(mediaFiles, path)
 		}
 		return nil
 	})
 
 	if err != nil {
-		log.Printf("Error walking directory %s: %v", folderPath, err)
+		logger.Error("Error walking directory", "folder", folderPath, "error", err)
+		retryOrDeadLetter(ctx, ch, d, body, headers, fmt.Sprintf("Error walking directory %s: %v", folderPath, err))
 		return
 	}
 
-	log.Printf("Found %d MKV files to process", len(mkvFiles))
-	if len(mkvFiles) == 0 {
-		log.Println("No MKV files found, nothing to process")
+	logger.Info("Found media files to process", "count", len(mediaFiles))
+	if len(mediaFiles) == 0 {
+		logger.Info("No media files found, nothing to process")
 		// Acknowledge the message since there are no files to process
 		if err := d.Ack(false); err != nil {
-			log.Printf("Error acknowledging message with no MKV files: %v", err)
+			logger.Error("Error acknowledging message with no media files", "error", err)
 		} else {
-			log.Println("Message acknowledged (no MKV files to process)")
+			logger.Info("Message acknowledged (no media files to process)")
+			messagesTotal.WithLabelValues(outcomeProcessed).Inc()
 		}
 		return
 	}
 
-	// Track successful file processing
-	successfullyProcessed := false
-	// Track files skipped because they already have only English audio tracks
-	skippedDueToOnlyEnglishAudio := true // Start with true, set to false if any file doesn't meet the criteria
-	filesProcessed := 0                  // Count of files processed or skipped
-
-	// Process each MKV file
-	for _, file := range mkvFiles {
-		log.Printf("Processing file: %s", file)
-
-		// Get track information using mkvmerge
-		jsonCmd := execCommand("mkvmerge", "-J", file)
-		jsonOutput, err := jsonCmd.Output()
-		if err != nil {
-			log.Printf("Error getting track info for %s: %v", file, err)
-			continue
-		}
-
-		// Parse JSON output
-		var trackInfo struct {
-			Tracks []struct {
-				ID         int    `json:"id"`
-				Type       string `json:"type"`
-				Properties struct {
-					Language string `json:"language"`
-				} `json:"properties"`
-			} `json:"tracks"`
-		}
-
-		if err := json.Unmarshal(jsonOutput, &trackInfo); err != nil {
-			log.Printf("Error parsing track info JSON for %s: %v", file, err)
-			continue
-		}
-
-		// Check if file already has only English audio tracks
-		hasNonEnglishAudio := false
-		for _, track := range trackInfo.Tracks {
-			if track.Type == "audio" && track.Properties.Language != "eng" {
-				hasNonEnglishAudio = true
-				break
-			}
-		}
-
-		if !hasNonEnglishAudio {
-			log.Printf("File %s already has only English audio tracks, skipping", file)
-			filesProcessed++
-			continue
+	// In dry-run mode only report what would be done
+	if dryRun {
+		reportDryRun(ctx, steps.backend, policy, mediaFiles)
+		if err := d.Ack(false); err != nil {
+			logger.Error("Error acknowledging dry-run message", "error", err)
 		} else {
-			// If any file has non-English audio, set flag to false
-			skippedDueToOnlyEnglishAudio = false
-		}
-
-		// Build track selection arguments
-		var videoTracks, audioTracks, subtitleTracks []string
-
-		for _, track := range trackInfo.Tracks {
-			id := fmt.Sprintf("%d", track.ID)
-
-			if track.Type == "video" {
-				videoTracks = append(videoTracks, id)
-			} else if track.Type == "audio" && track.Properties.Language == "eng" {
-				audioTracks = append(audioTracks, id)
-			} else if track.Type == "subtitles" && track.Properties.Language == "eng" {
-				subtitleTracks = append(subtitleTracks, id)
-			}
+			messagesTotal.WithLabelValues(outcomeProcessed).Inc()
 		}
+		return
+	}
 
-		// If no English audio tracks found, keep all audio tracks
-		if len(audioTracks) == 0 {
-			log.Printf("No English audio tracks found in %s, keeping all audio tracks", file)
-			audioTracks = nil
-			for _, track := range trackInfo.Tracks {
-				if track.Type == "audio" {
-					audioTracks = append(audioTracks, fmt.Sprintf("%d", track.ID))
-				}
+	// Process the files in parallel, bounded by the mkvmerge concurrency limit
+	results := make([]fileResult, len(mediaFiles))
+	var wg sync.WaitGroup
+	for i, file := range mediaFiles {
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			select {
+			case mkvmergeSlots <- struct{}{}:
+				defer func() { <-mkvmergeSlots }()
+				results[i] = processOnce(ctx, steps, file)
+			case <-ctx.Done():
+				results[i] = fileResult{Path: file, Outcome: fileFailed, Error: ctx.Err().Error()}
 			}
-		}
-
-		// Prepare output filename
-		dir := filepath.Dir(file)
-		basename := filepath.Base(file)
-		tmpFile := filepath.Join(dir, "."+basename+".tmp.mkv")
-
-		// Build mkvmerge command
-		args := []string{"-o", tmpFile}
-
-		if len(videoTracks) > 0 {
-			args = append(args, "--video-tracks", join(videoTracks, ","))
-		}
-
-		if len(audioTracks) > 0 {
-			args = append(args, "--audio-tracks", join(audioTracks, ","))
-		}
-
-		if len(subtitleTracks) > 0 {
-			args = append(args, "--subtitle-tracks", join(subtitleTracks, ","))
-		}
-
-		args = append(args, file)
-
-		// Run mkvmerge
-		log.Printf("Running mkvmerge with args: %v", args)
-		cmd := execCommand("mkvmerge", args...)
-		output, err := cmd.CombinedOutput()
-
-		if err != nil {
-			// mkvmerge returns 1 for warnings, but the file is still usable
-			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-				log.Printf("mkvmerge completed with warnings for %s: %s", file, string(output))
-				// Continue with the file move despite warnings
-			} else {
-				log.Printf("Error running mkvmerge for %s: %v", file, err)
-				log.Printf("Output: %s", string(output))
-				// Clean up temporary file
-				removeFunc(tmpFile)
-				continue
+		}(i, file)
+	}
+	wg.Wait()
+
+	// Stop here if the timeout expired or the consumer is shutting down
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			reason := fmt.Sprintf("Processing timed out after %s", policy.Timeout)
+			logger.Warn("Processing timed out, rejecting message", "timeout", policy.Timeout)
+			messageTimeoutsTotal.Inc()
+			if err := rejectMessageToDLQ(ctx, ch, d, body, reason); err != nil {
+				logger.Error("Error rejecting timed-out message", "error", err)
 			}
 		} else {
-			log.Printf("mkvmerge completed successfully for %s", file)
+			logger.Info("Processing cancelled, leaving message unsettled")
 		}
+		return
+	}
 
-		// Replace original file with new file
-		if err := renameFunc(tmpFile, file); err != nil {
-			log.Printf("Error replacing original file %s: %v", file, err)
-			removeFunc(tmpFile) // Clean up in case of error
-		} else {
-			log.Printf("Successfully processed %s", file)
-			// Mark that at least one file was successfully processed
-			successfullyProcessed = true
-			filesProcessed++
+	// Count how the files ended up
+	processed, skipped := 0, 0
+	for _, result := range results {
+		switch result.Outcome {
+		case fileProcessed:
+			processed++
+		case fileSkipped:
+			skipped++
 		}
 	}
+	successfullyProcessed := processed > 0
 
 	// If at least one file was processed successfully or all files were skipped because they
-	// already have only English audio tracks, acknowledge the original message
+	// already match the language policy, acknowledge the original message
 	// and send a completion message for the whole directory
-	if successfullyProcessed || (skippedDueToOnlyEnglishAudio && filesProcessed == len(mkvFiles)) {
+	if successfullyProcessed || skipped == len(mediaFiles) {
 		// Send a single message to the done queue with the torrent name
-		if err := publishDoneMessage(ch, msg.TorrentName); err != nil {
-			log.Printf("Error publishing done message for torrent %s: %v", msg.TorrentName, err)
+		event := newDoneEvent(msg, results)
+		event.CorrelationID = correlationID(ctx)
+		if err := publishDoneMessage(ch, event); err != nil {
+			logger.Error("Error publishing done message", "error", err)
 		} else {
-			log.Printf("Published completion message for entire directory: %s", msg.TorrentName)
+			logger.Info("Published completion message for entire directory")
 		}
 
 		if err := d.Ack(false); err != nil {
-			log.Printf("Error acknowledging message: %v", err)
+			logger.Error("Error acknowledging message", "error", err)
 		} else {
+			messagesTotal.WithLabelValues(outcomeProcessed).Inc()
 			if successfullyProcessed {
-				log.Println("Message acknowledged after successful processing")
+				logger.Info("Message acknowledged after successful processing", "processed", processed, "skipped", skipped)
 			} else {
-				log.Println("Message acknowledged because files already have only English audio tracks")
+				logger.Info("Message acknowledged because files already match the language policy", "skipped", skipped)
 			}
 		}
 	} else {
-		log.Println("No files were successfully processed, message remains in queue")
+		logger.Warn("No files were successfully processed")
+		reason := fmt.Sprintf("No files were successfully processed (%d of %d failed)", len(mediaFiles)-skipped, len(mediaFiles))
+		if errs := fileErrors(results); errs != "" {
+			reason += ": " + errs
+		}
+		retryOrDeadLetter(ctx, ch, d, body, headers, reason)
+	}
+
+	logger.Info("Message processing completed")
+}
+
+// fileErrors joins the errors of the failed files for a DLQ reason
+func fileErrors(results []fileResult) string {
+	var errs []string
+	for _, result := range results {
+		if result.Outcome == fileFailed && result.Error != "" {
+			errs = append(errs, filepath.Base(result.Path)+": "+result.Error)
+		}
 	}
+	return strings.Join(errs, "; ")
+}
+
+// categoryPath returns the base directory configured for a category
+func categoryPath(category string) (string, bool) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	path, ok := CategoryPathMap[category]
+	return path, ok
+}
 
-	log.Println("Message processing completed")
+// policyForCategory returns the processing policy configured for a category
+func policyForCategory(category string) config.CategoryPolicy {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if policy, ok := CategoryPolicyMap[category]; ok {
+		return policy
+	}
+	return defaultPolicy
 }
 
 // join joins string slice elements with a separator
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"testing"
@@ -50,6 +51,31 @@ func (m *MockChannelInterface) Consume(queue, consumer string, autoAck, exclusiv
 	return result.Get(0).(<-chan amqp.Delivery), result.Error(1)
 }
 
+func (m *MockChannelInterface) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	result := m.Called(queue, autoAck)
+	return result.Get(0).(amqp.Delivery), result.Bool(1), result.Error(2)
+}
+
+func (m *MockChannelInterface) QueueInspect(name string) (amqp.Queue, error) {
+	result := m.Called(name)
+	return result.Get(0).(amqp.Queue), result.Error(1)
+}
+
+func (m *MockChannelInterface) Ack(tag uint64, multiple bool) error {
+	result := m.Called(tag, multiple)
+	return result.Error(0)
+}
+
+func (m *MockChannelInterface) Nack(tag uint64, multiple, requeue bool) error {
+	result := m.Called(tag, multiple, requeue)
+	return result.Error(0)
+}
+
+func (m *MockChannelInterface) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	m.Called(receiver)
+	return receiver
+}
+
 func (m *MockChannelInterface) Close() error {
 	result := m.Called()
 	return result.Error(0)
@@ -110,12 +136,27 @@ func TestEnsureQueueExists(t *testing.T) {
 	expectedQueue := amqp.Queue{Name: "test-queue"}
 	mockChannel.On("QueueDeclare", "test-queue", true, false, false, false, mock.Anything).Return(expectedQueue, nil)
 
-	result := ensureQueueExists(mockChannel, "test-queue")
+	result, err := ensureQueueExists(mockChannel, "test-queue")
 
+	assert.NoError(t, err)
 	assert.Equal(t, expectedQueue, result)
 	mockChannel.AssertExpectations(t)
 }
 
+// Test for ensureQueueExists when the broker refuses the declaration
+func TestEnsureQueueExistsError(t *testing.T) {
+	mockChannel := new(MockChannelInterface)
+
+	declareErr := &amqp.Error{Code: 403, Reason: "ACCESS_REFUSED"}
+	mockChannel.On("QueueDeclare", "test-queue", true, false, false, false, mock.Anything).Return(amqp.Queue{}, declareErr)
+
+	_, err := ensureQueueExists(mockChannel, "test-queue")
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "test-queue")
+	mockChannel.AssertExpectations(t)
+}
+
 // Test for publishDoneMessage function
 func TestPublishDoneMessage(t *testing.T) {
 	mockChannel := new(MockChannelInterface)
@@ -131,22 +172,31 @@ func TestPublishDoneMessage(t *testing.T) {
 		false,
 		mock.MatchedBy(func(msg amqp.Publishing) bool {
 			// Verify message format
-			var message map[string]string
+			var message map[string]interface{}
 			err := json.Unmarshal(msg.Body, &message)
 			if err != nil {
 				return false
 			}
 
-			// Check if message has required fields
+			// Check if message has the version 1 fields
 			_, hasFilename := message["filename"]
 			_, hasStatus := message["status"]
 			_, hasTime := message["time"]
 
-			return hasFilename && hasStatus && hasTime
+			// Check the version 2 fields
+			files, hasFiles := message["files"].([]interface{})
+
+			return hasFilename && hasStatus && hasTime &&
+				message["version"] == float64(doneEventVersion) &&
+				message["torrentName"] == "test-file" &&
+				message["category"] == "test-category" &&
+				hasFiles && len(files) == 1
 		})).Return(nil)
 
 	// Test the function
-	err := publishDoneMessage(mockChannel, "test-file")
+	event := newDoneEvent(Message{TorrentName: "test-file", Category: "test-category"},
+		[]fileResult{{Path: "/test/test-file/movie.mkv", Outcome: fileSkipped, Skipped: true}})
+	err := publishDoneMessage(mockChannel, event)
 
 	// Verify results
 	assert.NoError(t, err)
@@ -197,21 +247,47 @@ func (m *MockDelivery) GetBody() []byte {
 
 // Test for rejectMessageToDLQ function
 func TestRejectMessageToDLQ(t *testing.T) {
+	dlqQueueName = "test-dlq"
+	ctx := withCorrelationID(context.Background(), "task-42")
+
+	// The message is published with its correlation ID and acknowledged
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("QueueDeclare", dlqQueueName, true, false, false, false, mock.Anything).
+		Return(amqp.Queue{Name: dlqQueueName}, nil)
+	mockChannel.On("Publish", "", dlqQueueName, false, false,
+		mock.MatchedBy(func(msg amqp.Publishing) bool {
+			var dlqMessage map[string]interface{}
+			if err := json.Unmarshal(msg.Body, &dlqMessage); err != nil {
+				return false
+			}
+			return msg.CorrelationId == "task-42" && dlqMessage["originalMessage"] == "test message" &&
+				dlqMessage["errorReason"] == "test reason"
+		})).Return(nil)
 	mockDelivery := new(MockDelivery)
+	mockDelivery.On("Ack", false).Return(nil)
+
+	err := rejectMessageToDLQ(ctx, mockChannel, mockDelivery, []byte("test message"), "test reason")
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+	mockDelivery.AssertExpectations(t)
 
-	// Mock the Reject method
+	// The message is rejected through the DLX when publishing fails
+	mockChannel = new(MockChannelInterface)
+	mockChannel.On("QueueDeclare", dlqQueueName, true, false, false, false, mock.Anything).
+		Return(amqp.Queue{}, errors.New("channel closed"))
+	mockDelivery = new(MockDelivery)
 	mockDelivery.On("Reject", false).Return(nil)
 
-	// Test successful rejection
-	err := rejectMessageToDLQ(mockDelivery, "test reason")
+	err = rejectMessageToDLQ(ctx, mockChannel, mockDelivery, []byte("test message"), "test reason")
 	assert.NoError(t, err)
 	mockDelivery.AssertExpectations(t)
+	mockDelivery.AssertNotCalled(t, "Ack", mock.Anything)
 
 	// Test with rejection error
 	mockDelivery = new(MockDelivery)
 	mockDelivery.On("Reject", false).Return(errors.New("rejection error"))
 
-	err = rejectMessageToDLQ(mockDelivery, "test reason")
+	err = rejectMessageToDLQ(ctx, mockChannel, mockDelivery, []byte("test message"), "test reason")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to reject message")
 	mockDelivery.AssertExpectations(t)
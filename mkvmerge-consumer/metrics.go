@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes the name of every consumer metric
+const metricsNamespace = "mkvmerge_consumer"
+
+// Outcomes of a message counted by messagesTotal
+const (
+	outcomeProcessed    = "processed"     // acknowledged after processing
+	outcomeRejected     = "rejected"      // rejected to the DLQ through the DLX
+	outcomeRetried      = "retried"       // scheduled for a delayed retry
+	outcomeDeadLettered = "dead_lettered" // published to the DLQ after the last retry
+)
+
+// metricsRegistry holds the metrics served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	messagesTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_total",
+		Help:      "Messages handled, by outcome.",
+	}, []string{"outcome"})
+
+	messageTimeoutsTotal = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "message_timeouts_total",
+		Help:      "Messages that exceeded their category timeout.",
+	})
+
+	filesTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_total",
+		Help:      "Files handled, by outcome.",
+	}, []string{"outcome"})
+
+	toolDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tool_duration_seconds",
+		Help:      "Duration of MKVToolNix and ffmpeg runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14), // 0.5s to about 68m
+	}, []string{"tool"})
+
+	bytesSavedTotal = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_saved_total",
+		Help:      "Bytes freed by processing files.",
+	})
+
+	queueMessages = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_messages",
+		Help:      "Messages ready in each queue.",
+	}, []string{"queue"})
+
+	brokerConnected = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "broker_connected",
+		Help:      "Whether the consumer is connected to RabbitMQ.",
+	})
+
+	configReloadsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// recordFileResult counts a processed file and the space it freed
+func recordFileResult(result fileResult) {
+	filesTotal.WithLabelValues(string(result.Outcome)).Inc()
+	if result.Outcome == fileProcessed && result.SizeBefore > result.SizeAfter {
+		bytesSavedTotal.Add(float64(result.SizeBefore - result.SizeAfter))
+	}
+}
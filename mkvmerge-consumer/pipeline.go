@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"mkvmerge-consumer/config"
+)
+
+// mediaFile is the file a pipeline works on. Steps update it as they go so
+// the following steps see the current path and tracks.
+type mediaFile struct {
+	Path   string
+	Info   mkvInfo
+	Result *fileResult
+}
+
+// Step is a single operation of the processing pipeline. Run reports
+// whether the step changed anything.
+type Step interface {
+	Name() string
+	Run(ctx context.Context, f *mediaFile) (bool, error)
+}
+
+// pipeline is the ordered list of steps applied to every file of a
+// category, together with the backend reading and remuxing the files
+type pipeline struct {
+	backend Backend
+	steps   []Step
+}
+
+// newPipeline builds the backend and the steps configured for a category
+func newPipeline(policy config.CategoryPolicy) (pipeline, error) {
+	backend := newBackend(policy)
+	steps := make([]Step, 0, len(policy.Pipeline))
+	for _, stepConfig := range policy.Pipeline {
+		var step Step
+		switch stepConfig.Step {
+		case config.StepStripTracks:
+			step = stripTracksStep{policy: policy.Languages, backend: backend, convert: policy.ConvertToMKV}
+		case config.StepDefaultFlags:
+			step = defaultFlagsStep{audio: stepConfig.Audio, subtitles: stepConfig.Subtitles}
+		case config.StepRename:
+			rename, err := newRenameStep(stepConfig.Pattern)
+			if err != nil {
+				return pipeline{}, err
+			}
+			step = rename
+		case config.StepExtractSubtitles:
+			step = extractSubtitlesStep{languages: stepConfig.Languages}
+		case config.StepMetadata:
+			step = metadataStep{title: stepConfig.Title, chapterInterval: stepConfig.ChapterInterval}
+		default:
+			return pipeline{}, fmt.Errorf("unknown pipeline step %q", stepConfig.Step)
+		}
+		steps = append(steps, step)
+	}
+	return pipeline{backend: backend, steps: steps}, nil
+}
+
+// checkPipelines builds the pipeline of every policy so that mistakes such as
+// an invalid rename pattern are reported at startup
+func checkPipelines(c *config.Config) error {
+	if _, err := newPipeline(c.Policy.Default); err != nil {
+		return fmt.Errorf("policy \"default\": %w", err)
+	}
+	for category, policy := range c.Policy.Categories {
+		if _, err := newPipeline(policy); err != nil {
+			return fmt.Errorf("policy %q: %w", category, err)
+		}
+	}
+	return nil
+}
+
+// process runs every step on a single file and reports what was done. The
+// file is skipped when no step changes anything.
+func (p pipeline) process(ctx context.Context, path string) (result fileResult) {
+	logger := loggerFrom(ctx).With("file", path)
+	logger.Info("Processing file")
+
+	start := time.Now()
+	result = fileResult{Path: path, Outcome: fileFailed}
+	defer func() {
+		result.DurationMs = time.Since(start).Milliseconds()
+		recordFileResult(result)
+	}()
+
+	if info, err := statFunc(path); err != nil {
+		logger.Warn("Error reading file size", "error", err)
+	} else {
+		result.SizeBefore = info.Size()
+	}
+
+	// Get track information from the backend
+	info, err := p.backend.Identify(ctx, path)
+	if err != nil {
+		logger.Error("Error reading file", "error", err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Kept = summarizeTracks(info.Tracks)
+
+	f := &mediaFile{Path: path, Info: info, Result: &result}
+	for _, step := range p.steps {
+		changed, err := step.Run(ctx, f)
+		if err != nil {
+			logger.Error("Step failed", "step", step.Name(), "error", err)
+			result.Error = fmt.Sprintf("%s: %v", step.Name(), err)
+			return result
+		}
+		if changed {
+			result.Steps = append(result.Steps, step.Name())
+		}
+	}
+
+	if len(result.Steps) == 0 {
+		logger.Info("Nothing to change, skipping")
+		result.Outcome = fileSkipped
+		result.Skipped = true
+		result.SizeAfter = result.SizeBefore
+		return result
+	}
+
+	if f.Path != path {
+		result.RenamedTo = f.Path
+	}
+	if info, err := statFunc(f.Path); err != nil {
+		logger.Warn("Error reading file size", "path", f.Path, "error", err)
+	} else {
+		result.SizeAfter = info.Size()
+	}
+
+	logger.Info("Successfully processed file", "steps", result.Steps)
+	result.Outcome = fileProcessed
+	return result
+}
+
+// identify reads the track information of a file with mkvmerge -J
+func identify(ctx context.Context, path string) (mkvInfo, error) {
+	output, err := execCommand(ctx, "mkvmerge", "-J", path).Output()
+	if err != nil {
+		return mkvInfo{}, fmt.Errorf("failed to get track info: %v", err)
+	}
+
+	var info mkvInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return mkvInfo{}, fmt.Errorf("failed to parse track info: %v", err)
+	}
+	return info, nil
+}
+
+// runMkvtoolnix runs one of the MKVToolNix tools on f. Exit code 1 only
+// signals warnings, which are recorded on the file result.
+func runMkvtoolnix(ctx context.Context, f *mediaFile, name string, args ...string) error {
+	logger := loggerFrom(ctx).With("tool", name, "file", f.Path)
+	logger.Info("Running tool", "args", args)
+	start := time.Now()
+	output, err := execCommand(ctx, name, args...).CombinedOutput()
+	toolDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	// The context kills the tool on timeout
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s was cancelled: %w", name, ctx.Err())
+	}
+
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			logger.Warn("Tool completed with warnings", "output", string(output))
+			f.Result.Warnings = append(f.Result.Warnings, mkvmergeWarnings(output)...)
+			return nil
+		}
+		logger.Error("Tool failed", "output", string(output))
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+
+	logger.Info("Tool completed successfully")
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// setupPipelineTest replaces the file system and command seams for a test
+func setupPipelineTest(t *testing.T) (*MockCmd, *MockFileSystem) {
+	mockCmd := new(MockCmd)
+	mockFS := new(MockFileSystem)
+
+	origExec := execCommand
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		return mockExecCommand(ctx, mockCmd, command, args...)
+	}
+	statFunc = mockFS.Stat
+	renameFunc = mockFS.Rename
+	removeFunc = mockFS.Remove
+	diskFreeFunc = func(string) (uint64, error) { return 1 << 40, nil }
+
+	t.Cleanup(func() {
+		execCommand = origExec
+		statFunc = os.Stat
+		renameFunc = os.Rename
+		removeFunc = os.Remove
+		writeFileFunc = os.WriteFile
+		diskFreeFunc = diskFree
+	})
+	return mockCmd, mockFS
+}
+
+// newMediaFile returns a media file with the given tracks
+func newMediaFile(path string, tracks ...mkvTrack) *mediaFile {
+	return &mediaFile{
+		Path:   path,
+		Info:   mkvInfo{Tracks: tracks},
+		Result: &fileResult{Path: path},
+	}
+}
+
+// Test for newPipeline building the configured steps
+func TestNewPipeline(t *testing.T) {
+	policy := config.DefaultCategoryPolicy()
+	policy.Pipeline = []config.StepConfig{
+		{Step: config.StepStripTracks},
+		{Step: config.StepDefaultFlags, Audio: "eng"},
+		{Step: config.StepRename},
+		{Step: config.StepExtractSubtitles},
+		{Step: config.StepMetadata, Title: true},
+	}
+
+	steps, err := newPipeline(policy)
+
+	assert.NoError(t, err)
+	var names []string
+	assert.Equal(t, "mkvmerge", steps.backend.Name())
+	for _, step := range steps.steps {
+		names = append(names, step.Name())
+	}
+	assert.Equal(t, []string{"strip_tracks", "default_flags", "rename", "extract_subtitles", "metadata"}, names)
+}
+
+// Test that invalid steps and rename patterns are reported
+func TestNewPipelineErrors(t *testing.T) {
+	policy := config.DefaultCategoryPolicy()
+
+	policy.Pipeline = []config.StepConfig{{Step: "transcode"}}
+	_, err := newPipeline(policy)
+	assert.EqualError(t, err, `unknown pipeline step "transcode"`)
+
+	policy.Pipeline = []config.StepConfig{{Step: config.StepRename, Pattern: "{{.Title"}}
+	_, err = newPipeline(policy)
+	assert.ErrorContains(t, err, "invalid rename pattern")
+
+	policy.Pipeline = []config.StepConfig{{Step: config.StepRename, Pattern: "{{.Show}}"}}
+	_, err = newPipeline(policy)
+	assert.ErrorContains(t, err, "invalid rename pattern")
+
+	cfg := &config.Config{Policy: config.PolicyConfig{
+		Default:    config.DefaultCategoryPolicy(),
+		Categories: map[string]config.CategoryPolicy{"local-movies": policy},
+	}}
+	assert.ErrorContains(t, checkPipelines(cfg), `policy "local-movies"`)
+}
+
+// Test that a file nothing changes is reported as skipped
+func TestPipelineSkipsUnchangedFile(t *testing.T) {
+	mockCmd, mockFS := setupPipelineTest(t)
+	mockFS.On("Stat", "/test/movie.mkv").Return(MockFileInfo{FileSize: 1000}, nil).Once()
+
+	// The canned file has English and Spanish audio, both are kept
+	policy := config.DefaultCategoryPolicy()
+	policy.Languages.Audio = []string{"eng", "spa"}
+	steps, err := newPipeline(policy)
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), "/test/movie.mkv")
+
+	assert.Equal(t, fileSkipped, result.Outcome)
+	assert.True(t, result.Skipped)
+	assert.Empty(t, result.Steps)
+	assert.Len(t, result.Kept, 4)
+	assert.Equal(t, int64(1000), result.SizeAfter)
+	assert.Equal(t, []string{"mkvmerge"}, mockCmd.Commands)
+	mockFS.AssertExpectations(t)
+}
+
+// Test that a failing step stops the pipeline and is reported
+func TestPipelineStepFailure(t *testing.T) {
+	_, mockFS := setupPipelineTest(t)
+	mockFS.On("Stat", "/test/movie.mkv").Return(MockFileInfo{}, nil).Once()
+	mockFS.On("Rename", "/test/.movie.mkv.tmp.mkv", "/test/movie.mkv").Return(fs.ErrPermission)
+	mockFS.On("Remove", "/test/.movie.mkv.tmp.mkv").Return(nil)
+
+	steps, err := newPipeline(config.DefaultCategoryPolicy())
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), "/test/movie.mkv")
+
+	assert.Equal(t, fileFailed, result.Outcome)
+	assert.Contains(t, result.Error, "strip_tracks: failed to replace original file")
+	mockFS.AssertExpectations(t)
+}
+
+// Test that default flags are only changed where needed
+func TestDefaultFlagsStep(t *testing.T) {
+	mockCmd, _ := setupPipelineTest(t)
+
+	video := newTrack(0, "video", "eng", false)
+	spanish := newTrack(1, "audio", "spa", false)
+	spanish.Properties.DefaultTrack = true
+	english := newTrack(2, "audio", "eng", false)
+	subtitles := newTrack(3, "subtitles", "eng", false)
+	subtitles.Properties.DefaultTrack = true
+	f := newMediaFile("/test/movie.mkv", video, spanish, english, subtitles)
+
+	step := defaultFlagsStep{audio: "eng", subtitles: defaultNone}
+	changed, err := step.Run(context.Background(), f)
+
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, [][]string{{"/test/movie.mkv",
+		"--edit", "track:2", "--set", "flag-default=0",
+		"--edit", "track:3", "--set", "flag-default=1",
+		"--edit", "track:4", "--set", "flag-default=0",
+	}}, mockCmd.Args)
+	assert.True(t, f.Info.Tracks[2].Properties.DefaultTrack)
+
+	// Running again has nothing left to change
+	changed, err = step.Run(context.Background(), f)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, mockCmd.Commands, 1)
+}
+
+// Test that a missing default language leaves the tracks alone
+func TestDefaultFlagsStepNoMatch(t *testing.T) {
+	mockCmd, _ := setupPipelineTest(t)
+	f := newMediaFile("/test/movie.mkv", newTrack(0, "video", "eng", false), newTrack(1, "audio", "spa", false))
+
+	changed, err := defaultFlagsStep{audio: "geo"}.Run(context.Background(), f)
+
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, mockCmd.Commands)
+}
+
+// Test for parseMediaName with common release names
+func TestParseMediaName(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     mediaName
+		title    string
+	}{
+		{"The.Matrix.1999.1080p.BluRay.x264-GRP.mkv", mediaName{Title: "The Matrix", Year: 1999}, "The Matrix (1999)"},
+		{"Show.Name.S01E02.720p.WEB-DL.mkv", mediaName{Title: "Show Name", Season: 1, Episode: 2}, "Show Name S01E02"},
+		{"Show Name (2019) - s02e10 - Episode.mkv", mediaName{Title: "Show Name", Year: 2019, Season: 2, Episode: 10}, "Show Name (2019) S02E10"},
+		{"Blade Runner 2049 (2017).mkv", mediaName{Title: "Blade Runner 2049", Year: 2017}, "Blade Runner 2049 (2017)"},
+		{"home_video.mkv", mediaName{Title: "home video"}, "home video"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			got := parseMediaName(test.filename)
+			assert.Equal(t, test.want, got)
+			assert.Equal(t, test.title, got.String())
+		})
+	}
+}
+
+// Test that the rename step renames within the directory
+func TestRenameStep(t *testing.T) {
+	_, mockFS := setupPipelineTest(t)
+	mockFS.On("Stat", "/test/The Matrix (1999).mkv").Return(MockFileInfo{}, fs.ErrNotExist)
+	mockFS.On("Rename", "/test/The.Matrix.1999.1080p.mkv", "/test/The Matrix (1999).mkv").Return(nil)
+
+	step, err := newRenameStep("")
+	assert.NoError(t, err)
+	f := newMediaFile("/test/The.Matrix.1999.1080p.mkv")
+
+	changed, err := step.Run(context.Background(), f)
+
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "/test/The Matrix (1999).mkv", f.Path)
+	mockFS.AssertExpectations(t)
+}
+
+// Test that the rename step never overwrites another file
+func TestRenameStepTargetExists(t *testing.T) {
+	_, mockFS := setupPipelineTest(t)
+	mockFS.On("Stat", "/test/Show - 1x02.mkv").Return(MockFileInfo{}, nil)
+
+	step, err := newRenameStep("{{.Title}} - {{.Season}}x{{pad .Episode}}")
+	assert.NoError(t, err)
+	f := newMediaFile("/test/Show.S01E02.mkv")
+
+	changed, err := step.Run(context.Background(), f)
+
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "/test/Show.S01E02.mkv", f.Path)
+	assert.Equal(t, []string{"not renamed, Show - 1x02.mkv already exists"}, f.Result.Warnings)
+	mockFS.AssertNotCalled(t, "Rename", mock.Anything, mock.Anything)
+}
+
+// Test that text subtitles are extracted to Jellyfin sidecar names
+func TestExtractSubtitlesStep(t *testing.T) {
+	mockCmd, mockFS := setupPipelineTest(t)
+
+	srt := func(id int, language string, forced bool) mkvTrack {
+		track := newTrack(id, "subtitles", language, forced)
+		track.Properties.CodecID = textSubtitleCodec
+		return track
+	}
+	pgs := newTrack(4, "subtitles", "eng", false)
+	pgs.Properties.CodecID = "S_HDMV/PGS"
+
+	f := newMediaFile("/test/Movie.mkv",
+		newTrack(0, "video", "eng", false), srt(1, "eng", false), srt(2, "eng", true), srt(3, "spa", false), pgs, srt(5, "eng", false))
+
+	mockFS.On("Stat", "/test/Movie.eng.srt").Return(MockFileInfo{}, fs.ErrNotExist)
+	mockFS.On("Stat", "/test/Movie.eng.forced.srt").Return(MockFileInfo{}, nil)
+	mockFS.On("Stat", "/test/Movie.eng.5.srt").Return(MockFileInfo{}, fs.ErrNotExist)
+
+	changed, err := extractSubtitlesStep{languages: []string{"eng"}}.Run(context.Background(), f)
+
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	// Spanish is not selected, PGS is not text and the forced sidecar exists
+	assert.Equal(t, [][]string{{"/test/Movie.mkv", "tracks", "1:/test/Movie.eng.srt", "5:/test/Movie.eng.5.srt"}}, mockCmd.Args)
+	assert.Equal(t, []string{"/test/Movie.eng.srt", "/test/Movie.eng.5.srt"}, f.Result.Sidecars)
+	mockFS.AssertExpectations(t)
+}
+
+// Test that the metadata step sets the title and adds chapters
+func TestMetadataStep(t *testing.T) {
+	mockCmd, mockFS := setupPipelineTest(t)
+
+	var chapters string
+	writeFileFunc = func(name string, data []byte, perm os.FileMode) error {
+		assert.Equal(t, "/test/.Movie.2024.mkv.chapters.txt", name)
+		chapters = string(data)
+		return nil
+	}
+	mockFS.On("Remove", "/test/.Movie.2024.mkv.chapters.txt").Return(nil).Once()
+
+	f := newMediaFile("/test/Movie.2024.mkv", newTrack(0, "video", "eng", false))
+	f.Info.Container.Properties.Duration = int64(25 * time.Minute)
+
+	step := metadataStep{title: true, chapterInterval: 10 * time.Minute}
+	changed, err := step.Run(context.Background(), f)
+
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, [][]string{{"/test/Movie.2024.mkv",
+		"--edit", "info", "--set", "title=Movie (2024)",
+		"--chapters", "/test/.Movie.2024.mkv.chapters.txt",
+	}}, mockCmd.Args)
+	assert.Equal(t, simpleChapters(25*time.Minute, 10*time.Minute), chapters)
+	mockFS.AssertExpectations(t)
+
+	// The title and chapters are in place now
+	changed, err = step.Run(context.Background(), f)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+}
+
+// Test for simpleChapters output
+func TestSimpleChapters(t *testing.T) {
+	assert.Equal(t,
+		"CHAPTER01=00:00:00.000\nCHAPTER01NAME=Chapter 1\n"+
+			"CHAPTER02=00:30:00.000\nCHAPTER02NAME=Chapter 2\n"+
+			"CHAPTER03=01:00:00.000\nCHAPTER03NAME=Chapter 3\n",
+		simpleChapters(75*time.Minute, 30*time.Minute))
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"mkvmerge-consumer/config"
+
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -17,13 +22,15 @@ import (
 )
 
 // Create a mock for exec.Command
-func mockExecCommand(mockCmd *MockCmd, command string, args ...string) *exec.Cmd {
+func mockExecCommand(ctx context.Context, mockCmd *MockCmd, command string, args ...string) *exec.Cmd {
 	cs := []string{"-test.run=TestHelperProcess", "--", command}
 	cs = append(cs, args...)
-	cmd := exec.Command(os.Args[0], cs...)
+	cmd := exec.CommandContext(ctx, os.Args[0], cs...)
 	cmd.Env = []string{
 		"GO_WANT_HELPER_PROCESS=1",
 	}
+	mockCmd.mu.Lock()
+	defer mockCmd.mu.Unlock()
 	mockCmd.Commands = append(mockCmd.Commands, command)
 	mockCmd.Args = append(mockCmd.Args, args)
 	return cmd
@@ -31,6 +38,7 @@ func mockExecCommand(mockCmd *MockCmd, command string, args ...string) *exec.Cmd
 
 // MockCmd stores the commands and arguments executed
 type MockCmd struct {
+	mu       sync.Mutex
 	Commands []string
 	Args     [][]string
 }
@@ -61,18 +69,33 @@ func TestHelperProcess(t *testing.T) {
 	cmd, args := args[0], args[1:]
 	switch cmd {
 	case "mkvmerge":
-		if args[0] == "-J" {
+		if args[0] == "-J" && strings.HasSuffix(args[1], ".tmp.mkv") {
+			// A remuxed copy holds the English tracks the default policy keeps
+			fmt.Println(`{
+				"tracks": [
+					{"id": 0, "type": "video", "properties": {"language": "eng"}},
+					{"id": 1, "type": "audio", "properties": {"language": "eng"}},
+					{"id": 2, "type": "subtitles", "properties": {"language": "eng"}}
+				]
+			}`)
+			os.Exit(0)
+		} else if args[0] == "-J" {
 			// Return mock track info JSON
 			fmt.Println(`{
 				"tracks": [
 					{"id": 0, "type": "video", "properties": {"language": "eng"}},
 					{"id": 1, "type": "audio", "properties": {"language": "eng"}},
-					{"id": 2, "type": "audio", "properties": {"language": "spa"}},
+					{"id": 2, "type": "audio", "properties": {"language": "spa", "tag_number_of_bytes": "500000000"}},
 					{"id": 3, "type": "subtitles", "properties": {"language": "eng"}}
 				]
 			}`)
 			os.Exit(0)
 		} else if args[0] == "-o" {
+			// Simulate an mkvmerge run that never finishes
+			if strings.Contains(args[1], "hang") {
+				time.Sleep(time.Minute)
+			}
+
 			// Simulate successful mkvmerge execution
 			// Create an empty output file to simulate success
 			file, err := os.Create(args[1])
@@ -84,6 +107,42 @@ func TestHelperProcess(t *testing.T) {
 			fmt.Println("Created mock output file")
 			os.Exit(0)
 		}
+	case "ffprobe":
+		path := args[len(args)-1]
+		if strings.Contains(filepath.Base(path), ".tmp.") {
+			// A copy holds the English streams the default policy keeps
+			fmt.Println(`{
+				"streams": [
+					{"index": 0, "codec_type": "video", "codec_name": "h264"},
+					{"index": 1, "codec_type": "audio", "codec_name": "aac", "tags": {"language": "eng"}},
+					{"index": 2, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng"}}
+				],
+				"format": {"duration": "5400.000000"}
+			}`)
+			os.Exit(0)
+		}
+		fmt.Println(`{
+			"streams": [
+				{"index": 0, "codec_type": "video", "codec_name": "h264", "disposition": {"default": 1}},
+				{"index": 1, "codec_type": "audio", "codec_name": "aac", "tags": {"language": "eng"}, "disposition": {"default": 1}},
+				{"index": 2, "codec_type": "audio", "codec_name": "aac", "bit_rate": "128000", "tags": {"language": "spa"}},
+				{"index": 3, "codec_type": "subtitle", "codec_name": "mov_text", "tags": {"language": "eng"}},
+				{"index": 4, "codec_type": "data", "codec_name": "bin_data"}
+			],
+			"format": {"duration": "5400.000000", "tags": {"title": "Movie"}},
+			"chapters": [{"id": 0}, {"id": 1}]
+		}`)
+		os.Exit(0)
+	case "ffmpeg":
+		// Write an empty copy to the output, the last argument, when its
+		// directory exists
+		if file, err := os.Create(args[len(args)-1]); err == nil {
+			file.Close()
+		}
+		os.Exit(0)
+	case "mkvpropedit", "mkvextract":
+		// Simulate tools that edit or extract in place
+		os.Exit(0)
 	default:
 		fmt.Fprintf(os.Stderr, "Unrecognized command: %s\n", cmd)
 		os.Exit(2)
@@ -139,7 +198,7 @@ type ProcessMessageTestSuite struct {
 	mockChannel *MockChannelInterface
 	mockFS      *MockFileSystem
 	mockCmd     *MockCmd
-	origExec    func(string, ...string) *exec.Cmd
+	origExec    func(context.Context, string, ...string) *exec.Cmd
 }
 
 func (suite *ProcessMessageTestSuite) SetupTest() {
@@ -154,6 +213,7 @@ func (suite *ProcessMessageTestSuite) SetupTest() {
 	queueName = "test-queue"
 	doneQueueName = "test-done"
 	dlqQueueName = "test-dlq"
+	retryPolicy = config.DefaultRetryConfig()
 
 	// Mock os.Stat
 	statFunc = suite.mockFS.Stat
@@ -167,10 +227,13 @@ func (suite *ProcessMessageTestSuite) SetupTest() {
 	// Mock os.Remove
 	removeFunc = suite.mockFS.Remove
 
+	// Report plenty of free space
+	diskFreeFunc = func(string) (uint64, error) { return 1 << 40, nil }
+
 	// Store original exec.Command and replace with mock
 	suite.origExec = execCommand
-	execCommand = func(command string, args ...string) *exec.Cmd {
-		return mockExecCommand(suite.mockCmd, command, args...)
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		return mockExecCommand(ctx, suite.mockCmd, command, args...)
 	}
 }
 
@@ -181,6 +244,35 @@ func (suite *ProcessMessageTestSuite) TearDownTest() {
 	walkFunc = filepath.Walk
 	renameFunc = os.Rename
 	removeFunc = os.Remove
+	diskFreeFunc = diskFree
+}
+
+// Test that a dry run reports the files and acknowledges without changing them
+func (suite *ProcessMessageTestSuite) TestProcessMessageDryRun() {
+	dryRun = true
+	defer func() { dryRun = false }()
+
+	body, err := json.Marshal(Message{TorrentName: "test-movie", Category: "test-category"})
+	assert.NoError(suite.T(), err)
+
+	suite.mockFS.On("Stat", "/test/path/test-movie").Return(MockFileInfo{FileName: "test-movie", FileIsDir: true}, nil)
+	suite.mockFS.On("Walk", "/test/path/test-movie", mock.AnythingOfType("filepath.WalkFunc")).Return(nil).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(filepath.WalkFunc)
+		fn("/test/path/test-movie/movie.mkv", MockFileInfo{FileName: "movie.mkv"}, nil)
+	})
+	suite.mockFS.On("Stat", "/test/path/test-movie/movie.mkv").Return(MockFileInfo{FileName: "movie.mkv", FileSize: 3000}, nil)
+
+	mockAcker := new(MockDelivery)
+	mockAcker.On("Ack", false).Return(nil)
+
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
+
+	// Only the tracks were read, nothing was remuxed, renamed or published
+	assert.Equal(suite.T(), []string{"mkvmerge"}, suite.mockCmd.Commands)
+	assert.Equal(suite.T(), "-J", suite.mockCmd.Args[0][0])
+	suite.mockFS.AssertNotCalled(suite.T(), "Rename", mock.Anything, mock.Anything)
+	suite.mockChannel.AssertNotCalled(suite.T(), "Publish", "", "test-done", mock.Anything, mock.Anything, mock.Anything)
+	mockAcker.AssertExpectations(suite.T())
 }
 
 // Test processing a valid message
@@ -215,6 +307,10 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageSuccess() {
 		fn("/test/path/test-movie/movie.mkv", mkvInfo, nil)
 	})
 
+	// Mock os.Stat for the file size before and after the remux
+	suite.mockFS.On("Stat", "/test/path/test-movie/movie.mkv").Return(MockFileInfo{FileName: "movie.mkv", FileSize: 3000}, nil).Once()
+	suite.mockFS.On("Stat", "/test/path/test-movie/movie.mkv").Return(MockFileInfo{FileName: "movie.mkv", FileSize: 2000}, nil).Once()
+
 	// Mock os.Rename to simulate successful file replacement
 	suite.mockFS.On("Rename", "/test/path/test-movie/.movie.mkv.tmp.mkv", "/test/path/test-movie/movie.mkv").Return(nil)
 
@@ -225,9 +321,27 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageSuccess() {
 		false,
 		false,
 		mock.MatchedBy(func(msg amqp.Publishing) bool {
-			var message map[string]string
-			err := json.Unmarshal(msg.Body, &message)
-			return err == nil && message["filename"] == "test-movie"
+			var event doneEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				return false
+			}
+			if event.Filename != "test-movie" || event.TorrentName != "test-movie" ||
+				event.Category != "test-category" || event.Version != doneEventVersion || len(event.Files) != 1 {
+				return false
+			}
+
+			// The correlation ID of the task is passed on
+			if event.CorrelationID != "task-42" || msg.CorrelationId != "task-42" {
+				return false
+			}
+
+			// The Spanish audio track is removed, everything else is kept
+			file := event.Files[0]
+			return file.Path == "/test/path/test-movie/movie.mkv" &&
+				file.Outcome == fileProcessed && !file.Skipped &&
+				file.SizeBefore == 3000 && file.SizeAfter == 2000 &&
+				len(file.Kept) == 3 &&
+				assert.ObjectsAreEqual([]trackSummary{{ID: 2, Type: "audio", Language: "spa"}}, file.Removed)
 		})).Return(nil)
 
 	// Set up the mock delivery to expect Ack
@@ -235,7 +349,8 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageSuccess() {
 	mockAcker.On("Ack", false).Return(nil)
 
 	// Process the message
-	processMessage(suite.mockChannel, mockAcker, body)
+	ctx := withCorrelationID(context.Background(), "task-42")
+	processMessage(ctx, suite.mockChannel, mockAcker, body, nil)
 
 	// Verify expectations
 	suite.mockFS.AssertExpectations(suite.T())
@@ -243,20 +358,39 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageSuccess() {
 	mockAcker.AssertExpectations(suite.T())
 }
 
+// expectDeadLetter expects body to be published to the DLQ in an envelope
+// with a reason containing reason
+func (suite *ProcessMessageTestSuite) expectDeadLetter(body []byte, reason string) {
+	suite.mockChannel.On("QueueDeclare", "test-dlq", true, false, false, false, mock.Anything).
+		Return(amqp.Queue{Name: "test-dlq"}, nil)
+	suite.mockChannel.On("Publish", "", "test-dlq", false, false,
+		mock.MatchedBy(func(msg amqp.Publishing) bool {
+			var envelope dlqEnvelope
+			if err := json.Unmarshal(msg.Body, &envelope); err != nil {
+				return false
+			}
+			return envelope.OriginalMessage == string(body) && strings.Contains(envelope.ErrorReason, reason) &&
+				msg.CorrelationId != "" && envelope.CorrelationID == msg.CorrelationId
+		})).Return(nil).Once()
+}
+
 // Test processing a message with invalid JSON
 func (suite *ProcessMessageTestSuite) TestProcessMessageInvalidJSON() {
 	// Create invalid JSON
 	body := []byte(`{"torrentName": "test-movie", "category": "test-category"`) // Missing closing brace
 
-	// Set up the mock delivery to expect Reject
+	// The message goes to the DLQ with its correlation ID
+	suite.expectDeadLetter(body, "JSON parsing error")
 	mockAcker := new(MockDelivery)
-	mockAcker.On("Reject", false).Return(nil)
+	mockAcker.On("Ack", false).Return(nil)
 
 	// Process the message
-	processMessage(suite.mockChannel, mockAcker, body)
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
 
 	// Verify expectations
+	suite.mockChannel.AssertExpectations(suite.T())
 	mockAcker.AssertExpectations(suite.T())
+	mockAcker.AssertNotCalled(suite.T(), "Reject", mock.Anything)
 }
 
 // Test processing a message with unknown category
@@ -271,15 +405,18 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageUnknownCategory() {
 	body, err := json.Marshal(message)
 	assert.NoError(suite.T(), err)
 
-	// Set up the mock delivery to expect Reject
+	// The message goes to the DLQ with its correlation ID
+	suite.expectDeadLetter(body, "Unknown category: unknown-category")
 	mockAcker := new(MockDelivery)
-	mockAcker.On("Reject", false).Return(nil)
+	mockAcker.On("Ack", false).Return(nil)
 
 	// Process the message
-	processMessage(suite.mockChannel, mockAcker, body)
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
 
 	// Verify expectations
+	suite.mockChannel.AssertExpectations(suite.T())
 	mockAcker.AssertExpectations(suite.T())
+	mockAcker.AssertNotCalled(suite.T(), "Reject", mock.Anything)
 }
 
 // Test processing a message with non-existent folder
@@ -297,15 +434,70 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageNonExistentFolder() {
 	// Mock os.Stat to return error
 	suite.mockFS.On("Stat", "/test/path/test-movie").Return(MockFileInfo{}, fs.ErrNotExist)
 
-	// Set up the mock delivery to expect Reject
+	// The folder may still be moving, so the message goes to the first retry queue
+	suite.mockChannel.On("Publish", "", "test-queue.retry.60s", false, false,
+		mock.MatchedBy(func(msg amqp.Publishing) bool {
+			return string(msg.Body) == string(body) && msg.Headers[retryCountHeader] == int32(1)
+		})).Return(nil).Once()
+
+	// Set up the mock delivery to expect Ack
 	mockAcker := new(MockDelivery)
-	mockAcker.On("Reject", false).Return(nil)
+	mockAcker.On("Ack", false).Return(nil)
 
 	// Process the message
-	processMessage(suite.mockChannel, mockAcker, body)
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
 
 	// Verify expectations
 	suite.mockFS.AssertExpectations(suite.T())
+	suite.mockChannel.AssertExpectations(suite.T())
+	mockAcker.AssertExpectations(suite.T())
+	mockAcker.AssertNotCalled(suite.T(), "Reject", mock.Anything)
+}
+
+// Test that a message is dead-lettered with its history once the retries run out
+func (suite *ProcessMessageTestSuite) TestProcessMessageRetriesExhausted() {
+	message := Message{
+		TorrentName: "test-movie",
+		Category:    "test-category",
+	}
+	body, err := json.Marshal(message)
+	assert.NoError(suite.T(), err)
+
+	suite.mockFS.On("Stat", "/test/path/test-movie").Return(MockFileInfo{}, fs.ErrNotExist)
+
+	// The message has already been retried three times
+	headers := amqp.Table{
+		retryCountHeader: int32(3),
+		retryHistoryHeader: []interface{}{
+			amqp.Table{"attempt": int32(1), "reason": "first", "time": "t1"},
+			amqp.Table{"attempt": int32(2), "reason": "second", "time": "t2"},
+			amqp.Table{"attempt": int32(3), "reason": "third", "time": "t3"},
+		},
+	}
+
+	suite.mockChannel.On("QueueDeclare", "test-dlq", true, false, false, false, mock.Anything).
+		Return(amqp.Queue{Name: "test-dlq"}, nil)
+	suite.mockChannel.On("Publish", "", "test-dlq", false, false,
+		mock.MatchedBy(func(msg amqp.Publishing) bool {
+			var dlqMessage struct {
+				Attempts int            `json:"attempts"`
+				History  []retryAttempt `json:"history"`
+			}
+			if err := json.Unmarshal(msg.Body, &dlqMessage); err != nil {
+				return false
+			}
+			return dlqMessage.Attempts == 4 && len(dlqMessage.History) == 4 &&
+				dlqMessage.History[0].Reason == "first" &&
+				dlqMessage.History[3].Attempt == 4 &&
+				dlqMessage.History[3].Reason == "Folder does not exist: /test/path/test-movie"
+		})).Return(nil).Once()
+
+	mockAcker := new(MockDelivery)
+	mockAcker.On("Ack", false).Return(nil)
+
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, headers)
+
+	suite.mockChannel.AssertExpectations(suite.T())
 	mockAcker.AssertExpectations(suite.T())
 }
 
@@ -336,13 +528,92 @@ func (suite *ProcessMessageTestSuite) TestProcessMessageNoMKVFiles() {
 	mockAcker.On("Ack", false).Return(nil)
 
 	// Process the message
-	processMessage(suite.mockChannel, mockAcker, body)
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
 
 	// Verify expectations
 	suite.mockFS.AssertExpectations(suite.T())
 	mockAcker.AssertExpectations(suite.T())
 }
 
+// Test processing a season pack with several files remuxed at once
+func (suite *ProcessMessageTestSuite) TestProcessMessageConcurrentFiles() {
+	origSlots := mkvmergeSlots
+	mkvmergeSlots = make(chan struct{}, 3)
+	defer func() { mkvmergeSlots = origSlots }()
+
+	message := Message{
+		TorrentName: "test-show",
+		Category:    "test-category",
+	}
+	body, err := json.Marshal(message)
+	assert.NoError(suite.T(), err)
+
+	suite.mockFS.On("Stat", "/test/path/test-show").Return(MockFileInfo{FileName: "test-show", FileIsDir: true}, nil)
+
+	episodes := []string{"e01.mkv", "e02.mkv", "e03.mkv", "e04.mkv"}
+	suite.mockFS.On("Walk", "/test/path/test-show", mock.AnythingOfType("filepath.WalkFunc")).Return(nil).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(filepath.WalkFunc)
+		for _, episode := range episodes {
+			fn("/test/path/test-show/"+episode, MockFileInfo{FileName: episode}, nil)
+		}
+	})
+	for _, episode := range episodes {
+		suite.mockFS.On("Stat", "/test/path/test-show/"+episode).Return(MockFileInfo{FileName: episode}, nil).Twice()
+		suite.mockFS.On("Rename", "/test/path/test-show/."+episode+".tmp.mkv", "/test/path/test-show/"+episode).Return(nil).Once()
+	}
+
+	// A single completion message and a single ack for the whole torrent
+	suite.mockChannel.On("Publish", "", "test-done", false, false, mock.Anything).Return(nil).Once()
+	mockAcker := new(MockDelivery)
+	mockAcker.On("Ack", false).Return(nil).Once()
+
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
+
+	suite.mockFS.AssertExpectations(suite.T())
+	suite.mockChannel.AssertExpectations(suite.T())
+	mockAcker.AssertExpectations(suite.T())
+	// Every file is identified, remuxed and identified again
+	assert.Len(suite.T(), suite.mockCmd.Commands, 3*len(episodes))
+}
+
+// Test that a timed-out mkvmerge run is killed, cleaned up and rejected once
+func (suite *ProcessMessageTestSuite) TestProcessMessageTimeout() {
+	origPolicy := defaultPolicy
+	defaultPolicy.Timeout = 2 * time.Second
+	defer func() { defaultPolicy = origPolicy }()
+
+	message := Message{
+		TorrentName: "test-movie",
+		Category:    "test-category",
+	}
+	body, err := json.Marshal(message)
+	assert.NoError(suite.T(), err)
+
+	suite.mockFS.On("Stat", "/test/path/test-movie").Return(MockFileInfo{FileName: "test-movie", FileIsDir: true}, nil)
+	suite.mockFS.On("Walk", "/test/path/test-movie", mock.AnythingOfType("filepath.WalkFunc")).Return(nil).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(filepath.WalkFunc)
+		fn("/test/path/test-movie/hang.mkv", MockFileInfo{FileName: "hang.mkv"}, nil)
+	})
+
+	suite.mockFS.On("Stat", "/test/path/test-movie/hang.mkv").Return(MockFileInfo{FileName: "hang.mkv"}, nil).Once()
+
+	// The partial output is removed and the original is never replaced
+	suite.mockFS.On("Remove", "/test/path/test-movie/.hang.mkv.tmp.mkv").Return(nil).Once()
+
+	suite.expectDeadLetter(body, "Processing timed out")
+	mockAcker := new(MockDelivery)
+	mockAcker.On("Ack", false).Return(nil).Once()
+
+	started := time.Now()
+	processMessage(context.Background(), suite.mockChannel, mockAcker, body, nil)
+
+	assert.Less(suite.T(), time.Since(started), 30*time.Second, "mkvmerge should have been killed")
+	suite.mockFS.AssertExpectations(suite.T())
+	suite.mockFS.AssertNotCalled(suite.T(), "Rename", mock.Anything, mock.Anything)
+	suite.mockChannel.AssertNotCalled(suite.T(), "Publish", "", "test-done", mock.Anything, mock.Anything, mock.Anything)
+	mockAcker.AssertExpectations(suite.T())
+}
+
 func TestProcessMessageSuite(t *testing.T) {
 	suite.Run(t, new(ProcessMessageTestSuite))
 }
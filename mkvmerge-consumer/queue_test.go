@@ -59,164 +59,71 @@ func TestEnsureMainQueueWithDLX(t *testing.T) {
 		mock.Anything).Return(nil)
 
 	// Call the function being tested
-	result := ensureMainQueueWithDLX(mockChannel)
+	result, err := ensureMainQueueWithDLX(mockChannel, nil)
 
 	// Verify results
+	assert.NoError(t, err)
 	assert.Equal(t, expectedQueue, result)
 	mockChannel.AssertExpectations(t)
 }
 
-// Test for ensureMainQueueWithDLX when queue exists with different configuration
-func TestEnsureMainQueueWithDLXExistingQueueError(t *testing.T) {
-	// Setup global variables for test
+// outdatedQueueChannel returns a mock channel on which declaring the main
+// queue fails with inequivalent arguments, closing the channel
+func outdatedQueueChannel() *MockChannelInterface {
 	queueName = "test-queue"
 	dlqQueueName = "test-dlq"
 
-	// Create a mock channel
 	mockChannel := new(MockChannelInterface)
-
-	// Set up expectations for DLX exchange declaration
-	mockChannel.On("ExchangeDeclare",
-		"dlx",
-		"direct",
-		true,
-		false,
-		false,
-		false,
-		mock.Anything).Return(nil)
-
-	// First queue declare returns an error indicating inequivalent arguments
-	preconditionErr := &amqp.Error{
-		Code:   406,
-		Reason: "PRECONDITION_FAILED",
-	}
-	mockChannel.On("QueueDeclare",
-		queueName,
-		true,
-		false,
-		false,
-		false,
+	mockChannel.On("ExchangeDeclare", "dlx", "direct", true, false, false, false, mock.Anything).Return(nil)
+	mockChannel.On("QueueDeclare", queueName, true, false, false, false,
 		mock.MatchedBy(func(args amqp.Table) bool {
 			dlx, hasDLX := args["x-dead-letter-exchange"].(string)
 			routingKey, hasRoutingKey := args["x-dead-letter-routing-key"].(string)
 			return hasDLX && dlx == "dlx" && hasRoutingKey && routingKey == dlqQueueName
-		})).Return(amqp.Queue{}, preconditionErr).Once()
+		})).Return(amqp.Queue{}, &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED"}).Once()
+	return mockChannel
+}
 
-	// QueueDelete attempt
-	mockChannel.On("QueueDelete",
-		queueName,
-		false,
-		false,
-		false).Return(0, nil)
+// Test for ensureMainQueueWithDLX when queue exists with different configuration
+func TestEnsureMainQueueWithDLXExistingQueueError(t *testing.T) {
+	mockChannel := outdatedQueueChannel()
 
-	// Second queue declare succeeds after deletion
-	expectedQueue := amqp.Queue{Name: queueName}
-	mockChannel.On("QueueDeclare",
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		mock.MatchedBy(func(args amqp.Table) bool {
-			dlx, hasDLX := args["x-dead-letter-exchange"].(string)
-			routingKey, hasRoutingKey := args["x-dead-letter-routing-key"].(string)
-			return hasDLX && dlx == "dlx" && hasRoutingKey && routingKey == dlqQueueName
-		})).Return(expectedQueue, nil).Once()
+	// The empty queue is deleted and declared again on a new channel
+	newChannel := new(MockChannelInterface)
+	newChannel.On("QueueDelete", queueName, false, true, false).Return(0, nil).Once()
+	newChannel.On("QueueDeclare", queueName, true, false, false, false, mock.Anything).
+		Return(amqp.Queue{Name: queueName}, nil).Once()
+	newChannel.On("Close").Return(nil).Once()
 
-	// Set up expectations for DLQ declaration
-	mockChannel.On("QueueDeclare",
-		dlqQueueName,
-		true,
-		false,
-		false,
-		false,
-		mock.Anything).Return(amqp.Queue{Name: dlqQueueName}, nil)
+	_, err := ensureMainQueueWithDLX(mockChannel, func() (ChannelInterface, error) { return newChannel, nil })
 
-	// Set up expectations for binding DLQ to DLX
-	mockChannel.On("QueueBind",
-		dlqQueueName,
-		dlqQueueName,
-		"dlx",
-		false,
-		mock.Anything).Return(nil)
-
-	// Call the function being tested
-	result := ensureMainQueueWithDLX(mockChannel)
-
-	// Verify results
-	assert.Equal(t, expectedQueue, result)
+	// The topology has to be declared again, the first channel is closed
+	assert.ErrorIs(t, err, errQueueRecreated)
 	mockChannel.AssertExpectations(t)
+	newChannel.AssertExpectations(t)
+	mockChannel.AssertNotCalled(t, "QueueDelete", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
 }
 
 // Test for ensureMainQueueWithDLX when queue exists with different configuration and deletion fails
 func TestEnsureMainQueueWithDLXDeletionFailure(t *testing.T) {
-	// Skip the test for now as it's hard to mock os.Exit
-	t.Skip("Skipping test that involves os.Exit which can't be easily mocked in Go")
-
-	// Save original os.Exit and restore it after the test
-	originalOsExit := osExit
-	defer func() { osExit = originalOsExit }()
-
-	// Create a flag to track if our mock exit was called
-	exitCalled := false
-
-	// Mock os.Exit
-	osExit = func(code int) {
-		exitCalled = true
-		// Just return instead of actually exiting
-	}
-
-	// Setup global variables for test
-	queueName = "test-queue"
-	dlqQueueName = "test-dlq"
-
-	// Create a mock channel
-	mockChannel := new(MockChannelInterface)
-
-	// Set up expectations for DLX exchange declaration
-	mockChannel.On("ExchangeDeclare",
-		"dlx",
-		"direct",
-		true,
-		false,
-		false,
-		false,
-		mock.Anything).Return(nil)
-
-	// First queue declare returns an error indicating inequivalent arguments
-	preconditionErr := &amqp.Error{
-		Code:   406,
-		Reason: "PRECONDITION_FAILED",
-	}
-	mockChannel.On("QueueDeclare",
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		mock.MatchedBy(func(args amqp.Table) bool {
-			dlx, hasDLX := args["x-dead-letter-exchange"].(string)
-			routingKey, hasRoutingKey := args["x-dead-letter-routing-key"].(string)
-			return hasDLX && dlx == "dlx" && hasRoutingKey && routingKey == dlqQueueName
-		})).Return(amqp.Queue{}, preconditionErr).Once()
-
-	// QueueDelete attempt fails
-	deleteErr := &amqp.Error{
-		Code:   406,
-		Reason: "QUEUE_IN_USE",
-	}
-	mockChannel.On("QueueDelete",
-		queueName,
-		false,
-		false,
-		false).Return(0, deleteErr)
-
-	// Call the function
-	ensureMainQueueWithDLX(mockChannel)
-
-	// Verify our mock exit was called
-	assert.True(t, exitCalled, "os.Exit should have been called")
-
-	// Verify expectations
+	mockChannel := outdatedQueueChannel()
+	origPriorities := taskPriorities
+	taskPriorities.Max = 10
+	defer func() { taskPriorities = origPriorities }()
+
+	// The queue still holds tasks
+	newChannel := new(MockChannelInterface)
+	newChannel.On("QueueDelete", queueName, false, true, false).
+		Return(0, &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED - queue 'test-queue' in use"}).Once()
+	newChannel.On("Close").Return(nil).Once()
+
+	_, err := ensureMainQueueWithDLX(mockChannel, func() (ChannelInterface, error) { return newChannel, nil })
+
+	// The error is returned instead of exiting the process
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errQueueRecreated)
+	assert.Contains(t, err.Error(), "task queue 'test-queue'")
+	assert.Contains(t, err.Error(), "priority.max=10")
 	mockChannel.AssertExpectations(t)
+	newChannel.AssertExpectations(t)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"mkvmerge-consumer/config"
+)
+
+// reloadablePrefixes are the settings a reload applies while running.
+// Changing any other setting requires a restart.
+var reloadablePrefixes = []string{"paths.", "policy.", "safety.", "log.level"}
+
+// watchConfigFunc calls its argument whenever the config file changes
+var watchConfigFunc = config.Watch
+
+// watchReloads reloads the configuration on SIGHUP and whenever the config
+// file changes, until ctx is cancelled. current is the configuration in use
+// and onReload runs after every applied reload.
+func watchReloads(ctx context.Context, current *config.Config, onReload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	// Editors write a file in several steps, one pending reload is enough
+	changed := make(chan struct{}, 1)
+	if file := watchConfigFunc(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}); file != "" {
+		slog.Info("Watching for configuration changes", "file", file)
+	}
+
+	for {
+		select {
+		case <-signals:
+			slog.Info("Received SIGHUP, reloading configuration")
+		case <-changed:
+			slog.Info("Configuration file changed, reloading configuration")
+		case <-ctx.Done():
+			return
+		}
+		var applied bool
+		if current, applied = reloadConfig(current); applied && onReload != nil {
+			onReload()
+		}
+	}
+}
+
+// reloadConfig reads the configuration again and atomically replaces the
+// category paths, policies and safety checks, and sets the log level. Messages being processed
+// keep the policy they started with. An invalid configuration is rejected
+// and the current one kept. It returns the configuration now in use and
+// whether the reload was applied.
+func reloadConfig(current *config.Config) (*config.Config, bool) {
+	next, changes, err := config.Reload(current)
+	if err == nil {
+		err = checkPipelines(next)
+	}
+	if err != nil {
+		slog.Error("Rejected new configuration, keeping the current one", "error", err)
+		logChanges(changes)
+		configReloadsTotal.WithLabelValues("rejected").Inc()
+		return current, false
+	}
+
+	var reloadable, restart []string
+	for _, change := range changes {
+		if isReloadable(change) {
+			reloadable = append(reloadable, change)
+		} else {
+			restart = append(restart, change[:strings.Index(change, ":")])
+		}
+	}
+	if len(restart) > 0 {
+		slog.Warn("Changes take effect after a restart", "settings", strings.Join(restart, ", "))
+	}
+	if len(reloadable) == 0 {
+		slog.Info("No configuration changes to apply")
+		configReloadsTotal.WithLabelValues("unchanged").Inc()
+		return current, false
+	}
+	slog.Info("Applying new configuration")
+	logChanges(reloadable)
+
+	settingsMu.Lock()
+	CategoryPathMap = next.Paths.Categories
+	CategoryPolicyMap = next.Policy.Categories
+	defaultPolicy = next.Policy.Default
+	safetyPolicy = next.Safety
+	settingsMu.Unlock()
+	logLevel.Set(parseLogLevel(next.Log.Level))
+
+	// Keep the settings still in use so later reloads report them again
+	applied := *current
+	applied.Paths = next.Paths
+	applied.Policy = next.Policy
+	applied.Safety = next.Safety
+	applied.Log.Level = next.Log.Level
+
+	configReloadsTotal.WithLabelValues("applied").Inc()
+	return &applied, true
+}
+
+// isReloadable reports whether a change applies without a restart
+func isReloadable(change string) bool {
+	for _, prefix := range reloadablePrefixes {
+		if strings.HasPrefix(change, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// logChanges logs the changes of a configuration, one per line
+func logChanges(changes []string) {
+	for _, change := range changes {
+		slog.Info("Configuration change", "change", change)
+	}
+}
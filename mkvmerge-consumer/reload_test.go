@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reloadTestConfig is the configuration the reload tests start from
+const reloadTestConfig = `
+rabbitmq:
+  host: broker
+paths:
+  categories:
+    local-movies: /movies
+`
+
+// setupReloadTest loads reloadTestConfig from a temporary working directory
+// and returns the path of its config file
+func setupReloadTest(t *testing.T) (*config.Config, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(reloadTestConfig), 0o644))
+
+	oldwd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+
+	oldPaths, oldPolicies, oldDefault, oldSafety := CategoryPathMap, CategoryPolicyMap, defaultPolicy, safetyPolicy
+	t.Cleanup(func() {
+		os.Chdir(oldwd)
+		CategoryPathMap, CategoryPolicyMap, defaultPolicy, safetyPolicy = oldPaths, oldPolicies, oldDefault, oldSafety
+	})
+
+	current, err := config.Load()
+	assert.NoError(t, err)
+	CategoryPathMap = current.Paths.Categories
+	CategoryPolicyMap = current.Policy.Categories
+	return current, path
+}
+
+// Test that a reload applies new categories and policies but keeps settings needing a restart
+func TestReloadConfigApplies(t *testing.T) {
+	current, path := setupReloadTest(t)
+
+	newConfig := `
+rabbitmq:
+  host: other-broker
+paths:
+  categories:
+    local-movies: /movies
+    local-anime: /anime
+policy:
+  categories:
+    local-anime:
+      languages:
+        audio: [jpn]
+safety:
+  min_free_mb: 10
+`
+	assert.NoError(t, os.WriteFile(path, []byte(newConfig), 0o644))
+
+	next, applied := reloadConfig(current)
+
+	assert.True(t, applied)
+	basePath, ok := categoryPath("local-anime")
+	assert.True(t, ok)
+	assert.Equal(t, "/anime", basePath)
+	assert.Equal(t, []string{"jpn"}, policyForCategory("local-anime").Languages.Audio)
+	assert.Equal(t, int64(10), currentSafetyPolicy().MinFreeMB)
+	assert.Equal(t, "broker", next.RabbitMQ.Host)
+
+	// The same file again changes nothing
+	_, applied = reloadConfig(next)
+	assert.False(t, applied)
+}
+
+// Test that an invalid configuration is rejected and the current one kept
+func TestReloadConfigRejectsInvalid(t *testing.T) {
+	current, path := setupReloadTest(t)
+
+	invalidConfig := reloadTestConfig + `
+policy:
+  categories:
+    local-anime:
+      pipeline:
+        - step: transcode
+`
+	assert.NoError(t, os.WriteFile(path, []byte(invalidConfig), 0o644))
+
+	next, applied := reloadConfig(current)
+
+	assert.False(t, applied)
+	assert.Same(t, current, next)
+	_, ok := CategoryPolicyMap["local-anime"]
+	assert.False(t, ok)
+}
+
+// Test that a changed config file is reloaded and the reload hook runs
+func TestWatchReloads(t *testing.T) {
+	current, path := setupReloadTest(t)
+
+	changed := make(chan func(), 1)
+	watchConfigFunc = func(onChange func()) string {
+		changed <- onChange
+		return path
+	}
+	defer func() { watchConfigFunc = config.Watch }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan struct{}, 1)
+	go watchReloads(ctx, current, func() { reloaded <- struct{}{} })
+
+	onChange := <-changed
+	assert.NoError(t, os.WriteFile(path, []byte(reloadTestConfig+"    local-anime: /anime\n"), 0o644))
+	onChange()
+
+	select {
+	case <-reloaded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("configuration was not reloaded")
+	}
+	_, ok := categoryPath("local-anime")
+	assert.True(t, ok)
+}
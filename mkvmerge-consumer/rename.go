@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"mkvmerge-consumer/config"
+)
+
+// defaultRenamePattern names movies "Title (Year)" and episodes
+// "Title S01E02", which Jellyfin recognises without further hints
+const defaultRenamePattern = `{{.Title}}{{if .Year}} ({{.Year}}){{end}}{{if .Episode}} S{{pad .Season}}E{{pad .Episode}}{{end}}`
+
+// mediaName is what can be learned from a release file name
+type mediaName struct {
+	Title   string
+	Year    int
+	Season  int
+	Episode int
+}
+
+var (
+	episodePattern = regexp.MustCompile(`(?i)[. _-]S(\d{1,2})E(\d{1,3})`)
+	yearPattern    = regexp.MustCompile(`[. _(\[]((?:19|20)\d{2})(?:[. _)\]]|$)`)
+	releasePattern = regexp.MustCompile(`(?i)[. _\[(-](2160p|1080p|720p|576p|480p|web-?dl|webrip|bluray|bdrip|hdtv|dvdrip|x264|x265|h\.?26[45]|hevc|remux)`)
+)
+
+// parseMediaName extracts title, year, season and episode from a release
+// file name such as "Show.Name.S01E02.1080p.WEB-DL.mkv"
+func parseMediaName(filename string) mediaName {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	var media mediaName
+
+	// Everything after the episode or year is release information
+	end := len(name)
+	if m := episodePattern.FindStringSubmatchIndex(name); m != nil {
+		end = m[0]
+		media.Season, _ = strconv.Atoi(name[m[2]:m[3]])
+		media.Episode, _ = strconv.Atoi(name[m[4]:m[5]])
+	}
+	// The last year wins, so titles such as "Blade Runner 2049" stay intact
+	if years := yearPattern.FindAllStringSubmatchIndex(name[:end], -1); len(years) > 0 {
+		if m := years[len(years)-1]; m[0] > 0 {
+			end = m[0]
+			media.Year, _ = strconv.Atoi(name[m[2]:m[3]])
+		}
+	}
+	if m := releasePattern.FindStringIndex(name[:end]); m != nil && m[0] > 0 {
+		end = m[0]
+	}
+
+	title := strings.NewReplacer(".", " ", "_", " ").Replace(name[:end])
+	media.Title = strings.Trim(strings.Join(strings.Fields(title), " "), " -")
+	return media
+}
+
+// String returns the display title, such as "Movie (2024)" or "Show S01E02"
+func (m mediaName) String() string {
+	var b strings.Builder
+	if err := renameTemplate.Execute(&b, m); err != nil {
+		return m.Title
+	}
+	return b.String()
+}
+
+// renameFuncs are the helpers available to rename patterns
+var renameFuncs = template.FuncMap{
+	"pad": func(n int) string { return fmt.Sprintf("%02d", n) },
+}
+
+// renameTemplate is the parsed default rename pattern
+var renameTemplate = template.Must(template.New(config.StepRename).Funcs(renameFuncs).Parse(defaultRenamePattern))
+
+// renameStep renames files to a pattern built from their release name. The
+// file stays in its directory and keeps its extension.
+type renameStep struct {
+	pattern *template.Template
+}
+
+// newRenameStep parses the rename pattern, using the default when it is empty
+func newRenameStep(pattern string) (renameStep, error) {
+	if pattern == "" {
+		return renameStep{pattern: renameTemplate}, nil
+	}
+	tmpl, err := template.New(config.StepRename).Funcs(renameFuncs).Parse(pattern)
+	if err != nil {
+		return renameStep{}, fmt.Errorf("invalid rename pattern: %w", err)
+	}
+	// Unknown fields only show up when the pattern is executed
+	if err := tmpl.Execute(io.Discard, mediaName{}); err != nil {
+		return renameStep{}, fmt.Errorf("invalid rename pattern: %w", err)
+	}
+	return renameStep{pattern: tmpl}, nil
+}
+
+// Name returns the configuration name of the step
+func (renameStep) Name() string { return config.StepRename }
+
+// Run renames the file unless the new name is taken
+func (s renameStep) Run(ctx context.Context, f *mediaFile) (bool, error) {
+	var b strings.Builder
+	if err := s.pattern.Execute(&b, parseMediaName(filepath.Base(f.Path))); err != nil {
+		return false, fmt.Errorf("failed to build file name: %v", err)
+	}
+
+	// Path separators in titles would move the file elsewhere
+	name := strings.TrimSpace(strings.NewReplacer("/", "-", "\\", "-").Replace(b.String()))
+	if name == "" {
+		return false, nil
+	}
+
+	target := filepath.Join(filepath.Dir(f.Path), name+filepath.Ext(f.Path))
+	if target == f.Path {
+		return false, nil
+	}
+	if _, err := statFunc(target); err == nil {
+		warning := fmt.Sprintf("not renamed, %s already exists", filepath.Base(target))
+		loggerFrom(ctx).Warn("File not renamed", "file", f.Path, "target", target)
+		f.Result.Warnings = append(f.Result.Warnings, warning)
+		return false, nil
+	}
+
+	if err := renameFunc(f.Path, target); err != nil {
+		return false, fmt.Errorf("failed to rename to %s: %v", target, err)
+	}
+	loggerFrom(ctx).Info("Renamed file", "file", f.Path, "target", target)
+	f.Path = target
+	return true, nil
+}
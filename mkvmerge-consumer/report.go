@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"mkvmerge-consumer/config"
+)
+
+// Actions reported for a file by a dry run
+const (
+	actionRemux   = "remux"   // strip_tracks would remove or reorder tracks
+	actionConvert = "convert" // strip_tracks would write the file as MKV
+	actionKeep    = "keep"    // the file already matches the policy
+	actionError   = "error"   // the file could not be read
+)
+
+// fileReport describes what processing would do to a single file
+type fileReport struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Target is the path after a conversion to MKV
+	Target  string         `json:"target,omitempty"`
+	Kept    []trackSummary `json:"kept,omitempty"`
+	Removed []trackSummary `json:"removed,omitempty"`
+	Size    int64          `json:"size"`
+	// EstimatedSavings adds up the sizes of the removed tracks
+	EstimatedSavings int64 `json:"estimatedSavings"`
+	// UnknownSizes counts the removed tracks whose size is unknown, which
+	// makes EstimatedSavings a lower bound
+	UnknownSizes int    `json:"unknownSizes,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// report is the result of a dry run over one or more folders
+type report struct {
+	Category         string       `json:"category,omitempty"`
+	Backend          string       `json:"backend"`
+	Files            []fileReport `json:"files"`
+	TotalSize        int64        `json:"totalSize"`
+	EstimatedSavings int64        `json:"estimatedSavings"`
+}
+
+// planFile reports what the strip_tracks step of a policy would do to a
+// file. Only the backend's identify command is run.
+func planFile(ctx context.Context, backend Backend, policy config.CategoryPolicy, path string) fileReport {
+	r := fileReport{Path: path, Action: actionError}
+	if info, err := statFunc(path); err == nil {
+		r.Size = info.Size()
+	}
+
+	info, err := backend.Identify(ctx, path)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	plan := planStripTracks(path, info.Tracks, policy.Languages, policy.ConvertToMKV)
+	if !stripsTracks(policy) || !plan.Change {
+		r.Action = actionKeep
+		r.Kept = summarizeTracks(info.Tracks)
+		return r
+	}
+
+	selection := plan.Selection
+	r.Kept = summarizeTracks(selection.Video, selection.Audio, selection.Subtitles)
+	switch {
+	case plan.Target != path:
+		r.Action = actionConvert
+		r.Target = plan.Target
+	default:
+		r.Action = actionRemux
+	}
+
+	r.Removed = summarizeTracks(selection.Removed)
+	for _, track := range selection.Removed {
+		if track.Properties.NumberOfBytes > 0 {
+			r.EstimatedSavings += int64(track.Properties.NumberOfBytes)
+		} else {
+			r.UnknownSizes++
+		}
+	}
+	return r
+}
+
+// stripsTracks reports whether the pipeline of a policy removes tracks
+func stripsTracks(policy config.CategoryPolicy) bool {
+	for _, step := range policy.Pipeline {
+		if step.Step == config.StepStripTracks {
+			return true
+		}
+	}
+	return false
+}
+
+// buildReport plans every file the backend of the policy handles below the
+// given paths
+func buildReport(ctx context.Context, category string, policy config.CategoryPolicy, paths []string) (report, error) {
+	backend := newBackend(policy)
+	r := report{Category: category, Backend: backend.Name(), Files: []fileReport{}}
+
+	for _, root := range paths {
+		err := walkFunc(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !handles(backend, path) {
+				return nil
+			}
+			file := planFile(ctx, backend, policy, path)
+			r.Files = append(r.Files, file)
+			r.TotalSize += file.Size
+			r.EstimatedSavings += file.EstimatedSavings
+			return nil
+		})
+		if err != nil {
+			return r, fmt.Errorf("failed to walk %s: %w", root, err)
+		}
+	}
+	return r, nil
+}
+
+// writeReportJSON writes the report as indented JSON
+func writeReportJSON(out io.Writer, r report) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// writeReportTable writes one row per file and a total
+func writeReportTable(out io.Writer, r report) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tACTION\tKEPT\tREMOVED\tSIZE\tSAVINGS")
+	for _, file := range r.Files {
+		savings := formatBytes(file.EstimatedSavings)
+		if file.UnknownSizes > 0 {
+			savings = ">=" + savings
+		}
+		action := file.Action
+		if file.Error != "" {
+			action += ": " + file.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", file.Path, action,
+			describeTracks(file.Kept), describeTracks(file.Removed), formatBytes(file.Size), savings)
+	}
+	fmt.Fprintf(w, "TOTAL (%d files)\t\t\t\t%s\t%s\n", len(r.Files), formatBytes(r.TotalSize), formatBytes(r.EstimatedSavings))
+	return w.Flush()
+}
+
+// describeTracks lists tracks as type:language, e.g. "audio:eng"
+func describeTracks(tracks []trackSummary) string {
+	if len(tracks) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(tracks))
+	for _, track := range tracks {
+		parts = append(parts, track.Type+":"+track.Language)
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatBytes formats a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// reportDryRun logs what processing would do to each file of a message
+func reportDryRun(ctx context.Context, backend Backend, policy config.CategoryPolicy, files []string) {
+	logger := loggerFrom(ctx)
+	for _, path := range files {
+		file := planFile(ctx, backend, policy, path)
+		logger.Info("Dry run", "file", file.Path, "action", file.Action,
+			"kept", describeTracks(file.Kept), "removed", describeTracks(file.Removed),
+			"size", file.Size, "estimated_savings", file.EstimatedSavings, "error", file.Error)
+	}
+}
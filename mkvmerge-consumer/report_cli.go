@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// reportCommand prints what processing would do to the files of a category
+// or folder without changing them
+func reportCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	flags.SetOutput(out)
+	format := flags.String("format", "table", "output format: table or json")
+	category := flags.String("category", "", "category whose policy and base directory are used")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown report format: %s", *format)
+	}
+
+	paths, err := reportPaths(*category, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	r, err := buildReport(context.Background(), *category, policyForCategory(*category), paths)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return writeReportJSON(out, r)
+	}
+	return writeReportTable(out, r)
+}
+
+// reportPaths resolves the folders to report on. Relative paths are taken
+// from the base directory of the category, and no path means all of it.
+func reportPaths(category string, paths []string) ([]string, error) {
+	basePath, ok := categoryPath(category)
+	if category != "" && !ok {
+		return nil, fmt.Errorf("unknown category: %s", category)
+	}
+	if len(paths) == 0 {
+		if category == "" {
+			return nil, errors.New("a category or a path is required")
+		}
+		return []string{basePath}, nil
+	}
+
+	resolved := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !filepath.IsAbs(path) && category != "" {
+			path = filepath.Join(basePath, path)
+		}
+		resolved = append(resolved, path)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupReportTest creates a folder with a movie and a file no backend
+// handles, and runs the fake tools against the real file system
+func setupReportTest(t *testing.T, movie string) string {
+	setupPipelineTest(t)
+	statFunc = os.Stat
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, movie), make([]byte, 2048), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "movie.nfo"), nil, 0o644))
+	return dir
+}
+
+// Test for a report of an MKV file losing a track of known size
+func TestBuildReportMkvmerge(t *testing.T) {
+	dir := setupReportTest(t, "movie.mkv")
+
+	r, err := buildReport(context.Background(), "movies", config.DefaultCategoryPolicy(), []string{dir})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "mkvmerge", r.Backend)
+	assert.Len(t, r.Files, 1)
+	file := r.Files[0]
+	assert.Equal(t, filepath.Join(dir, "movie.mkv"), file.Path)
+	assert.Equal(t, actionRemux, file.Action)
+	assert.Len(t, file.Kept, 3)
+	assert.Equal(t, []trackSummary{{ID: 2, Type: "audio", Language: "spa"}}, file.Removed)
+	assert.Equal(t, int64(2048), file.Size)
+	assert.Equal(t, int64(500000000), file.EstimatedSavings)
+	assert.Equal(t, 0, file.UnknownSizes)
+	assert.Equal(t, int64(2048), r.TotalSize)
+	assert.Equal(t, int64(500000000), r.EstimatedSavings)
+}
+
+// Test for a report of a file converted to MKV, sized from the bit rate
+func TestBuildReportFFmpegConvert(t *testing.T) {
+	dir := setupReportTest(t, "movie.mp4")
+
+	r, err := buildReport(context.Background(), "", ffmpegPolicy(true), []string{dir})
+
+	assert.NoError(t, err)
+	assert.Len(t, r.Files, 1)
+	file := r.Files[0]
+	assert.Equal(t, actionConvert, file.Action)
+	assert.Equal(t, filepath.Join(dir, "movie.mkv"), file.Target)
+	assert.Equal(t, []trackSummary{{ID: 2, Type: "audio", Language: "spa"}}, file.Removed)
+	assert.Equal(t, int64(128000/8*5400), file.EstimatedSavings)
+	assert.Equal(t, 0, file.UnknownSizes)
+}
+
+// Test that a policy without strip_tracks keeps every track
+func TestBuildReportWithoutStripTracks(t *testing.T) {
+	dir := setupReportTest(t, "movie.mkv")
+	policy := config.DefaultCategoryPolicy()
+	policy.Pipeline = []config.StepConfig{{Step: config.StepDefaultFlags, Audio: "eng"}}
+
+	r, err := buildReport(context.Background(), "", policy, []string{dir})
+
+	assert.NoError(t, err)
+	assert.Equal(t, actionKeep, r.Files[0].Action)
+	assert.Len(t, r.Files[0].Kept, 4)
+	assert.Empty(t, r.Files[0].Removed)
+	assert.Equal(t, int64(0), r.EstimatedSavings)
+}
+
+// Test for the report command printing JSON for a category folder
+func TestReportCommandJSON(t *testing.T) {
+	dir := setupReportTest(t, "movie.mkv")
+	oldPaths := CategoryPathMap
+	CategoryPathMap = map[string]string{"movies": filepath.Dir(dir)}
+	defer func() { CategoryPathMap = oldPaths }()
+
+	var out bytes.Buffer
+	err := reportCommand([]string{"-format", "json", "-category", "movies", filepath.Base(dir)}, &out)
+
+	assert.NoError(t, err)
+	var r report
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &r))
+	assert.Equal(t, "movies", r.Category)
+	assert.Len(t, r.Files, 1)
+	assert.Equal(t, actionRemux, r.Files[0].Action)
+}
+
+// Test for the report table
+func TestReportCommandTable(t *testing.T) {
+	dir := setupReportTest(t, "movie.mkv")
+
+	var out bytes.Buffer
+	err := reportCommand([]string{dir}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "FILE")
+	assert.Contains(t, out.String(), "video:eng,audio:eng,subtitles:eng")
+	assert.Contains(t, out.String(), "audio:spa")
+	assert.Contains(t, out.String(), "476.8 MiB")
+	assert.Contains(t, out.String(), "TOTAL (1 files)")
+}
+
+// Test for the errors of the report command
+func TestReportCommandErrors(t *testing.T) {
+	var out bytes.Buffer
+	assert.EqualError(t, reportCommand(nil, &out), "a category or a path is required")
+	assert.EqualError(t, reportCommand([]string{"-category", "nope"}, &out), "unknown category: nope")
+	assert.EqualError(t, reportCommand([]string{"-format", "xml", "/tmp"}, &out), "unknown report format: xml")
+}
+
+// Test for formatBytes
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "2.0 GiB", formatBytes(2<<30))
+}
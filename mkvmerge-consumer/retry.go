@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers used to track delayed redeliveries of a task
+const (
+	retryCountHeader   = "x-retry-count"
+	retryHistoryHeader = "x-retry-history"
+)
+
+// retryPolicy controls how often and how late failed tasks are retried
+var retryPolicy = config.DefaultRetryConfig()
+
+// retryAttempt records why a single processing attempt failed
+type retryAttempt struct {
+	Attempt int    `json:"attempt"`
+	Reason  string `json:"reason"`
+	Time    string `json:"time"`
+}
+
+// retryDelay returns how long to wait before the given retry (1-based).
+// The delay doubles with every attempt and is capped at the maximum delay.
+func retryDelay(attempt int) time.Duration {
+	delay := retryPolicy.InitialDelay
+	for i := 1; i < attempt; i++ {
+		delay = nextDelay(delay, retryPolicy.MaxDelay)
+	}
+	return min(delay, retryPolicy.MaxDelay)
+}
+
+// retryQueueName returns the name of the TTL queue holding messages of a
+// task queue for delay. Naming the queue after its delay keeps the
+// declaration valid when the retry settings change.
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%ds", queue, int64(delay/time.Second))
+}
+
+// ensureRetryQueues declares one TTL queue per task queue and retry attempt.
+// Expired messages are dead-lettered back to their task queue through the
+// default exchange.
+func ensureRetryQueues(ch ChannelInterface) error {
+	for _, queue := range taskQueues() {
+		for attempt := 1; attempt <= retryPolicy.MaxAttempts; attempt++ {
+			delay := retryDelay(attempt)
+			name := retryQueueName(queue, delay)
+			_, err := ch.QueueDeclare(
+				name,  // name
+				true,  // durable
+				false, // delete when unused
+				false, // exclusive
+				false, // no-wait
+				amqp.Table{
+					"x-message-ttl":             delay.Milliseconds(),
+					"x-dead-letter-exchange":    "",
+					"x-dead-letter-routing-key": queue,
+				}, // arguments
+			)
+			if err != nil {
+				return fmt.Errorf("failed to declare retry queue '%s': %w", name, err)
+			}
+			slog.Info("Retry queue declared", "queue", name, "attempt", attempt)
+		}
+	}
+	return nil
+}
+
+// retryCount returns how many times a task has already been retried
+func retryCount(headers amqp.Table) int {
+	return tableInt(headers[retryCountHeader])
+}
+
+// tableInt converts an integer read from an AMQP table, which may arrive
+// with any width, to an int
+func tableInt(value interface{}) int {
+	switch n := value.(type) {
+	case int:
+		return n
+	case int16:
+		return int(n)
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
+
+// retryHistory returns the failed attempts recorded in the headers
+func retryHistory(headers amqp.Table) []retryAttempt {
+	entries, _ := headers[retryHistoryHeader].([]interface{})
+
+	history := make([]retryAttempt, 0, len(entries)+1)
+	for _, entry := range entries {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		attempt := retryAttempt{Attempt: tableInt(table["attempt"])}
+		attempt.Reason, _ = table["reason"].(string)
+		attempt.Time, _ = table["time"].(string)
+		history = append(history, attempt)
+	}
+	return history
+}
+
+// retryOrDeadLetter handles a failure that may go away on its own, such as
+// a folder that is still being moved. The task is republished to a delayed
+// retry queue until the attempts run out; after that it is dead-lettered
+// together with the reason of every attempt.
+func retryOrDeadLetter(ctx context.Context, ch ChannelInterface, d acknowledger, body []byte, headers amqp.Table, reason string) {
+	logger := loggerFrom(ctx)
+	retries := retryCount(headers)
+	history := append(retryHistory(headers), retryAttempt{
+		Attempt: retries + 1,
+		Reason:  reason,
+		Time:    time.Now().Format(time.RFC3339),
+	})
+
+	if retries < retryPolicy.MaxAttempts {
+		if err := publishRetry(ctx, ch, body, headers, retries+1, history); err != nil {
+			logger.Error("Error scheduling retry", "error", err)
+			// Put the message back so the failure is not lost
+			if err := d.Nack(false, true); err != nil {
+				logger.Error("Error requeueing message", "error", err)
+			}
+			return
+		}
+		if err := d.Ack(false); err != nil {
+			logger.Error("Error acknowledging retried message", "error", err)
+		}
+		messagesTotal.WithLabelValues(outcomeRetried).Inc()
+		return
+	}
+
+	logger.Warn("Giving up", "attempts", len(history), "reason", reason)
+	if err := publishToDLQ(ctx, ch, body, reason, history); err != nil {
+		logger.Error("Error publishing to DLQ", "error", err)
+		// Fall back to the DLX so the message still ends up in the DLQ
+		if err := d.Reject(false); err != nil {
+			logger.Error("Error rejecting message to DLQ", "error", err)
+		} else {
+			messagesTotal.WithLabelValues(outcomeRejected).Inc()
+		}
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		logger.Error("Error acknowledging dead-lettered message", "error", err)
+	}
+	messagesTotal.WithLabelValues(outcomeDeadLettered).Inc()
+}
+
+// publishRetry publishes body to the retry queue of the given attempt. The
+// retried message keeps the correlation ID carried by ctx and returns to the
+// task queue of its category with the category's priority.
+func publishRetry(ctx context.Context, ch ChannelInterface, body []byte, headers amqp.Table, attempt int, history []retryAttempt) error {
+	retryHeaders := amqp.Table{}
+	for key, value := range headers {
+		retryHeaders[key] = value
+	}
+
+	entries := make([]interface{}, 0, len(history))
+	for _, entry := range history {
+		entries = append(entries, amqp.Table{
+			"attempt": int32(entry.Attempt),
+			"reason":  entry.Reason,
+			"time":    entry.Time,
+		})
+	}
+	retryHeaders[retryCountHeader] = int32(attempt)
+	retryHeaders[retryHistoryHeader] = entries
+
+	var msg Message
+	_ = json.Unmarshal(body, &msg)
+
+	delay := retryDelay(attempt)
+	name := retryQueueName(taskQueueFor(msg.Category), delay)
+	err := ch.Publish(
+		"",    // exchange
+		name,  // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			ContentType:   "application/json",
+			CorrelationId: correlationID(ctx),
+			Priority:      taskPriority(msg),
+			Headers:       retryHeaders,
+			Body:          body,
+			DeliveryMode:  amqp.Persistent, // make message persistent
+		})
+	if err != nil {
+		return fmt.Errorf("failed to publish to retry queue '%s': %w", name, err)
+	}
+
+	loggerFrom(ctx).Info("Scheduled retry", "attempt", attempt, "max_attempts", retryPolicy.MaxAttempts,
+		"delay", delay, "queue", name)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Test for retryDelay exponential growth
+func TestRetryDelay(t *testing.T) {
+	retryPolicy = config.RetryConfig{MaxAttempts: 5, InitialDelay: time.Minute, MaxDelay: 5 * time.Minute}
+	defer func() { retryPolicy = config.DefaultRetryConfig() }()
+
+	assert.Equal(t, time.Minute, retryDelay(1))
+	assert.Equal(t, 2*time.Minute, retryDelay(2))
+	assert.Equal(t, 4*time.Minute, retryDelay(3))
+	assert.Equal(t, 5*time.Minute, retryDelay(4))
+	assert.Equal(t, 5*time.Minute, retryDelay(5))
+}
+
+// Test for ensureRetryQueues function
+func TestEnsureRetryQueues(t *testing.T) {
+	queueName = "test-queue"
+	retryPolicy = config.RetryConfig{MaxAttempts: 3, InitialDelay: 30 * time.Second, MaxDelay: time.Minute}
+	defer func() { retryPolicy = config.DefaultRetryConfig() }()
+
+	mockChannel := new(MockChannelInterface)
+	for name, ttl := range map[string]int64{"test-queue.retry.30s": 30000, "test-queue.retry.60s": 60000} {
+		mockChannel.On("QueueDeclare", name, true, false, false, false, amqp.Table{
+			"x-message-ttl":             ttl,
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "test-queue",
+		}).Return(amqp.Queue{Name: name}, nil)
+	}
+
+	err := ensureRetryQueues(mockChannel)
+
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+	// The last two attempts share the capped delay and therefore the queue
+	mockChannel.AssertNumberOfCalls(t, "QueueDeclare", 3)
+}
+
+// Test that a failed retry publish puts the message back on the queue
+func TestRetryOrDeadLetterPublishFailure(t *testing.T) {
+	queueName = "test-queue"
+	retryPolicy = config.DefaultRetryConfig()
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("Publish", "", "test-queue.retry.60s", false, false, mock.Anything).
+		Return(&amqp.Error{Code: 504, Reason: "channel closed"})
+
+	mockAcker := new(MockDelivery)
+	mockAcker.On("Nack", false, true).Return(nil)
+
+	retryOrDeadLetter(context.Background(), mockChannel, mockAcker, []byte("{}"), nil, "busy")
+
+	mockAcker.AssertExpectations(t)
+	mockAcker.AssertNotCalled(t, "Ack", mock.Anything)
+}
+
+// Test for retryHistory parsing of header values
+func TestRetryHistory(t *testing.T) {
+	headers := amqp.Table{
+		retryCountHeader: int64(1),
+		retryHistoryHeader: []interface{}{
+			amqp.Table{"attempt": int32(1), "reason": "busy", "time": "2024-01-01T00:00:00Z"},
+			"not a table",
+		},
+	}
+
+	assert.Equal(t, 1, retryCount(headers))
+	assert.Equal(t, []retryAttempt{{Attempt: 1, Reason: "busy", Time: "2024-01-01T00:00:00Z"}}, retryHistory(headers))
+	assert.Equal(t, 0, retryCount(nil))
+	assert.Empty(t, retryHistory(nil))
+}
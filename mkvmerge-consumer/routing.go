@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+)
+
+// The priority and routing settings of the task queues. They describe the
+// broker topology and therefore only change on restart.
+var (
+	taskPriorities config.PriorityConfig
+	taskRouting    config.RoutingConfig
+	// categoryQueues maps each category to its task queue when tasks are
+	// routed through the exchange
+	categoryQueues map[string]string
+)
+
+// newCategoryQueues names the task queue of every category, or returns nil
+// when tasks are not routed through an exchange
+func newCategoryQueues(routing config.RoutingConfig, categories map[string]string) map[string]string {
+	if routing.Exchange == "" {
+		return nil
+	}
+	queues := make(map[string]string, len(categories))
+	for category := range categories {
+		queues[category] = queueName + "." + category
+	}
+	return queues
+}
+
+// unroutedExchangeName returns the alternate exchange of the routing
+// exchange. It passes tasks of categories without a queue on to the shared
+// tasks queue.
+func unroutedExchangeName() string {
+	return taskRouting.Exchange + ".unrouted"
+}
+
+// taskQueues returns the shared tasks queue followed by the queue of every
+// category
+func taskQueues() []string {
+	queues := make([]string, 0, len(categoryQueues)+1)
+	for _, queue := range categoryQueues {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return append([]string{queueName}, queues...)
+}
+
+// consumedQueues returns the task queues this consumer reads
+func consumedQueues() []string {
+	if len(taskRouting.Categories) == 0 {
+		return taskQueues()
+	}
+	queues := make([]string, 0, len(taskRouting.Categories))
+	for _, category := range taskRouting.Categories {
+		queues = append(queues, taskQueueFor(category))
+	}
+	return queues
+}
+
+// taskQueueFor returns the queue holding the tasks of a category
+func taskQueueFor(category string) string {
+	if queue, ok := categoryQueues[category]; ok {
+		return queue
+	}
+	return queueName
+}
+
+// taskPriority returns the priority of a task: its own, else the one of its
+// category, else the default. It is 0 when priorities are disabled.
+func taskPriority(msg Message) uint8 {
+	if taskPriorities.Max <= 0 {
+		return 0
+	}
+	priority := taskPriorities.Default
+	if p, ok := taskPriorities.Categories[msg.Category]; ok {
+		priority = p
+	}
+	if msg.Priority != nil {
+		priority = *msg.Priority
+	}
+	return uint8(max(0, min(priority, taskPriorities.Max)))
+}
+
+// taskQueueArgs returns the arguments every task queue is declared with
+func taskQueueArgs() amqp.Table {
+	args := amqp.Table{
+		"x-dead-letter-exchange":    "dlx",
+		"x-dead-letter-routing-key": dlqQueueName,
+	}
+	if taskPriorities.Max > 0 {
+		args["x-max-priority"] = int32(taskPriorities.Max)
+	}
+	return args
+}
+
+// ensureTaskRouting declares the routing exchange and binds the queue of
+// every category to it. Every consumer declares all of them, so tasks of a
+// category wait in its queue while no consumer of it is running. Without a
+// routing exchange it does nothing.
+func ensureTaskRouting(ch ChannelInterface, openChannel func() (ChannelInterface, error)) error {
+	if taskRouting.Exchange == "" {
+		return nil
+	}
+
+	// Tasks no category queue is bound for end up in the shared queue
+	unrouted := unroutedExchangeName()
+	if err := ch.ExchangeDeclare(unrouted, "fanout", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange '%s': %w", unrouted, err)
+	}
+	if err := ch.QueueBind(queueName, "", unrouted, false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue '%s' to '%s': %w", queueName, unrouted, err)
+	}
+
+	err := ch.ExchangeDeclare(
+		taskRouting.Exchange, // name
+		"topic",              // type
+		true,                 // durable
+		false,                // auto-deleted
+		false,                // internal
+		false,                // no-wait
+		amqp.Table{"alternate-exchange": unrouted},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare routing exchange '%s': %w", taskRouting.Exchange, err)
+	}
+
+	categories := make([]string, 0, len(categoryQueues))
+	for category := range categoryQueues {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		queue := categoryQueues[category]
+		if _, err := declareTaskQueue(ch, openChannel, queue); err != nil {
+			return err
+		}
+		if err := ch.QueueBind(queue, category, taskRouting.Exchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind queue '%s' to '%s': %w", queue, taskRouting.Exchange, err)
+		}
+		slog.Info("Queue bound for category", "queue", queue, "exchange", taskRouting.Exchange, "category", category)
+	}
+	return nil
+}
+
+// consumeQueues registers a consumer on every queue and merges their
+// deliveries. The merged channel closes once all of them are closed; it
+// stops being fed when ctx is cancelled.
+func consumeQueues(ctx context.Context, ch ChannelInterface, queues []string) (<-chan amqp.Delivery, error) {
+	sources := make([]<-chan amqp.Delivery, 0, len(queues))
+	for _, queue := range queues {
+		msgs, err := ch.Consume(
+			queue, // queue
+			"",    // consumer tag (empty means auto-generated)
+			false, // auto-ack (false means manual acknowledgment)
+			false, // exclusive
+			false, // no-local
+			false, // no-wait
+			nil,   // args
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register a consumer on '%s': %w", queue, err)
+		}
+		sources = append(sources, msgs)
+	}
+	if len(sources) == 1 {
+		return sources[0], nil
+	}
+
+	merged := make(chan amqp.Delivery)
+	var wg sync.WaitGroup
+	for _, msgs := range sources {
+		wg.Add(1)
+		go func(msgs <-chan amqp.Delivery) {
+			defer wg.Done()
+			for d := range msgs {
+				select {
+				case merged <- d:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(msgs)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged, nil
+}
+
+// taskDestination returns the exchange and routing key a task is published
+// with: the routing exchange and its category when there is one, else the
+// shared tasks queue
+func taskDestination(msg Message) (exchange, key string) {
+	if taskRouting.Exchange != "" {
+		return taskRouting.Exchange, msg.Category
+	}
+	return "", queueName
+}
+
+// tasksDestination describes where tasks are published to
+func tasksDestination() string {
+	if taskRouting.Exchange != "" {
+		return fmt.Sprintf("exchange %s", taskRouting.Exchange)
+	}
+	return queueName
+}
+
+// publishTask publishes a task message with the priority of its category,
+// through the routing exchange when there is one. A replayed task keeps its
+// correlation ID; new tasks pass an empty one and get theirs when consumed.
+func publishTask(ch ChannelInterface, body []byte, correlationID string) error {
+	// A task that cannot be parsed still goes to the shared queue, where the
+	// consumer dead-letters it
+	var msg Message
+	_ = json.Unmarshal(body, &msg)
+
+	exchange, key := taskDestination(msg)
+	return ch.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		amqp.Publishing{
+			ContentType:   "application/json",
+			CorrelationId: correlationID,
+			Body:          body,
+			Priority:      taskPriority(msg),
+			DeliveryMode:  amqp.Persistent, // make message persistent
+		})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withTaskRouting routes tasks of the test categories through an exchange
+// with priorities for the duration of a test
+func withTaskRouting(t *testing.T, consume ...string) {
+	queueName = "test-queue"
+	dlqQueueName = "test-dlq"
+	taskPriorities = config.PriorityConfig{Max: 10, Default: 2, Categories: map[string]int{"movies": 8}}
+	taskRouting = config.RoutingConfig{Exchange: "test-tasks", Categories: consume}
+	categoryQueues = newCategoryQueues(taskRouting, map[string]string{"movies": "/movies", "shows": "/shows"})
+	t.Cleanup(func() {
+		taskPriorities = config.PriorityConfig{}
+		taskRouting = config.RoutingConfig{}
+		categoryQueues = nil
+	})
+}
+
+// Test for the task priority taken from the message, the category or the default
+func TestTaskPriority(t *testing.T) {
+	withTaskRouting(t)
+	high, tooHigh := 9, 50
+
+	assert.Equal(t, uint8(8), taskPriority(Message{Category: "movies"}))
+	assert.Equal(t, uint8(2), taskPriority(Message{Category: "shows"}))
+	assert.Equal(t, uint8(9), taskPriority(Message{Category: "shows", Priority: &high}))
+	assert.Equal(t, uint8(10), taskPriority(Message{Category: "shows", Priority: &tooHigh}))
+
+	// Without priority queues every task has priority 0
+	taskPriorities = config.PriorityConfig{}
+	assert.Equal(t, uint8(0), taskPriority(Message{Category: "movies", Priority: &high}))
+}
+
+// Test for the queues of each category and the ones consumed
+func TestTaskQueues(t *testing.T) {
+	withTaskRouting(t)
+
+	assert.Equal(t, []string{"test-queue", "test-queue.movies", "test-queue.shows"}, taskQueues())
+	assert.Equal(t, taskQueues(), consumedQueues())
+	assert.Equal(t, "test-queue.movies", taskQueueFor("movies"))
+	assert.Equal(t, "test-queue", taskQueueFor("unknown"))
+
+	taskRouting.Categories = []string{"shows"}
+	assert.Equal(t, []string{"test-queue.shows"}, consumedQueues())
+
+	// Without an exchange there is only the shared queue
+	taskRouting, categoryQueues = config.RoutingConfig{}, nil
+	assert.Equal(t, []string{"test-queue"}, taskQueues())
+	assert.Equal(t, []string{"test-queue"}, consumedQueues())
+}
+
+// Test that task queues are declared as priority queues
+func TestDeclareTaskQueuePriority(t *testing.T) {
+	withTaskRouting(t)
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("QueueDeclare", "test-queue.movies", true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "dlx",
+		"x-dead-letter-routing-key": "test-dlq",
+		"x-max-priority":            int32(10),
+	}).Return(amqp.Queue{Name: "test-queue.movies"}, nil)
+
+	_, err := declareTaskQueue(mockChannel, nil, "test-queue.movies")
+
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+}
+
+// Test for declaring the routing exchange and binding the category queues
+func TestEnsureTaskRouting(t *testing.T) {
+	withTaskRouting(t)
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("ExchangeDeclare", "test-tasks.unrouted", "fanout", true, false, false, false, mock.Anything).Return(nil)
+	mockChannel.On("QueueBind", "test-queue", "", "test-tasks.unrouted", false, mock.Anything).Return(nil)
+	mockChannel.On("ExchangeDeclare", "test-tasks", "topic", true, false, false, false,
+		amqp.Table{"alternate-exchange": "test-tasks.unrouted"}).Return(nil)
+	for _, category := range []string{"movies", "shows"} {
+		queue := "test-queue." + category
+		mockChannel.On("QueueDeclare", queue, true, false, false, false, mock.Anything).Return(amqp.Queue{Name: queue}, nil)
+		mockChannel.On("QueueBind", queue, category, "test-tasks", false, mock.Anything).Return(nil)
+	}
+
+	err := ensureTaskRouting(mockChannel, nil)
+
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that the deliveries of several queues are merged
+func TestConsumeQueues(t *testing.T) {
+	movies, shows := make(chan amqp.Delivery, 1), make(chan amqp.Delivery, 1)
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("Consume", "test-queue.movies", "", false, false, false, false, mock.Anything).Return((<-chan amqp.Delivery)(movies), nil)
+	mockChannel.On("Consume", "test-queue.shows", "", false, false, false, false, mock.Anything).Return((<-chan amqp.Delivery)(shows), nil)
+
+	msgs, err := consumeQueues(context.Background(), mockChannel, []string{"test-queue.movies", "test-queue.shows"})
+	assert.NoError(t, err)
+
+	movies <- amqp.Delivery{Body: []byte("movie")}
+	shows <- amqp.Delivery{Body: []byte("show")}
+	close(movies)
+	close(shows)
+
+	var bodies []string
+	for d := range msgs {
+		bodies = append(bodies, string(d.Body))
+	}
+	assert.ElementsMatch(t, []string{"movie", "show"}, bodies)
+}
+
+// Test that tasks are published to the routing exchange with their priority
+func TestPublishTask(t *testing.T) {
+	withTaskRouting(t)
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("Publish", "test-tasks", "movies", false, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+		return msg.Priority == 8 && msg.DeliveryMode == amqp.Persistent
+	})).Return(nil)
+
+	err := publishTask(mockChannel, []byte(`{"torrentName":"Movie","category":"movies"}`), "")
+
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+}
+
+// Test that a retry returns to the queue of the task's category
+func TestPublishRetryCategoryQueue(t *testing.T) {
+	withTaskRouting(t)
+	retryPolicy = config.DefaultRetryConfig()
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("Publish", "", "test-queue.movies.retry.60s", false, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+		return msg.Priority == 8
+	})).Return(nil)
+
+	err := publishRetry(context.Background(), mockChannel, []byte(`{"torrentName":"Movie","category":"movies"}`), nil, 1, nil)
+
+	assert.NoError(t, err)
+	mockChannel.AssertExpectations(t)
+}
+
+// Test for the publish command
+func TestPublishCommand(t *testing.T) {
+	withTaskRouting(t)
+	oldPaths := CategoryPathMap
+	CategoryPathMap = map[string]string{"movies": "/movies"}
+	defer func() { CategoryPathMap = oldPaths }()
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("Publish", "test-tasks", "movies", false, false, mock.MatchedBy(func(msg amqp.Publishing) bool {
+		return msg.Priority == 3 && string(msg.Body) == `{"torrentName":"Movie (2020)","category":"movies","priority":3}`
+	})).Return(nil)
+
+	var out bytes.Buffer
+	err := publishCommand(mockChannel, []string{"-priority", "3", "movies", "Movie (2020)"}, &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "to test-queue.movies with priority 3")
+	mockChannel.AssertExpectations(t)
+
+	assert.EqualError(t, publishCommand(mockChannel, []string{"nope", "Movie"}, &out), "unknown category: nope")
+	assert.Error(t, publishCommand(mockChannel, []string{"movies"}, &out))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"mkvmerge-consumer/config"
+)
+
+// safetyPolicy holds the checks made around replacing an original file.
+// It is replaced on reload, read it with currentSafetyPolicy.
+var safetyPolicy = config.DefaultSafetyConfig()
+
+// diskFreeFunc returns the bytes available on the file system of a path
+var diskFreeFunc = diskFree
+
+// errFreeSpaceUnknown is returned where free space cannot be determined
+var errFreeSpaceUnknown = errors.New("free space cannot be determined on this platform")
+
+// backupTimeLayout names the backup directory of every replaced original
+const backupTimeLayout = "20060102-150405"
+
+// currentSafetyPolicy returns the safety checks currently configured
+func currentSafetyPolicy() config.SafetyConfig {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return safetyPolicy
+}
+
+// checkFreeSpace makes sure a copy of size bytes fits next to the original
+// while leaving the configured reserve free
+func checkFreeSpace(dir string, size int64) error {
+	free, err := diskFreeFunc(dir)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read free space of %s: %v", dir, err)
+	}
+
+	required := uint64(max(size, 0)) + uint64(currentSafetyPolicy().MinFreeMB)<<20
+	if free < required {
+		return fmt.Errorf("not enough free space in %s: %d MiB required, %d MiB available",
+			dir, required>>20, free>>20)
+	}
+	return nil
+}
+
+// verifyOutput identifies the remuxed copy and checks that it holds the
+// selected tracks and as much playing time as the original
+func verifyOutput(ctx context.Context, backend Backend, f *mediaFile, selection trackSelection, output string) (mkvInfo, error) {
+	info, err := backend.Identify(ctx, output)
+	if err != nil {
+		return info, fmt.Errorf("failed to identify output: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, track := range info.Tracks {
+		counts[track.Type]++
+	}
+	expected := []struct {
+		trackType string
+		count     int
+	}{
+		{"video", len(selection.Video)},
+		{"audio", len(selection.Audio)},
+		{"subtitles", len(selection.Subtitles)},
+	}
+	for _, want := range expected {
+		if counts[want.trackType] != want.count {
+			return info, fmt.Errorf("output has %d %s tracks, expected %d",
+				counts[want.trackType], want.trackType, want.count)
+		}
+	}
+
+	// Not every container reports a duration
+	original := time.Duration(f.Info.Container.Properties.Duration)
+	remuxed := time.Duration(info.Container.Properties.Duration)
+	if original > 0 {
+		if diff := (remuxed - original).Abs(); diff > currentSafetyPolicy().DurationTolerance {
+			return info, fmt.Errorf("output duration %s differs from original %s", remuxed, original)
+		}
+	}
+	return info, nil
+}
+
+// backupOriginal moves the original into a new directory of backupDir,
+// copying it when the backup lives on another file system. moved reports
+// whether the original is gone from its place.
+func backupOriginal(backupDir, path string) (backup string, moved bool, err error) {
+	dir := filepath.Join(backupDir, time.Now().Format(backupTimeLayout), filepath.Base(filepath.Dir(path)))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", false, err
+	}
+	backup = filepath.Join(dir, filepath.Base(path))
+
+	err = renameFunc(path, backup)
+	if err == nil {
+		return backup, true, nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return "", false, err
+	}
+	if err := copyFile(path, backup); err != nil {
+		os.Remove(backup)
+		return "", false, err
+	}
+	return backup, false, nil
+}
+
+// copyFile copies the content of src to a new file dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pruneBackups deletes the backups older than the retention period
+func pruneBackups(now time.Time) {
+	policy := currentSafetyPolicy()
+	if policy.BackupDir == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(policy.BackupDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Error reading backup directory", "error", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		created, err := time.ParseInLocation(backupTimeLayout, entry.Name(), time.Local)
+		if !entry.IsDir() || err != nil || now.Sub(created) < policy.BackupRetention {
+			continue
+		}
+		path := filepath.Join(policy.BackupDir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Error deleting expired backup", "backup", path, "error", err)
+			continue
+		}
+		slog.Info("Deleted expired backup", "backup", path)
+	}
+}
+
+// watchBackups prunes expired backups every hour until ctx is cancelled
+func watchBackups(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		pruneBackups(time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withSafetyPolicy replaces the safety policy for a test
+func withSafetyPolicy(t *testing.T, policy config.SafetyConfig) {
+	old := safetyPolicy
+	safetyPolicy = policy
+	t.Cleanup(func() { safetyPolicy = old })
+}
+
+// Test for the free space preflight
+func TestCheckFreeSpace(t *testing.T) {
+	withSafetyPolicy(t, config.SafetyConfig{MinFreeMB: 100})
+	defer func() { diskFreeFunc = diskFree }()
+
+	diskFreeFunc = func(string) (uint64, error) { return 600 << 20, nil }
+	assert.NoError(t, checkFreeSpace("/movies", 500<<20))
+	assert.EqualError(t, checkFreeSpace("/movies", 501<<20),
+		"not enough free space in /movies: 601 MiB required, 600 MiB available")
+
+	diskFreeFunc = func(string) (uint64, error) { return 0, errFreeSpaceUnknown }
+	assert.NoError(t, checkFreeSpace("/movies", 500<<20))
+
+	diskFreeFunc = func(string) (uint64, error) { return 0, os.ErrPermission }
+	assert.ErrorContains(t, checkFreeSpace("/movies", 500<<20), "failed to read free space of /movies")
+}
+
+// Test that the remuxed copy must hold the selected tracks and the original duration
+func TestVerifyOutput(t *testing.T) {
+	setupPipelineTest(t)
+	withSafetyPolicy(t, config.DefaultSafetyConfig())
+
+	video := mkvTrack{ID: 0, Type: "video"}
+	english := mkvTrack{ID: 1, Type: "audio"}
+	subtitles := mkvTrack{ID: 3, Type: "subtitles"}
+	f := newMediaFile("/test/movie.mkv", video, english, subtitles)
+
+	// The canned copy has one video, audio and subtitle track
+	selection := trackSelection{Video: []mkvTrack{video}, Audio: []mkvTrack{english}, Subtitles: []mkvTrack{subtitles}}
+	_, err := verifyOutput(context.Background(), mkvmergeBackend{}, f, selection, "/test/.movie.mkv.tmp.mkv")
+	assert.NoError(t, err)
+
+	selection.Subtitles = nil
+	_, err = verifyOutput(context.Background(), mkvmergeBackend{}, f, selection, "/test/.movie.mkv.tmp.mkv")
+	assert.EqualError(t, err, "output has 1 subtitles tracks, expected 0")
+
+	// The canned copy reports no duration
+	selection.Subtitles = []mkvTrack{subtitles}
+	f.Info.Container.Properties.Duration = int64(90 * time.Minute)
+	_, err = verifyOutput(context.Background(), mkvmergeBackend{}, f, selection, "/test/.movie.mkv.tmp.mkv")
+	assert.EqualError(t, err, "output duration 0s differs from original 1h30m0s")
+}
+
+// Test that a copy failing verification never replaces the original
+func TestStripTracksVerificationFailure(t *testing.T) {
+	_, mockFS := setupPipelineTest(t)
+	withSafetyPolicy(t, config.DefaultSafetyConfig())
+	mockFS.On("Stat", "/test/movie.mkv").Return(MockFileInfo{FileSize: 1000}, nil).Once()
+	mockFS.On("Remove", "/test/.movie.mkv.tmp.mkv").Return(nil).Once()
+
+	// Dropping the subtitles does not match the canned copy, which has one
+	policy := config.DefaultCategoryPolicy()
+	policy.Languages.Subtitles = nil
+	steps, err := newPipeline(policy)
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), "/test/movie.mkv")
+
+	assert.Equal(t, fileFailed, result.Outcome)
+	assert.Equal(t, "strip_tracks: output verification failed: output has 1 subtitles tracks, expected 0", result.Error)
+	mockFS.AssertExpectations(t)
+	mockFS.AssertNotCalled(t, "Rename", mock.Anything, mock.Anything)
+}
+
+// Test that a full file system stops the remux before mkvmerge runs
+func TestStripTracksNotEnoughSpace(t *testing.T) {
+	mockCmd, mockFS := setupPipelineTest(t)
+	withSafetyPolicy(t, config.DefaultSafetyConfig())
+	diskFreeFunc = func(string) (uint64, error) { return 10 << 20, nil }
+	mockFS.On("Stat", "/test/movie.mkv").Return(MockFileInfo{FileSize: 5 << 30}, nil).Once()
+
+	steps, err := newPipeline(config.DefaultCategoryPolicy())
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), "/test/movie.mkv")
+
+	assert.Equal(t, fileFailed, result.Outcome)
+	assert.Contains(t, result.Error, "strip_tracks: not enough free space in /test")
+	assert.Equal(t, []string{"mkvmerge"}, mockCmd.Commands) // only identified
+}
+
+// Test that the original is kept in the backup directory when it is replaced
+func TestStripTracksBackup(t *testing.T) {
+	setupPipelineTest(t)
+	statFunc, renameFunc, removeFunc = os.Stat, os.Rename, os.Remove
+	policy := config.DefaultSafetyConfig()
+	policy.BackupDir = t.TempDir()
+	withSafetyPolicy(t, policy)
+
+	dir := filepath.Join(t.TempDir(), "Movie")
+	assert.NoError(t, os.Mkdir(dir, 0o755))
+	path := writeTestFile(t, dir, "movie.mkv", "original")
+
+	steps, err := newPipeline(config.DefaultCategoryPolicy())
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), path)
+
+	assert.Equal(t, fileProcessed, result.Outcome, result.Error)
+	assert.Equal(t, "Movie", filepath.Base(filepath.Dir(result.Backup)))
+	assert.True(t, filepath.IsAbs(result.Backup))
+
+	backup, err := os.ReadFile(result.Backup)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(backup))
+
+	// The fake mkvmerge writes an empty copy
+	remuxed, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, remuxed)
+}
+
+// Test that the original is restored when it cannot be replaced after the backup
+func TestStripTracksBackupRestored(t *testing.T) {
+	setupPipelineTest(t)
+	statFunc, removeFunc = os.Stat, os.Remove
+	policy := config.DefaultSafetyConfig()
+	policy.BackupDir = t.TempDir()
+	withSafetyPolicy(t, policy)
+
+	path := writeTestFile(t, t.TempDir(), "movie.mkv", "original")
+	renameFunc = func(oldpath, newpath string) error {
+		if strings.HasSuffix(oldpath, ".tmp.mkv") {
+			return os.ErrPermission
+		}
+		return os.Rename(oldpath, newpath)
+	}
+
+	steps, err := newPipeline(config.DefaultCategoryPolicy())
+	assert.NoError(t, err)
+
+	result := steps.process(context.Background(), path)
+
+	assert.Equal(t, fileFailed, result.Outcome)
+	assert.Contains(t, result.Error, "failed to replace original file")
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(content))
+}
+
+// Test that backups are copied when they live on another file system
+func TestBackupOriginalCrossDevice(t *testing.T) {
+	defer func() { renameFunc = os.Rename }()
+	backupDir := t.TempDir()
+
+	path := writeTestFile(t, t.TempDir(), "movie.mkv", "original")
+	renameFunc = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	backup, moved, err := backupOriginal(backupDir, path)
+
+	assert.NoError(t, err)
+	assert.False(t, moved)
+	content, err := os.ReadFile(backup)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(content))
+	assert.FileExists(t, path)
+}
+
+// Test that only expired backups are deleted
+func TestPruneBackups(t *testing.T) {
+	policy := config.DefaultSafetyConfig()
+	policy.BackupDir = t.TempDir()
+	policy.BackupRetention = 24 * time.Hour
+	withSafetyPolicy(t, policy)
+
+	now := time.Now()
+	expired := filepath.Join(policy.BackupDir, now.Add(-25*time.Hour).Format(backupTimeLayout))
+	recent := filepath.Join(policy.BackupDir, now.Add(-time.Hour).Format(backupTimeLayout))
+	other := filepath.Join(policy.BackupDir, "keep-me")
+	for _, dir := range []string{expired, recent, other} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "Movie"), 0o755))
+	}
+
+	pruneBackups(now)
+
+	assert.NoDirExists(t, expired)
+	assert.DirExists(t, recent)
+	assert.DirExists(t, other)
+}
+
+// Test that the DLQ reason names the failed files
+func TestFileErrors(t *testing.T) {
+	results := []fileResult{
+		{Path: "/movies/a.mkv", Outcome: fileFailed, Error: "strip_tracks: not enough free space in /movies"},
+		{Path: "/movies/b.mkv", Outcome: fileSkipped},
+		{Path: "/movies/c.mkv", Outcome: fileFailed, Error: "failed to get track info: exit status 2"},
+	}
+
+	assert.Equal(t,
+		"a.mkv: strip_tracks: not enough free space in /movies; c.mkv: failed to get track info: exit status 2",
+		fileErrors(results))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"mkvmerge-consumer/config"
+)
+
+// stripTracksStep removes the audio and subtitle tracks the language policy
+// does not keep and orders the rest by preference. With convert set, files
+// in other containers are written as MKV even when no track is removed.
+type stripTracksStep struct {
+	policy  config.LanguagePolicy
+	backend Backend
+	convert bool
+}
+
+// Name returns the configuration name of the step
+func (stripTracksStep) Name() string { return config.StepStripTracks }
+
+// Run remuxes the file with the selected tracks and replaces the original
+func (s stripTracksStep) Run(ctx context.Context, f *mediaFile) (bool, error) {
+	// Apply the language policy and check whether anything would change
+	plan := planStripTracks(f.Path, f.Info.Tracks, s.policy, s.convert)
+	selection, target := plan.Selection, plan.Target
+	if !plan.Change {
+		loggerFrom(ctx).Info("File already matches the language policy", "file", f.Path)
+		return false, nil
+	}
+
+	loggerFrom(ctx).Info("Selected tracks", "file", target,
+		"audio", languagesOf(selection.Audio), "subtitles", languagesOf(selection.Subtitles))
+
+	if target != f.Path {
+		if _, err := statFunc(target); err == nil {
+			return false, fmt.Errorf("cannot convert to %s, the file already exists", filepath.Base(target))
+		}
+	}
+
+	// Prepare output filename, in the container of the target
+	dir := filepath.Dir(f.Path)
+	basename := filepath.Base(target)
+	tmpFile := filepath.Join(dir, "."+basename+".tmp"+filepath.Ext(target))
+
+	// The copy is at most as large as the original
+	if err := checkFreeSpace(dir, f.Result.SizeBefore); err != nil {
+		return false, err
+	}
+
+	// Run the backend, never keeping its partial output
+	if err := s.backend.Remux(ctx, f, selection, tmpFile); err != nil {
+		removeFunc(tmpFile)
+		return false, err
+	}
+
+	// The checks stay the same for the whole file, also across a reload
+	safety := currentSafetyPolicy()
+	var verified *mkvInfo
+	if safety.Verify {
+		info, err := verifyOutput(ctx, s.backend, f, selection, tmpFile)
+		if err != nil {
+			removeFunc(tmpFile)
+			return false, fmt.Errorf("output verification failed: %v", err)
+		}
+		verified = &info
+	}
+
+	// Keep the original before it is replaced
+	backup, moved := "", false
+	if safety.BackupDir != "" {
+		var err error
+		if backup, moved, err = backupOriginal(safety.BackupDir, f.Path); err != nil {
+			removeFunc(tmpFile)
+			return false, fmt.Errorf("failed to back up original file: %v", err)
+		}
+		loggerFrom(ctx).Info("Backed up original file", "file", f.Path, "backup", backup)
+		f.Result.Backup = backup
+	}
+
+	// Replace original file with new file
+	if err := renameFunc(tmpFile, target); err != nil {
+		removeFunc(tmpFile) // Clean up in case of error
+		if moved {
+			if restoreErr := renameFunc(backup, f.Path); restoreErr != nil {
+				loggerFrom(ctx).Error("Error restoring original file from backup", "file", f.Path,
+					"backup", backup, "error", restoreErr)
+			}
+		}
+		return false, fmt.Errorf("failed to replace original file: %v", err)
+	}
+
+	// A converted file leaves the original behind under its old name
+	if target != f.Path {
+		if !moved {
+			if err := removeFunc(f.Path); err != nil {
+				f.Result.Warnings = append(f.Result.Warnings, fmt.Sprintf("failed to remove %s after converting it: %v", filepath.Base(f.Path), err))
+			}
+		}
+		loggerFrom(ctx).Info("Converted file", "file", f.Path, "target", target)
+		f.Path = target
+	}
+
+	f.Result.Kept = summarizeTracks(selection.Video, selection.Audio, selection.Subtitles)
+	f.Result.Removed = summarizeTracks(selection.Removed)
+
+	// Track IDs change with the remux, the following steps need the new ones
+	if verified != nil {
+		f.Info = *verified
+		return true, nil
+	}
+	info, err := s.backend.Identify(ctx, f.Path)
+	if err != nil {
+		return true, err
+	}
+	f.Info = info
+	return true, nil
+}
+
+// defaultFlagsStep marks the first audio and subtitle track of the
+// configured languages as default and clears the flag on the others
+type defaultFlagsStep struct {
+	audio     string
+	subtitles string
+}
+
+// defaultNone clears the default flag of every track of a type
+const defaultNone = "none"
+
+// Name returns the configuration name of the step
+func (defaultFlagsStep) Name() string { return config.StepDefaultFlags }
+
+// Run sets the default flags in place with mkvpropedit
+func (s defaultFlagsStep) Run(ctx context.Context, f *mediaFile) (bool, error) {
+	if !isMatroska(f.Path) {
+		loggerFrom(ctx).Info("Skipping step, it only works on MKV files", "step", s.Name(), "file", f.Path)
+		return false, nil
+	}
+
+	flags := make(map[int]bool)
+	s.chooseDefault(f.Info.Tracks, "audio", s.audio, flags)
+	s.chooseDefault(f.Info.Tracks, "subtitles", s.subtitles, flags)
+
+	args := []string{f.Path}
+	for i, track := range f.Info.Tracks {
+		isDefault, ok := flags[track.ID]
+		if !ok || isDefault == track.Properties.DefaultTrack {
+			continue
+		}
+		// mkvpropedit numbers tracks from 1 in file order, mkvmerge from 0
+		args = append(args, "--edit", fmt.Sprintf("track:%d", i+1), "--set", fmt.Sprintf("flag-default=%d", boolToInt(isDefault)))
+	}
+	if len(args) == 1 {
+		loggerFrom(ctx).Info("Default flags are already set", "file", f.Path)
+		return false, nil
+	}
+
+	if err := runMkvtoolnix(ctx, f, "mkvpropedit", args...); err != nil {
+		return false, err
+	}
+
+	for i := range f.Info.Tracks {
+		if isDefault, ok := flags[f.Info.Tracks[i].ID]; ok {
+			f.Info.Tracks[i].Properties.DefaultTrack = isDefault
+		}
+	}
+	return true, nil
+}
+
+// chooseDefault records the wanted default flag of every track of trackType.
+// Tracks are left alone when language is empty or no track matches it.
+func (defaultFlagsStep) chooseDefault(tracks []mkvTrack, trackType, language string, flags map[int]bool) {
+	if language == "" {
+		return
+	}
+
+	chosen := -1
+	if language != defaultNone {
+		for _, track := range tracks {
+			if track.Type == trackType && strings.EqualFold(track.Properties.Language, language) {
+				chosen = track.ID
+				break
+			}
+		}
+		if chosen < 0 {
+			return
+		}
+	}
+
+	for _, track := range tracks {
+		if track.Type == trackType {
+			flags[track.ID] = track.ID == chosen
+		}
+	}
+}
+
+// boolToInt converts a flag to the 0 or 1 used by mkvpropedit
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// textSubtitleCodec is the codec ID of SRT subtitles in Matroska
+const textSubtitleCodec = "S_TEXT/UTF8"
+
+// extractSubtitlesStep writes text subtitle tracks to .srt sidecar files
+// named the way Jellyfin picks them up, such as "Movie.eng.forced.srt"
+type extractSubtitlesStep struct {
+	languages []string
+}
+
+// Name returns the configuration name of the step
+func (extractSubtitlesStep) Name() string { return config.StepExtractSubtitles }
+
+// Run extracts the subtitles with mkvextract. Existing sidecars are kept.
+func (s extractSubtitlesStep) Run(ctx context.Context, f *mediaFile) (bool, error) {
+	if !isMatroska(f.Path) {
+		loggerFrom(ctx).Info("Skipping step, it only works on MKV files", "step", s.Name(), "file", f.Path)
+		return false, nil
+	}
+
+	base := strings.TrimSuffix(f.Path, filepath.Ext(f.Path))
+	args := []string{f.Path, "tracks"}
+	var sidecars []string
+	used := make(map[string]bool)
+
+	for _, track := range f.Info.Tracks {
+		if track.Type != "subtitles" || track.Properties.CodecID != textSubtitleCodec {
+			continue
+		}
+		language := track.Properties.Language
+		if language == "" {
+			language = undefinedLanguage
+		}
+		if len(s.languages) > 0 && !slices.ContainsFunc(s.languages, func(l string) bool { return strings.EqualFold(l, language) }) {
+			continue
+		}
+
+		name := base + "." + language
+		if track.Properties.ForcedTrack {
+			name += ".forced"
+		}
+		// Several tracks of the same language need distinct names
+		if used[name] {
+			name += fmt.Sprintf(".%d", track.ID)
+		}
+		used[name] = true
+
+		sidecar := name + ".srt"
+		if _, err := statFunc(sidecar); err == nil {
+			loggerFrom(ctx).Info("Subtitle sidecar already exists", "sidecar", sidecar)
+			continue
+		}
+		args = append(args, fmt.Sprintf("%d:%s", track.ID, sidecar))
+		sidecars = append(sidecars, sidecar)
+	}
+
+	if len(sidecars) == 0 {
+		return false, nil
+	}
+
+	if err := runMkvtoolnix(ctx, f, "mkvextract", args...); err != nil {
+		for _, sidecar := range sidecars {
+			removeFunc(sidecar)
+		}
+		return false, err
+	}
+
+	f.Result.Sidecars = append(f.Result.Sidecars, sidecars...)
+	return true, nil
+}
+
+// metadataStep sets the title of a file from its name and adds chapters at
+// a fixed interval to files that have none
+type metadataStep struct {
+	title           bool
+	chapterInterval time.Duration
+}
+
+// Name returns the configuration name of the step
+func (metadataStep) Name() string { return config.StepMetadata }
+
+// Run writes the metadata in place with mkvpropedit
+func (s metadataStep) Run(ctx context.Context, f *mediaFile) (bool, error) {
+	if !isMatroska(f.Path) {
+		loggerFrom(ctx).Info("Skipping step, it only works on MKV files", "step", s.Name(), "file", f.Path)
+		return false, nil
+	}
+
+	args := []string{f.Path}
+
+	title := ""
+	if s.title {
+		title = parseMediaName(filepath.Base(f.Path)).String()
+		if title != "" && title != f.Info.Container.Properties.Title {
+			args = append(args, "--edit", "info", "--set", "title="+title)
+		}
+	}
+
+	duration := time.Duration(f.Info.Container.Properties.Duration)
+	addChapters := s.chapterInterval > 0 && len(f.Info.Chapters) == 0 && duration > s.chapterInterval
+	if addChapters {
+		chapterFile := filepath.Join(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".chapters.txt")
+		if err := writeFileFunc(chapterFile, []byte(simpleChapters(duration, s.chapterInterval)), 0o644); err != nil {
+			return false, fmt.Errorf("failed to write chapter file: %v", err)
+		}
+		defer removeFunc(chapterFile)
+		args = append(args, "--chapters", chapterFile)
+	}
+
+	if len(args) == 1 {
+		return false, nil
+	}
+
+	if err := runMkvtoolnix(ctx, f, "mkvpropedit", args...); err != nil {
+		return false, err
+	}
+
+	if title != "" {
+		f.Info.Container.Properties.Title = title
+	}
+	if addChapters {
+		f.Info.Chapters = append(f.Info.Chapters, struct {
+			NumEntries int `json:"num_entries"`
+		}{NumEntries: int((duration-1)/s.chapterInterval) + 1})
+	}
+	return true, nil
+}
+
+// simpleChapters returns chapters every interval in the OGM format understood
+// by mkvpropedit
+func simpleChapters(duration, interval time.Duration) string {
+	var b strings.Builder
+	for i, start := 1, time.Duration(0); start < duration; i, start = i+1, start+interval {
+		fmt.Fprintf(&b, "CHAPTER%02d=%02d:%02d:%02d.%03d\n", i,
+			int(start.Hours()), int(start.Minutes())%60, int(start.Seconds())%60, start.Milliseconds()%1000)
+		fmt.Fprintf(&b, "CHAPTER%02dNAME=Chapter %d\n", i, i)
+	}
+	return b.String()
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ConnectionInterface defines the RabbitMQ connection operations needed by the supervisor
+type ConnectionInterface interface {
+	Channel() (ChannelInterface, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// amqpConnection adapts *amqp.Connection to ConnectionInterface
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+// Channel opens a new channel on the connection
+func (c amqpConnection) Channel() (ChannelInterface, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// dialFunc opens a new connection to the broker
+type dialFunc func() (ConnectionInterface, error)
+
+// dialAMQP returns a dialFunc connecting to the given AMQP URL
+func dialAMQP(url string, tlsConfig *tls.Config) dialFunc {
+	return func() (ConnectionInterface, error) {
+		conn, err := dialBroker(url, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return amqpConnection{conn}, nil
+	}
+}
+
+// deliveryHandler processes a single delivery received on ch. It must
+// return promptly once ctx is cancelled.
+type deliveryHandler func(ctx context.Context, ch ChannelInterface, d amqp.Delivery)
+
+// errDeliveriesClosed is returned when the broker stops delivering on a channel
+var errDeliveriesClosed = errors.New("delivery channel closed")
+
+// supervisor keeps a consumer attached to RabbitMQ. Whenever the connection
+// or channel is lost it reconnects with exponential backoff, redeclares the
+// queues, restores Qos and registers the consumer again.
+type supervisor struct {
+	dial     dialFunc
+	handle   deliveryHandler
+	workers  int
+	prefetch int
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	mu   sync.RWMutex
+	conn ConnectionInterface
+	ch   ChannelInterface
+	// changed is when the consumer last connected or disconnected
+	changed time.Time
+}
+
+// supervisorStatus describes the broker connection of a supervisor
+type supervisorStatus struct {
+	Connection bool
+	Channel    bool
+	Since      time.Time
+}
+
+// errNotConnected is returned when an operation needs the broker while it is unreachable
+var errNotConnected = errors.New("not connected to RabbitMQ")
+
+// run consumes until ctx is cancelled
+func (s *supervisor) run(ctx context.Context) error {
+	s.setActive(nil, nil)
+	delay := s.minDelay
+	var conn ConnectionInterface
+
+	defer func() {
+		if conn != nil && !conn.IsClosed() {
+			if err := conn.Close(); err != nil {
+				slog.Error("Error closing RabbitMQ connection", "error", err)
+			}
+		}
+	}()
+
+	for {
+		if conn == nil || conn.IsClosed() {
+			var err error
+			conn, err = s.dial()
+			if err != nil {
+				conn = nil
+				slog.Warn("Failed to connect to RabbitMQ", "error", err, "retry_in", delay)
+				if !sleepContext(ctx, delay) {
+					return nil
+				}
+				delay = nextDelay(delay, s.maxDelay)
+				continue
+			}
+			slog.Info("Connected to RabbitMQ")
+		}
+
+		consuming, err := s.session(ctx, conn)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// A session that got as far as consuming resets the backoff
+		if consuming {
+			delay = s.minDelay
+		}
+
+		// A recreated queue leaves nothing to wait for
+		if errors.Is(err, errQueueRecreated) {
+			slog.Info("Declaring the queues again", "reason", err)
+			continue
+		}
+
+		if conn.IsClosed() {
+			slog.Warn("RabbitMQ connection lost", "error", err)
+		} else {
+			slog.Warn("RabbitMQ channel lost", "error", err)
+		}
+		slog.Info("Reconnecting", "delay", delay)
+		if !sleepContext(ctx, delay) {
+			return nil
+		}
+		delay = nextDelay(delay, s.maxDelay)
+	}
+}
+
+// session opens a channel on conn, declares the topology and consumes until
+// the channel closes or ctx is cancelled. It reports whether the consumer
+// was registered.
+func (s *supervisor) session(ctx context.Context, conn ConnectionInterface) (bool, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
+	slog.Info("Channel opened")
+
+	// Buffered so the client library never blocks while reporting a close
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	msgs, err := s.setup(ctx, ch, conn.Channel)
+	if err != nil {
+		return false, err
+	}
+
+	s.setActive(conn, ch)
+	defer s.setActive(nil, nil)
+
+	// Handlers stop with the session, a lost channel cannot settle their
+	// messages anyway
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Deliveries are handed to a pool of workers, so several messages are
+	// processed at once
+	jobs := make(chan amqp.Delivery)
+	var inFlight sync.WaitGroup
+	for i := 0; i < max(s.workers, 1); i++ {
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			for d := range jobs {
+				s.handle(sessionCtx, ch, d)
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Cancellation stops the handlers, wait for them to settle
+			close(jobs)
+			inFlight.Wait()
+			return true, ctx.Err()
+		case d, ok := <-msgs:
+			if !ok {
+				// Cancel the in-flight messages rather than finishing work whose
+				// acks would fail. The broker redelivers them on the new channel,
+				// once their handlers stopped so none is processed twice at the
+				// same time.
+				cancel()
+				close(jobs)
+				inFlight.Wait()
+				return true, closeReason(chClosed)
+			}
+			select {
+			case jobs <- d:
+			case <-ctx.Done():
+				close(jobs)
+				inFlight.Wait()
+				return true, ctx.Err()
+			}
+		}
+	}
+}
+
+// setup declares the queues, restores Qos and registers the consumer
+func (s *supervisor) setup(ctx context.Context, ch ChannelInterface, openChannel func() (ChannelInterface, error)) (<-chan amqp.Delivery, error) {
+	// Declare queues (ensures they exist)
+	if _, err := ensureMainQueueWithDLX(ch, openChannel); err != nil { // Use DLX-configured queue
+		return nil, err
+	}
+	if err := ensureTaskRouting(ch, openChannel); err != nil { // Per-category queues
+		return nil, err
+	}
+	if _, err := ensureQueueExists(ch, doneQueueName); err != nil { // Ensure done queue exists
+		return nil, err
+	}
+	if err := ensureRetryQueues(ch); err != nil { // Delayed redelivery queues
+		return nil, err
+	}
+
+	// Set QoS (prefetch count), shared by the consumers of all queues
+	queues := consumedQueues()
+	if err := ch.Qos(s.prefetch, 0, len(queues) > 1); err != nil {
+		return nil, fmt.Errorf("failed to set QoS: %w", err)
+	}
+
+	// Register consumer
+	msgs, err := consumeQueues(ctx, ch, queues)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Consumer registered, waiting for messages", "queues", queues)
+
+	return msgs, nil
+}
+
+// setActive records the connection and channel currently in use
+func (s *supervisor) setActive(conn ConnectionInterface, ch ChannelInterface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn, s.ch = conn, ch
+	s.changed = time.Now()
+
+	if ch != nil {
+		brokerConnected.Set(1)
+	} else {
+		brokerConnected.Set(0)
+	}
+}
+
+// connected reports whether the supervisor currently has a live consumer
+func (s *supervisor) connected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn != nil && s.ch != nil && !s.conn.IsClosed()
+}
+
+// status reports the state of the connection and channel and since when
+// the consumer has been connected or disconnected
+func (s *supervisor) status() supervisorStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return supervisorStatus{
+		Connection: s.conn != nil && !s.conn.IsClosed(),
+		Channel:    s.ch != nil,
+		Since:      s.changed,
+	}
+}
+
+// inspectQueues returns the number of ready messages in each queue
+func (s *supervisor) inspectQueues(names ...string) (map[string]int, error) {
+	depths := make(map[string]int, len(names))
+	err := s.useChannel(func(ch ChannelInterface) error {
+		for _, name := range names {
+			queue, err := ch.QueueInspect(name)
+			if err != nil {
+				return fmt.Errorf("failed to inspect queue '%s': %w", name, err)
+			}
+			depths[name] = queue.Messages
+		}
+		return nil
+	})
+	return depths, err
+}
+
+// useChannel runs fn on a new channel of the current connection. The
+// channel is its own, so a failed operation cannot close the consumer channel.
+func (s *supervisor) useChannel(fn func(ch ChannelInterface) error) error {
+	s.mu.RLock()
+	conn := s.conn
+	s.mu.RUnlock()
+	if conn == nil || conn.IsClosed() {
+		return errNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
+
+	return fn(ch)
+}
+
+// closeReason returns the error reported when a channel closed, if any
+func closeReason(chClosed chan *amqp.Error) error {
+	select {
+	case err, ok := <-chClosed:
+		if ok && err != nil {
+			return err
+		}
+	default:
+	}
+	return errDeliveriesClosed
+}
+
+// nextDelay doubles delay without exceeding limit
+func nextDelay(delay, limit time.Duration) time.Duration {
+	delay *= 2
+	if delay > limit {
+		return limit
+	}
+	return delay
+}
+
+// sleepContext waits for d and reports false if ctx was cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
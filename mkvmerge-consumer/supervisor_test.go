@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeConnection implements ConnectionInterface on top of mock channels
+type fakeConnection struct {
+	mu       sync.Mutex
+	channels []ChannelInterface
+	opened   int
+	closed   bool
+}
+
+func (c *fakeConnection) Channel() (ChannelInterface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opened >= len(c.channels) {
+		return nil, errors.New("no more channels")
+	}
+	ch := c.channels[c.opened]
+	c.opened++
+	return ch, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return receiver
+}
+
+func (c *fakeConnection) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *fakeConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// fakeDialer hands out prepared connections, failing when it runs out
+type fakeDialer struct {
+	mu    sync.Mutex
+	conns []*fakeConnection
+	calls int
+}
+
+func (f *fakeDialer) dial() (ConnectionInterface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := f.calls
+	f.calls++
+	if call >= len(f.conns) || f.conns[call] == nil {
+		return nil, errors.New("broker unavailable")
+	}
+	return f.conns[call], nil
+}
+
+func (f *fakeDialer) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// newConsumingChannel returns a mock channel that accepts the consumer setup
+// and delivers whatever is sent on the returned channel
+func newConsumingChannel() (*MockChannelInterface, chan amqp.Delivery) {
+	deliveries := make(chan amqp.Delivery)
+
+	mockChannel := new(MockChannelInterface)
+	mockChannel.On("NotifyClose", mock.Anything).Return()
+	mockChannel.On("ExchangeDeclare", "dlx", "direct", true, false, false, false, mock.Anything).Return(nil)
+	mockChannel.On("QueueDeclare", mock.Anything, true, false, false, false, mock.Anything).Return(amqp.Queue{Name: "test-queue"}, nil)
+	mockChannel.On("QueueBind", mock.Anything, mock.Anything, "dlx", false, mock.Anything).Return(nil)
+	mockChannel.On("Qos", mock.Anything, 0, false).Return(nil)
+	mockChannel.On("Consume", "test-queue", "", false, false, false, false, mock.Anything).Return((<-chan amqp.Delivery)(deliveries), nil)
+	mockChannel.On("Close").Return(nil)
+
+	return mockChannel, deliveries
+}
+
+// newTestSupervisor returns a supervisor that records handled message bodies
+func newTestSupervisor(dialer *fakeDialer) (*supervisor, chan string) {
+	queueName = "test-queue"
+	doneQueueName = "test-done"
+	dlqQueueName = "test-dlq"
+
+	handled := make(chan string, 10)
+	sup := &supervisor{
+		dial: dialer.dial,
+		handle: func(ctx context.Context, ch ChannelInterface, d amqp.Delivery) {
+			handled <- string(d.Body)
+		},
+		prefetch: 1,
+		minDelay: time.Millisecond,
+		maxDelay: 4 * time.Millisecond,
+	}
+	return sup, handled
+}
+
+// startSupervisor runs sup until the test ends
+func startSupervisor(t *testing.T, sup *supervisor) {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- sup.run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-result:
+		case <-time.After(2 * time.Second):
+			t.Error("supervisor did not stop after cancellation")
+		}
+	})
+}
+
+// waitHandled waits for the next handled message body
+func waitHandled(t *testing.T, handled chan string) string {
+	t.Helper()
+	select {
+	case body := <-handled:
+		return body
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message to be handled")
+		return ""
+	}
+}
+
+// Test that the supervisor retries the initial connection and reconnects after the broker restarts
+func TestSupervisorReconnectsAfterConnectionLoss(t *testing.T) {
+	firstChannel, firstDeliveries := newConsumingChannel()
+	secondChannel, secondDeliveries := newConsumingChannel()
+	firstConn := &fakeConnection{channels: []ChannelInterface{firstChannel}}
+	secondConn := &fakeConnection{channels: []ChannelInterface{secondChannel}}
+
+	// The first dial fails, then the broker comes up, restarts and comes back
+	dialer := &fakeDialer{conns: []*fakeConnection{nil, firstConn, secondConn}}
+	sup, handled := newTestSupervisor(dialer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- sup.run(ctx) }()
+
+	firstDeliveries <- amqp.Delivery{Body: []byte("first")}
+	assert.Equal(t, "first", waitHandled(t, handled))
+	assert.True(t, sup.connected())
+
+	// Simulate a broker restart: the connection drops and deliveries stop
+	firstConn.Close()
+	close(firstDeliveries)
+
+	secondDeliveries <- amqp.Delivery{Body: []byte("second")}
+	assert.Equal(t, "second", waitHandled(t, handled))
+
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("supervisor did not stop after cancellation")
+	}
+
+	assert.Equal(t, 3, dialer.callCount())
+	assert.False(t, sup.connected())
+	assert.True(t, secondConn.IsClosed())
+	firstChannel.AssertCalled(t, "Qos", 1, 0, false)
+	secondChannel.AssertCalled(t, "Qos", 1, 0, false)
+	secondChannel.AssertCalled(t, "ExchangeDeclare", "dlx", "direct", true, false, false, false, mock.Anything)
+}
+
+// Test that a closed channel is reopened on the same connection
+func TestSupervisorRecoversChannel(t *testing.T) {
+	firstChannel, firstDeliveries := newConsumingChannel()
+	secondChannel, secondDeliveries := newConsumingChannel()
+	conn := &fakeConnection{channels: []ChannelInterface{firstChannel, secondChannel}}
+
+	dialer := &fakeDialer{conns: []*fakeConnection{conn}}
+	sup, handled := newTestSupervisor(dialer)
+
+	startSupervisor(t, sup)
+
+	firstDeliveries <- amqp.Delivery{Body: []byte("first")}
+	assert.Equal(t, "first", waitHandled(t, handled))
+
+	// Only the channel closes, the connection stays up
+	close(firstDeliveries)
+
+	secondDeliveries <- amqp.Delivery{Body: []byte("second")}
+	assert.Equal(t, "second", waitHandled(t, handled))
+
+	assert.Equal(t, 1, dialer.callCount())
+	firstChannel.AssertCalled(t, "Close")
+}
+
+// Test that a lost channel cancels the message in flight instead of waiting
+// for it before reconnecting
+func TestSupervisorCancelsInFlightOnChannelLoss(t *testing.T) {
+	firstChannel, firstDeliveries := newConsumingChannel()
+	secondChannel, secondDeliveries := newConsumingChannel()
+	conn := &fakeConnection{channels: []ChannelInterface{firstChannel, secondChannel}}
+
+	dialer := &fakeDialer{conns: []*fakeConnection{conn}}
+	sup, handled := newTestSupervisor(dialer)
+	sup.workers = 2
+
+	// The first message runs until its session is cancelled
+	started := make(chan struct{})
+	sup.handle = func(ctx context.Context, ch ChannelInterface, d amqp.Delivery) {
+		if string(d.Body) == "slow" {
+			close(started)
+			<-ctx.Done()
+		}
+		handled <- string(d.Body)
+	}
+
+	startSupervisor(t, sup)
+
+	firstDeliveries <- amqp.Delivery{Body: []byte("slow")}
+	<-started
+	close(firstDeliveries)
+	assert.Equal(t, "slow", waitHandled(t, handled))
+
+	secondDeliveries <- amqp.Delivery{Body: []byte("second")}
+	assert.Equal(t, "second", waitHandled(t, handled))
+}
+
+// Test that a failed topology declaration is retried instead of exiting
+func TestSupervisorRetriesFailedSetup(t *testing.T) {
+	failingChannel := new(MockChannelInterface)
+	failingChannel.On("NotifyClose", mock.Anything).Return()
+	failingChannel.On("ExchangeDeclare", "dlx", "direct", true, false, false, false, mock.Anything).
+		Return(&amqp.Error{Code: 403, Reason: "ACCESS_REFUSED"})
+	failingChannel.On("Close").Return(nil)
+
+	workingChannel, deliveries := newConsumingChannel()
+	conn := &fakeConnection{channels: []ChannelInterface{failingChannel, workingChannel}}
+
+	dialer := &fakeDialer{conns: []*fakeConnection{conn}}
+	sup, handled := newTestSupervisor(dialer)
+
+	startSupervisor(t, sup)
+
+	deliveries <- amqp.Delivery{Body: []byte("message")}
+	assert.Equal(t, "message", waitHandled(t, handled))
+	failingChannel.AssertExpectations(t)
+}
+
+// Test that deliveries are spread over the worker pool
+func TestSupervisorWorkerPool(t *testing.T) {
+	mockChannel, deliveries := newConsumingChannel()
+	conn := &fakeConnection{channels: []ChannelInterface{mockChannel}}
+
+	dialer := &fakeDialer{conns: []*fakeConnection{conn}}
+	sup, handled := newTestSupervisor(dialer)
+	sup.workers = 3
+	sup.prefetch = 3
+
+	// Every handler blocks until all three messages are being processed
+	var started sync.WaitGroup
+	started.Add(3)
+	sup.handle = func(ctx context.Context, ch ChannelInterface, d amqp.Delivery) {
+		started.Done()
+		started.Wait()
+		handled <- string(d.Body)
+	}
+
+	startSupervisor(t, sup)
+
+	for _, body := range []string{"one", "two", "three"} {
+		deliveries <- amqp.Delivery{Body: []byte(body)}
+	}
+
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		bodies = append(bodies, waitHandled(t, handled))
+	}
+	assert.ElementsMatch(t, []string{"one", "two", "three"}, bodies)
+	mockChannel.AssertCalled(t, "Qos", 3, 0, false)
+}
+
+// Test for nextDelay backoff growth
+func TestNextDelay(t *testing.T) {
+	assert.Equal(t, 2*time.Second, nextDelay(time.Second, time.Minute))
+	assert.Equal(t, time.Minute, nextDelay(40*time.Second, time.Minute))
+	assert.Equal(t, time.Minute, nextDelay(time.Minute, time.Minute))
+}
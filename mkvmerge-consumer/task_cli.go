@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// publishCommand publishes a task for a torrent, for download clients that
+// can run a program when a download completes
+func publishCommand(ch ChannelInterface, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("publish", flag.ContinueOnError)
+	flags.SetOutput(out)
+	priority := flags.Int("priority", -1, "priority of the task, by default the one of its category")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: publish [-priority n] <category> <torrent name>")
+	}
+
+	msg := Message{Category: flags.Arg(0), TorrentName: flags.Arg(1)}
+	if _, ok := categoryPath(msg.Category); !ok {
+		return fmt.Errorf("unknown category: %s", msg.Category)
+	}
+	if *priority >= 0 {
+		msg.Priority = priority
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task message: %v", err)
+	}
+	if err := publishTask(ch, body, ""); err != nil {
+		return fmt.Errorf("failed to publish task: %w", err)
+	}
+	fmt.Fprintf(out, "Published %s to %s with priority %d\n", msg.TorrentName, taskQueueFor(msg.Category), taskPriority(msg))
+	return nil
+}
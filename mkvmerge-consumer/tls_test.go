@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM
+// files and returns their paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mkvmerge-consumer"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// Test that no TLS configuration is built when TLS is disabled
+func TestNewTLSConfigDisabled(t *testing.T) {
+	tlsConfig, err := newTLSConfig(config.TLSConfig{CAFile: "/missing.pem"})
+
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+// Test for loading the CA bundle and the client certificate
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	tlsConfig, err := newTLSConfig(config.TLSConfig{
+		Enabled:    true,
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "rabbitmq.internal",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbitmq.internal", tlsConfig.ServerName)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+}
+
+// Test that unreadable or invalid files are reported
+func TestNewTLSConfigErrors(t *testing.T) {
+	certFile, _ := writeTestCertificate(t)
+
+	_, err := newTLSConfig(config.TLSConfig{Enabled: true, CAFile: "/missing.pem"})
+	assert.ErrorContains(t, err, "failed to read CA file")
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o644))
+	_, err = newTLSConfig(config.TLSConfig{Enabled: true, CAFile: notPEM})
+	assert.ErrorContains(t, err, "no certificates found")
+
+	_, err = newTLSConfig(config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: "/missing.pem"})
+	assert.ErrorContains(t, err, "failed to load client certificate")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mkvmerge-consumer/config"
+)
+
+// undefinedLanguage is the ISO 639-2 code mkvmerge reports for untagged tracks
+const undefinedLanguage = "und"
+
+// mkvTrack is a single track as reported by mkvmerge -J
+type mkvTrack struct {
+	ID         int    `json:"id"`
+	Type       string `json:"type"`
+	Codec      string `json:"codec"`
+	Properties struct {
+		Language     string `json:"language"`
+		ForcedTrack  bool   `json:"forced_track"`
+		DefaultTrack bool   `json:"default_track"`
+		CodecID      string `json:"codec_id"`
+		// NumberOfBytes is the track size from the statistics tags mkvmerge
+		// writes, 0 when unknown
+		NumberOfBytes tagInt `json:"tag_number_of_bytes"`
+	} `json:"properties"`
+}
+
+// tagInt is a number mkvmerge may report either as a JSON number or as a string
+type tagInt int64
+
+// UnmarshalJSON accepts both forms and treats anything else as unknown
+func (n *tagInt) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		value = 0
+	}
+	*n = tagInt(value)
+	return nil
+}
+
+// mkvInfo is the part of the mkvmerge -J output we rely on
+type mkvInfo struct {
+	Container struct {
+		Properties struct {
+			// Duration is in nanoseconds
+			Duration int64  `json:"duration"`
+			Title    string `json:"title"`
+		} `json:"properties"`
+	} `json:"container"`
+	Chapters []struct {
+		NumEntries int `json:"num_entries"`
+	} `json:"chapters"`
+	Tracks []mkvTrack `json:"tracks"`
+}
+
+// trackSelection is the outcome of applying a language policy to a file
+type trackSelection struct {
+	Video     []mkvTrack
+	Audio     []mkvTrack
+	Subtitles []mkvTrack
+	Removed   []mkvTrack
+	// Reordered is set when the kept tracks are not in their original order
+	Reordered bool
+	// Skip is set when the fallback asks to leave the file untouched
+	Skip bool
+}
+
+// NeedsRemux reports whether applying the selection would change the file
+func (s trackSelection) NeedsRemux() bool {
+	return !s.Skip && (len(s.Removed) > 0 || s.Reordered)
+}
+
+// selectTracks applies a language policy to the tracks of a file. Video
+// tracks are always kept; audio and subtitle tracks are kept when their
+// language is listed in the policy and ordered by that list.
+func selectTracks(tracks []mkvTrack, policy config.LanguagePolicy) trackSelection {
+	var sel trackSelection
+	var audio, subtitles []mkvTrack
+
+	for _, track := range tracks {
+		switch track.Type {
+		case "video":
+			sel.Video = append(sel.Video, track)
+		case "audio":
+			audio = append(audio, track)
+		case "subtitles":
+			subtitles = append(subtitles, track)
+		}
+	}
+
+	// Audio falls back according to the policy when nothing matches
+	sel.Audio = matchLanguages(audio, policy.Audio, policy.KeepUndefined, false)
+	if len(sel.Audio) == 0 && len(audio) > 0 {
+		switch policy.Fallback {
+		case config.FallbackFirst:
+			sel.Audio = audio[:1]
+		case config.FallbackSkip:
+			sel.Skip = true
+		default:
+			sel.Audio = audio
+		}
+	}
+
+	sel.Subtitles = matchLanguages(subtitles, policy.Subtitles, policy.KeepUndefined, policy.KeepForcedSubtitles)
+
+	kept := make(map[int]bool)
+	for _, group := range [][]mkvTrack{sel.Video, sel.Audio, sel.Subtitles} {
+		for _, track := range group {
+			kept[track.ID] = true
+		}
+	}
+	for _, track := range tracks {
+		if (track.Type == "audio" || track.Type == "subtitles") && !kept[track.ID] {
+			sel.Removed = append(sel.Removed, track)
+		}
+	}
+
+	sel.Reordered = !inSourceOrder(sel.Audio) || !inSourceOrder(sel.Subtitles)
+	return sel
+}
+
+// tracksPlan is what strip_tracks does to a file
+type tracksPlan struct {
+	Selection trackSelection
+	// Target is the path of the file afterwards, which differs from the
+	// original when the file is converted to MKV
+	Target string
+	// Change is set when the file is remuxed or converted
+	Change bool
+}
+
+// planStripTracks decides how strip_tracks handles a file with the given
+// tracks, without touching the file
+func planStripTracks(path string, tracks []mkvTrack, policy config.LanguagePolicy, convert bool) tracksPlan {
+	plan := tracksPlan{Selection: selectTracks(tracks, policy), Target: path}
+	if convert && !isMatroska(path) {
+		plan.Target = strings.TrimSuffix(path, filepath.Ext(path)) + ".mkv"
+	}
+	plan.Change = !plan.Selection.Skip && (plan.Selection.NeedsRemux() || plan.Target != path)
+	return plan
+}
+
+// matchLanguages returns the tracks whose language appears in languages,
+// ordered by the position of that language in the list
+func matchLanguages(tracks []mkvTrack, languages []string, keepUndefined, keepForced bool) []mkvTrack {
+	var matched []mkvTrack
+	taken := make(map[int]bool)
+
+	for _, language := range languages {
+		for _, track := range tracks {
+			if !taken[track.ID] && strings.EqualFold(track.Properties.Language, language) {
+				matched = append(matched, track)
+				taken[track.ID] = true
+			}
+		}
+	}
+
+	// Undefined and forced tracks keep their original position after the matches
+	for _, track := range tracks {
+		if taken[track.ID] {
+			continue
+		}
+		undefined := track.Properties.Language == "" || track.Properties.Language == undefinedLanguage
+		if (keepUndefined && undefined) || (keepForced && track.Properties.ForcedTrack) {
+			matched = append(matched, track)
+			taken[track.ID] = true
+		}
+	}
+
+	return matched
+}
+
+// inSourceOrder reports whether tracks are sorted by their ID
+func inSourceOrder(tracks []mkvTrack) bool {
+	for i := 1; i < len(tracks); i++ {
+		if tracks[i].ID < tracks[i-1].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// mkvmergeArgs builds the mkvmerge arguments that write the selection to output
+func (s trackSelection) mkvmergeArgs(input, output string) []string {
+	args := []string{"-o", output}
+
+	if len(s.Video) > 0 {
+		args = append(args, "--video-tracks", join(trackIDs(s.Video), ","))
+	}
+
+	if len(s.Audio) > 0 {
+		args = append(args, "--audio-tracks", join(trackIDs(s.Audio), ","))
+	}
+
+	if len(s.Subtitles) > 0 {
+		args = append(args, "--subtitle-tracks", join(trackIDs(s.Subtitles), ","))
+	} else {
+		args = append(args, "--no-subtitles")
+	}
+
+	// Only a single input file is used, so every track belongs to file ID 0
+	if s.Reordered {
+		var order []string
+		for _, group := range [][]mkvTrack{s.Video, s.Audio, s.Subtitles} {
+			for _, track := range group {
+				order = append(order, fmt.Sprintf("0:%d", track.ID))
+			}
+		}
+		args = append(args, "--track-order", join(order, ","))
+	}
+
+	return append(args, input)
+}
+
+// trackIDs returns the IDs of tracks as strings
+func trackIDs(tracks []mkvTrack) []string {
+	ids := make([]string, 0, len(tracks))
+	for _, track := range tracks {
+		ids = append(ids, fmt.Sprintf("%d", track.ID))
+	}
+	return ids
+}
+
+// languagesOf returns the distinct languages of tracks, in order of appearance
+func languagesOf(tracks []mkvTrack) []string {
+	var languages []string
+	seen := make(map[string]bool)
+	for _, track := range tracks {
+		language := track.Properties.Language
+		if language == "" {
+			language = undefinedLanguage
+		}
+		if !seen[language] {
+			languages = append(languages, language)
+			seen[language] = true
+		}
+	}
+	return languages
+}
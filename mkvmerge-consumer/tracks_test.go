@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"mkvmerge-consumer/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTrack builds an mkvTrack for selection tests
+func newTrack(id int, trackType, language string, forced bool) mkvTrack {
+	track := mkvTrack{ID: id, Type: trackType}
+	track.Properties.Language = language
+	track.Properties.ForcedTrack = forced
+	return track
+}
+
+// Test for selectTracks with the built-in default policy
+func TestSelectTracksDefaultPolicy(t *testing.T) {
+	tracks := []mkvTrack{
+		newTrack(0, "video", "eng", false),
+		newTrack(1, "audio", "eng", false),
+		newTrack(2, "audio", "spa", false),
+		newTrack(3, "subtitles", "eng", false),
+		newTrack(4, "subtitles", "spa", true),
+	}
+
+	sel := selectTracks(tracks, config.DefaultCategoryPolicy().Languages)
+
+	assert.Equal(t, []string{"0"}, trackIDs(sel.Video))
+	assert.Equal(t, []string{"1"}, trackIDs(sel.Audio))
+	assert.Equal(t, []string{"3"}, trackIDs(sel.Subtitles))
+	assert.Equal(t, []string{"2", "4"}, trackIDs(sel.Removed))
+	assert.True(t, sel.NeedsRemux())
+}
+
+// Test for selectTracks when the file already matches the policy
+func TestSelectTracksNothingToRemove(t *testing.T) {
+	tracks := []mkvTrack{
+		newTrack(0, "video", "eng", false),
+		newTrack(1, "audio", "eng", false),
+		newTrack(2, "subtitles", "eng", false),
+	}
+
+	sel := selectTracks(tracks, config.DefaultCategoryPolicy().Languages)
+
+	assert.Empty(t, sel.Removed)
+	assert.False(t, sel.NeedsRemux())
+}
+
+// Test for selectTracks keeping several languages in preference order
+func TestSelectTracksOrderedLanguages(t *testing.T) {
+	policy := config.LanguagePolicy{
+		Audio:     []string{"geo", "eng"},
+		Subtitles: []string{"geo", "rus"},
+		Fallback:  config.FallbackAll,
+	}
+	tracks := []mkvTrack{
+		newTrack(0, "video", "und", false),
+		newTrack(1, "audio", "eng", false),
+		newTrack(2, "audio", "rus", false),
+		newTrack(3, "audio", "geo", false),
+		newTrack(4, "subtitles", "rus", false),
+	}
+
+	sel := selectTracks(tracks, policy)
+
+	assert.Equal(t, []string{"3", "1"}, trackIDs(sel.Audio))
+	assert.Equal(t, []string{"4"}, trackIDs(sel.Subtitles))
+	assert.Equal(t, []string{"2"}, trackIDs(sel.Removed))
+	assert.True(t, sel.Reordered)
+
+	args := sel.mkvmergeArgs("in.mkv", "out.mkv")
+	assert.Equal(t, []string{
+		"-o", "out.mkv",
+		"--video-tracks", "0",
+		"--audio-tracks", "3,1",
+		"--subtitle-tracks", "4",
+		"--track-order", "0:0,0:3,0:1,0:4",
+		"in.mkv",
+	}, args)
+}
+
+// Test for selectTracks with forced and undefined tracks
+func TestSelectTracksForcedAndUndefined(t *testing.T) {
+	tracks := []mkvTrack{
+		newTrack(0, "video", "eng", false),
+		newTrack(1, "audio", "eng", false),
+		newTrack(2, "audio", "und", false),
+		newTrack(3, "subtitles", "spa", true),
+		newTrack(4, "subtitles", "", false),
+		newTrack(5, "subtitles", "fre", false),
+	}
+
+	policy := config.DefaultCategoryPolicy().Languages
+	policy.KeepForcedSubtitles = true
+	policy.KeepUndefined = true
+
+	sel := selectTracks(tracks, policy)
+
+	assert.Equal(t, []string{"1", "2"}, trackIDs(sel.Audio))
+	assert.Equal(t, []string{"3", "4"}, trackIDs(sel.Subtitles))
+	assert.Equal(t, []string{"5"}, trackIDs(sel.Removed))
+}
+
+// Test for selectTracks fallback modes when no audio matches
+func TestSelectTracksFallback(t *testing.T) {
+	tracks := []mkvTrack{
+		newTrack(0, "video", "jpn", false),
+		newTrack(1, "audio", "jpn", false),
+		newTrack(2, "audio", "kor", false),
+		newTrack(3, "subtitles", "eng", false),
+	}
+
+	testCases := []struct {
+		fallback string
+		audio    []string
+		skip     bool
+	}{
+		{config.FallbackAll, []string{"1", "2"}, false},
+		{config.FallbackFirst, []string{"1"}, false},
+		{config.FallbackSkip, nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.fallback, func(t *testing.T) {
+			policy := config.DefaultCategoryPolicy().Languages
+			policy.Fallback = tc.fallback
+
+			sel := selectTracks(tracks, policy)
+
+			if tc.audio == nil {
+				assert.Empty(t, sel.Audio)
+			} else {
+				assert.Equal(t, tc.audio, trackIDs(sel.Audio))
+			}
+			assert.Equal(t, tc.skip, sel.Skip)
+			if tc.skip {
+				assert.False(t, sel.NeedsRemux())
+			}
+		})
+	}
+}
+
+// Test for policyForCategory
+func TestPolicyForCategory(t *testing.T) {
+	origPolicies, origDefault := CategoryPolicyMap, defaultPolicy
+	defer func() { CategoryPolicyMap, defaultPolicy = origPolicies, origDefault }()
+
+	georgian := config.DefaultCategoryPolicy()
+	georgian.Languages.Audio = []string{"geo"}
+	CategoryPolicyMap = map[string]config.CategoryPolicy{"local-georgian": georgian}
+	defaultPolicy = config.DefaultCategoryPolicy()
+
+	assert.Equal(t, []string{"geo"}, policyForCategory("local-georgian").Languages.Audio)
+	assert.Equal(t, []string{"eng"}, policyForCategory("local-movies").Languages.Audio)
+}
+
+// Test for planStripTracks deciding whether a file changes and where it ends up
+func TestPlanStripTracks(t *testing.T) {
+	policy := config.DefaultCategoryPolicy().Languages
+	englishOnly := []mkvTrack{newTrack(0, "video", "eng", false), newTrack(1, "audio", "eng", false)}
+	withSpanish := append(englishOnly, newTrack(2, "audio", "spa", false))
+
+	plan := planStripTracks("/movies/a.mkv", withSpanish, policy, false)
+	assert.True(t, plan.Change)
+	assert.Equal(t, "/movies/a.mkv", plan.Target)
+	assert.Len(t, plan.Selection.Removed, 1)
+
+	plan = planStripTracks("/movies/a.mkv", englishOnly, policy, true)
+	assert.False(t, plan.Change)
+
+	// Converting to MKV changes the file even when every track is kept
+	plan = planStripTracks("/movies/a.mp4", englishOnly, policy, true)
+	assert.True(t, plan.Change)
+	assert.Equal(t, "/movies/a.mkv", plan.Target)
+}
+
+// Test that track sizes are read from numbers and strings alike
+func TestTagIntUnmarshal(t *testing.T) {
+	var track mkvTrack
+	assert.NoError(t, json.Unmarshal([]byte(`{"properties": {"tag_number_of_bytes": "1234"}}`), &track))
+	assert.Equal(t, tagInt(1234), track.Properties.NumberOfBytes)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"properties": {"tag_number_of_bytes": 42}}`), &track))
+	assert.Equal(t, tagInt(42), track.Properties.NumberOfBytes)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"properties": {"tag_number_of_bytes": "n/a"}}`), &track))
+	assert.Equal(t, tagInt(0), track.Properties.NumberOfBytes)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// folderWatcher turns new entries of the category directories into task
+// messages once nothing has changed in them for the quiet period. Entries
+// that exist at startup or were already submitted are left alone, so the
+// consumer's own changes never trigger another run.
+type folderWatcher struct {
+	fsw   *fsnotify.Watcher
+	quiet time.Duration
+
+	mu sync.Mutex
+	// bases maps each watched category directory to its category
+	bases map[string]string
+	// pending holds the entries waiting for the quiet period to pass
+	pending map[string]*pendingEntry
+	// submitted holds the entries that existed at startup or were submitted
+	submitted map[string]bool
+	// stopped is set once run returns, so failed entries are not rearmed
+	stopped bool
+}
+
+// pendingEntry is a new file or folder of a category directory
+type pendingEntry struct {
+	msg   Message
+	timer *time.Timer
+	// dirs lists the watched directories inside the entry
+	dirs []string
+}
+
+// newFolderWatcher watches the directories of the given categories
+func newFolderWatcher(categories map[string]string, quiet time.Duration) (*folderWatcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	w := &folderWatcher{
+		fsw:       fsw,
+		quiet:     quiet,
+		bases:     make(map[string]string),
+		pending:   make(map[string]*pendingEntry),
+		submitted: make(map[string]bool),
+	}
+	if err := w.setCategories(categories); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// setCategories watches the directories of the given categories from now
+// on, and stops watching those of categories no longer configured
+func (w *folderWatcher) setCategories(categories map[string]string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	bases := make(map[string]string, len(categories))
+	for category, dir := range categories {
+		bases[filepath.Clean(dir)] = category
+	}
+
+	for dir, category := range w.bases {
+		if _, ok := bases[dir]; !ok {
+			w.fsw.Remove(dir)
+			delete(w.bases, dir)
+			slog.Info("Stopped watching for new folders", "dir", dir, "category", category)
+		}
+	}
+
+	for dir, category := range bases {
+		if _, ok := w.bases[dir]; ok {
+			w.bases[dir] = category
+			continue
+		}
+		if err := w.fsw.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+		w.bases[dir] = category
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			w.submitted[filepath.Join(dir, entry.Name())] = true
+		}
+		slog.Info("Watching for new folders", "dir", dir, "category", category)
+	}
+	return nil
+}
+
+// run handles file system events until ctx is cancelled. submit is called
+// for every entry that became quiet; when it fails the entry is submitted
+// again after another quiet period.
+func (w *folderWatcher) run(ctx context.Context, submit func(Message) error) {
+	defer w.fsw.Close()
+
+	for {
+		select {
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handle(event, submit)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Watcher error", "error", err)
+		case <-ctx.Done():
+			w.mu.Lock()
+			w.stopped = true
+			for _, entry := range w.pending {
+				entry.timer.Stop()
+			}
+			w.mu.Unlock()
+			return
+		}
+	}
+}
+
+// handle records activity in a category directory
+func (w *folderWatcher) handle(event fsnotify.Event, submit func(Message) error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	path := filepath.Clean(event.Name)
+	entryPath, category, ok := w.entryOf(path)
+	if !ok || strings.HasPrefix(filepath.Base(entryPath), ".") {
+		return
+	}
+
+	// The entry itself went away, a new one of the same name is new again
+	if path == entryPath && event.Has(fsnotify.Remove|fsnotify.Rename) {
+		if entry, ok := w.pending[entryPath]; ok {
+			entry.timer.Stop()
+			w.unwatch(entry)
+			delete(w.pending, entryPath)
+		}
+		delete(w.submitted, entryPath)
+		return
+	}
+
+	entry, ok := w.pending[entryPath]
+	if !ok {
+		if w.submitted[entryPath] || path != entryPath || !event.Has(fsnotify.Create) {
+			return
+		}
+		entry = &pendingEntry{msg: Message{TorrentName: filepath.Base(entryPath), Category: category}}
+		entry.timer = time.AfterFunc(w.quiet, func() { w.fire(entryPath, submit) })
+		w.pending[entryPath] = entry
+		slog.Info("New entry, waiting until it has been quiet", "category", category, "entry", entryPath, "quiet", w.quiet)
+	} else {
+		entry.timer.Reset(w.quiet)
+	}
+
+	// Follow the directories of the entry to see when it stops changing
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			w.watchTree(entry, path)
+		}
+	}
+}
+
+// entryOf returns the top-level entry of a category directory containing path
+func (w *folderWatcher) entryOf(path string) (string, string, bool) {
+	for dir, category := range w.bases {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		first, _, _ := strings.Cut(rel, string(filepath.Separator))
+		return filepath.Join(dir, first), category, true
+	}
+	return "", "", false
+}
+
+// watchTree adds watches for dir and every directory below it
+func (w *folderWatcher) watchTree(entry *pendingEntry, dir string) {
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := w.fsw.Add(path); err != nil {
+			slog.Error("Error watching directory", "dir", path, "error", err)
+			return nil
+		}
+		entry.dirs = append(entry.dirs, path)
+		return nil
+	})
+}
+
+// unwatch removes the watches of the directories inside an entry
+func (w *folderWatcher) unwatch(entry *pendingEntry) {
+	for _, dir := range entry.dirs {
+		w.fsw.Remove(dir)
+	}
+	entry.dirs = nil
+}
+
+// fire submits an entry that has been quiet for the quiet period
+func (w *folderWatcher) fire(entryPath string, submit func(Message) error) {
+	w.mu.Lock()
+	entry, ok := w.pending[entryPath]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	// Stop following the entry before processing changes it
+	w.unwatch(entry)
+	delete(w.pending, entryPath)
+	w.submitted[entryPath] = true
+	w.mu.Unlock()
+
+	slog.Info("Entry has been quiet, submitting it", "entry", entryPath, "quiet", w.quiet)
+	if err := submit(entry.msg); err != nil {
+		slog.Error("Error submitting entry", "entry", entryPath, "retry_in", w.quiet, "error", err)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.stopped {
+			return
+		}
+		delete(w.submitted, entryPath)
+		entry.timer = time.AfterFunc(w.quiet, func() { w.fire(entryPath, submit) })
+		w.pending[entryPath] = entry
+	}
+}
+
+// submitToBroker returns a submit function publishing task messages through
+// the supervisor's connection
+func submitToBroker(sup *supervisor) func(Message) error {
+	return func(msg Message) error {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal task message: %v", err)
+		}
+		return sup.useChannel(func(ch ChannelInterface) error {
+			return publishTask(ch, body, "")
+		})
+	}
+}
+
+// runWithoutBroker processes the folders found by the watcher until ctx is
+// cancelled. Done events and dead-lettered messages go to the local log,
+// and failures are not retried because there is no retry queue.
+func runWithoutBroker(ctx context.Context, w *folderWatcher, logPath string, workers int) {
+	ch := newLocalChannel(logPath)
+	retryPolicy.MaxAttempts = 0
+	slog.Info("Running without RabbitMQ", "done_log", logPath)
+
+	jobs := make(chan Message)
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case msg := <-jobs:
+					body, err := json.Marshal(msg)
+					if err != nil {
+						slog.Error("Error marshalling task message", "error", err)
+						continue
+					}
+					processMessage(ctx, ch, localDelivery{ch: ch, body: body}, body, nil)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	w.run(ctx, func(msg Message) error {
+		select {
+		case jobs <- msg:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	wg.Wait()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// testQuietPeriod keeps the watcher tests fast
+const testQuietPeriod = 100 * time.Millisecond
+
+// submissions collects the messages submitted by a watcher
+type submissions struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// submit records a message
+func (s *submissions) submit(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// list returns the messages submitted so far
+func (s *submissions) list() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// startWatcher watches dir as the movies category until the test ends
+func startWatcher(t *testing.T, dir string) *submissions {
+	w, err := newFolderWatcher(map[string]string{"movies": dir}, testQuietPeriod)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	subs := &submissions{}
+	go func() {
+		w.run(ctx, subs.submit)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return subs
+}
+
+// Test that a new folder is submitted once it has been quiet
+func TestWatcherSubmitsNewFolder(t *testing.T) {
+	dir := t.TempDir()
+	subs := startWatcher(t, dir)
+
+	folder := filepath.Join(dir, "Movie.2024")
+	assert.NoError(t, os.Mkdir(folder, 0o755))
+	writeTestFile(t, folder, "movie.mkv", "data")
+
+	assert.Eventually(t, func() bool { return len(subs.list()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []Message{{TorrentName: "Movie.2024", Category: "movies"}}, subs.list())
+
+	// Changes made by processing do not submit the folder again
+	writeTestFile(t, folder, "movie.srt", "subtitles")
+	time.Sleep(3 * testQuietPeriod)
+	assert.Len(t, subs.list(), 1)
+}
+
+// Test that writes inside a new folder postpone its submission
+func TestWatcherWaitsForQuietFolder(t *testing.T) {
+	dir := t.TempDir()
+	subs := startWatcher(t, dir)
+
+	folder := filepath.Join(dir, "Show.S01")
+	assert.NoError(t, os.MkdirAll(filepath.Join(folder, "Season 1"), 0o755))
+	time.Sleep(testQuietPeriod / 2)
+
+	// Keep writing into a nested directory for longer than the quiet period
+	for i := 0; i < 4; i++ {
+		writeTestFile(t, filepath.Join(folder, "Season 1"), "episode.mkv", string(make([]byte, i)))
+		time.Sleep(testQuietPeriod / 2)
+	}
+	assert.Empty(t, subs.list())
+
+	assert.Eventually(t, func() bool { return len(subs.list()) == 1 }, 2*time.Second, 10*time.Millisecond)
+}
+
+// Test that existing, hidden and recreated entries are handled
+func TestWatcherIgnoresExistingEntries(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "Existing")
+	assert.NoError(t, os.Mkdir(existing, 0o755))
+	subs := startWatcher(t, dir)
+
+	writeTestFile(t, existing, "movie.mkv", "data")
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, ".incomplete"), 0o755))
+	time.Sleep(3 * testQuietPeriod)
+	assert.Empty(t, subs.list())
+
+	// A folder that was removed and created again is new
+	assert.NoError(t, os.RemoveAll(existing))
+	assert.NoError(t, os.Mkdir(existing, 0o755))
+	assert.Eventually(t, func() bool { return len(subs.list()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Existing", subs.list()[0].TorrentName)
+}
+
+// Test that a failed submission is tried again
+func TestWatcherRetriesFailedSubmission(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newFolderWatcher(map[string]string{"movies": dir}, testQuietPeriod)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempts := make(chan Message, 2)
+	calls := 0
+	go w.run(ctx, func(msg Message) error {
+		calls++
+		attempts <- msg
+		if calls == 1 {
+			return errNotConnected
+		}
+		return nil
+	})
+
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "Movie"), 0o755))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("submission %d did not happen", i+1)
+		}
+	}
+}
+
+// Test that the local channel appends published messages to the log
+func TestLocalChannel(t *testing.T) {
+	oldDLQ := dlqQueueName
+	dlqQueueName = "dlq"
+	defer func() { dlqQueueName = oldDLQ }()
+
+	path := filepath.Join(t.TempDir(), "done.log")
+	ch := newLocalChannel(path)
+
+	assert.NoError(t, publishDoneMessage(ch, doneEvent{TorrentName: "Movie"}))
+	assert.NoError(t, localDelivery{ch: ch, body: []byte("not json")}.Reject(false))
+	_, err := ch.Consume("tasks", "", false, false, false, false, amqp.Table{})
+	assert.ErrorIs(t, err, errNoBroker)
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	var entries []localLogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry localLogEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	if !assert.Len(t, entries, 2) {
+		return
+	}
+	assert.Equal(t, doneQueueName, entries[0].Queue)
+	assert.Contains(t, string(entries[0].Message), `"torrentName":"Movie"`)
+	assert.Equal(t, "dlq", entries[1].Queue)
+	assert.Equal(t, `"not json"`, string(entries[1].Message))
+}
+
+// Test that directories of categories added later are watched
+func TestWatcherSetCategories(t *testing.T) {
+	movies, anime := t.TempDir(), t.TempDir()
+	w, err := newFolderWatcher(map[string]string{"movies": movies}, testQuietPeriod)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subs := &submissions{}
+	go w.run(ctx, subs.submit)
+
+	assert.NoError(t, w.setCategories(map[string]string{"anime": anime}))
+	assert.NoError(t, os.Mkdir(filepath.Join(movies, "Movie"), 0o755))
+	assert.NoError(t, os.Mkdir(filepath.Join(anime, "Show"), 0o755))
+
+	assert.Eventually(t, func() bool { return len(subs.list()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(2 * testQuietPeriod)
+	assert.Equal(t, []Message{{TorrentName: "Show", Category: "anime"}}, subs.list())
+}
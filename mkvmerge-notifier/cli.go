@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"mkvmerge-notifier/config"
+)
+
+// usage describes the commands the notifier runs instead of consuming
+const usage = `Usage: mkvmerge-notifier [command]
+
+Without a command the notifier consumes done events.
+
+Commands:
+  preview   render a sample notification with the templates
+`
+
+// runCommand runs a command line and returns the exit code
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "preview":
+		if err := runPreview(args[1:], stdout, stderr); err != nil {
+			fmt.Fprintf(stderr, "preview: %v\n", err)
+			return 1
+		}
+		return 0
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// sampleMessage is the done event previews are rendered with. Its filename
+// holds characters that break an unescaped Markdown template.
+var sampleMessage = Message{
+	Filename:    "/downloads/tv/My_Show S01 [1080p]/My_Show.S01E01.*Pilot*.mkv",
+	Status:      "processed",
+	Time:        "2025-07-30T12:00:00Z",
+	TorrentName: "My_Show S01 [1080p]",
+	Category:    "tv",
+	Media: &MediaItem{
+		ID:     "f1d2d2f924e986ac86fdf7b36c94bcdf",
+		Name:   "My Show - Pilot",
+		Server: "Jellyfin",
+		Link:   "https://jellyfin.example.com/web/#/details?id=f1d2d2f924e986ac86fdf7b36c94bcdf&serverId=1",
+	},
+}
+
+// runPreview renders a sample notification with the templates of a backend
+// and prints it
+func runPreview(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("preview", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	backend := flags.String("backend", config.NotifierTelegram, "notifier type whose templates are rendered")
+	status := flags.String("status", sampleMessage.Status, "status of the sample events, or summary for the daily summary")
+	count := flags.Int("events", 1, "number of sample events, more than one renders a digest")
+	dir := flags.String("dir", os.Getenv("TEMPLATES_DIR"), "directory of the user-supplied templates")
+	file := flags.String("message", "", "JSON file of the done event to render instead of the sample")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 {
+		return fmt.Errorf("invalid number of events: %d", *count)
+	}
+
+	set, err := loadTemplates(*dir)
+	if err != nil {
+		return err
+	}
+
+	msg := sampleMessage
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to parse message: %w", err)
+		}
+	}
+
+	n := Notification{Status: *status, GroupBy: config.GroupByTorrent, Key: msg.Filename}
+	if msg.TorrentName != "" {
+		n.Key = msg.TorrentName
+	}
+	if *status == summaryStatus {
+		n.Day, _ = time.Parse(time.RFC3339, msg.Time)
+	} else {
+		msg.Status = *status
+	}
+	for i := 0; i < *count; i++ {
+		n.Events = append(n.Events, msg)
+	}
+
+	text, err := set.render(*backend, n)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, text)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test for the preview command rendering the sample message
+func TestRunPreview(t *testing.T) {
+	t.Setenv("TEMPLATES_DIR", "")
+	testCases := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"telegram", []string{"preview"}, []string{"🎬 *MKV Processing Complete*", "`My_Show.S01E01.*Pilot*.mkv`"}},
+		{"digest", []string{"preview", "-backend", "slack", "-events", "3"}, []string{"(3 items)", "*Torrent:* `My_Show S01 [1080p]`"}},
+		{"summary", []string{"preview", "-backend", "email", "-status", "summary"}, []string{"Daily summary of 2025-07-30", "tv: 1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCommand(tc.args, &stdout, &stderr); code != 0 {
+				t.Fatalf("runCommand() = %d, stderr: %s", code, stderr.String())
+			}
+			for _, want := range tc.expected {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("preview does not contain %q, got: %v", want, stdout.String())
+				}
+			}
+		})
+	}
+}
+
+// Test for the preview of a user template and message
+func TestRunPreviewMessageFile(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{"telegram.tmpl": "{{.Event.Category}}: {{escapeMarkdownV2 (base .Event.Filename)}}"})
+	file := filepath.Join(t.TempDir(), "message.json")
+	if err := os.WriteFile(file, []byte(`{"filename": "/movies/Film_1.mkv", "status": "processed", "category": "movies"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"preview", "-dir", dir, "-message", file}, &stdout, &stderr); code != 0 {
+		t.Fatalf("runCommand() = %d, stderr: %s", code, stderr.String())
+	}
+	if got := stdout.String(); got != "movies: Film\\_1\\.mkv\n" {
+		t.Errorf("preview = %q", got)
+	}
+}
+
+// Test for the exit codes of failing commands
+func TestRunCommandErrors(t *testing.T) {
+	testCases := [][]string{
+		{"unknown"},
+		{"preview", "-events", "0"},
+		{"preview", "-dir", filepath.Join(t.TempDir(), "missing")},
+		{"preview", "-message", filepath.Join(t.TempDir(), "missing.json")},
+	}
+	for _, args := range testCases {
+		var stdout, stderr bytes.Buffer
+		if code := runCommand(args, &stdout, &stderr); code == 0 {
+			t.Errorf("runCommand(%v) = 0, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/streadway/amqp"
+)
+
+// commandBot is the Telegram bot commands are answered with
+type commandBot interface {
+	TelegramBotInterface
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+}
+
+// Ensure tgbotapi.BotAPI implements our interface at compile time
+var _ commandBot = (*tgbotapi.BotAPI)(nil)
+
+// commandChannel is the part of a RabbitMQ channel the commands use
+type commandChannel interface {
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	Close() error
+}
+
+// Ensure amqp.Channel implements our interface at compile time
+var _ commandChannel = (*amqp.Channel)(nil)
+
+// botCommands are the commands the bot answers, as listed in its menu
+var botCommands = []tgbotapi.BotCommand{
+	{Command: "status", Description: "Queue depths of the tasks, done and DLQ queues"},
+	{Command: "last", Description: "The last N processed items"},
+	{Command: "dlq", Description: "Dead-lettered messages, to replay or discard"},
+}
+
+// Limits of the command replies. Buttons settle only messages among the
+// first dlqListLimit of the DLQ, those a listing shows.
+const (
+	defaultLastItems = 5
+	dlqListLimit     = 10
+)
+
+// replayConfirmTimeout bounds the wait for the broker to confirm a replay
+const replayConfirmTimeout = 30 * time.Second
+
+// Callback data prefixes of the buttons of dead-lettered messages
+const (
+	callbackReplay  = "replay:"
+	callbackDiscard = "discard:"
+)
+
+// commandHandler answers the commands of the authorized chats
+type commandHandler struct {
+	bot     commandBot
+	allowed map[int64]bool
+	// openChannel opens a channel for each command, since a failed passive
+	// declare closes its channel
+	openChannel func() (commandChannel, error)
+	tasksQueue  string
+}
+
+// newCommandHandler returns the command handler of the Telegram settings
+func newCommandHandler(c *config.Config, bot commandBot, openChannel func() (commandChannel, error)) *commandHandler {
+	allowed := make(map[int64]bool)
+	for _, chat := range c.Telegram.Chats() {
+		allowed[chat] = true
+	}
+	return &commandHandler{bot: bot, allowed: allowed, openChannel: openChannel, tasksQueue: c.RabbitMQ.Queue.Tasks}
+}
+
+// run handles updates until their channel is closed
+func (h *commandHandler) run(updates tgbotapi.UpdatesChannel) {
+	for update := range updates {
+		h.handleUpdate(update)
+	}
+}
+
+// handleUpdate answers a command or a button of an authorized chat
+func (h *commandHandler) handleUpdate(update tgbotapi.Update) {
+	switch {
+	case update.CallbackQuery != nil:
+		query := update.CallbackQuery
+		if query.Message == nil || !h.allowed[query.Message.Chat.ID] {
+			log.Printf("Ignoring button from unauthorized user %d", query.From.ID)
+			h.answerCallback(query.ID, "Not authorized")
+			return
+		}
+		h.handleCallback(query)
+	case update.Message != nil && update.Message.IsCommand():
+		msg := update.Message
+		if !h.allowed[msg.Chat.ID] {
+			log.Printf("Ignoring /%s from unauthorized chat %d", msg.Command(), msg.Chat.ID)
+			return
+		}
+		log.Printf("Received /%s from chat %d", msg.Command(), msg.Chat.ID)
+		switch msg.Command() {
+		case "status":
+			h.reply(msg.Chat.ID, h.status())
+		case "last":
+			h.reply(msg.Chat.ID, h.last(msg.CommandArguments()))
+		case "dlq":
+			h.listDeadLetters(msg.Chat.ID)
+		case "start", "help":
+			h.reply(msg.Chat.ID, commandHelp())
+		default:
+			h.reply(msg.Chat.ID, "Unknown command /"+msg.Command()+"\n\n"+commandHelp())
+		}
+	}
+}
+
+// commandHelp lists the commands
+func commandHelp() string {
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, command := range botCommands {
+		fmt.Fprintf(&b, "\n/%s - %s", command.Command, command.Description)
+	}
+	return b.String()
+}
+
+// reply sends a plain text message to a chat
+func (h *commandHandler) reply(chatID int64, text string) {
+	if err := sendTelegramMessage(h.bot, chatID, text, ""); err != nil {
+		log.Printf("Failed to answer command: %v", err)
+	}
+}
+
+// answerCallback acknowledges a button press with a short notice
+func (h *commandHandler) answerCallback(id, text string) {
+	if _, err := h.bot.Request(tgbotapi.NewCallback(id, text)); err != nil {
+		log.Printf("Failed to answer button: %v", err)
+	}
+}
+
+// status reports the depths of the tasks, done and DLQ queues
+func (h *commandHandler) status() string {
+	var b strings.Builder
+	b.WriteString("📊 Queue status")
+	for _, name := range []string{h.tasksQueue, queueName, dlqQueueName} {
+		if name == "" {
+			continue
+		}
+		q, err := h.inspectQueue(name)
+		if err != nil {
+			log.Printf("Failed to inspect queue '%s': %v", name, err)
+			fmt.Fprintf(&b, "\n%s: unavailable", name)
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s: %d messages, %d consumers", q.Name, q.Messages, q.Consumers)
+	}
+	return b.String()
+}
+
+// inspectQueue returns the depth and consumers of a queue without creating it
+func (h *commandHandler) inspectQueue(name string) (amqp.Queue, error) {
+	ch, err := h.openChannel()
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+	return ch.QueueDeclarePassive(name, true, false, false, false, nil)
+}
+
+// last lists the most recent processed items, as many as the argument asks
+func (h *commandHandler) last(args string) string {
+	n := defaultLastItems
+	if args = strings.TrimSpace(args); args != "" {
+		value, err := strconv.Atoi(args)
+		if err != nil || value < 1 {
+			return "Usage: /last [N]"
+		}
+		n = value
+	}
+
+	items := history.last(n)
+	if len(items) == 0 {
+		return "No items processed yet"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "🎬 Last %d processed items", len(items))
+	for _, item := range items {
+		fmt.Fprintf(&b, "\n%s  %s (%s)", formatEventTime(item.Time), filepath.Base(item.Filename), item.Status)
+		if item.Category != "" {
+			fmt.Fprintf(&b, " [%s]", item.Category)
+		}
+	}
+	return b.String()
+}
+
+// deadLetter is a message of the DLQ
+type deadLetter struct {
+	// id identifies the message in the callback data of its buttons. It is
+	// derived from the message or correlation ID, or the body of messages
+	// without one, and numbered among identical messages.
+	id       string
+	filename string
+	reason   string
+	// original is the done event to replay
+	original []byte
+}
+
+// parseDeadLetter describes a DLQ message: a wrapper published after a
+// failed notification, or a done event rejected as it was
+func parseDeadLetter(d amqp.Delivery) deadLetter {
+	body := d.Body
+	key := body
+	if id := d.MessageId + d.CorrelationId; id != "" {
+		key = []byte(id)
+	}
+	sum := sha1.Sum(key)
+	letter := deadLetter{id: hex.EncodeToString(sum[:8]), original: body, reason: "rejected"}
+
+	var wrapper struct {
+		OriginalMessage string `json:"originalMessage"`
+		ErrorReason     string `json:"errorReason"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err == nil && wrapper.OriginalMessage != "" {
+		letter.original = []byte(wrapper.OriginalMessage)
+		letter.reason = wrapper.ErrorReason
+	}
+
+	var msg Message
+	if err := json.Unmarshal(letter.original, &msg); err == nil && msg.Filename != "" {
+		letter.filename = msg.Filename
+	} else {
+		letter.filename = "unparseable message"
+	}
+	return letter
+}
+
+// deadLetterIDs numbers the IDs of identical messages in queue order
+type deadLetterIDs map[string]int
+
+// parse describes the next DLQ message, with an ID unique among the
+// messages parsed before
+func (ids deadLetterIDs) parse(d amqp.Delivery) deadLetter {
+	letter := parseDeadLetter(d)
+	ids[letter.id]++
+	if n := ids[letter.id]; n > 1 {
+		letter.id = fmt.Sprintf("%s-%d", letter.id, n)
+	}
+	return letter
+}
+
+// listDeadLetters sends the first messages of the DLQ, each with buttons to
+// replay or discard it. The messages are peeked and returned to the queue.
+func (h *commandHandler) listDeadLetters(chatID int64) {
+	ch, err := h.openChannel()
+	if err != nil {
+		h.reply(chatID, fmt.Sprintf("Failed to open channel: %v", err))
+		return
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(dlqQueueName, true, false, false, false, nil)
+	if err != nil {
+		h.reply(chatID, fmt.Sprintf("Failed to inspect %s: %v", dlqQueueName, err))
+		return
+	}
+	if q.Messages == 0 {
+		h.reply(chatID, fmt.Sprintf("✅ %s is empty", dlqQueueName))
+		return
+	}
+
+	var letters []deadLetter
+	ids := make(deadLetterIDs)
+	for len(letters) < dlqListLimit {
+		d, ok, err := ch.Get(dlqQueueName, false)
+		if err != nil {
+			log.Printf("Failed to get message from DLQ: %v", err)
+			break
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, ids.parse(d))
+		defer nackRequeue(d)
+	}
+
+	h.reply(chatID, fmt.Sprintf("☠️ %s holds %d messages, showing %d", dlqQueueName, q.Messages, len(letters)))
+	for _, letter := range letters {
+		text := fmt.Sprintf("%s\n%s", letter.filename, letter.reason)
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔁 Replay", callbackReplay+letter.id),
+			tgbotapi.NewInlineKeyboardButtonData("🗑 Discard", callbackDiscard+letter.id),
+		))
+		if _, err := h.bot.Send(msg); err != nil {
+			log.Printf("Failed to list DLQ message: %v", err)
+		}
+	}
+}
+
+// nackRequeue returns a peeked message to its queue
+func nackRequeue(d amqp.Delivery) {
+	if err := d.Nack(false, true); err != nil {
+		log.Printf("Error returning message to the DLQ: %v", err)
+	}
+}
+
+// handleCallback replays or discards the DLQ message of a button
+func (h *commandHandler) handleCallback(query *tgbotapi.CallbackQuery) {
+	var replay bool
+	var id string
+	switch {
+	case strings.HasPrefix(query.Data, callbackReplay):
+		replay, id = true, strings.TrimPrefix(query.Data, callbackReplay)
+	case strings.HasPrefix(query.Data, callbackDiscard):
+		id = strings.TrimPrefix(query.Data, callbackDiscard)
+	default:
+		h.answerCallback(query.ID, "Unknown button")
+		return
+	}
+
+	result, err := h.settleDeadLetter(id, replay)
+	if err != nil {
+		log.Printf("Failed to settle DLQ message %s: %v", id, err)
+		h.answerCallback(query.ID, err.Error())
+		return
+	}
+	log.Printf("%s DLQ message %s", result, id)
+	h.answerCallback(query.ID, result)
+
+	// Replace the buttons with the outcome
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, query.Message.Text+"\n\n"+result)
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Failed to update DLQ message: %v", err)
+	}
+}
+
+// settleDeadLetter takes the DLQ message of an id among the first
+// dlqListLimit and publishes its done event to the done queue again or drops
+// it. The other messages are returned to the DLQ. A replayed message is
+// removed only once the broker confirmed the replay.
+func (h *commandHandler) settleDeadLetter(id string, replay bool) (string, error) {
+	ch, err := h.openChannel()
+	if err != nil {
+		return "", fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	var confirms chan amqp.Confirmation
+	if replay {
+		if err := ch.Confirm(false); err != nil {
+			return "", fmt.Errorf("failed to enable publisher confirms: %w", err)
+		}
+		confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+
+	ids := make(deadLetterIDs)
+	for scanned := 0; ; scanned++ {
+		if scanned == dlqListLimit {
+			return "", fmt.Errorf("message is no longer among the first %d of the DLQ", dlqListLimit)
+		}
+		d, ok, err := ch.Get(dlqQueueName, false)
+		if err != nil {
+			return "", fmt.Errorf("failed to get message from DLQ: %w", err)
+		}
+		if !ok {
+			return "", fmt.Errorf("message is no longer in the DLQ")
+		}
+		letter := ids.parse(d)
+		if letter.id != id {
+			defer nackRequeue(d)
+			continue
+		}
+
+		if replay {
+			err := ch.Publish("", queueName, false, false, amqp.Publishing{
+				ContentType:  "application/json",
+				DeliveryMode: amqp.Persistent,
+				Body:         letter.original,
+			})
+			if err == nil {
+				err = waitConfirm(confirms)
+			}
+			if err != nil {
+				nackRequeue(d)
+				return "", fmt.Errorf("failed to replay message: %w", err)
+			}
+		}
+		if err := d.Ack(false); err != nil {
+			return "", fmt.Errorf("failed to remove message from DLQ: %w", err)
+		}
+		if replay {
+			return "Replayed", nil
+		}
+		return "Discarded", nil
+	}
+}
+
+// waitConfirm waits for the broker to confirm the last publish
+func waitConfirm(confirms chan amqp.Confirmation) error {
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			return fmt.Errorf("channel closed before the broker confirmed")
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker rejected the message")
+		}
+		return nil
+	case <-time.After(replayConfirmTimeout):
+		return fmt.Errorf("broker did not confirm within %s", replayConfirmTimeout)
+	}
+}
+
+// recentItems remembers the last processed items for /last
+type recentItems struct {
+	limit int
+
+	mu    sync.Mutex
+	items []Message
+}
+
+// Processed items listed by /last, nil while commands are disabled
+var history *recentItems
+
+// newRecentItems returns a history of at most limit items
+func newRecentItems(limit int) *recentItems {
+	return &recentItems{limit: limit}
+}
+
+// add records a processed item, dropping the oldest beyond the limit
+func (r *recentItems) add(msg Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, msg)
+	if len(r.items) > r.limit {
+		r.items = r.items[len(r.items)-r.limit:]
+	}
+}
+
+// last returns up to n items, the most recent first
+func (r *recentItems) last(n int) []Message {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n = min(n, len(r.items))
+	result := make([]Message, 0, n)
+	for i := len(r.items) - 1; i >= len(r.items)-n; i-- {
+		result = append(result, r.items[i])
+	}
+	return result
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/streadway/amqp"
+)
+
+// mockCommandBot records the messages and callback answers of commands
+type mockCommandBot struct {
+	MockTelegramBot
+	answers []string
+}
+
+func (m *mockCommandBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	if callback, ok := c.(tgbotapi.CallbackConfig); ok {
+		m.answers = append(m.answers, callback.Text)
+	}
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+// texts returns the text of the sent messages and edits
+func (m *mockCommandBot) texts() []string {
+	var result []string
+	for _, c := range m.messages {
+		switch msg := c.(type) {
+		case tgbotapi.MessageConfig:
+			result = append(result, msg.Text)
+		case tgbotapi.EditMessageTextConfig:
+			result = append(result, msg.Text)
+		}
+	}
+	return result
+}
+
+// peeked is a message taken from a queue and not yet acknowledged
+type peeked struct {
+	queue string
+	body  []byte
+}
+
+// fakeQueues holds the messages of the queues a fakeCommandChannel serves
+type fakeQueues struct {
+	queues    map[string][]amqp.Delivery
+	unacked   map[uint64]peeked
+	published map[string][]string
+	nextTag   uint64
+	// nackPublish makes the broker reject published messages
+	nackPublish bool
+}
+
+// newFakeQueues returns empty tasks and done queues and a DLQ of bodies
+func newFakeQueues(dlq ...string) *fakeQueues {
+	q := &fakeQueues{
+		queues:    map[string][]amqp.Delivery{"mkvmerge.tasks": nil, "mkvmerge.done": nil, "mkvmerge.done_DLQ": nil},
+		unacked:   make(map[uint64]peeked),
+		published: make(map[string][]string),
+	}
+	for _, body := range dlq {
+		q.queues["mkvmerge.done_DLQ"] = append(q.queues["mkvmerge.done_DLQ"], amqp.Delivery{Body: []byte(body)})
+	}
+	return q
+}
+
+// bodies returns the bodies of a queue
+func (q *fakeQueues) bodies(queue string) []string {
+	var result []string
+	for _, d := range q.queues[queue] {
+		result = append(result, string(d.Body))
+	}
+	return result
+}
+
+// fakeCommandChannel is a channel on fakeQueues. Messages it gets stay
+// unacknowledged until they are acked, or nacked back to their queue.
+type fakeCommandChannel struct {
+	q        *fakeQueues
+	confirms chan amqp.Confirmation
+	sent     uint64
+}
+
+func (c *fakeCommandChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	messages, ok := c.q.queues[name]
+	if !ok {
+		return amqp.Queue{}, fmt.Errorf("NOT_FOUND - no queue '%s'", name)
+	}
+	return amqp.Queue{Name: name, Messages: len(messages)}, nil
+}
+
+func (c *fakeCommandChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	messages := c.q.queues[queue]
+	if len(messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	d := messages[0]
+	c.q.queues[queue] = messages[1:]
+	c.q.nextTag++
+	d.DeliveryTag = c.q.nextTag
+	d.Acknowledger = c
+	c.q.unacked[d.DeliveryTag] = peeked{queue: queue, body: d.Body}
+	return d, true, nil
+}
+
+func (c *fakeCommandChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if c.confirms != nil {
+		c.sent++
+		c.confirms <- amqp.Confirmation{DeliveryTag: c.sent, Ack: !c.q.nackPublish}
+	}
+	if !c.q.nackPublish {
+		c.q.published[key] = append(c.q.published[key], string(msg.Body))
+	}
+	return nil
+}
+
+func (c *fakeCommandChannel) Confirm(noWait bool) error { return nil }
+
+func (c *fakeCommandChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = confirm
+	return confirm
+}
+
+func (c *fakeCommandChannel) Close() error { return nil }
+
+func (c *fakeCommandChannel) Ack(tag uint64, multiple bool) error {
+	delete(c.q.unacked, tag)
+	return nil
+}
+
+func (c *fakeCommandChannel) Nack(tag uint64, multiple, requeue bool) error {
+	p := c.q.unacked[tag]
+	delete(c.q.unacked, tag)
+	if requeue {
+		c.q.queues[p.queue] = append(c.q.queues[p.queue], amqp.Delivery{Body: p.body})
+	}
+	return nil
+}
+
+func (c *fakeCommandChannel) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+// newTestCommandHandler returns a handler for chat 42 on fake queues
+func newTestCommandHandler(t *testing.T, q *fakeQueues) (*commandHandler, *mockCommandBot) {
+	origQueue, origDLQ, origHistory := queueName, dlqQueueName, history
+	t.Cleanup(func() { queueName, dlqQueueName, history = origQueue, origDLQ, origHistory })
+	queueName, dlqQueueName = "mkvmerge.done", "mkvmerge.done_DLQ"
+
+	c := &config.Config{Telegram: config.TelegramConfig{ChatID: 42}}
+	c.RabbitMQ.Queue.Tasks = "mkvmerge.tasks"
+	bot := &mockCommandBot{}
+	h := newCommandHandler(c, bot, func() (commandChannel, error) {
+		return &fakeCommandChannel{q: q}, nil
+	})
+	return h, bot
+}
+
+// command returns the update of a command sent by a chat
+func command(chatID int64, text string) tgbotapi.Update {
+	name := strings.Fields(text)[0]
+	return tgbotapi.Update{Message: &tgbotapi.Message{
+		Chat:     &tgbotapi.Chat{ID: chatID},
+		Text:     text,
+		Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(name)}},
+	}}
+}
+
+// Test for /status reporting the depth of each queue
+func TestCommandStatus(t *testing.T) {
+	q := newFakeQueues("a", "b")
+	q.queues["mkvmerge.tasks"] = []amqp.Delivery{{}, {}, {}}
+	h, bot := newTestCommandHandler(t, q)
+	delete(q.queues, "mkvmerge.done")
+
+	h.handleUpdate(command(42, "/status"))
+
+	texts := bot.texts()
+	if len(texts) != 1 {
+		t.Fatalf("sent %d replies, want 1", len(texts))
+	}
+	for _, want := range []string{"mkvmerge.tasks: 3 messages", "mkvmerge.done: unavailable", "mkvmerge.done_DLQ: 2 messages"} {
+		if !strings.Contains(texts[0], want) {
+			t.Errorf("/status does not contain %q, got: %v", want, texts[0])
+		}
+	}
+}
+
+// Test for commands of other chats being ignored
+func TestCommandUnauthorized(t *testing.T) {
+	h, bot := newTestCommandHandler(t, newFakeQueues())
+	h.handleUpdate(command(7, "/status"))
+	h.handleUpdate(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID: "1", From: &tgbotapi.User{ID: 7}, Data: callbackDiscard + "x",
+		Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 7}},
+	}})
+
+	if len(bot.messages) != 0 {
+		t.Errorf("sent %d replies to an unauthorized chat", len(bot.messages))
+	}
+	if len(bot.answers) != 1 || bot.answers[0] != "Not authorized" {
+		t.Errorf("button answers = %v, want Not authorized", bot.answers)
+	}
+}
+
+// Test for /last listing the most recent items first
+func TestCommandLast(t *testing.T) {
+	h, bot := newTestCommandHandler(t, newFakeQueues())
+	history = newRecentItems(3)
+	for i := 1; i <= 4; i++ {
+		history.add(Message{Filename: fmt.Sprintf("/tv/Show S01E0%d.mkv", i), Status: "processed", Time: "2025-07-30T12:00:00Z", Category: "tv"})
+	}
+
+	h.handleUpdate(command(42, "/last 2"))
+	h.handleUpdate(command(42, "/last"))
+	h.handleUpdate(command(42, "/last two"))
+
+	texts := bot.texts()
+	if len(texts) != 3 {
+		t.Fatalf("sent %d replies, want 3", len(texts))
+	}
+	if !strings.Contains(texts[0], "Last 2") || strings.Index(texts[0], "S01E04") > strings.Index(texts[0], "S01E03") || strings.Contains(texts[0], "S01E02") {
+		t.Errorf("/last 2 = %v, want S01E04 and S01E03", texts[0])
+	}
+	if !strings.Contains(texts[1], "Last 3") || strings.Contains(texts[1], "S01E01") || !strings.Contains(texts[1], "(processed) [tv]") {
+		t.Errorf("/last = %v, want the 3 remembered items", texts[1])
+	}
+	if !strings.Contains(texts[2], "Usage") {
+		t.Errorf("/last two = %v, want the usage", texts[2])
+	}
+}
+
+// Test for /dlq listing messages with buttons and leaving them queued
+func TestCommandDLQ(t *testing.T) {
+	wrapped := `{"originalMessage": "{\"filename\": \"/tv/Show.mkv\"}", "errorReason": "Failed to send notification: telegram: chat not found"}`
+	q := newFakeQueues(wrapped, `{"status": "processed"}`)
+	h, bot := newTestCommandHandler(t, q)
+
+	h.handleUpdate(command(42, "/dlq"))
+
+	if len(bot.messages) != 3 {
+		t.Fatalf("sent %d messages, want a header and 2 entries", len(bot.messages))
+	}
+	entry := bot.messages[1].(tgbotapi.MessageConfig)
+	if !strings.Contains(entry.Text, "/tv/Show.mkv") || !strings.Contains(entry.Text, "chat not found") {
+		t.Errorf("DLQ entry = %v, want the filename and reason", entry.Text)
+	}
+	keyboard, ok := entry.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	if !ok || len(keyboard.InlineKeyboard[0]) != 2 {
+		t.Fatalf("DLQ entry markup = %+v, want replay and discard buttons", entry.ReplyMarkup)
+	}
+	if data := *keyboard.InlineKeyboard[0][0].CallbackData; data != callbackReplay+parseDeadLetter(amqp.Delivery{Body: []byte(wrapped)}).id {
+		t.Errorf("replay button data = %q", data)
+	}
+	if got := bot.messages[2].(tgbotapi.MessageConfig).Text; got != "unparseable message\nrejected" {
+		t.Errorf("rejected DLQ entry = %v", got)
+	}
+	if len(q.queues["mkvmerge.done_DLQ"]) != 2 || len(q.unacked) != 0 {
+		t.Errorf("DLQ holds %d messages with %d unacked, want both returned", len(q.queues["mkvmerge.done_DLQ"]), len(q.unacked))
+	}
+}
+
+// Test for the buttons replaying and discarding DLQ messages
+func TestCommandDLQButtons(t *testing.T) {
+	wrapped := `{"originalMessage": "{\"filename\": \"/tv/Show.mkv\"}", "errorReason": "failed"}`
+	rejected := `{"filename": "/movies/Film.mkv"}`
+	q := newFakeQueues(`{"filename": "/other.mkv"}`, wrapped, rejected)
+	h, bot := newTestCommandHandler(t, q)
+
+	press := func(data string) {
+		h.handleUpdate(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID: "1", From: &tgbotapi.User{ID: 1}, Data: data,
+			Message: &tgbotapi.Message{MessageID: 9, Text: "entry", Chat: &tgbotapi.Chat{ID: 42}},
+		}})
+	}
+	press(callbackReplay + parseDeadLetter(amqp.Delivery{Body: []byte(wrapped)}).id)
+	press(callbackDiscard + parseDeadLetter(amqp.Delivery{Body: []byte(rejected)}).id)
+	press(callbackDiscard + parseDeadLetter(amqp.Delivery{Body: []byte(rejected)}).id)
+
+	if got := q.published["mkvmerge.done"]; len(got) != 1 || got[0] != `{"filename": "/tv/Show.mkv"}` {
+		t.Errorf("replayed %v, want the original done event", got)
+	}
+	if got := q.bodies("mkvmerge.done_DLQ"); len(got) != 1 || got[0] != `{"filename": "/other.mkv"}` {
+		t.Errorf("DLQ = %v, want only the other message", got)
+	}
+	if len(bot.answers) != 3 || bot.answers[0] != "Replayed" || bot.answers[1] != "Discarded" || !strings.Contains(bot.answers[2], "no longer") {
+		t.Errorf("button answers = %v", bot.answers)
+	}
+	if texts := bot.texts(); len(texts) != 2 || texts[0] != "entry\n\nReplayed" {
+		t.Errorf("edited messages = %q", texts)
+	}
+}
+
+// Test for identical DLQ messages getting their own buttons
+func TestCommandDLQDuplicates(t *testing.T) {
+	body := `{"filename": "/tv/Show.mkv"}`
+	q := newFakeQueues(body, body)
+	h, bot := newTestCommandHandler(t, q)
+
+	h.handleUpdate(command(42, "/dlq"))
+
+	if len(bot.messages) != 3 {
+		t.Fatalf("sent %d messages, want a header and 2 entries", len(bot.messages))
+	}
+	var ids []string
+	for _, c := range bot.messages[1:] {
+		keyboard := c.(tgbotapi.MessageConfig).ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+		ids = append(ids, *keyboard.InlineKeyboard[0][1].CallbackData)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("identical messages share the button data %q", ids[0])
+	}
+	if ids[1] != ids[0]+"-2" {
+		t.Errorf("second button data = %q, want %q", ids[1], ids[0]+"-2")
+	}
+}
+
+// Test for a replay the broker does not confirm keeping the message in the
+// DLQ, and for the scan stopping after the listed messages
+func TestCommandDLQSettleLimits(t *testing.T) {
+	wrapped := `{"originalMessage": "{\"filename\": \"/tv/Show.mkv\"}", "errorReason": "failed"}`
+	q := newFakeQueues(wrapped)
+	q.nackPublish = true
+	h, _ := newTestCommandHandler(t, q)
+
+	id := parseDeadLetter(amqp.Delivery{Body: []byte(wrapped)}).id
+	if _, err := h.settleDeadLetter(id, true); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("settleDeadLetter() of an unconfirmed replay error = %v", err)
+	}
+	if got := q.bodies("mkvmerge.done_DLQ"); len(got) != 1 || len(q.unacked) != 0 {
+		t.Errorf("DLQ = %v with %d unacked, want the message returned", got, len(q.unacked))
+	}
+
+	var bodies []string
+	for i := 0; i < dlqListLimit; i++ {
+		bodies = append(bodies, fmt.Sprintf(`{"filename": "/tv/%d.mkv"}`, i))
+	}
+	last := `{"filename": "/tv/last.mkv"}`
+	q = newFakeQueues(append(bodies, last)...)
+	h, _ = newTestCommandHandler(t, q)
+	if _, err := h.settleDeadLetter(parseDeadLetter(amqp.Delivery{Body: []byte(last)}).id, false); err == nil || !strings.Contains(err.Error(), "first 10") {
+		t.Errorf("settleDeadLetter() beyond the listed messages error = %v", err)
+	}
+	if got := q.bodies("mkvmerge.done_DLQ"); len(got) != dlqListLimit+1 || len(q.unacked) != 0 {
+		t.Errorf("DLQ holds %d messages with %d unacked, want all returned", len(got), len(q.unacked))
+	}
+}
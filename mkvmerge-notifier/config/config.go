@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
@@ -13,6 +14,86 @@ import (
 type Config struct {
 	RabbitMQ RabbitMQConfig `mapstructure:"rabbitmq"`
 	Telegram TelegramConfig `mapstructure:"telegram"`
+	Digest   DigestConfig   `mapstructure:"digest"`
+	// Templates holds the directory of user-supplied notification templates
+	Templates TemplateConfig `mapstructure:"templates"`
+	// MediaServer is the Jellyfin or Emby server refreshed on done events
+	MediaServer MediaServerConfig `mapstructure:"media_server"`
+	// Notifiers are the channels notifications are sent through. Without
+	// any, notifications go to telegram.chat_id.
+	Notifiers []NotifierConfig `mapstructure:"notifiers"`
+	// Routes choose the notifiers of each done event. Without any, every
+	// event goes to every notifier.
+	Routes []RouteConfig `mapstructure:"routes"`
+}
+
+// Types of notifiers
+const (
+	NotifierTelegram = "telegram"
+	NotifierDiscord  = "discord"
+	NotifierSlack    = "slack"
+	NotifierWebhook  = "webhook"
+	NotifierEmail    = "email"
+	NotifierNtfy     = "ntfy"
+	NotifierGotify   = "gotify"
+)
+
+// DefaultNotifier is the name of the Telegram notifier used when no
+// notifiers are configured
+const DefaultNotifier = "telegram"
+
+// NotifierConfig describes a channel notifications are sent through
+type NotifierConfig struct {
+	// Name identifies the notifier in routes
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+	// URL is the Discord, Slack or generic webhook, the ntfy topic or the
+	// Gotify server
+	URL string `mapstructure:"url"`
+	// Headers are added to the requests of a generic webhook
+	Headers map[string]string `mapstructure:"headers"`
+	// Token is the ntfy access token or the Gotify application token
+	Token string `mapstructure:"token"`
+	// BotToken overrides telegram.bot_token for a Telegram notifier
+	BotToken string     `mapstructure:"bot_token"`
+	ChatID   int64      `mapstructure:"chat_id"`
+	SMTP     SMTPConfig `mapstructure:"smtp"`
+}
+
+// SMTPConfig holds the mail server and addresses of an email notifier
+type SMTPConfig struct {
+	Host     string   `mapstructure:"host"`
+	Port     string   `mapstructure:"port"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+}
+
+// RouteConfig sends the done events of some categories and statuses to
+// some notifiers. Empty categories or statuses match any.
+type RouteConfig struct {
+	Categories []string `mapstructure:"categories"`
+	Statuses   []string `mapstructure:"statuses"`
+	Notifiers  []string `mapstructure:"notifiers"`
+}
+
+// Matches reports whether a route applies to an event of a category and status
+func (r RouteConfig) Matches(category, status string) bool {
+	return matchesAny(r.Categories, category) && matchesAny(r.Statuses, status)
+}
+
+// matchesAny reports whether values is empty or holds value
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
 }
 
 // RabbitMQConfig holds all RabbitMQ related configuration
@@ -23,8 +104,10 @@ type RabbitMQConfig struct {
 	Password string `mapstructure:"password"`
 	Vhost    string `mapstructure:"vhost"`
 	Queue    struct {
-		Done string `mapstructure:"done"`
-		DLQ  string `mapstructure:"dlq"`
+		// Tasks is the queue of the consumer, only reported by /status
+		Tasks string `mapstructure:"tasks"`
+		Done  string `mapstructure:"done"`
+		DLQ   string `mapstructure:"dlq"`
 	} `mapstructure:"queue"`
 }
 
@@ -32,6 +115,99 @@ type RabbitMQConfig struct {
 type TelegramConfig struct {
 	BotToken string `mapstructure:"bot_token"`
 	ChatID   int64  `mapstructure:"chat_id"`
+	// ParseMode is how Telegram formats the rendered templates: MarkdownV2,
+	// HTML, the legacy Markdown, or empty for plain text
+	ParseMode string         `mapstructure:"parse_mode"`
+	Retry     RetryConfig    `mapstructure:"retry"`
+	Commands  CommandsConfig `mapstructure:"commands"`
+}
+
+// CommandsConfig holds the bot commands answered in Telegram chats
+type CommandsConfig struct {
+	// Enabled makes the bot read its updates and answer commands
+	Enabled bool `mapstructure:"enabled"`
+	// AllowedChats may send commands, telegram.chat_id when empty
+	AllowedChats []int64 `mapstructure:"allowed_chats"`
+	// History is how many processed items /last can list
+	History int `mapstructure:"history"`
+}
+
+// Chats returns the chats allowed to send commands
+func (c TelegramConfig) Chats() []int64 {
+	if len(c.Commands.AllowedChats) > 0 {
+		return c.Commands.AllowedChats
+	}
+	return []int64{c.ChatID}
+}
+
+// Telegram parse modes
+const (
+	ParseModeMarkdownV2 = "MarkdownV2"
+	ParseModeHTML       = "HTML"
+	ParseModeMarkdown   = "Markdown"
+)
+
+// TemplateConfig holds where notification templates are read from
+type TemplateConfig struct {
+	// Dir holds <backend>.<status>.tmpl and <backend>.tmpl files overriding
+	// the built-in templates. Empty uses the built-in ones only.
+	Dir string `mapstructure:"dir"`
+}
+
+// RetryConfig holds how often a failed send is retried
+type RetryConfig struct {
+	// MaxAttempts is the number of sends, including the first, before giving up
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// InitialDelay is the wait after the first failure, doubled after each one
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	// MaxDelay caps the wait between attempts, except for waits Telegram asks for
+	MaxDelay time.Duration `mapstructure:"max_delay"`
+}
+
+// Types of media servers
+const (
+	MediaServerJellyfin = "jellyfin"
+	MediaServerEmby     = "emby"
+)
+
+// MediaServerConfig holds the Jellyfin or Emby server whose library is
+// refreshed when a done event arrives
+type MediaServerConfig struct {
+	// Type is jellyfin or emby. Empty disables the refresh.
+	Type   string `mapstructure:"type"`
+	URL    string `mapstructure:"url"`
+	APIKey string `mapstructure:"api_key"`
+	// PublicURL is the address used in the links of notifications, the URL
+	// when empty
+	PublicURL string `mapstructure:"public_url"`
+	// PathMappings translate the path prefixes of done events into the
+	// paths the media server sees
+	PathMappings map[string]string `mapstructure:"path_mappings"`
+	// WaitTimeout is how long to wait for the item to appear after the
+	// refresh, PollInterval how often to look for it
+	WaitTimeout  time.Duration `mapstructure:"wait_timeout"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+}
+
+// Groupings of done events in a digest
+const (
+	GroupByTorrent  = "torrent"
+	GroupByCategory = "category"
+)
+
+// DigestConfig holds how done events are batched into digest messages
+type DigestConfig struct {
+	// Window is how long events are collected before their digest is sent,
+	// starting with the first event of a group. Zero sends every event on its own.
+	Window time.Duration `mapstructure:"window"`
+	// GroupBy is torrent or category
+	GroupBy string `mapstructure:"group_by"`
+	// MaxPending caps the events waiting for their digest, it is the prefetch
+	// count while a window is set
+	MaxPending int `mapstructure:"max_pending"`
+	// DailySummary is the local time, as HH:MM, a summary of the day is sent
+	// at. Empty disables the summary.
+	DailySummary string `mapstructure:"daily_summary"`
 }
 
 // Load reads in config from files and environment variables
@@ -71,9 +247,146 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+// validate checks the settings that cannot be used as they are
+func (c *Config) validate() error {
+	switch c.Telegram.ParseMode {
+	case ParseModeMarkdownV2, ParseModeHTML, ParseModeMarkdown, "":
+	default:
+		return fmt.Errorf("invalid telegram.parse_mode %q: expected %s, %s or %s", c.Telegram.ParseMode, ParseModeMarkdownV2, ParseModeHTML, ParseModeMarkdown)
+	}
+	// The built-in templates are written for MarkdownV2
+	if c.Telegram.ParseMode != ParseModeMarkdownV2 && c.Templates.Dir == "" {
+		return fmt.Errorf("telegram.parse_mode %q requires templates.dir, the built-in templates are written for %s", c.Telegram.ParseMode, ParseModeMarkdownV2)
+	}
+	if c.Telegram.Commands.Enabled && c.Telegram.Commands.History < 1 {
+		return fmt.Errorf("invalid telegram.commands.history: %d", c.Telegram.Commands.History)
+	}
+	if c.Telegram.Retry.MaxAttempts < 1 {
+		return fmt.Errorf("invalid telegram.retry.max_attempts: %d", c.Telegram.Retry.MaxAttempts)
+	}
+	if c.Digest.Window < 0 {
+		return fmt.Errorf("invalid digest.window: %s", c.Digest.Window)
+	}
+	if c.Digest.GroupBy != GroupByTorrent && c.Digest.GroupBy != GroupByCategory {
+		return fmt.Errorf("invalid digest.group_by %q: expected %s or %s", c.Digest.GroupBy, GroupByTorrent, GroupByCategory)
+	}
+	if c.Digest.Window > 0 && c.Digest.MaxPending < 1 {
+		return fmt.Errorf("invalid digest.max_pending: %d", c.Digest.MaxPending)
+	}
+	if _, _, err := c.Digest.SummaryTime(); err != nil {
+		return err
+	}
+	if err := c.MediaServer.validate(); err != nil {
+		return err
+	}
+	return c.validateNotifiers()
+}
+
+// validateNotifiers checks that every notifier has the settings of its type
+// and that routes only name known notifiers
+func (c *Config) validateNotifiers() error {
+	names := map[string]bool{}
+	if len(c.Notifiers) == 0 {
+		names[DefaultNotifier] = true
+	}
+	for i, n := range c.Notifiers {
+		if n.Name == "" {
+			return fmt.Errorf("notifiers[%d] has no name", i)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("notifier %q is defined twice", n.Name)
+		}
+		names[n.Name] = true
+
+		var missing string
+		switch n.Type {
+		case NotifierTelegram:
+			if n.ChatID == 0 {
+				missing = "chat_id"
+			}
+		case NotifierDiscord, NotifierSlack, NotifierWebhook, NotifierNtfy:
+			if n.URL == "" {
+				missing = "url"
+			}
+		case NotifierGotify:
+			if n.URL == "" {
+				missing = "url"
+			} else if n.Token == "" {
+				missing = "token"
+			}
+		case NotifierEmail:
+			if n.SMTP.Host == "" {
+				missing = "smtp.host"
+			} else if n.SMTP.From == "" {
+				missing = "smtp.from"
+			} else if len(n.SMTP.To) == 0 {
+				missing = "smtp.to"
+			}
+		default:
+			return fmt.Errorf("notifier %q has unknown type %q", n.Name, n.Type)
+		}
+		if missing != "" {
+			return fmt.Errorf("notifier %q requires %s", n.Name, missing)
+		}
+	}
+
+	for i, route := range c.Routes {
+		if len(route.Notifiers) == 0 {
+			return fmt.Errorf("routes[%d] has no notifiers", i)
+		}
+		for _, name := range route.Notifiers {
+			if !names[name] {
+				return fmt.Errorf("routes[%d] uses unknown notifier %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks that an enabled media server can be reached and polled
+func (m MediaServerConfig) validate() error {
+	switch m.Type {
+	case "":
+		return nil
+	case MediaServerJellyfin, MediaServerEmby:
+	default:
+		return fmt.Errorf("invalid media_server.type %q: expected %s or %s", m.Type, MediaServerJellyfin, MediaServerEmby)
+	}
+	if m.URL == "" {
+		return fmt.Errorf("media_server.url is required for %s", m.Type)
+	}
+	if m.APIKey == "" {
+		return fmt.Errorf("media_server.api_key is required for %s", m.Type)
+	}
+	if m.WaitTimeout < 0 {
+		return fmt.Errorf("invalid media_server.wait_timeout: %s", m.WaitTimeout)
+	}
+	if m.PollInterval <= 0 {
+		return fmt.Errorf("invalid media_server.poll_interval: %s", m.PollInterval)
+	}
+	return nil
+}
+
+// SummaryTime returns the hour and minute of the daily summary, or -1 for
+// the hour when the summary is disabled
+func (d DigestConfig) SummaryTime() (hour, minute int, err error) {
+	if d.DailySummary == "" {
+		return -1, 0, nil
+	}
+	t, err := time.Parse("15:04", d.DailySummary)
+	if err != nil {
+		return -1, 0, fmt.Errorf("invalid digest.daily_summary %q: expected HH:MM", d.DailySummary)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
 // setDefaults sets default values for configuration
 func setDefaults(v *viper.Viper) {
 	// RabbitMQ defaults
@@ -82,12 +395,37 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("rabbitmq.username", "guest")
 	v.SetDefault("rabbitmq.password", "guest")
 	v.SetDefault("rabbitmq.vhost", "/")
+	v.SetDefault("rabbitmq.queue.tasks", "mkvmerge.tasks")
 	v.SetDefault("rabbitmq.queue.done", "mkvmerge.done")
 	v.SetDefault("rabbitmq.queue.dlq", "mkvmerge.done_DLQ")
 
 	// Telegram defaults
 	v.SetDefault("telegram.bot_token", "")
 	v.SetDefault("telegram.chat_id", 0)
+	v.SetDefault("telegram.parse_mode", ParseModeMarkdownV2)
+	v.SetDefault("telegram.retry.max_attempts", 5)
+	v.SetDefault("telegram.retry.initial_delay", "1s")
+	v.SetDefault("telegram.retry.max_delay", "1m")
+	v.SetDefault("telegram.commands.enabled", false)
+	v.SetDefault("telegram.commands.allowed_chats", []int64{})
+	v.SetDefault("telegram.commands.history", 50)
+
+	// Digest defaults
+	v.SetDefault("digest.window", 0)
+	v.SetDefault("digest.group_by", GroupByTorrent)
+	v.SetDefault("digest.max_pending", 100)
+	v.SetDefault("digest.daily_summary", "")
+
+	// Template defaults
+	v.SetDefault("templates.dir", "")
+
+	// Media server defaults
+	v.SetDefault("media_server.type", "")
+	v.SetDefault("media_server.url", "")
+	v.SetDefault("media_server.api_key", "")
+	v.SetDefault("media_server.public_url", "")
+	v.SetDefault("media_server.wait_timeout", "2m")
+	v.SetDefault("media_server.poll_interval", "5s")
 }
 
 // ConnectionString returns the RabbitMQ connection string
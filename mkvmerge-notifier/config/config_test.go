@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConnectionString(t *testing.T) {
@@ -97,3 +99,228 @@ func TestLoad(t *testing.T) {
 		t.Errorf("cfg.Telegram.ChatID = %v, want %v", cfg.Telegram.ChatID, 12345)
 	}
 }
+
+func TestLoadDigest(t *testing.T) {
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Digest.Window != 0 || cfg.Digest.GroupBy != GroupByTorrent || cfg.Digest.MaxPending != 100 || cfg.Digest.DailySummary != "" {
+		t.Errorf("cfg.Digest = %+v, want the defaults", cfg.Digest)
+	}
+
+	os.Setenv("DIGEST_WINDOW", "2m")
+	os.Setenv("DIGEST_GROUP_BY", "category")
+	os.Setenv("DIGEST_DAILY_SUMMARY", "21:30")
+	defer func() {
+		os.Unsetenv("DIGEST_WINDOW")
+		os.Unsetenv("DIGEST_GROUP_BY")
+		os.Unsetenv("DIGEST_DAILY_SUMMARY")
+	}()
+
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Digest.Window != 2*time.Minute {
+		t.Errorf("cfg.Digest.Window = %v, want %v", cfg.Digest.Window, 2*time.Minute)
+	}
+	if cfg.Digest.GroupBy != GroupByCategory {
+		t.Errorf("cfg.Digest.GroupBy = %v, want %v", cfg.Digest.GroupBy, GroupByCategory)
+	}
+	if hour, minute, err := cfg.Digest.SummaryTime(); err != nil || hour != 21 || minute != 30 {
+		t.Errorf("SummaryTime() = %d, %d, %v, want 21, 30, nil", hour, minute, err)
+	}
+}
+
+func TestLoadRejectsInvalidDigest(t *testing.T) {
+	testCases := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"unknown grouping", "DIGEST_GROUP_BY", "file"},
+		{"invalid summary time", "DIGEST_DAILY_SUMMARY", "9pm"},
+		{"negative window", "DIGEST_WINDOW", "-1m"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Setenv(tc.key, tc.value)
+			defer os.Unsetenv(tc.key)
+
+			if _, err := Load(); err == nil {
+				t.Errorf("Load() with %s=%s succeeded, want an error", tc.key, tc.value)
+			}
+		})
+	}
+}
+
+func TestValidateNotifiers(t *testing.T) {
+	valid := []NotifierConfig{
+		{Name: "family", Type: NotifierTelegram, ChatID: 1},
+		{Name: "discord", Type: NotifierDiscord, URL: "https://discord.com/api/webhooks/1/x"},
+		{Name: "gotify", Type: NotifierGotify, URL: "https://gotify.example.com", Token: "app"},
+		{Name: "mail", Type: NotifierEmail, SMTP: SMTPConfig{Host: "mail", From: "a@example.com", To: []string{"b@example.com"}}},
+	}
+
+	testCases := []struct {
+		name      string
+		notifiers []NotifierConfig
+		routes    []RouteConfig
+		wantError string
+	}{
+		{"valid", valid, []RouteConfig{{Categories: []string{"movies"}, Notifiers: []string{"family", "mail"}}}, ""},
+		{"default telegram route", nil, []RouteConfig{{Notifiers: []string{DefaultNotifier}}}, ""},
+		{"unknown type", []NotifierConfig{{Name: "x", Type: "pager"}}, nil, `unknown type "pager"`},
+		{"missing name", []NotifierConfig{{Type: NotifierSlack, URL: "u"}}, nil, "has no name"},
+		{"duplicate name", []NotifierConfig{valid[0], valid[0]}, nil, "defined twice"},
+		{"missing url", []NotifierConfig{{Name: "x", Type: NotifierNtfy}}, nil, "requires url"},
+		{"missing gotify token", []NotifierConfig{{Name: "x", Type: NotifierGotify, URL: "u"}}, nil, "requires token"},
+		{"missing recipients", []NotifierConfig{{Name: "x", Type: NotifierEmail, SMTP: SMTPConfig{Host: "h", From: "f"}}}, nil, "requires smtp.to"},
+		{"unknown route notifier", valid, []RouteConfig{{Notifiers: []string{"kids"}}}, `unknown notifier "kids"`},
+		{"route without notifiers", valid, []RouteConfig{{Categories: []string{"tv"}}}, "has no notifiers"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Notifiers: tc.notifiers, Routes: tc.routes}
+			err := cfg.validateNotifiers()
+			if tc.wantError == "" {
+				if err != nil {
+					t.Errorf("validateNotifiers() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("validateNotifiers() error = %v, want %q", err, tc.wantError)
+			}
+		})
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	route := RouteConfig{Categories: []string{"movies", "tv"}, Statuses: []string{"processed"}}
+	if !route.Matches("TV", "processed") {
+		t.Error("Matches(TV, processed) = false, want true")
+	}
+	if route.Matches("anime", "processed") || route.Matches("movies", "failed") {
+		t.Error("Matches() = true for another category or status")
+	}
+	if !(RouteConfig{}).Matches("", "summary") {
+		t.Error("empty route does not match everything")
+	}
+}
+
+func TestLoadTelegramRetry(t *testing.T) {
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := RetryConfig{MaxAttempts: 5, InitialDelay: time.Second, MaxDelay: time.Minute}
+	if cfg.Telegram.Retry != want {
+		t.Errorf("cfg.Telegram.Retry = %+v, want %+v", cfg.Telegram.Retry, want)
+	}
+
+	os.Setenv("TELEGRAM_RETRY_MAX_ATTEMPTS", "0")
+	defer os.Unsetenv("TELEGRAM_RETRY_MAX_ATTEMPTS")
+	if _, err := Load(); err == nil {
+		t.Error("Load() with TELEGRAM_RETRY_MAX_ATTEMPTS=0 succeeded, want an error")
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Telegram.ParseMode != ParseModeMarkdownV2 || cfg.Templates.Dir != "" {
+		t.Errorf("parse mode %q and templates %+v, want the defaults", cfg.Telegram.ParseMode, cfg.Templates)
+	}
+
+	os.Setenv("TELEGRAM_PARSE_MODE", "HTML")
+	os.Setenv("TEMPLATES_DIR", "/etc/mkvmerge-notifier/templates")
+	defer func() {
+		os.Unsetenv("TELEGRAM_PARSE_MODE")
+		os.Unsetenv("TEMPLATES_DIR")
+	}()
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Telegram.ParseMode != ParseModeHTML || cfg.Templates.Dir != "/etc/mkvmerge-notifier/templates" {
+		t.Errorf("parse mode %q and templates %+v, want the environment", cfg.Telegram.ParseMode, cfg.Templates)
+	}
+
+	os.Setenv("TELEGRAM_PARSE_MODE", "BBCode")
+	if _, err := Load(); err == nil {
+		t.Error("Load() with TELEGRAM_PARSE_MODE=BBCode succeeded, want an error")
+	}
+
+	// The built-in templates only render MarkdownV2
+	os.Setenv("TELEGRAM_PARSE_MODE", "HTML")
+	os.Unsetenv("TEMPLATES_DIR")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "requires templates.dir") {
+		t.Errorf("Load() with TELEGRAM_PARSE_MODE=HTML and no TEMPLATES_DIR error = %v, want an error", err)
+	}
+}
+
+func TestMediaServerValidate(t *testing.T) {
+	valid := MediaServerConfig{Type: MediaServerJellyfin, URL: "http://jellyfin:8096", APIKey: "key", WaitTimeout: time.Minute, PollInterval: time.Second}
+	if err := valid.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	if err := (MediaServerConfig{}).validate(); err != nil {
+		t.Errorf("validate() of a disabled media server error = %v", err)
+	}
+
+	testCases := map[string]func(m *MediaServerConfig){
+		"unknown type":     func(m *MediaServerConfig) { m.Type = "plex" },
+		"missing url":      func(m *MediaServerConfig) { m.URL = "" },
+		"missing api key":  func(m *MediaServerConfig) { m.APIKey = "" },
+		"no poll interval": func(m *MediaServerConfig) { m.PollInterval = 0 },
+	}
+	for name, change := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := valid
+			change(&m)
+			if err := m.validate(); err == nil {
+				t.Errorf("validate() of %+v succeeded, want an error", m)
+			}
+		})
+	}
+}
+
+func TestLoadTelegramCommands(t *testing.T) {
+	os.Setenv("TELEGRAM_CHAT_ID", "42")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Telegram.Commands.Enabled || cfg.Telegram.Commands.History != 50 || cfg.RabbitMQ.Queue.Tasks != "mkvmerge.tasks" {
+		t.Errorf("cfg.Telegram.Commands = %+v and tasks queue %q, want the defaults", cfg.Telegram.Commands, cfg.RabbitMQ.Queue.Tasks)
+	}
+	if chats := cfg.Telegram.Chats(); len(chats) != 1 || chats[0] != 42 {
+		t.Errorf("Chats() = %v, want the notification chat", chats)
+	}
+
+	os.Setenv("TELEGRAM_COMMANDS_ENABLED", "true")
+	os.Setenv("TELEGRAM_COMMANDS_ALLOWED_CHATS", "1,-1002")
+	defer func() {
+		os.Unsetenv("TELEGRAM_COMMANDS_ENABLED")
+		os.Unsetenv("TELEGRAM_COMMANDS_ALLOWED_CHATS")
+	}()
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if chats := cfg.Telegram.Chats(); !cfg.Telegram.Commands.Enabled || len(chats) != 2 || chats[1] != -1002 {
+		t.Errorf("commands %+v with chats %v, want the environment", cfg.Telegram.Commands, chats)
+	}
+
+	os.Setenv("TELEGRAM_COMMANDS_HISTORY", "0")
+	defer os.Unsetenv("TELEGRAM_COMMANDS_HISTORY")
+	if _, err := Load(); err == nil {
+		t.Error("Load() with TELEGRAM_COMMANDS_HISTORY=0 succeeded, want an error")
+	}
+}
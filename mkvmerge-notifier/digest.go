@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"mkvmerge-notifier/config"
+
+	"github.com/streadway/amqp"
+)
+
+// pendingEvent is a done event waiting for its notification to be sent
+type pendingEvent struct {
+	msg      Message
+	delivery amqp.Delivery
+	body     []byte
+}
+
+// digestAggregator collects the done events of a torrent or category for a
+// window and hands them over in one batch when the window ends
+type digestAggregator struct {
+	window  time.Duration
+	groupBy string
+	// flush sends the notification of a batch and settles its deliveries
+	flush func(key string, events []pendingEvent)
+
+	mu     sync.Mutex
+	groups map[string]*digestGroup
+}
+
+// digestGroup holds the events of one key until its window ends
+type digestGroup struct {
+	events []pendingEvent
+	timer  *time.Timer
+}
+
+// Aggregation of done events, nil while no window is configured
+var digests *digestAggregator
+
+// newDigestAggregator returns an aggregator for the digest settings, or nil
+// when events are sent one by one
+func newDigestAggregator(c config.DigestConfig, flush func(key string, events []pendingEvent)) *digestAggregator {
+	if c.Window <= 0 {
+		return nil
+	}
+	return &digestAggregator{
+		window:  c.Window,
+		groupBy: c.GroupBy,
+		flush:   flush,
+		groups:  make(map[string]*digestGroup),
+	}
+}
+
+// digestKey returns the group of an event: its category or its torrent
+func digestKey(groupBy string, msg Message) string {
+	if groupBy == config.GroupByCategory {
+		return msg.Category
+	}
+	return msg.Filename
+}
+
+// add queues an event, starting the window of its group if it is the first
+func (a *digestAggregator) add(event pendingEvent) {
+	key := digestKey(a.groupBy, event.msg)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	group, ok := a.groups[key]
+	if !ok {
+		group = &digestGroup{}
+		group.timer = time.AfterFunc(a.window, func() { a.flushGroup(key, group) })
+		a.groups[key] = group
+	}
+	group.events = append(group.events, event)
+	log.Printf("Queued done event for digest '%s' (%d pending)", key, len(group.events))
+}
+
+// flushGroup sends the digest of a group whose window ended
+func (a *digestAggregator) flushGroup(key string, group *digestGroup) {
+	a.mu.Lock()
+	if a.groups[key] != group {
+		// Already flushed on shutdown
+		a.mu.Unlock()
+		return
+	}
+	delete(a.groups, key)
+	a.mu.Unlock()
+
+	a.flush(key, group.events)
+}
+
+// flushAll sends the digests of every group without waiting for their window
+func (a *digestAggregator) flushAll() {
+	a.mu.Lock()
+	groups := a.groups
+	a.groups = make(map[string]*digestGroup)
+	a.mu.Unlock()
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		groups[key].timer.Stop()
+		a.flush(key, groups[key].events)
+	}
+}
+
+// newNotification returns the notification of done events grouped under key
+func newNotification(key string, events []pendingEvent) Notification {
+	msgs := make([]Message, 0, len(events))
+	for _, event := range events {
+		msgs = append(msgs, event.msg)
+	}
+	title := "MKV Processing Complete: " + filepath.Base(key)
+	if len(events) > 1 {
+		title = fmt.Sprintf("MKV Processing Complete: %d items in %s", len(events), key)
+	}
+	return Notification{
+		Title:   title,
+		Status:  msgs[0].Status,
+		GroupBy: cfg.Digest.GroupBy,
+		Key:     key,
+		Events:  msgs,
+	}
+}
+
+// dailySummary records the done events of a day and reports them once a
+// day. The records live in memory, so a restart loses them.
+type dailySummary struct {
+	hour, minute int
+
+	mu      sync.Mutex
+	entries []Message
+}
+
+// Summary of the processed events, nil while it is disabled
+var summary *dailySummary
+
+// newDailySummary returns the daily summary of the digest settings, or nil
+// when it is disabled
+func newDailySummary(c config.DigestConfig) *dailySummary {
+	hour, minute, err := c.SummaryTime()
+	if err != nil || hour < 0 {
+		return nil
+	}
+	return &dailySummary{hour: hour, minute: minute}
+}
+
+// record adds a done event to the summary of the day
+func (s *dailySummary) record(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, msg)
+}
+
+// take returns the recorded events and starts a new day
+func (s *dailySummary) take() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.entries
+	s.entries = nil
+	return entries
+}
+
+// next returns when the summary after now is due
+func (s *dailySummary) next(now time.Time) time.Time {
+	due := time.Date(now.Year(), now.Month(), now.Day(), s.hour, s.minute, 0, 0, now.Location())
+	if !due.After(now) {
+		due = due.AddDate(0, 0, 1)
+	}
+	return due
+}
+
+// run sends the summary at its time every day until stop is closed, through
+// the notifiers routed for the summary status. Days without events are not
+// reported.
+func (s *dailySummary) run(stop <-chan struct{}) {
+	for {
+		due := s.next(time.Now())
+		log.Printf("Next daily summary at %s", due.Format("2006-01-02 15:04"))
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		entries := s.take()
+		if len(entries) == 0 {
+			log.Println("No done events today, skipping the daily summary")
+			continue
+		}
+		n := Notification{
+			Title:  "Daily Summary " + due.Format("2006-01-02"),
+			Status: summaryStatus,
+			Day:    due,
+			Events: entries,
+		}
+		for _, notifier := range routeNotifiers("", summaryStatus) {
+			if err := notify(notifier, n); err != nil {
+				log.Printf("Failed to send daily summary through %s: %v", notifier.Name(), err)
+			}
+		}
+	}
+}
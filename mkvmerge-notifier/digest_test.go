@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"mkvmerge-notifier/config"
+
+	"github.com/streadway/amqp"
+)
+
+// newTestEvent returns a pending event whose acknowledgement increments acks
+func newTestEvent(msg Message, acks *int, mu *sync.Mutex) pendingEvent {
+	ack := &mockAcknowledger{ackCallback: func(multiple bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*acks++
+		return nil
+	}}
+	return pendingEvent{msg: msg, delivery: amqp.Delivery{Acknowledger: ack}, body: []byte(msg.Filename)}
+}
+
+// Test for the grouping key of done events
+func TestDigestKey(t *testing.T) {
+	msg := Message{Filename: "Show S01", Category: "tv"}
+	if key := digestKey(config.GroupByTorrent, msg); key != "Show S01" {
+		t.Errorf("digestKey(torrent) = %q, want %q", key, "Show S01")
+	}
+	if key := digestKey(config.GroupByCategory, msg); key != "tv" {
+		t.Errorf("digestKey(category) = %q, want %q", key, "tv")
+	}
+}
+
+// Test for events being batched per group until their window ends
+func TestDigestAggregatorWindow(t *testing.T) {
+	var mu sync.Mutex
+	batches := make(map[string][]string)
+	flushed := make(chan string, 2)
+	a := newDigestAggregator(config.DigestConfig{Window: 20 * time.Millisecond, GroupBy: config.GroupByCategory},
+		func(key string, events []pendingEvent) {
+			mu.Lock()
+			for _, event := range events {
+				batches[key] = append(batches[key], event.msg.Filename)
+			}
+			mu.Unlock()
+			flushed <- key
+		})
+
+	a.add(pendingEvent{msg: Message{Filename: "a.mkv", Category: "tv"}})
+	a.add(pendingEvent{msg: Message{Filename: "b.mkv", Category: "movies"}})
+	a.add(pendingEvent{msg: Message{Filename: "c.mkv", Category: "tv"}})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-flushed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("digest was not flushed")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(batches["tv"], ","); got != "a.mkv,c.mkv" {
+		t.Errorf("tv digest = %q, want %q", got, "a.mkv,c.mkv")
+	}
+	if got := strings.Join(batches["movies"], ","); got != "b.mkv" {
+		t.Errorf("movies digest = %q, want %q", got, "b.mkv")
+	}
+}
+
+// Test for flushAll sending pending digests at once, and only once
+func TestDigestAggregatorFlushAll(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	a := newDigestAggregator(config.DigestConfig{Window: 50 * time.Millisecond, GroupBy: config.GroupByTorrent},
+		func(key string, events []pendingEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			keys = append(keys, key)
+		})
+
+	a.add(pendingEvent{msg: Message{Filename: "b"}})
+	a.add(pendingEvent{msg: Message{Filename: "a"}})
+	a.flushAll()
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(keys, ","); got != "a,b" {
+		t.Errorf("flushed digests = %q, want %q", got, "a,b")
+	}
+}
+
+// Test for the aggregator being disabled without a window
+func TestNewDigestAggregatorDisabled(t *testing.T) {
+	if a := newDigestAggregator(config.DigestConfig{}, nil); a != nil {
+		t.Errorf("newDigestAggregator() = %v, want nil", a)
+	}
+}
+
+// Test for the digest of several events and of a single one
+func TestFormatDigestMessage(t *testing.T) {
+	events := []pendingEvent{
+		{msg: Message{Filename: "/tv/Show S01E01.mkv", Status: "processed", Time: "2025-07-30T12:00:00Z"}},
+		{msg: Message{Filename: "/tv/Show S01E02.mkv", Status: "processed", Time: "2025-07-30T12:01:00Z"}},
+	}
+
+	cfg = &config.Config{Digest: config.DigestConfig{GroupBy: config.GroupByCategory}}
+
+	result, err := templates.render(defaultBackend, newNotification("tv", events))
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	for _, want := range []string{"(2 items)", "*Category:* `tv`", "`Show S01E01.mkv`", "`Show S01E02.mkv`", "2025-07-30 12:01:00"} {
+		if !strings.Contains(result, want) {
+			t.Errorf("render() does not contain %q, got: %v", want, result)
+		}
+	}
+
+	single, err := templates.render(defaultBackend, newNotification("tv", events[:1]))
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	if want := renderMessage(t, defaultBackend, events[0].msg); single != want {
+		t.Errorf("render() of one event = %v, want the regular notification %v", single, want)
+	}
+}
+
+// Test for a large digest listing the first events only, within the length
+// of a Telegram message
+func TestFormatLargeDigestMessage(t *testing.T) {
+	cfg = &config.Config{Digest: config.DigestConfig{GroupBy: config.GroupByTorrent}}
+	var events []pendingEvent
+	for i := 1; i <= 500; i++ {
+		filename := fmt.Sprintf("/tv/A Very Long Show Name (2025)/Season 01/A Very Long Show Name (2025) - S01E%03d - An Episode With A Long Title [WEBDL-1080p].mkv", i)
+		events = append(events, pendingEvent{msg: Message{Filename: filename, Status: "processed", Time: "2025-07-30T12:00:00Z"}})
+	}
+
+	for _, backend := range []string{config.NotifierTelegram, defaultBackend, config.NotifierEmail} {
+		result, err := templates.render(backend, newNotification("A Very Long Show Name", events))
+		if err != nil {
+			t.Fatalf("render(%s) error = %v", backend, err)
+		}
+		if n := utf8.RuneCountInString(result); n > telegramMessageLimit {
+			t.Errorf("render(%s) is %d characters long, want at most %d", backend, n, telegramMessageLimit)
+		}
+		if !strings.Contains(result, "S01E020") || strings.Contains(result, "S01E021") {
+			t.Errorf("render(%s) does not list the first 20 events only, got: %v", backend, result)
+		}
+		if !strings.Contains(result, "and 480 more") {
+			t.Errorf("render(%s) does not count the events left out, got: %v", backend, result)
+		}
+	}
+}
+
+// Test for processMessage holding a message until its digest is sent
+func TestProcessMessageQueuesDigest(t *testing.T) {
+	cfg = &config.Config{}
+	notifier := useMockNotifiers(t, &mockNotifier{name: "telegram"})[0]
+	defer func() { digests = nil }()
+	digests = newDigestAggregator(config.DigestConfig{Window: time.Hour, GroupBy: config.GroupByTorrent},
+		func(key string, events []pendingEvent) {
+			deliverNotification(nil, events, func(routed []pendingEvent) Notification {
+				return newNotification(key, routed)
+			})
+		})
+
+	var mu sync.Mutex
+	acks := 0
+	for i := 1; i <= 2; i++ {
+		body := []byte(fmt.Sprintf(`{"filename": "Show S01", "status": "processed", "time": "2025-07-30T12:0%d:00Z"}`, i))
+		event := newTestEvent(Message{}, &acks, &mu)
+		event.delivery.Body = body
+		processMessage(nil, event.delivery, body)
+	}
+
+	if len(notifier.sent) != 0 || acks != 0 {
+		t.Fatalf("sent %d notifications and acked %d before the window ended", len(notifier.sent), acks)
+	}
+
+	digests.flushAll()
+	if len(notifier.sent) != 1 {
+		t.Fatalf("Expected 1 digest to be sent, got %d", len(notifier.sent))
+	}
+	if got := notifier.sent[0].Title; got != "MKV Processing Complete: 2 items in Show S01" {
+		t.Errorf("digest title = %q", got)
+	}
+	if acks != 2 {
+		t.Errorf("Expected 2 messages to be acknowledged, got %d", acks)
+	}
+}
+
+// Test for the time of the next daily summary
+func TestDailySummaryNext(t *testing.T) {
+	s := &dailySummary{hour: 21, minute: 30}
+	testCases := []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		{time.Date(2025, 7, 30, 12, 0, 0, 0, time.UTC), time.Date(2025, 7, 30, 21, 30, 0, 0, time.UTC)},
+		{time.Date(2025, 7, 30, 21, 30, 0, 0, time.UTC), time.Date(2025, 7, 31, 21, 30, 0, 0, time.UTC)},
+		{time.Date(2025, 7, 31, 23, 0, 0, 0, time.UTC), time.Date(2025, 8, 1, 21, 30, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		if next := s.next(tc.now); !next.Equal(tc.expected) {
+			t.Errorf("next(%s) = %s, want %s", tc.now, next, tc.expected)
+		}
+	}
+}
+
+// Test for the daily summary counting events per category and starting over
+func TestDailySummary(t *testing.T) {
+	s := newDailySummary(config.DigestConfig{DailySummary: "08:00"})
+	if s == nil {
+		t.Fatal("newDailySummary() = nil, want a summary")
+	}
+	for i := 0; i < 22; i++ {
+		s.record(Message{Filename: fmt.Sprintf("/tv/Show S01E%02d.mkv", i+1), Category: "tv"})
+	}
+	s.record(Message{Filename: "/movies/Movie.mkv"})
+
+	entries := s.take()
+	if len(s.take()) != 0 {
+		t.Error("take() did not start a new day")
+	}
+
+	n := Notification{Status: summaryStatus, Day: time.Date(2025, 7, 30, 8, 0, 0, 0, time.UTC), Events: entries}
+	result, err := templates.render(defaultBackend, n)
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	for _, want := range []string{"*Daily Summary* (2025-07-30)", "*Processed:* 23", "tv: 22", "uncategorized: 1", "`Show S01E01.mkv`", "…and 3 more"} {
+		if !strings.Contains(result, want) {
+			t.Errorf("render() does not contain %q, got: %v", want, result)
+		}
+	}
+
+	if s := newDailySummary(config.DigestConfig{}); s != nil {
+		t.Errorf("newDailySummary() = %v, want nil when disabled", s)
+	}
+}
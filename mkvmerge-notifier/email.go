@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"mkvmerge-notifier/config"
+)
+
+// defaultSMTPPort is the submission port used when none is configured
+const defaultSMTPPort = "587"
+
+// emailNotifier mails notifications through an SMTP server
+type emailNotifier struct {
+	name string
+	smtp config.SMTPConfig
+}
+
+// Name identifies the notifier
+func (e *emailNotifier) Name() string { return e.name }
+
+// Type returns the backend the notifier sends through
+func (e *emailNotifier) Type() string { return config.NotifierEmail }
+
+// Notify mails the notification as plain text
+func (e *emailNotifier) Notify(n Notification) error {
+	port := e.smtp.Port
+	if port == "" {
+		port = defaultSMTPPort
+	}
+
+	var auth smtp.Auth
+	if e.smtp.Username != "" {
+		auth = smtp.PlainAuth("", e.smtp.Username, e.smtp.Password, e.smtp.Host)
+	}
+
+	if err := smtpSendMail(net.JoinHostPort(e.smtp.Host, port), auth, e.smtp.From, e.smtp.To, formatEmail(e.smtp, n)); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// formatEmail builds the mail of a notification
+func formatEmail(c config.SMTPConfig, n Notification) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", c.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -6,7 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -28,6 +28,19 @@ type Message struct {
 	Filename string `json:"filename"`
 	Status   string `json:"status"`
 	Time     string `json:"time"`
+	// TorrentName and Category are set by consumers publishing version 2 events
+	TorrentName string `json:"torrentName,omitempty"`
+	Category    string `json:"category,omitempty"`
+	// Files are the processed files of version 2 events
+	Files []doneFile `json:"files,omitempty"`
+	// Media is the media server item the event was added as, set once its
+	// library was refreshed
+	Media *MediaItem `json:"media,omitempty"`
+}
+
+// doneFile is a file of a version 2 done event
+type doneFile struct {
+	Path string `json:"path"`
 }
 
 // failOnError logs and exits on error
@@ -164,12 +177,14 @@ func isInequivalentArgError(err error) bool {
 	return false
 }
 
-// publishToDLQ publishes a message to the Dead Letter Queue with an error reason
-func publishToDLQ(ch *amqp.Channel, body []byte, reason string) error {
+// publishToDLQ publishes a message to the Dead Letter Queue with an error
+// reason and the number of attempts made to send its notification
+func publishToDLQ(ch *amqp.Channel, body []byte, reason string, attempts int) error {
 	// Create a wrapper message with the original message and error reason
 	dlqMessage := map[string]interface{}{
 		"originalMessage": string(body),
 		"errorReason":     reason,
+		"attempts":        attempts,
 		"timestamp":       time.Now().Format(time.RFC3339),
 	}
 
@@ -240,47 +255,53 @@ var _ TelegramBotInterface = (*tgbotapi.BotAPI)(nil)
 // Helper variable to make failOnError testable
 var osExit = os.Exit
 
-// sendTelegramNotification sends a notification message via Telegram bot
-func sendTelegramNotification(bot TelegramBotInterface, message string) error {
-	msg := tgbotapi.NewMessage(cfg.Telegram.ChatID, message)
-	msg.ParseMode = "Markdown"
+// sendTelegramMessage sends a notification message to a chat via Telegram
+// bot, formatted in a parse mode such as MarkdownV2 or HTML
+func sendTelegramMessage(bot TelegramBotInterface, chatID int64, message, parseMode string) error {
+	msg := tgbotapi.NewMessage(chatID, message)
+	msg.ParseMode = parseMode
 
 	_, err := bot.Send(msg)
 	if err != nil {
-		return fmt.Errorf("failed to send telegram message: %v", err)
+		return fmt.Errorf("failed to send telegram message: %w", err)
 	}
 
 	log.Printf("Successfully sent Telegram notification: %s", message)
 	return nil
 }
 
-// formatNotificationMessage formats the notification message for Telegram
-func formatNotificationMessage(msg Message) string {
-	filename := filepath.Base(msg.Filename)
+// sendTelegramPhoto sends a photo with a caption to a chat via Telegram bot
+func sendTelegramPhoto(bot TelegramBotInterface, chatID int64, photo []byte, caption, parseMode string) error {
+	msg := tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: "poster.jpg", Bytes: photo})
+	msg.Caption = caption
+	msg.ParseMode = parseMode
 
-	// Parse the time to make it more readable
-	parsedTime, err := time.Parse(time.RFC3339, msg.Time)
+	_, err := bot.Send(msg)
 	if err != nil {
-		log.Printf("Warning: Could not parse time %s: %v", msg.Time, err)
-		parsedTime = time.Now()
+		return fmt.Errorf("failed to send telegram photo: %w", err)
 	}
 
-	formattedTime := parsedTime.Format("2006-01-02 15:04:05")
-
-	return fmt.Sprintf(
-		"🎬 *MKV Processing Complete*\n\n"+
-			"📁 *File:* `%s`\n"+
-			"✅ *Status:* %s\n"+
-			"🕒 *Completed:* %s\n"+
-			"📂 *Full Path:* `%s`",
-		filename,
-		msg.Status,
-		formattedTime,
-		msg.Filename,
-	)
+	log.Printf("Successfully sent Telegram notification with poster: %s", caption)
+	return nil
+}
+
+// formatEventTime makes the RFC 3339 time of an event more readable
+func formatEventTime(value string) string {
+	parsedTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Printf("Warning: Could not parse time %s: %v", value, err)
+		parsedTime = time.Now()
+	}
+	return parsedTime.Format("2006-01-02 15:04:05")
 }
 
 func main() {
+	// Run a command instead of consuming when one is given
+	if len(os.Args) > 1 {
+		osExit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+		return
+	}
+
 	// Set up logging
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
@@ -299,12 +320,33 @@ func main() {
 
 	log.Printf("Configuration loaded successfully")
 
-	// Initialize Telegram bot
-	bot, err := tgbotapi.NewBotAPI(cfg.Telegram.BotToken)
+	// Load the user-supplied notification templates
+	templates, err = loadTemplates(cfg.Templates.Dir)
+	if err == nil {
+		err = templates.checkParseMode(cfg.Telegram.ParseMode)
+	}
 	if err != nil {
-		failOnError(err, "Failed to initialize Telegram bot")
+		failOnError(err, "Failed to load templates")
+	}
+	if cfg.Templates.Dir != "" {
+		log.Printf("Templates loaded from %s", cfg.Templates.Dir)
+	}
+
+	// Initialize the notifiers and their Telegram bots
+	notifiers, err = newNotifiers(cfg, newTelegramBot)
+	if err != nil {
+		failOnError(err, "Failed to initialize notifiers")
+	}
+	routes = cfg.Routes
+	for _, n := range notifiers {
+		log.Printf("Notifier '%s' initialized", n.Name())
+	}
+
+	// Refresh the media server library on done events when configured
+	media = newMediaServer(cfg.MediaServer)
+	if media != nil {
+		log.Printf("Refreshing the %s library at %s on done events", media.displayName(), media.url)
 	}
-	log.Printf("Telegram bot initialized: @%s", bot.Self.UserName)
 
 	// Connect to RabbitMQ
 	conn, err := amqp.Dial(cfg.ConnectionString())
@@ -323,18 +365,29 @@ func main() {
 	defer mainCh.Close()
 	_ = ensureQueueExists(mainCh, dlqQueueName) // Ensure dead letter queue exists
 
+	// Events waiting for their digest stay unacknowledged, so the prefetch
+	// count must leave room for them
+	prefetch := 1
+	if cfg.Digest.Window > 0 {
+		prefetch = cfg.Digest.MaxPending
+	}
+	// So do events waiting for their media server item
+	if media != nil {
+		prefetch += maxPendingRefreshes
+	}
+
 	// Set QoS (prefetch count)
 	err = mainCh.Qos(
-		1,     // prefetch count (process one message at a time)
-		0,     // prefetch size
-		false, // global
+		prefetch, // prefetch count
+		0,        // prefetch size
+		false,    // global
 	)
 	failOnError(err, "Failed to set QoS")
 
 	// Register consumer
 	msgs, err := mainCh.Consume(
 		processingQueue.Name, // queue
-		"",                   // consumer tag (empty means auto-generated)
+		consumerTag,          // consumer tag, to cancel it on shutdown
 		false,                // auto-ack (false means manual acknowledgment)
 		false,                // exclusive
 		false,                // no-local
@@ -344,6 +397,39 @@ func main() {
 	failOnError(err, "Failed to register a consumer")
 	log.Println("Consumer registered, waiting for messages...")
 
+	// Batch done events into digests and summarize the day when configured
+	digests = newDigestAggregator(cfg.Digest, func(key string, events []pendingEvent) {
+		deliverNotification(mainCh, events, func(routed []pendingEvent) Notification {
+			return newNotification(key, routed)
+		})
+	})
+	if digests != nil {
+		log.Printf("Sending digests of the done events of each %s every %s", cfg.Digest.GroupBy, cfg.Digest.Window)
+	}
+	stopSummary := make(chan struct{})
+	summary = newDailySummary(cfg.Digest)
+	if summary != nil {
+		go summary.run(stopSummary)
+	}
+
+	// Answer the bot commands of the authorized chats when enabled
+	var commandUpdates *tgbotapi.BotAPI
+	if cfg.Telegram.Commands.Enabled {
+		commandUpdates, err = tgbotapi.NewBotAPI(cfg.Telegram.BotToken)
+		failOnError(err, "Failed to initialize Telegram bot for commands")
+		if _, err := commandUpdates.Request(tgbotapi.NewSetMyCommands(botCommands...)); err != nil {
+			log.Printf("Warning: Failed to set the bot commands menu: %v", err)
+		}
+		history = newRecentItems(cfg.Telegram.Commands.History)
+		handler := newCommandHandler(cfg, commandUpdates, func() (commandChannel, error) {
+			return conn.Channel()
+		})
+		updates := tgbotapi.NewUpdate(0)
+		updates.Timeout = 60
+		go handler.run(commandUpdates.GetUpdatesChan(updates))
+		log.Printf("Answering bot commands from chats %v", cfg.Telegram.Chats())
+	}
+
 	// Create a channel to handle shutdown signals
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
@@ -352,12 +438,14 @@ func main() {
 	forever := make(chan bool)
 
 	// Process messages in a goroutine
+	consumed := make(chan struct{})
 	go func() {
+		defer close(consumed)
 		for d := range msgs {
 			log.Printf("Received a message: %s", d.Body)
 
 			// Process the message and acknowledge only after successful notification
-			processMessage(mainCh, bot, d, d.Body)
+			processMessage(mainCh, d, d.Body)
 		}
 	}()
 
@@ -367,6 +455,26 @@ func main() {
 		log.Printf("Received shutdown signal: %v", sig)
 		log.Println("Shutting down gracefully...")
 
+		// Stop taking messages, then let the events waiting for their media
+		// server item join their digests
+		if err := mainCh.Cancel(consumerTag, false); err != nil {
+			log.Printf("Error cancelling the consumer: %v", err)
+		}
+		<-consumed
+		if media != nil {
+			media.stopWaiting()
+		}
+		refreshes.Wait()
+
+		// Send what is waiting for its digest while the channel is still open
+		close(stopSummary)
+		if commandUpdates != nil {
+			commandUpdates.StopReceivingUpdates()
+		}
+		if digests != nil {
+			digests.flushAll()
+		}
+
 		// Close RabbitMQ connection
 		if err := conn.Close(); err != nil {
 			log.Printf("Error closing RabbitMQ connection: %v", err)
@@ -380,8 +488,19 @@ func main() {
 	log.Println("MKV Notifier shutdown complete")
 }
 
-// processMessage handles the received message by sending a Telegram notification
-func processMessage(ch *amqp.Channel, bot TelegramBotInterface, d amqp.Delivery, body []byte) {
+// maxPendingRefreshes is the number of events that wait for their media
+// server item at the same time
+const maxPendingRefreshes = 20
+
+// consumerTag identifies the consumer of the done queue
+const consumerTag = "mkvmerge-notifier"
+
+// refreshes tracks the events waiting for their media server item, which
+// shutdown waits for before flushing the digests
+var refreshes sync.WaitGroup
+
+// processMessage handles the received message by sending its notifications
+func processMessage(ch *amqp.Channel, d amqp.Delivery, body []byte) {
 	log.Printf("Processing notification message: %s", body)
 
 	// Parse the JSON message
@@ -404,33 +523,49 @@ func processMessage(ch *amqp.Channel, bot TelegramBotInterface, d amqp.Delivery,
 		return
 	}
 
-	// Format and send the Telegram notification
-	notificationText := formatNotificationMessage(msg)
+	// Refresh the media server so the notification can link to the item.
+	// The refresh waits for the scan, so it runs aside and the following
+	// events are processed meanwhile.
+	if media != nil {
+		refreshes.Add(1)
+		go func() {
+			defer refreshes.Done()
+			item, err := media.refreshItem(msg)
+			if err != nil {
+				log.Printf("Warning: Could not refresh the media server: %v", err)
+			} else {
+				msg.Media = item
+			}
+			dispatchEvent(ch, msg, d, body)
+		}()
+		return
+	}
 
-	// Attempt to send the notification
-	if err := sendTelegramNotification(bot, notificationText); err != nil {
-		log.Printf("Failed to send Telegram notification: %v", err)
+	dispatchEvent(ch, msg, d, body)
+}
 
-		// Move message to DLQ since notification failed
-		if err := publishToDLQ(ch, body, fmt.Sprintf("Failed to send Telegram notification: %v", err)); err != nil {
-			log.Printf("Error publishing to DLQ: %v", err)
-		}
+// dispatchEvent records a parsed done event and sends its notifications, or
+// adds it to its digest
+func dispatchEvent(ch *amqp.Channel, msg Message, d amqp.Delivery, body []byte) {
+	if summary != nil {
+		summary.record(msg)
+	}
+	if history != nil {
+		history.add(msg)
+	}
 
-		// Acknowledge the original message to remove it from the main queue
-		if err := d.Ack(false); err != nil {
-			log.Printf("Error acknowledging failed message: %v", err)
-		} else {
-			log.Println("Message acknowledged after moving to DLQ due to notification failure")
-		}
+	event := pendingEvent{msg: msg, delivery: d, body: body}
+	if digests != nil {
+		// The message is acknowledged once its digest is sent
+		digests.add(event)
 		return
 	}
 
-	// If notification was sent successfully, acknowledge the message
-	if err := d.Ack(false); err != nil {
-		log.Printf("Error acknowledging message after successful notification: %v", err)
-	} else {
-		log.Println("Message acknowledged after successful Telegram notification")
-	}
+	// Format and send the notifications
+	key := digestKey(cfg.Digest.GroupBy, msg)
+	deliverNotification(ch, []pendingEvent{event}, func(routed []pendingEvent) Notification {
+		return newNotification(key, routed)
+	})
 
 	log.Println("Notification message processing completed")
 }
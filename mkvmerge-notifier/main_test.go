@@ -81,21 +81,21 @@ func TestFormatNotificationMessage(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := formatNotificationMessage(tc.message)
+			result := renderMessage(t, defaultBackend, tc.message)
 
 			// Check that the result contains the expected filename
 			if !strings.Contains(result, filepath.Base(tc.message.Filename)) {
-				t.Errorf("formatNotificationMessage() does not contain filename, got: %v", result)
+				t.Errorf("render() does not contain filename, got: %v", result)
 			}
 
 			// Check that the result contains the status
 			if !strings.Contains(result, tc.message.Status) {
-				t.Errorf("formatNotificationMessage() does not contain status, got: %v", result)
+				t.Errorf("render() does not contain status, got: %v", result)
 			}
 
 			// Check for the expected text pattern
 			if !strings.Contains(result, tc.expected) {
-				t.Errorf("formatNotificationMessage() does not contain %v, got: %v", tc.expected, result)
+				t.Errorf("render() does not contain %v, got: %v", tc.expected, result)
 			}
 		})
 	}
@@ -131,7 +131,7 @@ func TestSendTelegramNotification(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			err := sendTelegramNotification(tc.bot, tc.message)
+			err := sendTelegramMessage(tc.bot, cfg.Telegram.ChatID, tc.message, config.ParseModeMarkdownV2)
 
 			if tc.shouldError {
 				if err == nil {
@@ -281,11 +281,11 @@ func TestMessageIntegration(t *testing.T) {
 	mockBot := &MockTelegramBot{}
 
 	// Test formatting and notification logic
-	notificationText := formatNotificationMessage(validMessage)
-	err := sendTelegramNotification(mockBot, notificationText)
+	notificationText := renderMessage(t, config.NotifierTelegram, validMessage)
+	err := sendTelegramMessage(mockBot, cfg.Telegram.ChatID, notificationText, config.ParseModeMarkdownV2)
 
 	if err != nil {
-		t.Errorf("sendTelegramNotification() failed: %v", err)
+		t.Errorf("sendTelegramMessage() failed: %v", err)
 	}
 
 	// Verify notification format contains expected elements
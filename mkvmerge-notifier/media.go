@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"mkvmerge-notifier/config"
+)
+
+// MediaItem is the media server item a done event was added as
+type MediaItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Server is the product name shown in links, Jellyfin or Emby
+	Server string `json:"server"`
+	// Link opens the item in the web client
+	Link string `json:"link"`
+	// Poster is the public URL of the primary image, empty without one
+	Poster string `json:"poster,omitempty"`
+
+	// imagePath is the API path the poster is downloaded from
+	imagePath string
+}
+
+// mediaServer refreshes the libraries of a Jellyfin or Emby server and
+// looks up the items added to them. Both servers share the API used here.
+type mediaServer struct {
+	kind         string
+	url          string
+	publicURL    string
+	apiKey       string
+	pathMappings map[string]string
+	waitTimeout  time.Duration
+	pollInterval time.Duration
+
+	// serverID is looked up once, refreshes run concurrently
+	mu       sync.Mutex
+	serverID string
+
+	// stop ends the waits for items on shutdown
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Media server refreshed on done events, nil while it is disabled
+var media *mediaServer
+
+// mediaPollLimit is the number of recent items searched for a new one
+const mediaPollLimit = 100
+
+// newMediaServer returns the media server of the settings, or nil when the
+// refresh is disabled
+func newMediaServer(c config.MediaServerConfig) *mediaServer {
+	if c.Type == "" {
+		return nil
+	}
+	publicURL := c.PublicURL
+	if publicURL == "" {
+		publicURL = c.URL
+	}
+	return &mediaServer{
+		kind:         c.Type,
+		url:          strings.TrimSuffix(c.URL, "/"),
+		publicURL:    strings.TrimSuffix(publicURL, "/"),
+		apiKey:       c.APIKey,
+		pathMappings: c.PathMappings,
+		waitTimeout:  c.WaitTimeout,
+		pollInterval: c.PollInterval,
+		stop:         make(chan struct{}),
+	}
+}
+
+// stopWaiting makes the refreshes give up waiting for their items, so their
+// events are sent without them
+func (m *mediaServer) stopWaiting() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// displayName is the product name of the server
+func (m *mediaServer) displayName() string {
+	if m.kind == config.MediaServerEmby {
+		return "Emby"
+	}
+	return "Jellyfin"
+}
+
+// virtualFolder is a library of the server
+type virtualFolder struct {
+	Name      string   `json:"Name"`
+	Locations []string `json:"Locations"`
+	ItemID    string   `json:"ItemId"`
+}
+
+// serverItem is an item as the server returns it
+type serverItem struct {
+	ID                    string            `json:"Id"`
+	Name                  string            `json:"Name"`
+	Path                  string            `json:"Path"`
+	ImageTags             map[string]string `json:"ImageTags"`
+	SeriesID              string            `json:"SeriesId"`
+	SeriesName            string            `json:"SeriesName"`
+	SeriesPrimaryImageTag string            `json:"SeriesPrimaryImageTag"`
+}
+
+// mediaUpdate reports a changed path to the server
+type mediaUpdate struct {
+	Path       string `json:"Path"`
+	UpdateType string `json:"UpdateType"`
+}
+
+// request sends an authenticated API request with body as JSON unless it is
+// nil, and decodes the JSON response into v unless it is nil
+func (m *mediaServer) request(method, endpoint string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, m.url+endpoint, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-Emby-Token", m.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s returned %s: %s", method, endpoint, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %v", endpoint, err)
+	}
+	return nil
+}
+
+// mediaPath returns the path of a done event: its first file for version 2
+// events, whose filename is the torrent name, else the filename
+func mediaPath(msg Message) string {
+	if len(msg.Files) > 0 && msg.Files[0].Path != "" {
+		return msg.Files[0].Path
+	}
+	return msg.Filename
+}
+
+// mapPath translates a path of a done event into the path the server sees,
+// using the longest matching prefix
+func (m *mediaServer) mapPath(p string) string {
+	p = path.Clean(p)
+	from, to := "", ""
+	for prefix, target := range m.pathMappings {
+		prefix = path.Clean(prefix)
+		if hasPathPrefix(p, prefix) && len(prefix) > len(from) {
+			from, to = prefix, target
+		}
+	}
+	if from == "" {
+		return p
+	}
+	return path.Join(to, strings.TrimPrefix(p, from))
+}
+
+// hasPathPrefix reports whether p is dir or lies inside it
+func hasPathPrefix(p, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// findLibrary returns the library whose locations contain a path
+func (m *mediaServer) findLibrary(p string) (*virtualFolder, error) {
+	var folders []virtualFolder
+	if err := m.request(http.MethodGet, "/Library/VirtualFolders", nil, &folders); err != nil {
+		return nil, fmt.Errorf("failed to list libraries: %w", err)
+	}
+	var found *virtualFolder
+	longest := -1
+	for i, folder := range folders {
+		for _, location := range folder.Locations {
+			if hasPathPrefix(p, location) && len(location) > longest {
+				found, longest = &folders[i], len(location)
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no library contains %s", p)
+	}
+	return found, nil
+}
+
+// findItem returns the most recent item of a library at or below a path, or
+// nil while there is none
+func (m *mediaServer) findItem(library, p string) (*serverItem, error) {
+	query := url.Values{
+		"ParentId":  {library},
+		"Recursive": {"true"},
+		"Fields":    {"Path"},
+		"SortBy":    {"DateCreated"},
+		"SortOrder": {"Descending"},
+		"Limit":     {fmt.Sprint(mediaPollLimit)},
+	}
+	var result struct {
+		Items []serverItem `json:"Items"`
+	}
+	if err := m.request(http.MethodGet, "/Items?"+query.Encode(), nil, &result); err != nil {
+		return nil, fmt.Errorf("failed to list items: %w", err)
+	}
+	for i, item := range result.Items {
+		if item.Path != "" && hasPathPrefix(item.Path, p) {
+			return &result.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// refreshItem reports the path of a done event to the server, which scans
+// only that path, and waits for its item to appear in the library holding it
+func (m *mediaServer) refreshItem(msg Message) (*MediaItem, error) {
+	p := m.mapPath(mediaPath(msg))
+	library, err := m.findLibrary(p)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Reporting %s to %s library '%s'", p, m.displayName(), library.Name)
+	update := map[string][]mediaUpdate{"Updates": {{Path: p, UpdateType: "Created"}}}
+	if err := m.request(http.MethodPost, "/Library/Media/Updated", update, nil); err != nil {
+		return nil, fmt.Errorf("failed to report %s: %w", p, err)
+	}
+
+	// Polls are counted rather than timed, the sleeps may be mocked
+	polls := int(m.waitTimeout/m.pollInterval) + 1
+	for poll := 1; ; poll++ {
+		item, err := m.findItem(library.ItemID, p)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			log.Printf("Found %s item '%s' for %s", m.displayName(), item.Name, p)
+			return m.newMediaItem(item)
+		}
+		if poll >= polls {
+			return nil, fmt.Errorf("no item appeared for %s within %s", p, m.waitTimeout)
+		}
+		select {
+		case <-m.stop:
+			return nil, fmt.Errorf("stopped waiting for the item of %s on shutdown", p)
+		default:
+		}
+		sleepFunc(m.pollInterval)
+	}
+}
+
+// newMediaItem returns the link and poster of an item
+func (m *mediaServer) newMediaItem(item *serverItem) (*MediaItem, error) {
+	serverID, err := m.lookupServerID()
+	if err != nil {
+		return nil, err
+	}
+
+	link := fmt.Sprintf("%s/web/#/details?id=%s&serverId=%s", m.publicURL, item.ID, serverID)
+	if m.kind == config.MediaServerEmby {
+		link = fmt.Sprintf("%s/web/index.html#!/item?id=%s&serverId=%s", m.publicURL, item.ID, serverID)
+	}
+	result := &MediaItem{ID: item.ID, Name: item.Name, Server: m.displayName(), Link: link}
+	if item.SeriesName != "" {
+		result.Name = item.SeriesName + " - " + item.Name
+	}
+
+	// Episodes get the poster of their series rather than a still
+	switch {
+	case item.SeriesID != "" && item.SeriesPrimaryImageTag != "":
+		result.imagePath = "/Items/" + url.PathEscape(item.SeriesID) + "/Images/Primary?tag=" + url.QueryEscape(item.SeriesPrimaryImageTag)
+	case item.ImageTags["Primary"] != "":
+		result.imagePath = "/Items/" + url.PathEscape(item.ID) + "/Images/Primary?tag=" + url.QueryEscape(item.ImageTags["Primary"])
+	}
+	if result.imagePath != "" {
+		result.Poster = m.publicURL + result.imagePath
+	}
+	return result, nil
+}
+
+// lookupServerID returns the ID of the server the links point to
+func (m *mediaServer) lookupServerID() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.serverID == "" {
+		var info struct {
+			ID string `json:"Id"`
+		}
+		if err := m.request(http.MethodGet, "/System/Info/Public", nil, &info); err != nil {
+			return "", fmt.Errorf("failed to get server info: %w", err)
+		}
+		m.serverID = info.ID
+	}
+	return m.serverID, nil
+}
+
+// poster downloads the poster of an item
+func (m *mediaServer) poster(item *MediaItem) ([]byte, error) {
+	if item.imagePath == "" {
+		return nil, fmt.Errorf("item %s has no poster", item.ID)
+	}
+	req, err := http.NewRequest(http.MethodGet, m.url+item.imagePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-Emby-Token", m.apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download poster: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download poster: server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxPosterSize))
+}
+
+// maxPosterSize caps a poster download, Telegram accepts photos up to 10 MB
+const maxPosterSize = 10 << 20
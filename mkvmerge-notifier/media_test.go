@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeJellyfin is an httptest stand-in for the Jellyfin API. Its items
+// appear once a path was reported and the library polled appearAfter times.
+// Reports wait for release when it is set.
+type fakeJellyfin struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	items       []serverItem
+	appearAfter int
+	polls       int
+	refreshed   []string
+	release     chan struct{}
+}
+
+// newFakeJellyfin starts a Jellyfin stand-in with a tv library at /media/tv
+func newFakeJellyfin(t *testing.T, items ...serverItem) *fakeJellyfin {
+	f := &fakeJellyfin{items: items}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Library/VirtualFolders", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]virtualFolder{
+			{Name: "Movies", Locations: []string{"/media/movies"}, ItemID: "lib-movies"},
+			{Name: "Shows", Locations: []string{"/media/tv"}, ItemID: "lib-tv"},
+		})
+	})
+	mux.HandleFunc("/Library/Media/Updated", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Updates []mediaUpdate `json:"Updates"`
+		}
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if f.release != nil {
+			<-f.release
+		}
+		f.mu.Lock()
+		for _, update := range body.Updates {
+			f.refreshed = append(f.refreshed, update.UpdateType+" "+update.Path)
+		}
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/Items", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.URL.Query().Get("ParentId") != "lib-tv" || len(f.refreshed) == 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"Items": []serverItem{}})
+			return
+		}
+		f.polls++
+		items := []serverItem{}
+		if f.polls > f.appearAfter {
+			items = f.items
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Items": items})
+	})
+	mux.HandleFunc("/Items/series-1/Images/Primary", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("poster"))
+	})
+	mux.HandleFunc("/System/Info/Public", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"Id": "server-1"})
+	})
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Emby-Token") != "key" && r.URL.Path != "/System/Info/Public" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// newTestMediaServer returns the media server of a stand-in, polling without
+// sleeping
+func newTestMediaServer(t *testing.T, kind, url string) *mediaServer {
+	origSleep := sleepFunc
+	t.Cleanup(func() { sleepFunc = origSleep })
+	sleepFunc = func(time.Duration) {}
+
+	return newMediaServer(config.MediaServerConfig{
+		Type:         kind,
+		URL:          url,
+		APIKey:       "key",
+		PublicURL:    "https://media.example.com/",
+		PathMappings: map[string]string{"/downloads/done": "/media"},
+		WaitTimeout:  time.Minute,
+		PollInterval: 20 * time.Second,
+	})
+}
+
+// episode is the item of a processed episode in the stand-in
+var episode = serverItem{
+	ID:                    "ep-1",
+	Name:                  "Pilot",
+	Path:                  "/media/tv/Show/Season 1/Show.S01E01.mkv",
+	SeriesID:              "series-1",
+	SeriesName:            "Show",
+	SeriesPrimaryImageTag: "tag1",
+}
+
+// Test for reporting the path of an event and waiting for its item
+func TestMediaServerRefreshItem(t *testing.T) {
+	jellyfin := newFakeJellyfin(t, serverItem{ID: "other", Path: "/media/tv/Other/Other.S01E01.mkv"}, episode)
+	jellyfin.appearAfter = 2
+	m := newTestMediaServer(t, config.MediaServerJellyfin, jellyfin.URL)
+
+	msg := Message{Filename: "Show S01", Files: []doneFile{{Path: "/downloads/done/tv/Show/Season 1/Show.S01E01.mkv"}}}
+	item, err := m.refreshItem(msg)
+	if err != nil {
+		t.Fatalf("refreshItem() error = %v", err)
+	}
+	if want := "Created /media/tv/Show/Season 1/Show.S01E01.mkv"; len(jellyfin.refreshed) != 1 || jellyfin.refreshed[0] != want || jellyfin.polls != 3 {
+		t.Errorf("reported %v and polled %d times, want %q once and 3 polls", jellyfin.refreshed, jellyfin.polls, want)
+	}
+	want := MediaItem{
+		ID:        "ep-1",
+		Name:      "Show - Pilot",
+		Server:    "Jellyfin",
+		Link:      "https://media.example.com/web/#/details?id=ep-1&serverId=server-1",
+		Poster:    "https://media.example.com/Items/series-1/Images/Primary?tag=tag1",
+		imagePath: "/Items/series-1/Images/Primary?tag=tag1",
+	}
+	if *item != want {
+		t.Errorf("refreshItem() = %+v, want %+v", *item, want)
+	}
+
+	poster, err := m.poster(item)
+	if err != nil || string(poster) != "poster" {
+		t.Errorf("poster() = %q, %v, want the image", poster, err)
+	}
+}
+
+// Test for the Emby link and the errors of a refresh
+func TestMediaServerRefreshItemErrors(t *testing.T) {
+	jellyfin := newFakeJellyfin(t, episode)
+	m := newTestMediaServer(t, config.MediaServerEmby, jellyfin.URL)
+
+	item, err := m.refreshItem(Message{Filename: "/media/tv/Show/Season 1/Show.S01E01.mkv"})
+	if err != nil {
+		t.Fatalf("refreshItem() error = %v", err)
+	}
+	if want := "https://media.example.com/web/index.html#!/item?id=ep-1&serverId=server-1"; item.Link != want {
+		t.Errorf("Emby link = %q, want %q", item.Link, want)
+	}
+
+	if _, err := m.refreshItem(Message{Filename: "/music/song.flac"}); err == nil || !strings.Contains(err.Error(), "no library contains") {
+		t.Errorf("refreshItem() outside the libraries error = %v", err)
+	}
+
+	jellyfin.appearAfter = 100
+	if _, err := m.refreshItem(Message{Filename: "/media/tv/Show/Season 1/Show.S01E02.mkv"}); err == nil || !strings.Contains(err.Error(), "no item appeared") {
+		t.Errorf("refreshItem() of a missing item error = %v", err)
+	}
+
+	m.apiKey = "wrong"
+	if _, err := m.refreshItem(Message{Filename: "/media/tv/Show/Season 1/Show.S01E01.mkv"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("refreshItem() with a wrong key error = %v", err)
+	}
+}
+
+// Test for shutdown ending the wait for an item and sending the event without it
+func TestProcessMessageStopWaiting(t *testing.T) {
+	jellyfin := newFakeJellyfin(t, episode)
+	jellyfin.appearAfter = 1000
+	defer func() { media = nil }()
+	media = newTestMediaServer(t, config.MediaServerJellyfin, jellyfin.URL)
+	polled := make(chan struct{})
+	sleepFunc = func(time.Duration) {
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	origNotifiers, origRoutes := notifiers, routes
+	defer func() { notifiers, routes = origNotifiers, origRoutes }()
+	bot := &MockTelegramBot{}
+	notifiers = []Notifier{&telegramNotifier{name: "telegram", bot: bot, chatID: 42, parseMode: config.ParseModeMarkdownV2, retry: config.RetryConfig{MaxAttempts: 1}}}
+	routes = nil
+	cfg = &config.Config{}
+
+	acks := 0
+	var mu sync.Mutex
+	event := newTestEvent(Message{}, &acks, &mu)
+	body := []byte(`{"filename": "/downloads/done/tv/Show/Season 1/Show.S01E01.mkv", "status": "processed", "time": "2025-07-30T12:00:00Z"}`)
+	processMessage(nil, event.delivery, body)
+
+	// Shutdown waits for the event once it stopped the wait for its item
+	<-polled
+	media.stopWaiting()
+	refreshes.Wait()
+
+	if acks != 1 || len(bot.messages) != 1 {
+		t.Fatalf("acked %d and sent %d messages, want 1 of each", acks, len(bot.messages))
+	}
+	if _, ok := bot.messages[0].(tgbotapi.MessageConfig); !ok {
+		t.Errorf("sent %T, want a message without the item", bot.messages[0])
+	}
+}
+
+// Test for the translation of event paths into server paths
+func TestMediaServerMapPath(t *testing.T) {
+	m := &mediaServer{pathMappings: map[string]string{"/downloads": "/data", "/downloads/done/": "/media"}}
+	testCases := map[string]string{
+		"/downloads/done/tv/a.mkv": "/media/tv/a.mkv",
+		"/downloads/new/a.mkv":     "/data/new/a.mkv",
+		"/downloads-old/a.mkv":     "/downloads-old/a.mkv",
+	}
+	for input, expected := range testCases {
+		if got := m.mapPath(input); got != expected {
+			t.Errorf("mapPath(%q) = %q, want %q", input, got, expected)
+		}
+	}
+}
+
+// Test for the notification of a refreshed event linking to its item and
+// being sent as the caption of its poster once the item appeared, without
+// holding up the consumer meanwhile
+func TestProcessMessageWithMediaServer(t *testing.T) {
+	jellyfin := newFakeJellyfin(t, episode)
+	jellyfin.release = make(chan struct{})
+	defer func() { media = nil }()
+	media = newTestMediaServer(t, config.MediaServerJellyfin, jellyfin.URL)
+
+	origNotifiers, origRoutes := notifiers, routes
+	defer func() { notifiers, routes = origNotifiers, origRoutes }()
+	bot := &MockTelegramBot{}
+	notifiers = []Notifier{&telegramNotifier{name: "telegram", bot: bot, chatID: 42, parseMode: config.ParseModeMarkdownV2, retry: config.RetryConfig{MaxAttempts: 1}}}
+	routes = nil
+	cfg = &config.Config{}
+
+	acks := 0
+	var mu sync.Mutex
+	event := newTestEvent(Message{}, &acks, &mu)
+	body := []byte(`{"filename": "/downloads/done/tv/Show/Season 1/Show.S01E01.mkv", "status": "processed", "time": "2025-07-30T12:00:00Z"}`)
+	processMessage(nil, event.delivery, body)
+
+	mu.Lock()
+	if acks != 0 {
+		t.Errorf("acked %d messages before the item appeared", acks)
+	}
+	mu.Unlock()
+	close(jellyfin.release)
+
+	// The event is acknowledged once its notification was sent
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := acks > 0
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if acks != 1 || len(bot.messages) != 1 {
+		t.Fatalf("acked %d and sent %d messages, want 1 of each", acks, len(bot.messages))
+	}
+	photo, ok := bot.messages[0].(tgbotapi.PhotoConfig)
+	if !ok {
+		t.Fatalf("sent %T, want a photo", bot.messages[0])
+	}
+	if file, ok := photo.File.(tgbotapi.FileBytes); !ok || string(file.Bytes) != "poster" {
+		t.Errorf("photo file = %+v, want the poster", photo.File)
+	}
+	if want := "[Open in Jellyfin](https://media.example.com/web/#/details?id=ep-1&serverId=server-1)"; !strings.Contains(photo.Caption, want) {
+		t.Errorf("caption does not contain %q, got: %v", want, photo.Caption)
+	}
+}
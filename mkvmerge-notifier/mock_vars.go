@@ -1,6 +1,9 @@
 package main
 
 import (
+	"net/smtp"
+	"time"
+
 	"github.com/streadway/amqp"
 )
 
@@ -13,5 +16,11 @@ var (
 	}
 
 	// Mock version of publishToDLQ
-	mockPublishToDLQ func(ch *amqp.Channel, body []byte, reason string) error
+	mockPublishToDLQ func(ch *amqp.Channel, body []byte, reason string, attempts int) error
+
+	// smtpSendMail sends the mails of the email notifiers
+	smtpSendMail = smtp.SendMail
+
+	// sleepFunc waits between the attempts of a send
+	sleepFunc = time.Sleep
 )
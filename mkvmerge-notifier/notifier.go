@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/streadway/amqp"
+)
+
+// Notification is a message sent through the notifiers
+type Notification struct {
+	// Title is a plain text summary, used where the channel has a subject
+	Title string
+	// Text is the body, rendered from the template of the notifier's backend
+	Text string
+	// Status selects the template: the status of the events or summary
+	Status string
+	// GroupBy and Key are the grouping of a digest and the torrent or
+	// category it reports
+	GroupBy string
+	Key     string
+	// Day is the day a summary reports
+	Day time.Time
+	// Events are the done events the notification reports
+	Events []Message
+}
+
+// Notifier sends notifications through one channel
+type Notifier interface {
+	// Name identifies the notifier in routes and logs
+	Name() string
+	// Type is the backend, whose templates render the notification text
+	Type() string
+	Notify(n Notification) error
+}
+
+// summaryStatus is the status the daily summary is routed with
+const summaryStatus = "summary"
+
+// The notifiers and the routes choosing them
+var (
+	notifiers []Notifier
+	routes    []config.RouteConfig
+)
+
+// newNotifiers creates the configured notifiers. newBot returns the
+// Telegram bot of a token.
+func newNotifiers(c *config.Config, newBot func(token string) (TelegramBotInterface, error)) ([]Notifier, error) {
+	if len(c.Notifiers) == 0 {
+		bot, err := newBot(c.Telegram.BotToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Telegram bot: %w", err)
+		}
+		return []Notifier{&telegramNotifier{name: config.DefaultNotifier, bot: bot, chatID: c.Telegram.ChatID, parseMode: c.Telegram.ParseMode, retry: c.Telegram.Retry}}, nil
+	}
+
+	bots := make(map[string]TelegramBotInterface)
+	result := make([]Notifier, 0, len(c.Notifiers))
+	for _, n := range c.Notifiers {
+		switch n.Type {
+		case config.NotifierTelegram:
+			token := n.BotToken
+			if token == "" {
+				token = c.Telegram.BotToken
+			}
+			bot, ok := bots[token]
+			if !ok {
+				var err error
+				if bot, err = newBot(token); err != nil {
+					return nil, fmt.Errorf("failed to initialize Telegram bot of notifier %q: %w", n.Name, err)
+				}
+				bots[token] = bot
+			}
+			result = append(result, &telegramNotifier{name: n.Name, bot: bot, chatID: n.ChatID, parseMode: c.Telegram.ParseMode, retry: c.Telegram.Retry})
+		case config.NotifierDiscord:
+			result = append(result, &discordNotifier{name: n.Name, url: n.URL})
+		case config.NotifierSlack:
+			result = append(result, &slackNotifier{name: n.Name, url: n.URL})
+		case config.NotifierWebhook:
+			result = append(result, &webhookNotifier{name: n.Name, url: n.URL, headers: n.Headers})
+		case config.NotifierNtfy:
+			result = append(result, &ntfyNotifier{name: n.Name, url: n.URL, token: n.Token})
+		case config.NotifierGotify:
+			result = append(result, &gotifyNotifier{name: n.Name, url: n.URL, token: n.Token})
+		case config.NotifierEmail:
+			result = append(result, &emailNotifier{name: n.Name, smtp: n.SMTP})
+		default:
+			return nil, fmt.Errorf("notifier %q has unknown type %q", n.Name, n.Type)
+		}
+	}
+	return result, nil
+}
+
+// routeNotifiers returns the notifiers of an event of a category and status:
+// every notifier without routes, else those of the matching routes
+func routeNotifiers(category, status string) []Notifier {
+	if len(routes) == 0 {
+		return notifiers
+	}
+	names := make(map[string]bool)
+	for _, route := range routes {
+		if route.Matches(category, status) {
+			for _, name := range route.Notifiers {
+				names[name] = true
+			}
+		}
+	}
+	var result []Notifier
+	for _, n := range notifiers {
+		if names[n.Name()] {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// deliverNotification sends the notifications of one or more done events
+// through the notifiers they are routed to and acknowledges their messages.
+// The messages a notifier failed to send are moved to the DLQ first.
+func deliverNotification(ch *amqp.Channel, events []pendingEvent, format func(events []pendingEvent) Notification) {
+	failures := make([][]string, len(events))
+	attempts := make([]int, len(events))
+	for _, n := range notifiers {
+		var routed []int
+		for i, event := range events {
+			for _, target := range routeNotifiers(event.msg.Category, event.msg.Status) {
+				if target == n {
+					routed = append(routed, i)
+					break
+				}
+			}
+		}
+		if len(routed) == 0 {
+			continue
+		}
+
+		batch := make([]pendingEvent, 0, len(routed))
+		for _, i := range routed {
+			batch = append(batch, events[i])
+		}
+		// Attempt to send the notification
+		if err := notify(n, format(batch)); err != nil {
+			log.Printf("Failed to send notification through %s: %v", n.Name(), err)
+			for _, i := range routed {
+				failures[i] = append(failures[i], fmt.Sprintf("%s: %v", n.Name(), err))
+				attempts[i] = max(attempts[i], sendAttempts(err))
+			}
+			continue
+		}
+		log.Printf("Successfully sent notification through %s", n.Name())
+	}
+
+	for i, event := range events {
+		if len(failures[i]) > 0 {
+			// Move message to DLQ since notification failed
+			reason := "Failed to send notification: " + strings.Join(failures[i], "; ")
+			if err := publishToDLQ(ch, event.body, reason, attempts[i]); err != nil {
+				log.Printf("Error publishing to DLQ: %v", err)
+			}
+
+			// Acknowledge the original message to remove it from the main queue
+			if err := event.delivery.Ack(false); err != nil {
+				log.Printf("Error acknowledging failed message: %v", err)
+			} else {
+				log.Println("Message acknowledged after moving to DLQ due to notification failure")
+			}
+			continue
+		}
+
+		// If notifications were sent successfully, acknowledge the message
+		if err := event.delivery.Ack(false); err != nil {
+			log.Printf("Error acknowledging message after successful notification: %v", err)
+		} else {
+			log.Println("Message acknowledged after successful notification")
+		}
+	}
+}
+
+// notify renders the text of a notification with the templates of the
+// notifier's backend and sends it
+func notify(n Notifier, note Notification) error {
+	text, err := templates.render(n.Type(), note)
+	if err != nil {
+		return err
+	}
+	note.Text = text
+	return n.Notify(note)
+}
+
+// telegramNotifier sends notifications to a Telegram chat
+type telegramNotifier struct {
+	name      string
+	bot       TelegramBotInterface
+	chatID    int64
+	parseMode string
+	retry     config.RetryConfig
+}
+
+// Name identifies the notifier
+func (t *telegramNotifier) Name() string { return t.name }
+
+// Type returns the backend the notifier sends through
+func (t *telegramNotifier) Type() string { return config.NotifierTelegram }
+
+// Notify sends the text to the chat in the configured parse mode, retrying
+// rate limits and transient errors. The notification of a single event found
+// on the media server is sent as a caption of its poster.
+func (t *telegramNotifier) Notify(n Notification) error {
+	if poster := t.poster(n); poster != nil {
+		return sendWithRetry(t.retry, func() error {
+			return sendTelegramPhoto(t.bot, t.chatID, poster, n.Text, t.parseMode)
+		})
+	}
+	return sendWithRetry(t.retry, func() error {
+		return sendTelegramMessage(t.bot, t.chatID, n.Text, t.parseMode)
+	})
+}
+
+// Telegram's limits on the length of a message and of a photo caption
+const (
+	telegramMessageLimit = 4096
+	telegramCaptionLimit = 1024
+)
+
+// poster returns the poster of the event of a notification, or nil when it
+// is sent as text
+func (t *telegramNotifier) poster(n Notification) []byte {
+	item := n.Event().Media
+	if media == nil || len(n.Events) != 1 || item == nil || item.imagePath == "" {
+		return nil
+	}
+	if utf8.RuneCountInString(n.Text) > telegramCaptionLimit {
+		return nil
+	}
+	poster, err := media.poster(item)
+	if err != nil {
+		log.Printf("Warning: Sending the notification without a poster: %v", err)
+		return nil
+	}
+	return poster
+}
+
+// newTelegramBot connects to the Telegram bot API with a token
+func newTelegramBot(token string) (TelegramBotInterface, error) {
+	bot, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Telegram bot initialized: @%s", bot.Self.UserName)
+	return bot, nil
+}
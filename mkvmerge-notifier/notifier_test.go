@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/streadway/amqp"
+)
+
+// mockNotifier records the notifications it is sent and fails with err
+type mockNotifier struct {
+	name string
+	err  error
+	sent []Notification
+}
+
+func (m *mockNotifier) Name() string { return m.name }
+
+func (m *mockNotifier) Type() string { return "mock" }
+
+func (m *mockNotifier) Notify(n Notification) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, n)
+	return nil
+}
+
+// useMockNotifiers makes the notifier send through mocks, without routes,
+// for the duration of a test
+func useMockNotifiers(t *testing.T, mocks ...*mockNotifier) []*mockNotifier {
+	origNotifiers, origRoutes := notifiers, routes
+	t.Cleanup(func() { notifiers, routes = origNotifiers, origRoutes })
+
+	notifiers = nil
+	for _, m := range mocks {
+		notifiers = append(notifiers, m)
+	}
+	routes = nil
+	return mocks
+}
+
+// Test for routes choosing the notifiers of an event
+func TestRouteNotifiers(t *testing.T) {
+	useMockNotifiers(t, &mockNotifier{name: "family"}, &mockNotifier{name: "me"}, &mockNotifier{name: "kids"})
+
+	if got := routeNotifiers("tv", "processed"); len(got) != 3 {
+		t.Errorf("routeNotifiers() without routes = %d notifiers, want all 3", len(got))
+	}
+
+	routes = []config.RouteConfig{
+		{Categories: []string{"movies"}, Notifiers: []string{"family"}},
+		{Categories: []string{"anime"}, Statuses: []string{"processed"}, Notifiers: []string{"kids"}},
+		{Notifiers: []string{"me"}},
+	}
+	testCases := []struct {
+		category string
+		status   string
+		expected []string
+	}{
+		{"movies", "processed", []string{"family", "me"}},
+		{"Anime", "processed", []string{"me", "kids"}},
+		{"anime", "failed", []string{"me"}},
+		{"", summaryStatus, []string{"me"}},
+	}
+	for _, tc := range testCases {
+		var names []string
+		for _, n := range routeNotifiers(tc.category, tc.status) {
+			names = append(names, n.Name())
+		}
+		if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("routeNotifiers(%q, %q) = %v, want %v", tc.category, tc.status, names, tc.expected)
+		}
+	}
+}
+
+// Test for every notifier getting the events routed to it and the messages
+// a notifier failed to send moving to the DLQ
+func TestDeliverNotificationRoutes(t *testing.T) {
+	cfg = &config.Config{}
+	mocks := useMockNotifiers(t, &mockNotifier{name: "family"}, &mockNotifier{name: "me", err: errors.New("webhook down")})
+	routes = []config.RouteConfig{
+		{Categories: []string{"movies"}, Notifiers: []string{"family"}},
+		{Categories: []string{"tv"}, Notifiers: []string{"family", "me"}},
+	}
+
+	originalPublish := amqpPublish
+	defer func() { amqpPublish = originalPublish }()
+	var published []map[string]interface{}
+	amqpPublish = func(ch *amqp.Channel, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+		var dlq map[string]interface{}
+		_ = json.Unmarshal(msg.Body, &dlq)
+		published = append(published, dlq)
+		return nil
+	}
+
+	var mu sync.Mutex
+	acks := 0
+	events := []pendingEvent{
+		newTestEvent(Message{Filename: "Movie", Category: "movies"}, &acks, &mu),
+		newTestEvent(Message{Filename: "Show", Category: "tv"}, &acks, &mu),
+	}
+	deliverNotification(nil, events, func(routed []pendingEvent) Notification {
+		return newNotification("batch", routed)
+	})
+
+	if len(mocks[0].sent) != 1 || len(mocks[0].sent[0].Events) != 2 {
+		t.Errorf("family was sent %v, want one notification of both events", mocks[0].sent)
+	}
+	if len(published) != 1 {
+		t.Fatalf("Expected 1 DLQ message, got %d", len(published))
+	}
+	if published[0]["originalMessage"] != "Show" {
+		t.Errorf("DLQ message = %v, want the message of Show", published[0])
+	}
+	if reason, _ := published[0]["errorReason"].(string); !strings.Contains(reason, "me: webhook down") {
+		t.Errorf("DLQ reason = %q, want the failing notifier", reason)
+	}
+	if acks != 2 {
+		t.Errorf("Expected 2 messages to be acknowledged, got %d", acks)
+	}
+}
+
+// Test for the notifiers created from the configuration
+func TestNewNotifiers(t *testing.T) {
+	var tokens []string
+	newBot := func(token string) (TelegramBotInterface, error) {
+		tokens = append(tokens, token)
+		return &MockTelegramBot{}, nil
+	}
+
+	// Without notifiers the Telegram chat of the telegram section is used
+	c := &config.Config{Telegram: config.TelegramConfig{BotToken: "main", ChatID: 1}}
+	result, err := newNotifiers(c, newBot)
+	if err != nil {
+		t.Fatalf("newNotifiers() error = %v", err)
+	}
+	if len(result) != 1 || result[0].Name() != config.DefaultNotifier {
+		t.Errorf("newNotifiers() = %v, want the default Telegram notifier", result)
+	}
+
+	tokens = nil
+	c.Notifiers = []config.NotifierConfig{
+		{Name: "family", Type: config.NotifierTelegram, ChatID: 2},
+		{Name: "kids", Type: config.NotifierTelegram, ChatID: 3},
+		{Name: "other", Type: config.NotifierTelegram, ChatID: 4, BotToken: "other"},
+		{Name: "discord", Type: config.NotifierDiscord, URL: "http://discord"},
+		{Name: "mail", Type: config.NotifierEmail},
+	}
+	result, err = newNotifiers(c, newBot)
+	if err != nil {
+		t.Fatalf("newNotifiers() error = %v", err)
+	}
+	if len(result) != 5 {
+		t.Errorf("newNotifiers() = %d notifiers, want 5", len(result))
+	}
+	if strings.Join(tokens, ",") != "main,other" {
+		t.Errorf("bots created for %v, want one per token", tokens)
+	}
+
+	_, err = newNotifiers(c, func(string) (TelegramBotInterface, error) { return nil, errors.New("unauthorized") })
+	if err == nil {
+		t.Error("newNotifiers() error = nil, want the bot error")
+	}
+}
+
+// Test for the Telegram notifier sending to its own chat
+func TestTelegramNotifier(t *testing.T) {
+	bot := &MockTelegramBot{}
+	n := &telegramNotifier{name: "family", bot: bot, chatID: 42, parseMode: config.ParseModeMarkdownV2}
+	if err := n.Notify(Notification{Text: "*done*"}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if len(bot.messages) != 1 {
+		t.Fatalf("Expected 1 message to be sent, got %d", len(bot.messages))
+	}
+	if msg := bot.messages[0].(tgbotapi.MessageConfig); msg.ChatID != 42 || msg.Text != "*done*" || msg.ParseMode != config.ParseModeMarkdownV2 {
+		t.Errorf("sent %+v, want *done* as MarkdownV2 to chat 42", msg)
+	}
+}
+
+// capturedRequest is a request received by an httptest server
+type capturedRequest struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+// newCaptureServer returns a server recording its requests and answering
+// with status
+func newCaptureServer(t *testing.T, status int) (*httptest.Server, *[]capturedRequest) {
+	var requests []capturedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, capturedRequest{path: r.URL.Path, headers: r.Header, body: string(body)})
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("rejected"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// Test for the requests of the HTTP notifiers
+func TestHTTPNotifiers(t *testing.T) {
+	server, requests := newCaptureServer(t, http.StatusOK)
+	n := Notification{Title: "Done", Text: "*Movie* done", Events: []Message{{Filename: "Movie", Category: "movies"}}}
+
+	testCases := []struct {
+		name     string
+		notifier Notifier
+		path     string
+		headers  map[string]string
+		body     string
+	}{
+		{"discord", &discordNotifier{url: server.URL + "/discord"}, "/discord", nil, `{"content":"*Movie* done"}`},
+		{"slack", &slackNotifier{url: server.URL + "/slack"}, "/slack", nil, `{"text":"*Movie* done"}`},
+		{"webhook", &webhookNotifier{url: server.URL + "/hook", headers: map[string]string{"authorization": "Bearer x"}}, "/hook",
+			map[string]string{"Authorization": "Bearer x"},
+			`{"title":"Done","text":"*Movie* done","events":[{"filename":"Movie","status":"","time":"","category":"movies"}]}`},
+		{"ntfy", &ntfyNotifier{url: server.URL + "/media", token: "tk"}, "/media",
+			map[string]string{"Title": "Done", "Markdown": "yes", "Authorization": "Bearer tk"}, "*Movie* done"},
+		{"gotify", &gotifyNotifier{url: server.URL + "/", token: "app"}, "/message",
+			map[string]string{"X-Gotify-Key": "app"},
+			`{"title":"Done","message":"*Movie* done","extras":{"client::display":{"contentType":"text/markdown"}}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			*requests = nil
+			if err := tc.notifier.Notify(n); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+			if len(*requests) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(*requests))
+			}
+			req := (*requests)[0]
+			if req.path != tc.path {
+				t.Errorf("path = %q, want %q", req.path, tc.path)
+			}
+			for key, value := range tc.headers {
+				if got := req.headers.Get(key); got != value {
+					t.Errorf("header %s = %q, want %q", key, got, value)
+				}
+			}
+			if strings.HasPrefix(tc.body, "{") {
+				var got, want interface{}
+				_ = json.Unmarshal([]byte(req.body), &got)
+				_ = json.Unmarshal([]byte(tc.body), &want)
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				if string(gotJSON) != string(wantJSON) {
+					t.Errorf("body = %s, want %s", req.body, tc.body)
+				}
+			} else if req.body != tc.body {
+				t.Errorf("body = %q, want %q", req.body, tc.body)
+			}
+		})
+	}
+}
+
+// Test for HTTP notifiers failing on responses other than 2xx
+func TestHTTPNotifierError(t *testing.T) {
+	server, _ := newCaptureServer(t, http.StatusBadRequest)
+	err := (&slackNotifier{url: server.URL}).Notify(Notification{Text: "done"})
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request: rejected") {
+		t.Errorf("Notify() error = %v, want the status and response", err)
+	}
+}
+
+// Test for long Discord messages being cut to the limit
+func TestDiscordNotifierTruncates(t *testing.T) {
+	server, requests := newCaptureServer(t, http.StatusNoContent)
+	if err := (&discordNotifier{url: server.URL}).Notify(Notification{Text: strings.Repeat("é", 3000)}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	var payload map[string]string
+	_ = json.Unmarshal([]byte((*requests)[0].body), &payload)
+	if n := len([]rune(payload["content"])); n != discordMessageLimit {
+		t.Errorf("content has %d characters, want %d", n, discordMessageLimit)
+	}
+}
+
+// Test for the email notifier mailing through its SMTP server
+func TestEmailNotifier(t *testing.T) {
+	origSendMail := smtpSendMail
+	defer func() { smtpSendMail = origSendMail }()
+
+	var addr, from string
+	var to []string
+	var mail string
+	var auth smtp.Auth
+	smtpSendMail = func(a string, au smtp.Auth, f string, t []string, msg []byte) error {
+		addr, auth, from, to, mail = a, au, f, t, string(msg)
+		return nil
+	}
+
+	n := &emailNotifier{smtp: config.SMTPConfig{
+		Host: "mail.example.com", Username: "user", Password: "pass",
+		From: "notifier@example.com", To: []string{"a@example.com", "b@example.com"},
+	}}
+	if err := n.Notify(Notification{Title: "MKV Processing Complete: Film", Text: "line 1\nline 2"}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	if addr != "mail.example.com:587" || from != "notifier@example.com" || len(to) != 2 || auth == nil {
+		t.Errorf("mail sent to %s from %s for %v with auth %v", addr, from, to, auth)
+	}
+	for _, want := range []string{"To: a@example.com, b@example.com\r\n", "Subject: MKV Processing Complete: Film\r\n", "\r\n\r\nline 1\r\nline 2\r\n"} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail does not contain %q, got: %q", want, mail)
+		}
+	}
+
+	smtpSendMail = func(string, smtp.Auth, string, []string, []byte) error { return errors.New("connection refused") }
+	if err := n.Notify(Notification{}); err == nil {
+		t.Error("Notify() error = nil, want the SMTP error")
+	}
+}
@@ -26,7 +26,7 @@ func TestPublishToDLQ(t *testing.T) {
 		return nil
 	}
 
-	err := publishToDLQ(nil, []byte("test message"), "test reason")
+	err := publishToDLQ(nil, []byte("test message"), "test reason", 1)
 	if err != nil {
 		t.Errorf("publishToDLQ() error = %v, want nil", err)
 	}
@@ -40,7 +40,7 @@ func TestPublishToDLQ(t *testing.T) {
 		return publishError
 	}
 
-	err = publishToDLQ(nil, []byte("test message"), "test reason")
+	err = publishToDLQ(nil, []byte("test message"), "test reason", 1)
 	if err == nil {
 		t.Error("publishToDLQ() error = nil, want error")
 	}
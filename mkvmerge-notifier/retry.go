@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// sendError is returned when a send was given up, permanently failing or
+// still failing after every attempt
+type sendError struct {
+	Attempts  int
+	Permanent bool
+	Err       error
+}
+
+// Error describes the last error and why sending stopped
+func (e *sendError) Error() string {
+	if e.Permanent {
+		return fmt.Sprintf("%v (permanent error, attempt %d)", e.Err, e.Attempts)
+	}
+	return fmt.Sprintf("%v (gave up after %d attempts)", e.Err, e.Attempts)
+}
+
+// Unwrap returns the last error
+func (e *sendError) Unwrap() error { return e.Err }
+
+// sendAttempts returns how often a failed send was attempted
+func sendAttempts(err error) int {
+	var sendErr *sendError
+	if errors.As(err, &sendErr) {
+		return sendErr.Attempts
+	}
+	return 1
+}
+
+// classifyTelegramError returns how long Telegram asks to wait before the
+// next attempt and whether retrying cannot help. Rate limits, server errors
+// and network errors are transient; the other API errors, such as chat not
+// found or an invalid token, are permanent.
+func classifyTelegramError(err error) (retryAfter time.Duration, permanent bool) {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests:
+		return time.Duration(apiErr.RetryAfter) * time.Second, false
+	case apiErr.Code >= http.StatusInternalServerError:
+		return 0, false
+	default:
+		return 0, true
+	}
+}
+
+// sendWithRetry calls send until it succeeds, fails permanently or the
+// attempts run out. It waits as long as Telegram asks for, else with
+// exponential backoff.
+func sendWithRetry(policy config.RetryConfig, send func() error) error {
+	delay := policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("Sent after %d attempts", attempt)
+			}
+			return nil
+		}
+
+		wait, permanent := classifyTelegramError(err)
+		if permanent {
+			return &sendError{Attempts: attempt, Permanent: true, Err: err}
+		}
+		if attempt >= policy.MaxAttempts {
+			return &sendError{Attempts: attempt, Err: err}
+		}
+
+		if wait == 0 {
+			wait = delay
+			delay = min(delay*2, policy.MaxDelay)
+		}
+		log.Printf("Attempt %d failed: %v (retrying in %s)", attempt, err, wait)
+		sleepFunc(wait)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"mkvmerge-notifier/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/streadway/amqp"
+)
+
+// useRecordedSleeps records the waits between attempts instead of sleeping
+func useRecordedSleeps(t *testing.T) *[]time.Duration {
+	var sleeps []time.Duration
+	origSleep := sleepFunc
+	sleepFunc = func(d time.Duration) { sleeps = append(sleeps, d) }
+	t.Cleanup(func() { sleepFunc = origSleep })
+	return &sleeps
+}
+
+// failingSends returns a send function failing with errs in turn, then succeeding
+func failingSends(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+var testRetryPolicy = config.RetryConfig{MaxAttempts: 4, InitialDelay: time.Second, MaxDelay: 3 * time.Second}
+
+func TestClassifyTelegramError(t *testing.T) {
+	testCases := []struct {
+		name       string
+		err        error
+		retryAfter time.Duration
+		permanent  bool
+	}{
+		{"rate limit", &tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 7", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}}, 7 * time.Second, false},
+		{"wrapped rate limit", fmt.Errorf("failed to send telegram message: %w", &tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 2}}), 2 * time.Second, false},
+		{"server error", &tgbotapi.Error{Code: 502, Message: "Bad Gateway"}, 0, false},
+		{"network error", errors.New("dial tcp: connection refused"), 0, false},
+		{"chat not found", &tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, 0, true},
+		{"bad token", &tgbotapi.Error{Code: 401, Message: "Unauthorized"}, 0, true},
+		{"bot blocked", &tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			retryAfter, permanent := classifyTelegramError(tc.err)
+			if retryAfter != tc.retryAfter || permanent != tc.permanent {
+				t.Errorf("classifyTelegramError() = %s, %v, want %s, %v", retryAfter, permanent, tc.retryAfter, tc.permanent)
+			}
+		})
+	}
+}
+
+// Test for rate limits waiting as long as Telegram asks and transient errors backing off
+func TestSendWithRetry(t *testing.T) {
+	sleeps := useRecordedSleeps(t)
+	send, calls := failingSends(
+		errors.New("connection reset"),
+		&tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 30}},
+		&tgbotapi.Error{Code: 500},
+	)
+
+	if err := sendWithRetry(testRetryPolicy, send); err != nil {
+		t.Fatalf("sendWithRetry() error = %v", err)
+	}
+	if *calls != 4 {
+		t.Errorf("send called %d times, want 4", *calls)
+	}
+	// The rate limit wait exceeds max_delay and does not advance the backoff
+	want := []time.Duration{time.Second, 30 * time.Second, 2 * time.Second}
+	if fmt.Sprint(*sleeps) != fmt.Sprint(want) {
+		t.Errorf("waited %v, want %v", *sleeps, want)
+	}
+}
+
+// Test for permanent errors not being retried
+func TestSendWithRetryPermanent(t *testing.T) {
+	sleeps := useRecordedSleeps(t)
+	send, calls := failingSends(errors.New("timeout"), &tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"})
+
+	err := sendWithRetry(testRetryPolicy, send)
+	var sendErr *sendError
+	if !errors.As(err, &sendErr) || !sendErr.Permanent || sendErr.Attempts != 2 {
+		t.Fatalf("sendWithRetry() error = %v, want a permanent error after 2 attempts", err)
+	}
+	if *calls != 2 || len(*sleeps) != 1 {
+		t.Errorf("send called %d times with %d waits, want 2 and 1", *calls, len(*sleeps))
+	}
+	if !strings.Contains(err.Error(), "chat not found (permanent error, attempt 2)") {
+		t.Errorf("error = %q", err.Error())
+	}
+}
+
+// Test for giving up once the attempts run out
+func TestSendWithRetryExhausted(t *testing.T) {
+	sleeps := useRecordedSleeps(t)
+	failure := &tgbotapi.Error{Code: 502, Message: "Bad Gateway"}
+	send, calls := failingSends(failure, failure, failure, failure, failure)
+
+	err := sendWithRetry(testRetryPolicy, send)
+	if sendAttempts(err) != 4 || *calls != 4 {
+		t.Fatalf("sendWithRetry() error = %v after %d calls, want to give up after 4", err, *calls)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if fmt.Sprint(*sleeps) != fmt.Sprint(want) {
+		t.Errorf("waited %v, want %v", *sleeps, want)
+	}
+	if !errors.Is(err, failure) {
+		t.Errorf("error %v does not wrap the last failure", err)
+	}
+}
+
+// Test for the DLQ message of a permanently failed Telegram notification
+// holding the attempts
+func TestTelegramNotifierDeadLettersWithAttempts(t *testing.T) {
+	cfg = &config.Config{}
+	sleeps := useRecordedSleeps(t)
+	bot := &sequenceBot{errs: []error{
+		&tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}},
+		&tgbotapi.Error{Code: 401, Message: "Unauthorized"},
+	}}
+	origNotifiers, origRoutes := notifiers, routes
+	defer func() { notifiers, routes = origNotifiers, origRoutes }()
+	notifiers, routes = []Notifier{&telegramNotifier{name: "telegram", bot: bot, chatID: 1, retry: testRetryPolicy}}, nil
+
+	originalPublish := amqpPublish
+	defer func() { amqpPublish = originalPublish }()
+	var dlq string
+	amqpPublish = func(ch *amqp.Channel, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+		dlq = string(msg.Body)
+		return nil
+	}
+
+	acked := false
+	d := amqp.Delivery{Acknowledger: &mockAcknowledger{ackCallback: func(bool) error { acked = true; return nil }}}
+	body := []byte(`{"filename": "/movies/Film.mkv", "status": "processed", "time": "2025-07-30T12:00:00Z"}`)
+	processMessage(nil, d, body)
+
+	if !strings.Contains(dlq, `"attempts":2`) || !strings.Contains(dlq, "Unauthorized") {
+		t.Errorf("DLQ message = %s, want the error after 2 attempts", dlq)
+	}
+	if !acked {
+		t.Error("message was not acknowledged")
+	}
+	if fmt.Sprint(*sleeps) != fmt.Sprint([]time.Duration{5 * time.Second}) {
+		t.Errorf("waited %v, want the 5s Telegram asked for", *sleeps)
+	}
+}
+
+// sequenceBot fails its sends with errs in turn, then succeeds
+type sequenceBot struct {
+	errs  []error
+	calls int
+}
+
+func (b *sequenceBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	b.calls++
+	if b.calls <= len(b.errs) {
+		return tgbotapi.Message{}, b.errs[b.calls-1]
+	}
+	return tgbotapi.Message{}, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"mkvmerge-notifier/config"
+)
+
+// builtinTemplates are used for the backends and statuses without a
+// user-supplied template
+//
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+// defaultBackend names the templates of backends without their own
+const defaultBackend = "default"
+
+// templateFuncs are the helpers available to notification templates
+var templateFuncs = template.FuncMap{
+	"base":                 filepath.Base,
+	"formatTime":           formatEventTime,
+	"escapeMarkdownV2":     escapeMarkdownV2,
+	"escapeMarkdownV2Code": escapeMarkdownV2Code,
+	"escapeMarkdownV2URL":  escapeMarkdownV2URL,
+	"escapeHTML":           html.EscapeString,
+	"first":                firstEvents,
+	"more":                 moreEvents,
+}
+
+// templateSet renders notifications with the user-supplied templates,
+// falling back to the built-in ones
+type templateSet struct {
+	user    *template.Template
+	builtin *template.Template
+}
+
+// Templates notifications are rendered with
+var templates = mustLoadTemplates("")
+
+// loadTemplates parses the built-in templates and the *.tmpl files of dir.
+// Templates are named <backend>.<status>.tmpl or <backend>.tmpl, where the
+// backend is a notifier type or default.
+func loadTemplates(dir string) (*templateSet, error) {
+	builtin, err := template.New("").Funcs(templateFuncs).ParseFS(builtinTemplates, "templates/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse built-in templates: %w", err)
+	}
+	set := &templateSet{builtin: builtin}
+	if dir == "" {
+		return set, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates in %s: %w", dir, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no templates found in %s", dir)
+	}
+	set.user, err = template.New("").Funcs(templateFuncs).ParseFiles(files...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+	return set, nil
+}
+
+// mustLoadTemplates is loadTemplates for templates that are known to parse
+func mustLoadTemplates(dir string) *templateSet {
+	set, err := loadTemplates(dir)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// checkParseMode returns an error when Telegram notifications in parseMode
+// could fall back to the built-in templates, which are written for MarkdownV2.
+// A user telegram.tmpl or default.tmpl covers every status.
+func (s *templateSet) checkParseMode(parseMode string) error {
+	if parseMode == config.ParseModeMarkdownV2 {
+		return nil
+	}
+	if s.user != nil {
+		for _, name := range []string{config.NotifierTelegram + ".tmpl", defaultBackend + ".tmpl"} {
+			if s.user.Lookup(name) != nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("telegram.parse_mode %q requires a telegram.tmpl or default.tmpl template, the built-in ones are written for %s",
+		parseMode, config.ParseModeMarkdownV2)
+}
+
+// lookup returns the most specific template of a backend and status: the
+// user's before the built-in ones, and the backend's before the default
+func (s *templateSet) lookup(backend, status string) *template.Template {
+	names := []string{
+		backend + "." + status + ".tmpl",
+		backend + ".tmpl",
+		defaultBackend + "." + status + ".tmpl",
+		defaultBackend + ".tmpl",
+	}
+	for _, set := range []*template.Template{s.user, s.builtin} {
+		if set == nil {
+			continue
+		}
+		for _, name := range names {
+			if t := set.Lookup(name); t != nil {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// render executes the template of a backend with a notification
+func (s *templateSet) render(backend string, n Notification) (string, error) {
+	status := n.Status
+	if status == "" {
+		status = "unknown"
+	}
+	t := s.lookup(backend, status)
+	if t == nil {
+		return "", fmt.Errorf("no template for backend %s", backend)
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, n); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", t.Name(), err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// markdownV2Replacer escapes the characters MarkdownV2 reserves
+var markdownV2Replacer = strings.NewReplacer(
+	`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`,
+	"~", `\~`, "`", "\\`", ">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`,
+	"|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+)
+
+// escapeMarkdownV2 escapes text for Telegram's MarkdownV2
+func escapeMarkdownV2(text string) string {
+	return markdownV2Replacer.Replace(text)
+}
+
+// markdownV2CodeReplacer escapes the characters reserved inside code
+var markdownV2CodeReplacer = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+
+// escapeMarkdownV2Code escapes text inside a MarkdownV2 code span or block
+func escapeMarkdownV2Code(text string) string {
+	return markdownV2CodeReplacer.Replace(text)
+}
+
+// markdownV2URLReplacer escapes the characters reserved inside a link URL
+var markdownV2URLReplacer = strings.NewReplacer(`\`, `\\`, ")", `\)`)
+
+// escapeMarkdownV2URL escapes the URL of a MarkdownV2 inline link
+func escapeMarkdownV2URL(text string) string {
+	return markdownV2URLReplacer.Replace(text)
+}
+
+// firstEvents returns at most the first n events
+func firstEvents(n int, events []Message) []Message {
+	return events[:min(n, len(events))]
+}
+
+// moreEvents returns how many events follow the first n
+func moreEvents(n int, events []Message) int {
+	return max(len(events)-n, 0)
+}
+
+// categoryCount is the number of events of a category
+type categoryCount struct {
+	Name  string
+	Count int
+}
+
+// Event returns the first event of a notification
+func (n Notification) Event() Message {
+	if len(n.Events) == 0 {
+		return Message{}
+	}
+	return n.Events[0]
+}
+
+// Last returns the last event of a notification
+func (n Notification) Last() Message {
+	if len(n.Events) == 0 {
+		return Message{}
+	}
+	return n.Events[len(n.Events)-1]
+}
+
+// Categories counts the events of each category, by name
+func (n Notification) Categories() []categoryCount {
+	counts := make(map[string]int)
+	for _, event := range n.Events {
+		category := event.Category
+		if category == "" {
+			category = "uncategorized"
+		}
+		counts[category]++
+	}
+	result := make([]categoryCount, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, categoryCount{Name: name, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mkvmerge-notifier/config"
+)
+
+// renderMessage renders the notification of a single done event
+func renderMessage(t *testing.T, backend string, msg Message) string {
+	t.Helper()
+	result, err := templates.render(backend, Notification{Status: msg.Status, Events: []Message{msg}})
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	return result
+}
+
+// writeTemplates writes template files to a temporary directory
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+// Test for the MarkdownV2 escaping helpers
+func TestEscapeMarkdownV2(t *testing.T) {
+	testCases := []struct {
+		text, expected, code string
+	}{
+		{"My_Show.S01E01", `My\_Show\.S01E01`, "My_Show.S01E01"},
+		{"*Pilot* [1080p] (2025)!", `\*Pilot\* \[1080p\] \(2025\)\!`, "*Pilot* [1080p] (2025)!"},
+		{"a`b\\c", "a\\`b\\\\c", "a\\`b\\\\c"},
+		{"~>#+-=|{}", `\~\>\#\+\-\=\|\{\}`, "~>#+-=|{}"},
+	}
+	for _, tc := range testCases {
+		if got := escapeMarkdownV2(tc.text); got != tc.expected {
+			t.Errorf("escapeMarkdownV2(%q) = %q, want %q", tc.text, got, tc.expected)
+		}
+		if got := escapeMarkdownV2Code(tc.text); got != tc.code {
+			t.Errorf("escapeMarkdownV2Code(%q) = %q, want %q", tc.text, got, tc.code)
+		}
+	}
+}
+
+// Test for the built-in Telegram template escaping filenames
+func TestRenderTelegramEscapes(t *testing.T) {
+	msg := Message{Filename: "/tv/My_Show.S01E01.*Pilot*.mkv", Status: "processed", Time: "2025-07-30T12:00:00Z"}
+	result := renderMessage(t, config.NotifierTelegram, msg)
+	for _, want := range []string{"`My_Show.S01E01.*Pilot*.mkv`", `*Status:* processed`, `2025\-07\-30 12:00:00`} {
+		if !strings.Contains(result, want) {
+			t.Errorf("render() does not contain %q, got: %v", want, result)
+		}
+	}
+}
+
+// Test for the backends and statuses choosing their templates
+func TestRenderLookup(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"telegram.failed.tmpl": "failed {{escapeMarkdownV2 .Event.Filename}}",
+		"default.tmpl":         "<b>{{escapeHTML .Event.Filename}}</b>",
+	})
+	set, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatalf("loadTemplates() error = %v", err)
+	}
+
+	testCases := []struct {
+		backend, status, expected string
+	}{
+		{config.NotifierTelegram, "failed", `failed a\_b\.mkv`},
+		{config.NotifierTelegram, "processed", "<b>a_b.mkv &amp; c</b>"},
+		{config.NotifierSlack, "processed", "<b>a_b.mkv &amp; c</b>"},
+	}
+	for _, tc := range testCases {
+		filename := "a_b.mkv"
+		if tc.status != "failed" {
+			filename += " & c"
+		}
+		n := Notification{Status: tc.status, Events: []Message{{Filename: filename, Status: tc.status}}}
+		got, err := set.render(tc.backend, n)
+		if err != nil {
+			t.Fatalf("render(%s, %s) error = %v", tc.backend, tc.status, err)
+		}
+		if got != tc.expected {
+			t.Errorf("render(%s, %s) = %q, want %q", tc.backend, tc.status, got, tc.expected)
+		}
+	}
+
+	// Statuses without a user template fall back to the built-in ones
+	day := time.Date(2025, 7, 30, 0, 0, 0, 0, time.UTC)
+	got, err := set.render(config.NotifierEmail, Notification{Status: summaryStatus, Day: day, Events: []Message{{Filename: "a.mkv"}}})
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	if got != "<b>a.mkv</b>" {
+		t.Errorf("render(email, summary) = %q, want the user default template", got)
+	}
+}
+
+// Test that another parse mode than MarkdownV2 needs user templates for Telegram
+func TestCheckParseMode(t *testing.T) {
+	builtin := mustLoadTemplates("")
+	statusOnly := mustLoadTemplates(writeTemplates(t, map[string]string{"telegram.failed.tmpl": "<b>{{escapeHTML .Event.Filename}}</b>"}))
+	telegram := mustLoadTemplates(writeTemplates(t, map[string]string{"telegram.tmpl": "<b>{{escapeHTML .Event.Filename}}</b>"}))
+	fallback := mustLoadTemplates(writeTemplates(t, map[string]string{"default.tmpl": "<b>{{escapeHTML .Event.Filename}}</b>"}))
+
+	testCases := []struct {
+		name      string
+		set       *templateSet
+		parseMode string
+		wantErr   bool
+	}{
+		{"built-in MarkdownV2", builtin, config.ParseModeMarkdownV2, false},
+		{"built-in HTML", builtin, config.ParseModeHTML, true},
+		{"built-in plain text", builtin, "", true},
+		{"one status only", statusOnly, config.ParseModeHTML, true},
+		{"telegram.tmpl", telegram, config.ParseModeHTML, false},
+		{"default.tmpl", fallback, config.ParseModeHTML, false},
+	}
+	for _, tc := range testCases {
+		if err := tc.set.checkParseMode(tc.parseMode); (err != nil) != tc.wantErr {
+			t.Errorf("%s: checkParseMode(%q) error = %v, wantErr %v", tc.name, tc.parseMode, err, tc.wantErr)
+		}
+	}
+}
+
+// Test for invalid template directories
+func TestLoadTemplatesErrors(t *testing.T) {
+	if _, err := loadTemplates(t.TempDir()); err == nil {
+		t.Error("loadTemplates() of an empty directory error = nil, want an error")
+	}
+	dir := writeTemplates(t, map[string]string{"default.tmpl": "{{.Event.Filename"})
+	if _, err := loadTemplates(dir); err == nil {
+		t.Error("loadTemplates() of a broken template error = nil, want an error")
+	}
+}
+
+// Test for templates being rendered for the notifier's backend
+func TestNotifyRendersTemplate(t *testing.T) {
+	orig := templates
+	defer func() { templates = orig }()
+	var err error
+	templates, err = loadTemplates(writeTemplates(t, map[string]string{"mock.tmpl": "{{len .Events}} {{.Status}}"}))
+	if err != nil {
+		t.Fatalf("loadTemplates() error = %v", err)
+	}
+
+	m := &mockNotifier{name: "mock"}
+	if err := notify(m, Notification{Status: "processed", Events: []Message{{}, {}}}); err != nil {
+		t.Fatalf("notify() error = %v", err)
+	}
+	if len(m.sent) != 1 || m.sent[0].Text != "2 processed" {
+		t.Errorf("sent %+v, want the rendered text", m.sent)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"mkvmerge-notifier/config"
+)
+
+// httpClient sends the requests of the HTTP notifiers
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// discordMessageLimit is the longest content Discord accepts
+const discordMessageLimit = 2000
+
+// postJSON posts a JSON payload and fails unless the server accepted it
+func postJSON(url string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return doRequest(req)
+}
+
+// doRequest sends a request and turns a response other than 2xx into an error
+func doRequest(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// discordNotifier posts notifications to a Discord webhook
+type discordNotifier struct {
+	name string
+	url  string
+}
+
+// Name identifies the notifier
+func (d *discordNotifier) Name() string { return d.name }
+
+// Type returns the backend the notifier sends through
+func (d *discordNotifier) Type() string { return config.NotifierDiscord }
+
+// Notify posts the text as the content of a message
+func (d *discordNotifier) Notify(n Notification) error {
+	content := n.Text
+	if runes := []rune(content); len(runes) > discordMessageLimit {
+		content = string(runes[:discordMessageLimit-1]) + "…"
+	}
+	return postJSON(d.url, map[string]string{"content": content}, nil)
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook
+type slackNotifier struct {
+	name string
+	url  string
+}
+
+// Name identifies the notifier
+func (s *slackNotifier) Name() string { return s.name }
+
+// Type returns the backend the notifier sends through
+func (s *slackNotifier) Type() string { return config.NotifierSlack }
+
+// Notify posts the text, whose *bold* and `code` Slack renders as well
+func (s *slackNotifier) Notify(n Notification) error {
+	return postJSON(s.url, map[string]string{"text": n.Text}, nil)
+}
+
+// webhookPayload is the body posted to a generic webhook
+type webhookPayload struct {
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Events []Message `json:"events"`
+}
+
+// webhookNotifier posts notifications and their events to any HTTP endpoint
+type webhookNotifier struct {
+	name    string
+	url     string
+	headers map[string]string
+}
+
+// Name identifies the notifier
+func (w *webhookNotifier) Name() string { return w.name }
+
+// Type returns the backend the notifier sends through
+func (w *webhookNotifier) Type() string { return config.NotifierWebhook }
+
+// Notify posts the notification as JSON
+func (w *webhookNotifier) Notify(n Notification) error {
+	events := n.Events
+	if events == nil {
+		events = []Message{}
+	}
+	return postJSON(w.url, webhookPayload{Title: n.Title, Text: n.Text, Events: events}, w.headers)
+}
+
+// ntfyNotifier publishes notifications to an ntfy topic
+type ntfyNotifier struct {
+	name  string
+	url   string
+	token string
+}
+
+// Name identifies the notifier
+func (t *ntfyNotifier) Name() string { return t.name }
+
+// Type returns the backend the notifier sends through
+func (t *ntfyNotifier) Type() string { return config.NotifierNtfy }
+
+// Notify publishes the text as a Markdown message to the topic URL
+func (t *ntfyNotifier) Notify(n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, t.url, strings.NewReader(n.Text))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Title", n.Title)
+	req.Header.Set("Markdown", "yes")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return doRequest(req)
+}
+
+// gotifyNotifier sends notifications to a Gotify server
+type gotifyNotifier struct {
+	name  string
+	url   string
+	token string
+}
+
+// Name identifies the notifier
+func (g *gotifyNotifier) Name() string { return g.name }
+
+// Type returns the backend the notifier sends through
+func (g *gotifyNotifier) Type() string { return config.NotifierGotify }
+
+// Notify creates a Markdown message with the application token
+func (g *gotifyNotifier) Notify(n Notification) error {
+	payload := map[string]interface{}{
+		"title":   n.Title,
+		"message": n.Text,
+		"extras": map[string]interface{}{
+			"client::display": map[string]string{"contentType": "text/markdown"},
+		},
+	}
+	return postJSON(strings.TrimSuffix(g.url, "/")+"/message", payload, map[string]string{"X-Gotify-Key": g.token})
+}